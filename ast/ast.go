@@ -2,6 +2,8 @@ package ast
 
 import (
 	"bytes"
+	"fmt"
+	"math/big"
 	"strings"
 
 	"kjarmicki.github.com/monkey/token"
@@ -14,6 +16,7 @@ import (
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Span() token.Span // source range the node was parsed from
 }
 
 // expression is a value, or anything that executes and in the end produces a value (e.g. 3 + 5)
@@ -51,10 +54,34 @@ func (es *ExpressionStatement) String() string {
 	return ""
 }
 
+func (es *ExpressionStatement) Span() token.Span {
+	return token.Join(es.Token.Span, spanOf(es.Expression))
+}
+
 // identifier is an expression even though it doesn't produce a value to keep things simple
 type Identifier struct {
-	Token token.Token
-	Value string
+	Token   token.Token
+	Value   string
+	Binding Binding `dump:"omitempty"` // where the variable lives, set by the resolver
+}
+
+// variables of the functions live in the slots of the function's environment, the ones declared at the top level
+// (and the ones not resolved) are looked up by name in the global environment
+type Binding struct {
+	Local bool
+	Depth int // number of functions between the one using the variable and the one declaring it
+	Slot  int // index of the variable among the locals of the declaring function, see FunctionLiteral.Locals
+
+	// binding of the same name in the enclosing functions (or the global one), which the name refers to
+	// while the slot is empty, e.g. when the let declaring the local hasn't run. Set for the locals only.
+	Outer *Binding
+}
+
+func (b Binding) String() string {
+	if !b.Local {
+		return "global"
+	}
+	return fmt.Sprintf("local(%d,%d)", b.Depth, b.Slot)
 }
 
 func (i *Identifier) expressionNode() {}
@@ -67,6 +94,10 @@ func (i *Identifier) String() string {
 	return i.Value
 }
 
+func (i *Identifier) Span() token.Span {
+	return i.Token.Span
+}
+
 type Program struct {
 	Statements []Statement
 }
@@ -86,10 +117,18 @@ func (p *Program) String() string {
 	return out.String()
 }
 
+func (p *Program) Span() token.Span {
+	if len(p.Statements) == 0 {
+		return token.Span{}
+	}
+	return token.Join(p.Statements[0].Span(), p.Statements[len(p.Statements)-1].Span())
+}
+
 type LetStatement struct {
 	Token token.Token
 	Name  *Identifier
 	Value Expression
+	Doc   string // text of the /// comments right before the statement, lines joined with \n
 }
 
 func (ls *LetStatement) statementNode() {}
@@ -110,6 +149,10 @@ func (ls *LetStatement) String() string {
 	return out.String()
 }
 
+func (ls *LetStatement) Span() token.Span {
+	return token.Join(ls.Token.Span, spanOf(ls.Value))
+}
+
 type ReturnStatement struct {
 	Token       token.Token
 	ReturnValue Expression
@@ -131,9 +174,75 @@ func (rs *ReturnStatement) String() string {
 	return out.String()
 }
 
+func (rs *ReturnStatement) Span() token.Span {
+	return token.Join(rs.Token.Span, spanOf(rs.ReturnValue))
+}
+
+type BreakStatement struct {
+	Token token.Token
+}
+
+func (bs *BreakStatement) statementNode() {}
+
+func (bs *BreakStatement) TokenLiteral() string {
+	return bs.Token.Literal
+}
+
+func (bs *BreakStatement) String() string {
+	return bs.TokenLiteral() + ";"
+}
+
+func (bs *BreakStatement) Span() token.Span {
+	return bs.Token.Span
+}
+
+type ContinueStatement struct {
+	Token token.Token
+}
+
+func (cs *ContinueStatement) statementNode() {}
+
+func (cs *ContinueStatement) TokenLiteral() string {
+	return cs.Token.Literal
+}
+
+func (cs *ContinueStatement) String() string {
+	return cs.TokenLiteral() + ";"
+}
+
+func (cs *ContinueStatement) Span() token.Span {
+	return cs.Token.Span
+}
+
+type ThrowStatement struct {
+	Token token.Token
+	Value Expression
+}
+
+func (ts *ThrowStatement) statementNode() {}
+
+func (ts *ThrowStatement) TokenLiteral() string {
+	return ts.Token.Literal
+}
+
+func (ts *ThrowStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(ts.TokenLiteral() + " ")
+	if ts.Value != nil {
+		out.WriteString(ts.Value.String())
+	}
+	out.WriteString(";")
+	return out.String()
+}
+
+func (ts *ThrowStatement) Span() token.Span {
+	return token.Join(ts.Token.Span, spanOf(ts.Value))
+}
+
 type IntegerLiteral struct {
 	Token token.Token
 	Value int64
+	Big   *big.Int // set instead of Value when the literal doesn't fit in int64
 }
 
 func (il *IntegerLiteral) expressionNode() {}
@@ -146,6 +255,29 @@ func (il *IntegerLiteral) String() string {
 	return il.Token.Literal
 }
 
+func (il *IntegerLiteral) Span() token.Span {
+	return il.Token.Span
+}
+
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode() {}
+
+func (fl *FloatLiteral) TokenLiteral() string {
+	return fl.Token.Literal
+}
+
+func (fl *FloatLiteral) String() string {
+	return fl.Token.Literal
+}
+
+func (fl *FloatLiteral) Span() token.Span {
+	return fl.Token.Span
+}
+
 type Boolean struct {
 	Token token.Token
 	Value bool
@@ -161,6 +293,10 @@ func (b *Boolean) String() string {
 	return b.Token.Literal
 }
 
+func (b *Boolean) Span() token.Span {
+	return b.Token.Span
+}
+
 // there are two types of prefixes in Monkey:
 // !<expression> and -<expression>
 type PrefixExpression struct {
@@ -184,6 +320,10 @@ func (pe *PrefixExpression) String() string {
 	return out.String()
 }
 
+func (pe *PrefixExpression) Span() token.Span {
+	return token.Join(pe.Token.Span, spanOf(pe.Right))
+}
+
 // infix expressions are <expression> <operator> <expression>,
 // where operator can be +, -, /, *, <, >, ==, !=
 type InfixExpression struct {
@@ -211,9 +351,14 @@ func (ie *InfixExpression) String() string {
 	return out.String()
 }
 
+func (ie *InfixExpression) Span() token.Span {
+	return token.Join(token.Join(spanOf(ie.Left), ie.Token.Span), spanOf(ie.Right))
+}
+
 type BlockStatement struct {
 	Token      token.Token // {
 	Statements []Statement
+	RBrace     token.Token // }
 }
 
 func (bs *BlockStatement) statementNode() {}
@@ -230,6 +375,10 @@ func (bs *BlockStatement) String() string {
 	return out.String()
 }
 
+func (bs *BlockStatement) Span() token.Span {
+	return token.Join(bs.Token.Span, bs.RBrace.Span)
+}
+
 // if (condition) Consequence [else Alternative]
 type IfExpression struct {
 	Token       token.Token // if
@@ -259,11 +408,157 @@ func (ie *IfExpression) String() string {
 	return out.String()
 }
 
+func (ie *IfExpression) Span() token.Span {
+	if ie.Alternative != nil {
+		return token.Join(ie.Token.Span, ie.Alternative.Span())
+	}
+	if ie.Consequence != nil {
+		return token.Join(ie.Token.Span, ie.Consequence.Span())
+	}
+	return ie.Token.Span
+}
+
+// while (Condition) { Body }
+type WhileExpression struct {
+	Token     token.Token // while
+	Condition Expression
+	Body      *BlockStatement
+}
+
+func (we *WhileExpression) expressionNode() {}
+
+func (we *WhileExpression) TokenLiteral() string {
+	return we.Token.Literal
+}
+
+func (we *WhileExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("while")
+	out.WriteString(we.Condition.String())
+	out.WriteString(" ")
+	out.WriteString(we.Body.String())
+	return out.String()
+}
+
+func (we *WhileExpression) Span() token.Span {
+	if we.Body != nil {
+		return token.Join(we.Token.Span, we.Body.Span())
+	}
+	return we.Token.Span
+}
+
+// try { Body } catch (CatchParameter) { Catch } finally { Finally }, either Catch or Finally can be left out
+type TryExpression struct {
+	Token          token.Token // try
+	Body           *BlockStatement
+	CatchParameter *Identifier
+	Catch          *BlockStatement
+	Finally        *BlockStatement
+}
+
+func (te *TryExpression) expressionNode() {}
+
+func (te *TryExpression) TokenLiteral() string {
+	return te.Token.Literal
+}
+
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("try ")
+	out.WriteString(te.Body.String())
+	if te.Catch != nil {
+		out.WriteString(" catch (")
+		out.WriteString(te.CatchParameter.String())
+		out.WriteString(") ")
+		out.WriteString(te.Catch.String())
+	}
+	if te.Finally != nil {
+		out.WriteString(" finally ")
+		out.WriteString(te.Finally.String())
+	}
+	return out.String()
+}
+
+func (te *TryExpression) Span() token.Span {
+	switch {
+	case te.Finally != nil:
+		return token.Join(te.Token.Span, te.Finally.Span())
+	case te.Catch != nil:
+		return token.Join(te.Token.Span, te.Catch.Span())
+	case te.Body != nil:
+		return token.Join(te.Token.Span, te.Body.Span())
+	}
+	return te.Token.Span
+}
+
+// for (Variable in Iterable) { Body }
+type ForExpression struct {
+	Token    token.Token // for
+	Variable *Identifier
+	Iterable Expression
+	Body     *BlockStatement
+}
+
+func (fe *ForExpression) expressionNode() {}
+
+func (fe *ForExpression) TokenLiteral() string {
+	return fe.Token.Literal
+}
+
+func (fe *ForExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("for")
+	out.WriteString("(")
+	out.WriteString(fe.Variable.String())
+	out.WriteString(" in ")
+	out.WriteString(fe.Iterable.String())
+	out.WriteString(") ")
+	out.WriteString(fe.Body.String())
+	return out.String()
+}
+
+func (fe *ForExpression) Span() token.Span {
+	if fe.Body != nil {
+		return token.Join(fe.Token.Span, fe.Body.Span())
+	}
+	return fe.Token.Span
+}
+
+// Target Operator Value, e.g. x = 5, counter += 1, arr[0] = 1
+type AssignExpression struct {
+	Token    token.Token // the operator
+	Target   Expression  // *Identifier or *IndexExpression
+	Operator string      // =, +=, -=, *= or /=
+	Value    Expression
+}
+
+func (ae *AssignExpression) expressionNode() {}
+
+func (ae *AssignExpression) TokenLiteral() string {
+	return ae.Token.Literal
+}
+
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(ae.Target.String())
+	out.WriteString(" " + ae.Operator + " ")
+	out.WriteString(ae.Value.String())
+	out.WriteString(")")
+	return out.String()
+}
+
+func (ae *AssignExpression) Span() token.Span {
+	return token.Join(spanOf(ae.Target), spanOf(ae.Value))
+}
+
 // fn Parameters Body
 type FunctionLiteral struct {
 	Token      token.Token
 	Parameters []*Identifier
 	Body       *BlockStatement
+	Name       string   // name the function is bound to with let, empty for anonymous functions
+	Locals     []string `dump:"omitempty"` // parameters followed by the variables the body declares, set by the resolver
 }
 
 func (fl *FunctionLiteral) expressionNode() {}
@@ -287,10 +582,19 @@ func (fl *FunctionLiteral) String() string {
 	return out.String()
 }
 
+func (fl *FunctionLiteral) Span() token.Span {
+	if fl.Body != nil {
+		return token.Join(fl.Token.Span, fl.Body.Span())
+	}
+	return fl.Token.Span
+}
+
 type CallExpression struct {
-	Token     token.Token
+	Token     token.Token // (
 	Function  Expression
 	Arguments []Expression
+	RParen    token.Token // )
+	Tail      bool        `dump:"omitempty"` // the result of the call is the result of the enclosing function, see parser.markTailCalls
 }
 
 func (ce *CallExpression) expressionNode() {}
@@ -313,6 +617,10 @@ func (ce *CallExpression) String() string {
 	return out.String()
 }
 
+func (ce *CallExpression) Span() token.Span {
+	return token.Join(token.Join(spanOf(ce.Function), ce.Token.Span), ce.RParen.Span)
+}
+
 type StringLiteral struct {
 	Token token.Token
 	Value string
@@ -328,9 +636,14 @@ func (sl *StringLiteral) String() string {
 	return sl.Token.Literal
 }
 
+func (sl *StringLiteral) Span() token.Span {
+	return sl.Token.Span
+}
+
 type ArrayLiteral struct {
-	Token    token.Token
+	Token    token.Token // [
 	Elements []Expression
+	RBracket token.Token // ]
 }
 
 func (al *ArrayLiteral) expressionNode() {}
@@ -352,10 +665,15 @@ func (al *ArrayLiteral) String() string {
 	return out.String()
 }
 
+func (al *ArrayLiteral) Span() token.Span {
+	return token.Join(al.Token.Span, al.RBracket.Span)
+}
+
 type IndexExpression struct {
-	Token token.Token
-	Left  Expression
-	Index Expression
+	Token    token.Token // [
+	Left     Expression
+	Index    Expression
+	RBracket token.Token // ]
 }
 
 func (ie *IndexExpression) expressionNode() {}
@@ -375,9 +693,14 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+func (ie *IndexExpression) Span() token.Span {
+	return token.Join(token.Join(spanOf(ie.Left), ie.Token.Span), ie.RBracket.Span)
+}
+
 type HashLiteral struct {
-	Token token.Token
-	Pairs map[Expression]Expression
+	Token  token.Token // {
+	Pairs  map[Expression]Expression
+	RBrace token.Token // }
 }
 
 func (hl *HashLiteral) expressionNode() {}
@@ -397,3 +720,15 @@ func (hl *HashLiteral) String() string {
 	out.WriteString("}")
 	return out.String()
 }
+
+func (hl *HashLiteral) Span() token.Span {
+	return token.Join(hl.Token.Span, hl.RBrace.Span)
+}
+
+// span of a child node that might be missing because of a parse error
+func spanOf(n Node) token.Span {
+	if n == nil {
+		return token.Span{}
+	}
+	return n.Span()
+}
@@ -26,3 +26,89 @@ func TestString(t *testing.T) {
 
 	assert.Equal(t, "let myVar = anotherVar;", program.String())
 }
+
+func TestDump(t *testing.T) {
+	program := &Program{
+		Statements: []Statement{
+			&LetStatement{
+				Token: token.Token{Type: token.LET, Literal: "let"},
+				Name:  &Identifier{Token: token.Token{Type: token.IDENT, Literal: "f"}, Value: "f"},
+				Value: &FunctionLiteral{
+					Token:      token.Token{Type: token.FUNCTION, Literal: "fn"},
+					Parameters: []*Identifier{{Token: token.Token{Type: token.IDENT, Literal: "x"}, Value: "x"}},
+					Body: &BlockStatement{
+						Statements: []Statement{
+							&ExpressionStatement{
+								Expression: &InfixExpression{
+									Left:     &Identifier{Value: "x"},
+									Operator: "+",
+									Right:    &IntegerLiteral{Value: 1},
+								},
+							},
+						},
+					},
+				},
+				Doc: "adds one",
+			},
+			&ExpressionStatement{Expression: &HashLiteral{Pairs: map[Expression]Expression{
+				&StringLiteral{Value: "k"}: &Boolean{Value: true},
+			}}},
+		},
+	}
+
+	expected := `Program
+  Statements[0]: LetStatement Doc="adds one"
+    Name: Identifier Value="f"
+    Value: FunctionLiteral
+      Parameters[0]: Identifier Value="x"
+      Body: BlockStatement
+        Statements[0]: ExpressionStatement
+          Expression: InfixExpression Operator="+"
+            Left: Identifier Value="x"
+            Right: IntegerLiteral Value=1
+  Statements[1]: ExpressionStatement
+    Expression: HashLiteral
+      Key: StringLiteral Value="k"
+      Value: Boolean Value=true
+`
+	assert.Equal(t, expected, Dump(program))
+}
+
+func TestWalk(t *testing.T) {
+	ident := func(name string) *Identifier { return &Identifier{Value: name} }
+	program := &Program{
+		Statements: []Statement{
+			&ExpressionStatement{Expression: &CallExpression{
+				Function: ident("f"),
+				Arguments: []Expression{
+					&InfixExpression{Left: ident("a"), Operator: "+", Right: &IntegerLiteral{Value: 1}},
+					&FunctionLiteral{Parameters: []*Identifier{ident("x")}, Body: &BlockStatement{
+						Statements: []Statement{&ReturnStatement{ReturnValue: ident("b")}},
+					}},
+				},
+			}},
+			&ExpressionStatement{Expression: &IfExpression{Condition: ident("c"), Consequence: &BlockStatement{
+				Statements: []Statement{&ExpressionStatement{Expression: ident("d")}},
+			}}},
+		},
+	}
+
+	var visited []string
+	Walk(program, func(node Node) bool {
+		if identifier, ok := node.(*Identifier); ok {
+			visited = append(visited, identifier.Value)
+		}
+		return true
+	})
+	assert.Equal(t, []string{"f", "a", "b", "c", "d"}, visited)
+
+	visited = nil
+	Walk(program, func(node Node) bool {
+		if identifier, ok := node.(*Identifier); ok {
+			visited = append(visited, identifier.Value)
+		}
+		_, isFunction := node.(*FunctionLiteral)
+		return !isFunction
+	})
+	assert.Equal(t, []string{"f", "a", "c", "d"}, visited)
+}
@@ -0,0 +1,104 @@
+package ast
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+
+	"kjarmicki.github.com/monkey/token"
+)
+
+// indented tree of the node and all of its children, one node per line, e.g. for 1 + 2:
+//
+//	Program 1:1
+//	  Statements[0]: ExpressionStatement 1:1
+//	    Expression: InfixExpression 1:1 Operator="+"
+//	      Left: IntegerLiteral 1:1 Value=1
+//	      Right: IntegerLiteral 1:5 Value=2
+//
+// Scalar fields are printed next to the node name, tokens are left out and so are the fields tagged
+// with dump:"omitempty" when they're not set.
+func Dump(node Node) string {
+	var out strings.Builder
+	dump(&out, node, "", 0)
+	return out.String()
+}
+
+var (
+	nodeType  = reflect.TypeOf((*Node)(nil)).Elem()
+	tokenType = reflect.TypeOf(token.Token{})
+	bigType   = reflect.TypeOf(&big.Int{})
+)
+
+func dump(out *strings.Builder, node Node, label string, depth int) {
+	out.WriteString(strings.Repeat("  ", depth))
+	if label != "" {
+		out.WriteString(label + ": ")
+	}
+	value := reflect.ValueOf(node)
+	if node == nil || (value.Kind() == reflect.Pointer && value.IsNil()) {
+		out.WriteString("<nil>\n")
+		return
+	}
+
+	out.WriteString(reflect.Indirect(value).Type().Name())
+	if start := node.Span().Start; start.IsValid() {
+		out.WriteString(" " + start.String())
+	}
+
+	type child struct {
+		label string
+		node  Node
+	}
+	var children []child
+
+	fields := reflect.Indirect(value)
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		fieldValue := fields.Field(i)
+		if field.Tag.Get("dump") == "omitempty" && fieldValue.IsZero() {
+			continue
+		}
+		switch {
+		case field.Type == tokenType:
+		case field.Type.Implements(nodeType):
+			var n Node
+			if !fieldValue.IsNil() {
+				n = fieldValue.Interface().(Node)
+			}
+			children = append(children, child{field.Name, n})
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Implements(nodeType):
+			for j := 0; j < fieldValue.Len(); j++ {
+				label := fmt.Sprintf("%s[%d]", field.Name, j)
+				children = append(children, child{label, fieldValue.Index(j).Interface().(Node)})
+			}
+		case field.Type.Kind() == reflect.Map:
+			// hash literal pairs, in the source order
+			keys := fieldValue.MapKeys()
+			sort.Slice(keys, func(a, b int) bool {
+				return keys[a].Interface().(Node).Span().Start.Offset < keys[b].Interface().(Node).Span().Start.Offset
+			})
+			for _, key := range keys {
+				children = append(children, child{"Key", key.Interface().(Node)})
+				children = append(children, child{"Value", fieldValue.MapIndex(key).Interface().(Node)})
+			}
+		case field.Type == bigType:
+			if !fieldValue.IsNil() {
+				fmt.Fprintf(out, " %s=%s", field.Name, fieldValue.Interface())
+			}
+		case field.Type.Kind() == reflect.String:
+			if fieldValue.String() != "" {
+				fmt.Fprintf(out, " %s=%q", field.Name, fieldValue.String())
+			}
+		default:
+			fmt.Fprintf(out, " %s=%v", field.Name, fieldValue.Interface())
+		}
+	}
+	out.WriteString("\n")
+
+	for _, c := range children {
+		dump(out, c.node, c.label, depth+1)
+	}
+}
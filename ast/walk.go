@@ -0,0 +1,94 @@
+package ast
+
+import "sort"
+
+// calls visit for the node and, as long as it returns true, for all of its children, in the source order
+func Walk(node Node, visit func(Node) bool) {
+	if node == nil || !visit(node) {
+		return
+	}
+	switch node := node.(type) {
+	case *Program:
+		for _, statement := range node.Statements {
+			Walk(statement, visit)
+		}
+	case *BlockStatement:
+		for _, statement := range node.Statements {
+			Walk(statement, visit)
+		}
+	case *ExpressionStatement:
+		walkExpression(node.Expression, visit)
+	case *LetStatement:
+		walkExpression(node.Value, visit)
+	case *ReturnStatement:
+		walkExpression(node.ReturnValue, visit)
+	case *ThrowStatement:
+		walkExpression(node.Value, visit)
+	case *PrefixExpression:
+		walkExpression(node.Right, visit)
+	case *InfixExpression:
+		walkExpression(node.Left, visit)
+		walkExpression(node.Right, visit)
+	case *IfExpression:
+		walkExpression(node.Condition, visit)
+		walkBlock(node.Consequence, visit)
+		walkBlock(node.Alternative, visit)
+	case *WhileExpression:
+		walkExpression(node.Condition, visit)
+		walkBlock(node.Body, visit)
+	case *ForExpression:
+		walkExpression(node.Iterable, visit)
+		walkBlock(node.Body, visit)
+	case *TryExpression:
+		walkBlock(node.Body, visit)
+		walkBlock(node.Catch, visit)
+		walkBlock(node.Finally, visit)
+	case *AssignExpression:
+		walkExpression(node.Target, visit)
+		walkExpression(node.Value, visit)
+	case *FunctionLiteral:
+		walkBlock(node.Body, visit)
+	case *CallExpression:
+		walkExpression(node.Function, visit)
+		for _, arg := range node.Arguments {
+			walkExpression(arg, visit)
+		}
+	case *ArrayLiteral:
+		for _, element := range node.Elements {
+			walkExpression(element, visit)
+		}
+	case *IndexExpression:
+		walkExpression(node.Left, visit)
+		walkExpression(node.Index, visit)
+	case *HashLiteral:
+		for _, pair := range node.OrderedPairs() {
+			walkExpression(pair[0], visit)
+			walkExpression(pair[1], visit)
+		}
+	}
+}
+
+// nil children (left out or missing after a parse error) are skipped, without calling visit with a typed nil
+func walkExpression(node Expression, visit func(Node) bool) {
+	if node != nil {
+		Walk(node, visit)
+	}
+}
+
+func walkBlock(block *BlockStatement, visit func(Node) bool) {
+	if block != nil {
+		Walk(block, visit)
+	}
+}
+
+// key and value pairs in the source order, unlike the map giving them in random order
+func (hl *HashLiteral) OrderedPairs() [][2]Expression {
+	pairs := make([][2]Expression, 0, len(hl.Pairs))
+	for key, value := range hl.Pairs {
+		pairs = append(pairs, [2]Expression{key, value})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i][0].Span().Start.Offset < pairs[j][0].Span().Start.Offset
+	})
+	return pairs
+}
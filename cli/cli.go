@@ -0,0 +1,445 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/compiler"
+	"kjarmicki.github.com/monkey/diagnostic"
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/lexer"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/optimizer"
+	"kjarmicki.github.com/monkey/parser"
+	"kjarmicki.github.com/monkey/repl"
+	"kjarmicki.github.com/monkey/vm"
+)
+
+/*
+ * Command line interface of the interpreter, main.go is just a thin wrapper around Run.
+ * Everything goes through the given streams and the result is the process exit code, so the whole CLI can be tested in-process.
+ */
+
+// process exit codes
+const (
+	ExitOK           = 0
+	ExitRuntimeError = 1  // evaluation resulted in an error
+	ExitSyntaxError  = 2  // source code couldn't be parsed or resolved
+	ExitUsage        = 64 // wrong command line usage, as in sysexits.h
+	ExitDataError    = 65 // compiled program couldn't be loaded, as in sysexits.h
+	ExitNoInput      = 66 // script file couldn't be read, as in sysexits.h
+	ExitCantCreate   = 73 // compiled program couldn't be written, as in sysexits.h
+)
+
+const usage = `Usage: monkey <command> [arguments]
+
+Commands:
+  run <file> [args...]   run the script, args are available to it as the args array (use - to read the script from stdin).
+                         Compiled programs (.mkc) are run with the virtual machine
+  eval -e <code>         evaluate the code and print the result
+  check <file>...        report syntax errors and undefined variables in the files without running anything
+  build [-o out] <file>  compile the script to bytecode, written to the file with the .mkc extension by default
+  disasm <file>          print the bytecode instructions of the script or of the compiled program
+  repl                   start the interactive REPL (the default when no command is given)
+  help                   show this message
+
+Run and eval accept -timeout <duration>, -max-steps <n>, -max-depth <n> and -max-memory <bytes> to limit the evaluation,
+-vm to run the code with the bytecode virtual machine, -optimize to optimize the code before running it
+and -dump-optimized to print the optimized code instead of running it.
+`
+
+// runs the command given by args (without the program name) and returns the exit code
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		return runRepl(nil, stdin, stdout, stderr)
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "run":
+		return runFile(args, stdin, stdout, stderr)
+	case "eval":
+		return runEval(args, stdin, stdout, stderr)
+	case "check":
+		return runCheck(args, stdin, stderr)
+	case "build":
+		return runBuild(args, stdin, stderr)
+	case "disasm":
+		return runDisasm(args, stdin, stdout, stderr)
+	case "repl":
+		return runRepl(args, stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		io.WriteString(stdout, usage)
+		return ExitOK
+	default:
+		fmt.Fprintf(stderr, "monkey: unknown command %q\n\n%s", command, usage)
+		return ExitUsage
+	}
+}
+
+func runFile(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("run", stderr)
+	limits := addLimitFlags(fs)
+	execution := addExecutionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagErrorCode(err)
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintf(stderr, "monkey run: missing script file\n\n%s", usage)
+		return ExitUsage
+	}
+
+	file, scriptArgs := fs.Arg(0), fs.Args()[1:]
+	source, err := readSource(file, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "monkey run: %s\n", err)
+		return ExitNoInput
+	}
+
+	env := limits.newEnvironment(stdin, stdout, stderr)
+	env.Set("args", stringArray(scriptArgs))
+	ctx, cancel := limits.context()
+	defer cancel()
+	if compiler.IsBytecode([]byte(source)) {
+		bytecode, err := compiler.Load([]byte(source))
+		if err != nil {
+			fmt.Fprintf(stderr, "monkey run: %s: %s\n", sourceName(file), err)
+			return ExitDataError
+		}
+		_, code := report(vm.New(bytecode, env).Run(ctx), stderr)
+		return code
+	}
+	_, code := execute(ctx, sourceName(file), source, env, *execution, stdout, stderr)
+	return code
+}
+
+func runEval(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("eval", stderr)
+	code := fs.String("e", "", "code to evaluate")
+	limits := addLimitFlags(fs)
+	execution := addExecutionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagErrorCode(err)
+	}
+	if *code == "" || fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "monkey eval: expected the code as -e <code>\n\n%s", usage)
+		return ExitUsage
+	}
+
+	env := limits.newEnvironment(stdin, stdout, stderr)
+	ctx, cancel := limits.context()
+	defer cancel()
+	result, exitCode := execute(ctx, "", *code, env, *execution, stdout, stderr)
+	if result != nil && result != evaluator.NULL && exitCode == ExitOK {
+		fmt.Fprintln(stdout, result.Inspect())
+	}
+	return exitCode
+}
+
+func runCheck(args []string, stdin io.Reader, stderr io.Writer) int {
+	fs := newFlagSet("check", stderr)
+	if err := fs.Parse(args); err != nil {
+		return flagErrorCode(err)
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintf(stderr, "monkey check: missing files to check\n\n%s", usage)
+		return ExitUsage
+	}
+
+	exitCode := ExitOK
+	for _, file := range fs.Args() {
+		source, err := readSource(file, stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "monkey check: %s\n", err)
+			exitCode = ExitNoInput
+			continue
+		}
+		ok := false
+		if program, parsed := parse(sourceName(file), source, stderr); parsed {
+			// scripts are checked as if they were run, with the args
+			env := object.NewEnvironment()
+			env.Set("args", stringArray(nil))
+			ok = resolve(program, source, env, stderr)
+		}
+		if !ok && exitCode == ExitOK {
+			exitCode = ExitSyntaxError
+		}
+	}
+	return exitCode
+}
+
+func runBuild(args []string, stdin io.Reader, stderr io.Writer) int {
+	fs := newFlagSet("build", stderr)
+	output := fs.String("o", "", "file to write the compiled program to")
+	if err := fs.Parse(args); err != nil {
+		return flagErrorCode(err)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(stderr, "monkey build: expected one script file\n\n%s", usage)
+		return ExitUsage
+	}
+	file := fs.Arg(0)
+	if *output == "" {
+		if file == "-" {
+			fmt.Fprintf(stderr, "monkey build: -o is required when reading the script from stdin\n")
+			return ExitUsage
+		}
+		*output = strings.TrimSuffix(file, filepath.Ext(file)) + ".mkc"
+	}
+
+	source, err := readSource(file, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "monkey build: %s\n", err)
+		return ExitNoInput
+	}
+	bytecode, code := compile(sourceName(file), source, stderr)
+	if bytecode == nil {
+		return code
+	}
+	data, err := bytecode.MarshalBinary()
+	if err == nil {
+		err = os.WriteFile(*output, data, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "monkey build: %s\n", err)
+		return ExitCantCreate
+	}
+	return ExitOK
+}
+
+func runDisasm(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := newFlagSet("disasm", stderr)
+	if err := fs.Parse(args); err != nil {
+		return flagErrorCode(err)
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintf(stderr, "monkey disasm: expected one file\n\n%s", usage)
+		return ExitUsage
+	}
+	file := fs.Arg(0)
+	source, err := readSource(file, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "monkey disasm: %s\n", err)
+		return ExitNoInput
+	}
+
+	var bytecode *compiler.Bytecode
+	if compiler.IsBytecode([]byte(source)) {
+		if bytecode, err = compiler.Load([]byte(source)); err != nil {
+			fmt.Fprintf(stderr, "monkey disasm: %s: %s\n", sourceName(file), err)
+			return ExitDataError
+		}
+	} else {
+		var code int
+		if bytecode, code = compile(sourceName(file), source, stderr); bytecode == nil {
+			return code
+		}
+	}
+	io.WriteString(stdout, compiler.Disassemble(bytecode))
+	return ExitOK
+}
+
+func runRepl(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		fmt.Fprintf(stderr, "monkey repl: unexpected arguments %s\n\n%s", strings.Join(args, " "), usage)
+		return ExitUsage
+	}
+	var options repl.Options
+	// only interactive sessions are remembered, piped input would just pollute the history
+	if f, ok := stdin.(*os.File); ok && repl.IsTerminal(f) {
+		options.HistoryFile = historyFile()
+		options.HistorySize = historySize
+	}
+	fmt.Fprintln(stdout, "Monkey REPL ready")
+	options.Stderr = stderr
+	repl.Start(stdin, stdout, options)
+	return ExitOK
+}
+
+const historySize = 1000
+
+// $MONKEY_HISTORY if set, ~/.monkey_history otherwise
+func historyFile() string {
+	if file, ok := os.LookupEnv("MONKEY_HISTORY"); ok {
+		return file
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".monkey_history")
+}
+
+// parses and evaluates the source (or compiles it and runs it with the vm), reporting problems to stderr
+func execute(ctx context.Context, file, source string, env *object.Environment, execution executionFlags, stdout, stderr io.Writer) (object.Object, int) {
+	program, ok := parse(file, source, stderr)
+	if !ok || !resolve(program, source, env, stderr) {
+		return nil, ExitSyntaxError
+	}
+	if execution.optimize || execution.dumpOptimized {
+		program = optimizer.Optimize(program)
+	}
+	if execution.dumpOptimized {
+		fmt.Fprintln(stdout, program.String())
+		return nil, ExitOK
+	}
+	if execution.vm {
+		bytecode, code := compileProgram(program, stderr)
+		if bytecode == nil {
+			return nil, code
+		}
+		return report(vm.New(bytecode, env).Run(ctx), stderr)
+	}
+	return report(evaluator.EvalContext(ctx, program, env), stderr)
+}
+
+// prints the runtime error the run resulted in, if any
+func report(result object.Object, stderr io.Writer) (object.Object, int) {
+	if err, ok := result.(*object.Error); ok {
+		printRuntimeError(stderr, err)
+		return nil, ExitRuntimeError
+	}
+	return result, ExitOK
+}
+
+// parses and compiles the source, reporting problems to stderr. The bytecode is nil when the compilation failed.
+func compile(file, source string, stderr io.Writer) (*compiler.Bytecode, int) {
+	program, ok := parse(file, source, stderr)
+	if !ok {
+		return nil, ExitSyntaxError
+	}
+	return compileProgram(program, stderr)
+}
+
+func compileProgram(program *ast.Program, stderr io.Writer) (*compiler.Bytecode, int) {
+	bytecode, err := compiler.New().Compile(program)
+	if err != nil {
+		fmt.Fprintf(stderr, "compile error: %s\n", err)
+		return nil, ExitSyntaxError
+	}
+	return bytecode, ExitOK
+}
+
+func parse(file, source string, stderr io.Writer) (*ast.Program, bool) {
+	p := parser.New(lexer.NewFile(file, source))
+	program := p.ParseProgram()
+	if errors := p.Errors(); len(errors) > 0 {
+		diagnostic.RenderAll(stderr, source, errors)
+		return nil, false
+	}
+	return program, true
+}
+
+// resolves the variables of the program to be run in the environment, reporting the problems to stderr
+func resolve(program *ast.Program, source string, env *object.Environment, stderr io.Writer) bool {
+	if diagnostics := evaluator.Resolve(program, env); len(diagnostics) > 0 {
+		diagnostic.RenderAll(stderr, source, diagnostics)
+		return false
+	}
+	return true
+}
+
+func printRuntimeError(out io.Writer, err *object.Error) {
+	if err.Span.IsValid() {
+		fmt.Fprintf(out, "%s: runtime error: %s\n", err.Span.Start, err.Message)
+	} else {
+		fmt.Fprintf(out, "runtime error: %s\n", err.Message)
+	}
+	for _, line := range err.StackTrace() {
+		fmt.Fprintf(out, "    %s\n", line)
+	}
+}
+
+// - stands for the standard input
+func readSource(file string, stdin io.Reader) (string, error) {
+	var source []byte
+	var err error
+	if file == "-" {
+		source, err = io.ReadAll(stdin)
+	} else {
+		source, err = os.ReadFile(file)
+	}
+	return string(source), err
+}
+
+// name of the source used in the error positions
+func sourceName(file string) string {
+	if file == "-" {
+		return "<stdin>"
+	}
+	return file
+}
+
+func stringArray(values []string) *object.Array {
+	elements := make([]object.Object, len(values))
+	for i, value := range values {
+		elements[i] = &object.String{Value: value}
+	}
+	return &object.Array{Elements: elements}
+}
+
+// -h is a successful request for help, anything else is a usage error (already reported by the flag set)
+func flagErrorCode(err error) int {
+	if err == flag.ErrHelp {
+		return ExitOK
+	}
+	return ExitUsage
+}
+
+// flags limiting the evaluation of run and eval
+type limitFlags struct {
+	timeout   time.Duration
+	maxSteps  int64
+	maxDepth  int
+	maxMemory int64
+}
+
+func addLimitFlags(fs *flag.FlagSet) *limitFlags {
+	limits := &limitFlags{}
+	fs.DurationVar(&limits.timeout, "timeout", 0, "stop the evaluation after the given time, e.g. 5s (0 means no timeout)")
+	fs.Int64Var(&limits.maxSteps, "max-steps", 0, "stop the evaluation after the given number of steps (0 means no limit)")
+	fs.IntVar(&limits.maxDepth, "max-depth", object.DefaultMaxDepth, "maximum depth of nested function calls")
+	fs.Int64Var(&limits.maxMemory, "max-memory", 0, "stop the evaluation after allocating about the given number of bytes for strings, arrays and hashes (0 means no limit)")
+	return limits
+}
+
+// flags choosing how run and eval execute the code
+type executionFlags struct {
+	vm            bool
+	optimize      bool
+	dumpOptimized bool
+}
+
+func addExecutionFlags(fs *flag.FlagSet) *executionFlags {
+	execution := &executionFlags{}
+	fs.BoolVar(&execution.vm, "vm", false, "compile the code to bytecode and run it with the virtual machine instead of evaluating the syntax tree")
+	fs.BoolVar(&execution.optimize, "optimize", false, "fold constants, remove dead branches and inline small functions before running the code")
+	fs.BoolVar(&execution.dumpOptimized, "dump-optimized", false, "print the optimized code instead of running it")
+	return execution
+}
+
+func (l *limitFlags) newEnvironment(stdin io.Reader, stdout, stderr io.Writer) *object.Environment {
+	runtime := object.NewRuntime(stdin, stdout, stderr)
+	runtime.Limits = object.Limits{MaxSteps: l.maxSteps, MaxDepth: l.maxDepth, MaxMemory: l.maxMemory}
+	return object.NewEnvironmentWithRuntime(runtime)
+}
+
+func (l *limitFlags) context() (context.Context, context.CancelFunc) {
+	if l.timeout > 0 {
+		return context.WithTimeout(context.Background(), l.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func newFlagSet(command string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("monkey "+command, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
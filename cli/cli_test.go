@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	ok := writeFile("ok.mk", "let add = fn(a, b) {\n  a + b\n};\nadd(1, 2);\n")
+	broken := writeFile("broken.mk", "let x = 1;\nlet y 2;\n")
+	failing := writeFile("failing.mk", "let x = 1;\nx + true;\n")
+	usesArgs := writeFile("args.mk", "puts(len(args)); for (arg in args) { puts(arg) }")
+	nested := writeFile("nested.mk", "let check = fn(x) {\n  x + true\n};\ncheck(1);\n")
+	echo := writeFile("echo.mk", "let line = readline(); while (line) { puts(\"> \" + line); line = readline(); }")
+	compiledNested := filepath.Join(dir, "nested.mkc")
+	compiledArgs := filepath.Join(dir, "compiled-args.mkc")
+	corrupted := writeFile("corrupted.mkc", "MKBC\x00\x03garbage")
+
+	tests := []struct {
+		args           []string
+		stdin          string
+		expectedCode   int
+		expectedStdout string
+		expectedStderr string
+	}{
+		{[]string{"eval", "-e", "1 + 2"}, "", ExitOK, "3\n", ""},
+		{[]string{"eval", "-e", "let f = fn(x) {\n x * 2\n}; f(21)"}, "", ExitOK, "42\n", ""},
+		{[]string{"eval", "-e", "if (false) { 1 }"}, "", ExitOK, "", ""},
+		{[]string{"eval", "-e", "let a = [1]; a[0] = a; puts(a)"}, "", ExitOK, "[[...]]\n", ""},
+		{[]string{"eval", "-e", "1 + true"}, "", ExitRuntimeError, "", "1:1: runtime error: type mismatch: INTEGER + BOOLEAN\n"},
+		{[]string{"eval", "-e", "let x 1"}, "", ExitSyntaxError, "", "error[E0001]: expected next token to be =, got INT instead"},
+		{[]string{"eval"}, "", ExitUsage, "", "monkey eval: expected the code as -e <code>"},
+		{[]string{"eval", "-e", "puts(1); x"}, "", ExitSyntaxError, "", "error[E0011]: identifier not found: x\n --> 1:10"},
+		{[]string{"eval", "-vm", "-e", "a; let a = 1"}, "", ExitSyntaxError, "", "error[E0012]: a is used before it's defined"},
+		{[]string{"eval", "-max-steps", "1000", "-e", "while (true) {}"}, "", ExitRuntimeError, "", "runtime error: step limit of 1000 exceeded"},
+		{[]string{"eval", "-vm", "-e", "let f = fn(x) {\n x * 2\n}; f(21)"}, "", ExitOK, "42\n", ""},
+		{[]string{"eval", "-vm", "-e", "1 + true"}, "", ExitRuntimeError, "", "1:1: runtime error: type mismatch: INTEGER + BOOLEAN\n"},
+		{[]string{"eval", "-vm", "-max-steps", "1000", "-e", "while (true) {}"}, "", ExitRuntimeError, "", "runtime error: step limit of 1000 exceeded"},
+		{[]string{"eval", "-optimize", "-e", "let sq = fn(x) { x * x }; sq(2 * 3)"}, "", ExitOK, "36\n", ""},
+		{[]string{"eval", "-optimize", "-vm", "-e", "if (1 > 2) { 1 } else { 60 * 60 }"}, "", ExitOK, "3600\n", ""},
+		{[]string{"eval", "-dump-optimized", "-e", "let sq = fn(x) { x * x }; sq(2 * 3)"}, "", ExitOK, "let sq = fn(x) (x * x);36\n", ""},
+		{[]string{"run", "-dump-optimized", ok}, "", ExitOK, "let add = fn(a, b) (a + b);3\n", ""},
+		{[]string{"eval", "-timeout", "10ms", "-e", "while (true) {}"}, "", ExitRuntimeError, "", "runtime error: evaluation timed out"},
+		{[]string{"eval", "-max-memory", "10000", "-e", "let a = []; while (true) { a = push(a, a) }"}, "", ExitRuntimeError, "", "runtime error: memory limit of 10000 bytes exceeded"},
+		{[]string{"eval", "-max-depth", "3", "-e", "let f = fn() { 1 + f() }; f()"}, "", ExitRuntimeError, "", "stack overflow: maximum call depth of 3 exceeded"},
+		{[]string{"eval", "-x"}, "", ExitUsage, "", "flag provided but not defined: -x"},
+		{[]string{"run", ok}, "", ExitOK, "", ""},
+		{[]string{"run", broken}, "", ExitSyntaxError, "", " --> " + broken + ":2:7"},
+		{[]string{"run", failing}, "", ExitRuntimeError, "", failing + ":2:1: runtime error: type mismatch: INTEGER + BOOLEAN"},
+		{[]string{"run", nested}, "", ExitRuntimeError, "", nested + ":2:3: runtime error: type mismatch: INTEGER + BOOLEAN\n    at check (" + nested + ":2:3)\n    at " + nested + ":4:1\n"},
+		{[]string{"run", usesArgs, "a", "b c"}, "", ExitOK, "2\na\nb c\n", ""},
+		{[]string{"run", usesArgs}, "", ExitOK, "0\n", ""},
+		{[]string{"run", echo}, "one\ntwo\n", ExitOK, "> one\n> two\n", ""},
+		{[]string{"run", "-vm", nested}, "", ExitRuntimeError, "", nested + ":2:3: runtime error: type mismatch: INTEGER + BOOLEAN\n    at check (" + nested + ":2:3)\n    at " + nested + ":4:1\n"},
+		{[]string{"run", "-vm", usesArgs, "a"}, "", ExitOK, "1\na\n", ""},
+		{[]string{"eval", "-e", "puts(readline() + \"!\")"}, "hi\n", ExitOK, "hi!\n", ""},
+		{[]string{"run", "-"}, "1 + true", ExitRuntimeError, "", "<stdin>:1:1: runtime error: type mismatch: INTEGER + BOOLEAN"},
+		{[]string{"run", filepath.Join(dir, "missing.mk")}, "", ExitNoInput, "", "monkey run: open "},
+		{[]string{"run"}, "", ExitUsage, "", "monkey run: missing script file"},
+		{[]string{"check", ok}, "", ExitOK, "", ""},
+		{[]string{"check", failing}, "", ExitOK, "", ""},
+		{[]string{"check", ok, broken}, "", ExitSyntaxError, "", "error[E0001]: expected next token to be =, got INT instead\n --> " + broken + ":2:7"},
+		{[]string{"check", "-"}, "let = 1;", ExitSyntaxError, "", " --> <stdin>:1:5"},
+		{[]string{"check", "-"}, "len(args); fn() { y }", ExitSyntaxError, "", "error[E0011]: identifier not found: y\n --> <stdin>:1:19"},
+		{[]string{"check"}, "", ExitUsage, "", "monkey check: missing files to check"},
+		{[]string{"build", nested}, "", ExitOK, "", ""},
+		{[]string{"run", compiledNested}, "", ExitRuntimeError, "", nested + ":2:3: runtime error: type mismatch: INTEGER + BOOLEAN\n    at check (" + nested + ":2:3)\n    at " + nested + ":4:1\n"},
+		{[]string{"build", "-o", compiledArgs, usesArgs}, "", ExitOK, "", ""},
+		{[]string{"run", compiledArgs, "a", "b c"}, "", ExitOK, "2\na\nb c\n", ""},
+		{[]string{"build", broken}, "", ExitSyntaxError, "", " --> " + broken + ":2:7"},
+		{[]string{"build", "-"}, "1", ExitUsage, "", "monkey build: -o is required when reading the script from stdin"},
+		{[]string{"build", "-o", filepath.Join(dir, "missing", "out.mkc"), ok}, "", ExitCantCreate, "", "monkey build: open "},
+		{[]string{"run", corrupted}, "", ExitDataError, "", "monkey run: " + corrupted + ": checksum mismatch, the file is corrupted"},
+		{[]string{"disasm", compiledNested}, "", ExitOK, "== main ==\n0000  1:13   OpClosure 0 0          ; fn check\n", ""},
+		{[]string{"disasm", "-"}, "puts(1)", ExitOK, "0000  1:1    OpGetGlobal 0          ; puts\n", ""},
+		{[]string{"disasm", broken}, "", ExitSyntaxError, "", " --> " + broken + ":2:7"},
+		{[]string{"disasm"}, "", ExitUsage, "", "monkey disasm: expected one file"},
+		{[]string{"repl"}, "1 + 2\n", ExitOK, "3\n", ""},
+		{[]string{"repl", "extra"}, "", ExitUsage, "", "monkey repl: unexpected arguments extra"},
+		{[]string{}, "5 * 5\n", ExitOK, "25\n", ""},
+		{[]string{"help"}, "", ExitOK, "Usage: monkey <command> [arguments]", ""},
+		{[]string{"bogus"}, "", ExitUsage, "", `monkey: unknown command "bogus"`},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code := Run(tt.args, strings.NewReader(tt.stdin), &stdout, &stderr)
+
+		name := strings.Join(tt.args, " ")
+		assert.Equal(t, tt.expectedCode, code, name)
+		assert.Contains(t, stdout.String(), tt.expectedStdout, name)
+		if tt.expectedStderr == "" {
+			assert.Empty(t, stderr.String(), name)
+		} else {
+			assert.Contains(t, stderr.String(), tt.expectedStderr, name)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package code
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"kjarmicki.github.com/monkey/token"
+)
+
+// bytecode of a function: opcodes, each followed by its operands (big endian)
+type Instructions []byte
+
+type Opcode byte
+
+const (
+	OpConstant Opcode = iota // push the constant
+	OpNull
+	OpTrue
+	OpFalse
+	OpPop
+	OpDup2 // duplicate the two values on top of the stack, e.g. the array and the index for arr[i] += 1
+
+	// binary operators, pop the right and the left operand and push the result
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpEqual
+	OpNotEqual
+	OpLess
+	OpLessEqual
+	OpGreater
+	OpGreaterEqual
+
+	// unary operators
+	OpMinus
+	OpBang
+
+	OpJump            // jump to the offset
+	OpJumpIfFalsy     // pop the condition, jump if it's falsy
+	OpJumpIfFalsyKeep // && - jump if the value on top is falsy, pop it otherwise
+	OpJumpIfTruthyKeep
+
+	// variables, the define ops pop the value (let), the assign ops leave it on the stack (assignment is an expression).
+	// Globals are stored in the environment by their name, locals in the frame slots, captured locals in cells
+	// shared with the closures, free variables are the cells the closure captured.
+	OpGetGlobal
+	OpDefineGlobal
+	OpAssignGlobal
+	OpGetLocal
+	OpDefineLocal
+	OpAssignLocal
+	OpGetCell
+	OpDefineCell
+	OpAssignCell
+	OpGetFree
+	OpAssignFree
+	// until the let of a declared local runs, its name refers to the outer variable of the same name: these ops
+	// push (or assign) the variable and jump to the offset when it's defined, and fall through to the op of
+	// the outer variable otherwise
+	OpGetLocalOrOuter
+	OpAssignLocalOrOuter
+	OpGetCellOrOuter
+	OpAssignCellOrOuter
+	OpGetFreeOrOuter
+	OpAssignFreeOrOuter
+	OpNewCell      // move the local into a new cell, done on entering the function for all the captured locals
+	OpLoadCell     // push the cell of the local, to be captured by a closure
+	OpLoadFreeCell // push the cell of the free variable, to be captured by a closure
+	OpClosure      // pop the captured cells and push a closure of the compiled function constant
+
+	OpArray    // pop the elements and push an array
+	OpHash     // pop the keys and values and push a hash
+	OpIndex    // pop the index and the indexed value, push the element
+	OpSetIndex // pop the value, the index and the indexed value, push the value
+
+	OpCall        // call the function below the arguments
+	OpTailCall    // call the function below the arguments in place of the current one, whose result is the call's result
+	OpReturnValue // return the value on top of the stack
+	OpReturn      // return nothing, only the main program does that
+
+	OpTry     // handle the errors raised until OpPopTry by jumping to the offset with the error on the stack
+	OpPopTry  // leave the innermost try
+	OpCatch   // turn the error on top of the stack into the hash seen by the catch block
+	OpRethrow // raise the error on top of the stack again, after running the finally block
+	OpThrow   // pop the value and raise it as an error
+	OpError   // raise an error with the message from the constant
+
+	OpIter     // replace the value on top of the stack with an iterator over it
+	OpIterNext // push the next item of the iterator on top of the stack, jump to the offset when there are none left
+)
+
+type Definition struct {
+	Name          string
+	OperandWidths []int // in bytes
+}
+
+var definitions = map[Opcode]*Definition{
+	OpConstant:           {"OpConstant", []int{2}},
+	OpNull:               {"OpNull", []int{}},
+	OpTrue:               {"OpTrue", []int{}},
+	OpFalse:              {"OpFalse", []int{}},
+	OpPop:                {"OpPop", []int{}},
+	OpDup2:               {"OpDup2", []int{}},
+	OpAdd:                {"OpAdd", []int{}},
+	OpSub:                {"OpSub", []int{}},
+	OpMul:                {"OpMul", []int{}},
+	OpDiv:                {"OpDiv", []int{}},
+	OpMod:                {"OpMod", []int{}},
+	OpEqual:              {"OpEqual", []int{}},
+	OpNotEqual:           {"OpNotEqual", []int{}},
+	OpLess:               {"OpLess", []int{}},
+	OpLessEqual:          {"OpLessEqual", []int{}},
+	OpGreater:            {"OpGreater", []int{}},
+	OpGreaterEqual:       {"OpGreaterEqual", []int{}},
+	OpMinus:              {"OpMinus", []int{}},
+	OpBang:               {"OpBang", []int{}},
+	OpJump:               {"OpJump", []int{4}},
+	OpJumpIfFalsy:        {"OpJumpIfFalsy", []int{4}},
+	OpJumpIfFalsyKeep:    {"OpJumpIfFalsyKeep", []int{4}},
+	OpJumpIfTruthyKeep:   {"OpJumpIfTruthyKeep", []int{4}},
+	OpGetGlobal:          {"OpGetGlobal", []int{2}},
+	OpDefineGlobal:       {"OpDefineGlobal", []int{2}},
+	OpAssignGlobal:       {"OpAssignGlobal", []int{2}},
+	OpGetLocal:           {"OpGetLocal", []int{2}},
+	OpDefineLocal:        {"OpDefineLocal", []int{2}},
+	OpAssignLocal:        {"OpAssignLocal", []int{2}},
+	OpGetCell:            {"OpGetCell", []int{2}},
+	OpDefineCell:         {"OpDefineCell", []int{2}},
+	OpAssignCell:         {"OpAssignCell", []int{2}},
+	OpGetFree:            {"OpGetFree", []int{2}},
+	OpAssignFree:         {"OpAssignFree", []int{2}},
+	OpGetLocalOrOuter:    {"OpGetLocalOrOuter", []int{2, 4}},
+	OpAssignLocalOrOuter: {"OpAssignLocalOrOuter", []int{2, 4}},
+	OpGetCellOrOuter:     {"OpGetCellOrOuter", []int{2, 4}},
+	OpAssignCellOrOuter:  {"OpAssignCellOrOuter", []int{2, 4}},
+	OpGetFreeOrOuter:     {"OpGetFreeOrOuter", []int{2, 4}},
+	OpAssignFreeOrOuter:  {"OpAssignFreeOrOuter", []int{2, 4}},
+	OpNewCell:            {"OpNewCell", []int{2}},
+	OpLoadCell:           {"OpLoadCell", []int{2}},
+	OpLoadFreeCell:       {"OpLoadFreeCell", []int{2}},
+	OpClosure:            {"OpClosure", []int{2, 2}},
+	OpArray:              {"OpArray", []int{2}},
+	OpHash:               {"OpHash", []int{2}},
+	OpIndex:              {"OpIndex", []int{}},
+	OpSetIndex:           {"OpSetIndex", []int{}},
+	OpCall:               {"OpCall", []int{1}},
+	OpTailCall:           {"OpTailCall", []int{1}},
+	OpReturnValue:        {"OpReturnValue", []int{}},
+	OpReturn:             {"OpReturn", []int{}},
+	OpTry:                {"OpTry", []int{4}},
+	OpPopTry:             {"OpPopTry", []int{}},
+	OpCatch:              {"OpCatch", []int{}},
+	OpRethrow:            {"OpRethrow", []int{}},
+	OpThrow:              {"OpThrow", []int{}},
+	OpError:              {"OpError", []int{2}},
+	OpIter:               {"OpIter", []int{}},
+	OpIterNext:           {"OpIterNext", []int{4}},
+}
+
+func Lookup(op byte) (*Definition, error) {
+	def, ok := definitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+	return def, nil
+}
+
+// largest value of an operand of the given width
+func MaxOperand(width int) int {
+	return 1<<(8*width) - 1
+}
+
+// encodes the instruction, operands that don't fit in their width are truncated
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	length := 1
+	for _, w := range def.OperandWidths {
+		length += w
+	}
+	instruction := make([]byte, length)
+	instruction[0] = byte(op)
+
+	offset := 1
+	for i, o := range operands {
+		width := def.OperandWidths[i]
+		switch width {
+		case 1:
+			instruction[offset] = byte(o)
+		case 2:
+			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
+		}
+		offset += width
+	}
+	return instruction
+}
+
+// decodes the operands following the opcode, returns them with the number of bytes read
+func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+	for i, width := range def.OperandWidths {
+		switch width {
+		case 1:
+			operands[i] = int(ins[offset])
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		case 4:
+			operands[i] = int(ReadUint32(ins[offset:]))
+		}
+		offset += width
+	}
+	return operands, offset
+}
+
+func ReadUint16(ins Instructions) uint16 {
+	return binary.BigEndian.Uint16(ins)
+}
+
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
+// one instruction per line, prefixed with its offset, e.g. 0003 OpConstant 1
+func (ins Instructions) String() string {
+	var out bytes.Buffer
+	for i := 0; i < len(ins); {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			return out.String()
+		}
+		operands, read := ReadOperands(def, ins[i+1:])
+		fmt.Fprintf(&out, "%04d %s\n", i, fmtInstruction(def, operands))
+		i += 1 + read
+	}
+	return out.String()
+}
+
+func fmtInstruction(def *Definition, operands []int) string {
+	out := def.Name
+	for _, operand := range operands {
+		out += fmt.Sprintf(" %d", operand)
+	}
+	return out
+}
+
+// where in the source the instructions starting at the offset come from
+type SourceEntry struct {
+	Offset int
+	Span   token.Span
+}
+
+// spans of the instructions, sorted by offset. An entry covers all the instructions up to the next one.
+type SourceMap []SourceEntry
+
+// span of the instruction at the offset, invalid when unknown
+func (m SourceMap) Lookup(offset int) token.Span {
+	i := sort.Search(len(m), func(i int) bool { return m[i].Offset > offset })
+	if i == 0 {
+		return token.Span{}
+	}
+	return m[i-1].Span
+}
@@ -0,0 +1,83 @@
+package code
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/token"
+)
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
+		{OpAdd, []int{}, []byte{byte(OpAdd)}},
+		{OpCall, []int{255}, []byte{byte(OpCall), 255}},
+		{OpJump, []int{65536}, []byte{byte(OpJump), 0, 1, 0, 0}},
+		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 0, 255}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Make(tt.op, tt.operands...))
+	}
+}
+
+func TestReadOperands(t *testing.T) {
+	tests := []struct {
+		op        Opcode
+		operands  []int
+		bytesRead int
+	}{
+		{OpConstant, []int{65535}, 2},
+		{OpCall, []int{3}, 1},
+		{OpJumpIfFalsy, []int{70000}, 4},
+		{OpClosure, []int{65535, 255}, 4},
+	}
+
+	for _, tt := range tests {
+		instruction := Make(tt.op, tt.operands...)
+		def, err := Lookup(byte(tt.op))
+		assert.NoError(t, err)
+		operands, read := ReadOperands(def, instruction[1:])
+		assert.Equal(t, tt.bytesRead, read)
+		assert.Equal(t, tt.operands, operands)
+	}
+}
+
+func TestInstructionsString(t *testing.T) {
+	instructions := []Instructions{
+		Make(OpAdd),
+		Make(OpGetLocal, 1),
+		Make(OpConstant, 2),
+		Make(OpConstant, 65535),
+		Make(OpClosure, 65535, 255),
+		Make(OpJump, 3),
+	}
+	expected := `0000 OpAdd
+0001 OpGetLocal 1
+0004 OpConstant 2
+0007 OpConstant 65535
+0010 OpClosure 65535 255
+0015 OpJump 3
+`
+	concatted := Instructions{}
+	for _, ins := range instructions {
+		concatted = append(concatted, ins...)
+	}
+	assert.Equal(t, expected, concatted.String())
+}
+
+func TestSourceMapLookup(t *testing.T) {
+	first := token.Span{Start: token.Position{Line: 1, Column: 1}, End: token.Position{Line: 1, Column: 5}}
+	second := token.Span{Start: token.Position{Line: 2, Column: 3}, End: token.Position{Line: 2, Column: 8}}
+	sourceMap := SourceMap{{Offset: 2, Span: first}, {Offset: 7, Span: second}}
+
+	assert.False(t, sourceMap.Lookup(0).IsValid())
+	assert.Equal(t, first, sourceMap.Lookup(2))
+	assert.Equal(t, first, sourceMap.Lookup(6))
+	assert.Equal(t, second, sourceMap.Lookup(7))
+	assert.Equal(t, second, sourceMap.Lookup(100))
+}
@@ -0,0 +1,661 @@
+package compiler
+
+import (
+	"fmt"
+
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/code"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/token"
+)
+
+// compiled program, run by the vm
+type Bytecode struct {
+	Main      *object.CompiledFunction // code of the top level statements
+	Constants []object.Object
+	Globals   []string // names of the globals, indexed by the operands of the global ops
+}
+
+/*
+ * Compiles the syntax tree to bytecode for the vm, which gives the same results as the evaluator:
+ * every expression leaves its value on the stack, statements leave the stack as it was.
+ * Errors are raised at runtime, just like the evaluator raises them, the compilation itself only fails
+ * when the program exceeds the limits of the instruction encoding.
+ */
+type Compiler struct {
+	constants []object.Object
+	globals   *SymbolTable
+	scopes    []*scope // of the functions being compiled, the innermost last
+
+	span        token.Span // of the node being compiled, recorded for the emitted instructions
+	programSpan token.Span
+	outer       map[*ast.FunctionLiteral]map[string]bool // see outerNames
+	err         error
+}
+
+// instructions of one function and what's needed to compile them
+type scope struct {
+	instructions code.Instructions
+	sourceMap    code.SourceMap
+	symbols      *SymbolTable
+	depth        int // number of values on the stack, known at any point of the code
+	loops        []*loop
+	unwind       []unwind // try blocks the code is in, the innermost last
+}
+
+type loop struct {
+	depth          int // of the stack at the start of the loop, break and continue drop the values above it
+	unwind         int // number of try blocks entered before the loop
+	continueTarget int
+	breaks         []int // positions of the jumps to the end of the loop
+}
+
+// what leaving a try block takes: popping its handler, then running its finally block
+type unwind struct {
+	handler bool
+	finally *ast.BlockStatement
+}
+
+func New() *Compiler {
+	return &Compiler{globals: NewSymbolTable(), outer: map[*ast.FunctionLiteral]map[string]bool{}}
+}
+
+// compiles the program, the globals and the constants are kept, so a compiler can compile subsequent inputs of a session
+func (c *Compiler) Compile(program *ast.Program) (*Bytecode, error) {
+	c.err = nil
+	c.scopes = []*scope{{symbols: c.globals}}
+	c.span = program.Span()
+	c.programSpan = program.Span()
+
+	for i, statement := range program.Statements {
+		// the program evaluates to the value of the last statement, nothing when it's not an expression
+		if es, ok := statement.(*ast.ExpressionStatement); ok && i == len(program.Statements)-1 {
+			c.compileExpression(es.Expression)
+			c.emit(code.OpReturnValue)
+			continue
+		}
+		c.compileStatement(statement)
+	}
+	c.emit(code.OpReturn)
+
+	main := c.scopes[0]
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &Bytecode{
+		Main:      &object.CompiledFunction{Instructions: main.instructions, SourceMap: main.sourceMap},
+		Constants: c.constants,
+		Globals:   c.globals.Names(),
+	}, nil
+}
+
+func (c *Compiler) scope() *scope {
+	return c.scopes[len(c.scopes)-1]
+}
+
+// makes the node the source of the instructions emitted until the returned function is called
+func (c *Compiler) at(node ast.Node) func() {
+	previous := c.span
+	c.span = node.Span()
+	return func() { c.span = previous }
+}
+
+func (c *Compiler) fail(format string, args ...any) {
+	if c.err == nil {
+		c.err = fmt.Errorf("%s: %s", c.span.Start, fmt.Sprintf(format, args...))
+	}
+}
+
+func (c *Compiler) compileStatement(statement ast.Statement) {
+	defer c.at(statement)()
+	switch statement := statement.(type) {
+	case *ast.ExpressionStatement:
+		c.compileExpression(statement.Expression)
+		c.emit(code.OpPop)
+	case *ast.LetStatement:
+		c.compileExpression(statement.Value)
+		c.define(statement.Name.Value)
+	case *ast.ReturnStatement:
+		c.compileExpression(statement.ReturnValue)
+		c.unwindTo(0)
+		c.emit(code.OpReturnValue)
+	case *ast.ThrowStatement:
+		c.compileExpression(statement.Value)
+		c.emit(code.OpThrow)
+	case *ast.BreakStatement:
+		c.compileLoopExit("break")
+	case *ast.ContinueStatement:
+		c.compileLoopExit("continue")
+	default:
+		c.fail("unsupported statement %T", statement)
+	}
+}
+
+// leaves the value of the block on the stack: the value of the last statement, null when it's not an expression
+func (c *Compiler) compileBlock(block *ast.BlockStatement) {
+	defer c.at(block)()
+	for i, statement := range block.Statements {
+		if es, ok := statement.(*ast.ExpressionStatement); ok && i == len(block.Statements)-1 {
+			c.compileExpression(es.Expression)
+			return
+		}
+		c.compileStatement(statement)
+	}
+	c.emit(code.OpNull)
+}
+
+var infixOperators = map[string]code.Opcode{
+	"+":  code.OpAdd,
+	"-":  code.OpSub,
+	"*":  code.OpMul,
+	"/":  code.OpDiv,
+	"%":  code.OpMod,
+	"==": code.OpEqual,
+	"!=": code.OpNotEqual,
+	"<":  code.OpLess,
+	"<=": code.OpLessEqual,
+	">":  code.OpGreater,
+	">=": code.OpGreaterEqual,
+}
+
+func (c *Compiler) compileExpression(expression ast.Expression) {
+	if expression == nil {
+		c.emit(code.OpNull)
+		return
+	}
+	defer c.at(expression)()
+	switch node := expression.(type) {
+	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			c.emit(code.OpConstant, c.addConstant(object.NewBigInteger(node.Big)))
+		} else {
+			c.emit(code.OpConstant, c.addConstant(&object.Integer{Value: node.Value}))
+		}
+	case *ast.FloatLiteral:
+		c.emit(code.OpConstant, c.addConstant(&object.Float{Value: node.Value}))
+	case *ast.StringLiteral:
+		c.emit(code.OpConstant, c.addConstant(&object.String{Value: node.Value}))
+	case *ast.Boolean:
+		if node.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+	case *ast.Identifier:
+		c.load(c.scope().symbols.ResolveChain(node.Value))
+	case *ast.PrefixExpression:
+		c.compileExpression(node.Right)
+		switch node.Operator {
+		case "-":
+			c.emit(code.OpMinus)
+		case "!":
+			c.emit(code.OpBang)
+		default:
+			c.fail("unknown operator %s", node.Operator)
+		}
+	case *ast.InfixExpression:
+		c.compileInfix(node)
+	case *ast.IfExpression:
+		c.compileIf(node)
+	case *ast.WhileExpression:
+		c.compileWhile(node)
+	case *ast.ForExpression:
+		c.compileFor(node)
+	case *ast.TryExpression:
+		c.compileTry(node)
+	case *ast.AssignExpression:
+		c.compileAssign(node)
+	case *ast.FunctionLiteral:
+		c.compileFunction(node)
+	case *ast.CallExpression:
+		c.compileExpression(node.Function)
+		for _, arg := range node.Arguments {
+			c.compileExpression(arg)
+		}
+		if len(node.Arguments) > code.MaxOperand(1) {
+			c.fail("too many arguments: %d", len(node.Arguments))
+		}
+		if node.Tail {
+			c.emit(code.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
+	case *ast.ArrayLiteral:
+		for _, element := range node.Elements {
+			c.compileExpression(element)
+		}
+		c.emit(code.OpArray, c.checkOperand(len(node.Elements), "array elements"))
+	case *ast.HashLiteral:
+		pairs := node.OrderedPairs()
+		for _, pair := range pairs {
+			c.compileExpression(pair[0])
+			c.compileExpression(pair[1])
+		}
+		c.emit(code.OpHash, c.checkOperand(len(pairs), "hash pairs"))
+	case *ast.IndexExpression:
+		c.compileExpression(node.Left)
+		c.compileExpression(node.Index)
+		c.emit(code.OpIndex)
+	default:
+		c.fail("unsupported expression %T", expression)
+		c.emit(code.OpNull)
+	}
+}
+
+func (c *Compiler) compileInfix(node *ast.InfixExpression) {
+	c.compileExpression(node.Left)
+	// && and || short-circuit and result in the operand that decided the result
+	if node.Operator == "&&" || node.Operator == "||" {
+		op := code.OpJumpIfFalsyKeep
+		if node.Operator == "||" {
+			op = code.OpJumpIfTruthyKeep
+		}
+		jump := c.emit(op, 0)
+		c.compileExpression(node.Right)
+		c.patchJump(jump)
+		return
+	}
+	c.compileExpression(node.Right)
+	op, ok := infixOperators[node.Operator]
+	if !ok {
+		c.fail("unknown operator %s", node.Operator)
+		return
+	}
+	c.emit(op)
+}
+
+func (c *Compiler) compileIf(node *ast.IfExpression) {
+	c.compileExpression(node.Condition)
+	jumpToElse := c.emit(code.OpJumpIfFalsy, 0)
+	depth := c.scope().depth
+	c.compileBlock(node.Consequence)
+	jumpToEnd := c.emit(code.OpJump, 0)
+
+	c.patchJump(jumpToElse)
+	c.scope().depth = depth
+	if node.Alternative != nil {
+		c.compileBlock(node.Alternative)
+	} else {
+		c.emit(code.OpNull)
+	}
+	c.patchJump(jumpToEnd)
+}
+
+// loops evaluate to null, their bodies share the scope with the surrounding code
+func (c *Compiler) compileWhile(node *ast.WhileExpression) {
+	s := c.scope()
+	l := &loop{depth: s.depth, unwind: len(s.unwind), continueTarget: len(s.instructions)}
+	c.compileExpression(node.Condition)
+	jumpToEnd := c.emit(code.OpJumpIfFalsy, 0)
+
+	s.loops = append(s.loops, l)
+	c.compileBlock(node.Body)
+	s.loops = s.loops[:len(s.loops)-1]
+	c.emit(code.OpPop)
+	c.emit(code.OpJump, l.continueTarget)
+
+	c.patchJump(jumpToEnd)
+	for _, jump := range l.breaks {
+		c.patchJump(jump)
+	}
+	c.emit(code.OpNull)
+}
+
+// the iterator stays on the stack while the loop runs
+func (c *Compiler) compileFor(node *ast.ForExpression) {
+	s := c.scope()
+	c.compileExpression(node.Iterable)
+	c.emit(code.OpIter)
+	l := &loop{depth: s.depth, unwind: len(s.unwind), continueTarget: len(s.instructions)}
+	jumpToEnd := c.emit(code.OpIterNext, 0)
+	c.define(node.Variable.Value)
+
+	s.loops = append(s.loops, l)
+	c.compileBlock(node.Body)
+	s.loops = s.loops[:len(s.loops)-1]
+	c.emit(code.OpPop)
+	c.emit(code.OpJump, l.continueTarget)
+
+	c.patchJump(jumpToEnd)
+	for _, jump := range l.breaks {
+		c.patchJump(jump)
+	}
+	c.emit(code.OpPop)
+	c.emit(code.OpNull)
+}
+
+// break and continue leave the try blocks entered in the loop (running their finally blocks) and jump.
+// Outside of a loop they're an error, raised once the finally blocks of the function ran.
+func (c *Compiler) compileLoopExit(keyword string) {
+	s := c.scope()
+	if len(s.loops) == 0 {
+		c.unwindTo(0)
+		// like in the evaluator, the error is located at the call of the function or at the whole program
+		span := token.Span{}
+		if len(c.scopes) == 1 {
+			span = c.programSpan
+		}
+		previous := c.span
+		c.span = span
+		c.emit(code.OpError, c.addConstant(&object.String{Value: keyword + " outside of a loop"}))
+		c.span = previous
+		return
+	}
+
+	// the try blocks are left first, their handlers restore the stack as it was at their start
+	l := s.loops[len(s.loops)-1]
+	depth := s.depth
+	c.unwindTo(l.unwind)
+	for s.depth > l.depth {
+		c.emit(code.OpPop)
+	}
+	if keyword == "break" {
+		l.breaks = append(l.breaks, c.emit(code.OpJump, 0))
+	} else {
+		c.emit(code.OpJump, l.continueTarget)
+	}
+	s.depth = depth
+}
+
+// emits the code leaving the try blocks entered since the given number of them: popping their handlers
+// and running their finally blocks
+func (c *Compiler) unwindTo(level int) {
+	s := c.scope()
+	for i := len(s.unwind) - 1; i >= level; i-- {
+		entry := s.unwind[i]
+		if entry.handler {
+			c.emit(code.OpPopTry)
+			continue
+		}
+		// the finally block is outside of its try block, so only the try blocks and loops around the try apply to it
+		unwind, loops := s.unwind, s.loops
+		s.unwind = s.unwind[:i]
+		for len(s.loops) > 0 && s.loops[len(s.loops)-1].unwind > i {
+			s.loops = s.loops[:len(s.loops)-1]
+		}
+		c.compileFinally(entry.finally)
+		s.unwind, s.loops = unwind, loops
+	}
+}
+
+/*
+ * The body runs with a handler, which jumps to the catch block when a catchable error is raised (errors stopping
+ * the run skip both catch and finally). The finally block is compiled into every way out of the try and catch
+ * blocks: the normal one, errors (after which the error is raised again) and return, break and continue.
+ */
+func (c *Compiler) compileTry(node *ast.TryExpression) {
+	s := c.scope()
+	depth := s.depth
+	handler := c.emit(code.OpTry, 0)
+	c.enterTry(node.Finally)
+	c.compileBlock(node.Body)
+	c.leaveTry(node.Finally)
+	c.emit(code.OpPopTry)
+	c.compileFinally(node.Finally)
+	ends := []int{c.emit(code.OpJump, 0)}
+
+	// the handler jumps here with the error on the stack
+	c.patchJump(handler)
+	s.depth = depth + 1
+	switch {
+	case node.Catch != nil && node.Finally != nil:
+		c.emit(code.OpCatch)
+		c.define(node.CatchParameter.Value)
+		finallyHandler := c.emit(code.OpTry, 0)
+		c.enterTry(node.Finally)
+		c.compileBlock(node.Catch)
+		c.leaveTry(node.Finally)
+		c.emit(code.OpPopTry)
+		c.compileFinally(node.Finally)
+		ends = append(ends, c.emit(code.OpJump, 0))
+
+		c.patchJump(finallyHandler)
+		s.depth = depth + 1
+		c.compileFinally(node.Finally)
+		c.emit(code.OpRethrow)
+	case node.Catch != nil:
+		c.emit(code.OpCatch)
+		c.define(node.CatchParameter.Value)
+		c.compileBlock(node.Catch)
+	default:
+		c.compileFinally(node.Finally)
+		c.emit(code.OpRethrow)
+	}
+
+	s.depth = depth + 1
+	for _, end := range ends {
+		c.patchJump(end)
+	}
+}
+
+func (c *Compiler) enterTry(finally *ast.BlockStatement) {
+	s := c.scope()
+	if finally != nil {
+		s.unwind = append(s.unwind, unwind{finally: finally})
+	}
+	s.unwind = append(s.unwind, unwind{handler: true})
+}
+
+func (c *Compiler) leaveTry(finally *ast.BlockStatement) {
+	s := c.scope()
+	s.unwind = s.unwind[:len(s.unwind)-1]
+	if finally != nil {
+		s.unwind = s.unwind[:len(s.unwind)-1]
+	}
+}
+
+// the value of the finally block is discarded
+func (c *Compiler) compileFinally(finally *ast.BlockStatement) {
+	if finally == nil {
+		return
+	}
+	c.compileBlock(finally)
+	c.emit(code.OpPop)
+}
+
+// assignment evaluates to the assigned value, compound operators (+= etc.) combine it with the current one
+func (c *Compiler) compileAssign(node *ast.AssignExpression) {
+	operator := node.Operator[:len(node.Operator)-1]
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		symbols := c.scope().symbols.ResolveChain(target.Value)
+		if operator != "" {
+			c.load(symbols)
+		}
+		c.compileExpression(node.Value)
+		if operator != "" {
+			c.emit(infixOperators[operator])
+		}
+		c.assign(symbols)
+	case *ast.IndexExpression:
+		c.compileExpression(target.Left)
+		c.compileExpression(target.Index)
+		if operator != "" {
+			c.emit(code.OpDup2)
+			c.emit(code.OpIndex)
+		}
+		c.compileExpression(node.Value)
+		if operator != "" {
+			c.emit(infixOperators[operator])
+		}
+		c.emit(code.OpSetIndex)
+	default:
+		c.emit(code.OpError, c.addConstant(&object.String{Value: "cannot assign to " + node.Target.String()}))
+		c.emit(code.OpNull)
+	}
+}
+
+// the function's locals are its parameters and everything it declares, the ones captured by the closures
+// nested in it live in cells created on entering the function
+func (c *Compiler) compileFunction(node *ast.FunctionLiteral) {
+	captured := c.capturedNames(node.Body)
+	symbols := NewEnclosedSymbolTable(c.scope().symbols)
+	for _, param := range node.Parameters {
+		symbols.DefineParameter(param.Value, captured[param.Value])
+	}
+	for _, name := range declarations(node.Body) {
+		symbols.Define(name, captured[name])
+	}
+
+	c.scopes = append(c.scopes, &scope{symbols: symbols})
+	for i, name := range symbols.Names() {
+		// the slots of the repeated parameters hidden by the last one aren't used
+		if symbol := symbols.Resolve(name); symbol.Captured && symbol.Index == i {
+			c.emit(code.OpNewCell, symbol.Index)
+		}
+	}
+	c.compileBlock(node.Body)
+	c.emit(code.OpReturnValue)
+	fnScope := c.scopes[len(c.scopes)-1]
+	c.scopes = c.scopes[:len(c.scopes)-1]
+
+	if len(symbols.Names()) > code.MaxOperand(2) {
+		c.fail("too many local variables: %d", len(symbols.Names()))
+	}
+	for _, free := range symbols.FreeSymbols {
+		if free.Scope == FreeScope {
+			c.emit(code.OpLoadFreeCell, free.Index)
+		} else {
+			c.emit(code.OpLoadCell, free.Index)
+		}
+	}
+	fn := &object.CompiledFunction{
+		Instructions:  fnScope.instructions,
+		SourceMap:     fnScope.sourceMap,
+		NumParameters: len(node.Parameters),
+		Locals:        symbols.Names(),
+		Free:          symbols.FreeNames(),
+		Name:          node.Name,
+		Body:          node.Body.String(),
+	}
+	c.emit(code.OpClosure, c.addConstant(fn), c.checkOperand(len(symbols.FreeSymbols), "captured variables"))
+}
+
+// loads the first defined variable of the chain, see ResolveChain
+func (c *Compiler) load(symbols []Symbol) {
+	var jumps []int
+	for _, symbol := range symbols[:len(symbols)-1] {
+		switch {
+		case symbol.Scope == FreeScope:
+			jumps = append(jumps, c.emit(code.OpGetFreeOrOuter, symbol.Index, 0))
+		case symbol.Captured:
+			jumps = append(jumps, c.emit(code.OpGetCellOrOuter, symbol.Index, 0))
+		default:
+			jumps = append(jumps, c.emit(code.OpGetLocalOrOuter, symbol.Index, 0))
+		}
+	}
+	switch symbol := symbols[len(symbols)-1]; {
+	case symbol.Scope == GlobalScope:
+		c.emit(code.OpGetGlobal, c.checkOperand(symbol.Index, "globals"))
+	case symbol.Scope == FreeScope:
+		c.emit(code.OpGetFree, symbol.Index)
+	case symbol.Captured:
+		c.emit(code.OpGetCell, symbol.Index)
+	default:
+		c.emit(code.OpGetLocal, symbol.Index)
+	}
+	for _, jump := range jumps {
+		c.patchJump(jump)
+	}
+}
+
+// let, also used for the variables of the for loops and the caught errors
+func (c *Compiler) define(name string) {
+	symbol := c.scope().symbols.Resolve(name)
+	switch {
+	case symbol.Scope == GlobalScope:
+		c.emit(code.OpDefineGlobal, c.checkOperand(symbol.Index, "globals"))
+	case symbol.Captured:
+		c.emit(code.OpDefineCell, symbol.Index)
+	default:
+		c.emit(code.OpDefineLocal, symbol.Index)
+	}
+}
+
+// assigns to the first defined variable of the chain
+func (c *Compiler) assign(symbols []Symbol) {
+	var jumps []int
+	for _, symbol := range symbols[:len(symbols)-1] {
+		switch {
+		case symbol.Scope == FreeScope:
+			jumps = append(jumps, c.emit(code.OpAssignFreeOrOuter, symbol.Index, 0))
+		case symbol.Captured:
+			jumps = append(jumps, c.emit(code.OpAssignCellOrOuter, symbol.Index, 0))
+		default:
+			jumps = append(jumps, c.emit(code.OpAssignLocalOrOuter, symbol.Index, 0))
+		}
+	}
+	switch symbol := symbols[len(symbols)-1]; {
+	case symbol.Scope == GlobalScope:
+		c.emit(code.OpAssignGlobal, c.checkOperand(symbol.Index, "globals"))
+	case symbol.Scope == FreeScope:
+		c.emit(code.OpAssignFree, symbol.Index)
+	case symbol.Captured:
+		c.emit(code.OpAssignCell, symbol.Index)
+	default:
+		c.emit(code.OpAssignLocal, symbol.Index)
+	}
+	for _, jump := range jumps {
+		c.patchJump(jump)
+	}
+}
+
+func (c *Compiler) addConstant(obj object.Object) int {
+	c.constants = append(c.constants, obj)
+	return c.checkOperand(len(c.constants)-1, "constants")
+}
+
+func (c *Compiler) checkOperand(operand int, what string) int {
+	if operand > code.MaxOperand(2) {
+		c.fail("too many %s: %d", what, operand)
+	}
+	return operand
+}
+
+func (c *Compiler) emit(op code.Opcode, operands ...int) int {
+	s := c.scope()
+	position := len(s.instructions)
+	if n := len(s.sourceMap); n == 0 || s.sourceMap[n-1].Span != c.span {
+		s.sourceMap = append(s.sourceMap, code.SourceEntry{Offset: position, Span: c.span})
+	}
+	s.instructions = append(s.instructions, code.Make(op, operands...)...)
+	s.depth += stackEffect(op, operands)
+	return position
+}
+
+// points the jump (the last operand) at the position about to be emitted
+func (c *Compiler) patchJump(position int) {
+	s := c.scope()
+	op := code.Opcode(s.instructions[position])
+	def, _ := code.Lookup(byte(op))
+	operands, _ := code.ReadOperands(def, s.instructions[position+1:])
+	operands[len(operands)-1] = len(s.instructions)
+	copy(s.instructions[position:], code.Make(op, operands...))
+}
+
+// how the instruction changes the number of values on the stack, when it doesn't jump
+func stackEffect(op code.Opcode, operands []int) int {
+	switch op {
+	case code.OpConstant, code.OpNull, code.OpTrue, code.OpFalse, code.OpGetGlobal, code.OpGetLocal, code.OpGetCell,
+		code.OpGetFree, code.OpLoadCell, code.OpLoadFreeCell, code.OpIterNext:
+		return 1
+	case code.OpDup2:
+		return 2
+	case code.OpPop, code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpEqual, code.OpNotEqual,
+		code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual, code.OpJumpIfFalsy, code.OpJumpIfFalsyKeep,
+		code.OpJumpIfTruthyKeep, code.OpDefineGlobal, code.OpDefineLocal, code.OpDefineCell, code.OpIndex,
+		code.OpReturnValue, code.OpRethrow, code.OpThrow:
+		return -1
+	case code.OpSetIndex:
+		return -2
+	case code.OpClosure:
+		return 1 - operands[1]
+	case code.OpArray:
+		return 1 - operands[0]
+	case code.OpHash:
+		return 1 - 2*operands[0]
+	case code.OpCall, code.OpTailCall:
+		return -operands[0]
+	}
+	return 0
+}
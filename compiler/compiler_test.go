@@ -0,0 +1,365 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/code"
+	"kjarmicki.github.com/monkey/lexer"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/parser"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		input        string
+		instructions []code.Instructions
+		globals      []string
+	}{
+		{
+			"1 + 2",
+			[]code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpReturn),
+			},
+			nil,
+		},
+		{
+			"let x = 1; x && 2",
+			[]code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpDefineGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpIfFalsyKeep, 17),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpReturn),
+			},
+			[]string{"x"},
+		},
+		{
+			"if (true) { 10 }; 3333",
+			[]code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpIfFalsy, 14),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpJump, 15),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpReturn),
+			},
+			nil,
+		},
+		{
+			"while (x) { x = false }",
+			[]code.Instructions{
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpJumpIfFalsy, 18),
+				code.Make(code.OpFalse),
+				code.Make(code.OpAssignGlobal, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpJump, 0),
+				code.Make(code.OpNull),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpReturn),
+			},
+			[]string{"x"},
+		},
+		{
+			"try { 1 } finally { 2 }",
+			[]code.Instructions{
+				code.Make(code.OpTry, 18),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPopTry),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpJump, 23),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpRethrow),
+				code.Make(code.OpReturnValue),
+				code.Make(code.OpReturn),
+			},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		bytecode := testCompile(t, tt.input)
+		assert.Equal(t, concat(tt.instructions).String(), bytecode.Main.Instructions.String(), tt.input)
+		assert.Equal(t, tt.globals, bytecode.Globals, tt.input)
+	}
+}
+
+// locals captured by the nested functions live in cells, the closure gets the cells
+func TestCompileClosures(t *testing.T) {
+	bytecode := testCompile(t, "let f = fn(a) { let b = 1; let c = 2; fn() { a + b } }")
+
+	inner := bytecode.Constants[2].(*object.CompiledFunction)
+	assert.Equal(t, []string{"a", "b"}, inner.Free)
+	assert.Equal(t, concat([]code.Instructions{
+		code.Make(code.OpGetFree, 0),
+		// b refers to the global until its let runs
+		code.Make(code.OpGetFreeOrOuter, 1, 13),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpAdd),
+		code.Make(code.OpReturnValue),
+	}).String(), inner.Instructions.String())
+
+	outer := bytecode.Constants[3].(*object.CompiledFunction)
+	assert.Equal(t, []string{"a", "b", "c"}, outer.Locals)
+	assert.Equal(t, 1, outer.NumParameters)
+	assert.Equal(t, "f", outer.Name)
+	assert.Equal(t, concat([]code.Instructions{
+		code.Make(code.OpNewCell, 0),
+		code.Make(code.OpNewCell, 1),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpDefineCell, 1),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpDefineLocal, 2),
+		code.Make(code.OpLoadCell, 0),
+		code.Make(code.OpLoadCell, 1),
+		code.Make(code.OpClosure, 2, 2),
+		code.Make(code.OpReturnValue),
+	}).String(), outer.Instructions.String())
+}
+
+// calls whose result is returned as it is replace the calling function
+func TestCompileTailCalls(t *testing.T) {
+	bytecode := testCompile(t, "let f = fn(n) { if (n) { return f(n - 1) }; 1 + f(n) }")
+
+	fn := bytecode.Constants[2].(*object.CompiledFunction)
+	assert.Equal(t, concat([]code.Instructions{
+		code.Make(code.OpGetLocal, 0),
+		code.Make(code.OpJumpIfFalsy, 27),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpGetLocal, 0),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpSub),
+		code.Make(code.OpTailCall, 1),
+		code.Make(code.OpReturnValue),
+		code.Make(code.OpNull),
+		code.Make(code.OpJump, 28),
+		code.Make(code.OpNull),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpGetGlobal, 0),
+		code.Make(code.OpGetLocal, 0),
+		code.Make(code.OpCall, 1),
+		code.Make(code.OpAdd),
+		code.Make(code.OpReturnValue),
+	}).String(), fn.Instructions.String())
+}
+
+func TestSourceMap(t *testing.T) {
+	bytecode := testCompile(t, "let x = 1;\nx + true")
+
+	// OpAdd comes from the infix expression on the second line
+	span := bytecode.Main.SourceMap.Lookup(10)
+	assert.Equal(t, "2:1", span.Start.String())
+	assert.Equal(t, "2:9", span.End.String())
+}
+
+func TestSymbolTable(t *testing.T) {
+	global := NewSymbolTable()
+	assert.Equal(t, Symbol{Name: "a", Scope: GlobalScope, Index: 0}, global.Define("a", true))
+	assert.Equal(t, Symbol{Name: "b", Scope: GlobalScope, Index: 1}, global.Resolve("b"))
+
+	outer := NewEnclosedSymbolTable(global)
+	assert.Equal(t, Symbol{Name: "c", Scope: LocalScope, Index: 0, Captured: true}, outer.Define("c", true))
+	assert.Equal(t, Symbol{Name: "c", Scope: LocalScope, Index: 0, Captured: true}, outer.Define("c", false))
+
+	inner := NewEnclosedSymbolTable(outer)
+	inner.Define("d", false)
+	assert.Equal(t, Symbol{Name: "a", Scope: GlobalScope, Index: 0}, inner.Resolve("a"))
+	assert.Equal(t, Symbol{Name: "c", Scope: FreeScope, Index: 0}, inner.Resolve("c"))
+	assert.Equal(t, Symbol{Name: "d", Scope: LocalScope, Index: 0}, inner.Resolve("d"))
+	assert.Equal(t, []string{"c"}, inner.FreeNames())
+	assert.Equal(t, []Symbol{{Name: "c", Scope: LocalScope, Index: 0, Captured: true}}, inner.FreeSymbols)
+}
+
+func TestMarshalBinary(t *testing.T) {
+	program := parser.New(lexer.NewFile("script.mk", `let big = 99999999999999999999;
+let f = fn(a) { let g = fn() { a + -99999999999999999999 }; g() };
+let s = try { throw "boom" } catch (e) { e["message"] } finally { 1.5 };
+for (x in [1, 2]) { if (x > 1) { break } };
+f(1)`)).ParseProgram()
+	bytecode, err := New().Compile(program)
+	assert.NoError(t, err)
+
+	data, err := bytecode.MarshalBinary()
+	assert.NoError(t, err)
+	assert.True(t, IsBytecode(data))
+	loaded, err := Load(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, bytecode.Globals, loaded.Globals)
+	assert.Equal(t, Disassemble(bytecode), Disassemble(loaded))
+	assert.Equal(t, len(bytecode.Constants), len(loaded.Constants))
+	for i, constant := range bytecode.Constants {
+		assert.Equal(t, constant, loaded.Constants[i])
+	}
+	assert.Equal(t, bytecode.Main, loaded.Main)
+	assert.Equal(t, "script.mk:5:1", loaded.Main.SourceMap.Lookup(len(loaded.Main.Instructions)-3).Start.String())
+}
+
+func TestMarshalRepeatedParameters(t *testing.T) {
+	bytecode := testCompile(t, "let f = fn(a, a) { fn() { a } }; f(1, 2)()")
+	data, err := bytecode.MarshalBinary()
+	assert.NoError(t, err)
+
+	loaded, err := Load(data)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Disassemble(bytecode), Disassemble(loaded))
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	bytecode := testCompile(t, "let f = fn(a) { a }; f(1)")
+	valid, err := bytecode.MarshalBinary()
+	assert.NoError(t, err)
+	payload := valid[:len(valid)-4]
+	// flips the byte of the payload and fixes the checksum, so that only the validation can catch the problem
+	modified := func(modify func(payload []byte) []byte) []byte {
+		data := modify(append([]byte{}, payload...))
+		checksum := make([]byte, 4)
+		binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(data))
+		return append(data, checksum...)
+	}
+	mainStart := bytes.LastIndex(payload, []byte(bytecode.Main.Instructions))
+
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte("let x = 1;"), "not a compiled Monkey program"},
+		{[]byte("MKBC"), "truncated file"},
+		{modified(func(p []byte) []byte { p[5] = 9; return p }), "unsupported format version 9, expected 3"},
+		{append(append([]byte{}, payload...), 0, 0, 0, 0), "checksum mismatch, the file is corrupted"},
+		{modified(func(p []byte) []byte { return p[:len(p)-3] }), "unexpected end of file"},
+		{modified(func(p []byte) []byte { return append(p, 0) }), "unexpected data after the main function"},
+		{modified(func(p []byte) []byte { p[mainStart] = 255; return p }), "main: offset 0: opcode 255 undefined"},
+		{modified(func(p []byte) []byte { p[mainStart+2] = 200; return p }), "main: offset 0: OpClosure refers to constant 200 out of 2"},
+		{modified(func(p []byte) []byte { p[mainStart+7] = 7; return p }), "main: offset 5: OpDefineGlobal refers to global 7 out of 1"},
+	}
+
+	for _, tt := range tests {
+		_, err := Load(tt.data)
+		if assert.Error(t, err) {
+			assert.Equal(t, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestLoadVerifiesStack(t *testing.T) {
+	instructions := func(instructions ...[]byte) code.Instructions {
+		return bytes.Join(instructions, nil)
+	}
+	main := func(instructions code.Instructions) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: instructions}
+	}
+	valid := main(instructions(code.Make(code.OpNull), code.Make(code.OpReturn)))
+	tests := []struct {
+		main      *object.CompiledFunction
+		constants []object.Object
+		expected  string
+	}{
+		{main(instructions(code.Make(code.OpPop), code.Make(code.OpReturn))), nil,
+			"main: offset 0: OpPop takes 1 values from the stack, there are 0"},
+		{main(instructions(code.Make(code.OpNull), code.Make(code.OpCatch), code.Make(code.OpReturnValue))), nil,
+			"main: offset 1: OpCatch expects an error on top of the stack"},
+		{main(instructions(code.Make(code.OpPopTry), code.Make(code.OpReturn))), nil,
+			"main: offset 0: OpPopTry outside of a try block"},
+		{main(instructions(code.Make(code.OpNull), code.Make(code.OpIterNext, 1), code.Make(code.OpReturn))), nil,
+			"main: offset 1: OpIterNext expects an iterator on top of the stack"},
+		{main(instructions(code.Make(code.OpNull), code.Make(code.OpClosure, 0, 1), code.Make(code.OpReturnValue))),
+			[]object.Object{&object.CompiledFunction{Instructions: instructions(code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)), Free: []string{"x"}}},
+			"main: offset 1: OpClosure expects the captured cells on the stack"},
+		{main(instructions(code.Make(code.OpTrue), code.Make(code.OpJumpIfFalsy, 7), code.Make(code.OpNull), code.Make(code.OpNull), code.Make(code.OpReturnValue))), nil,
+			"main: offset 7: the stack differs between the ways the instruction is reached"},
+		// the handler restores the stack as it was at the start of the try
+		{main(instructions(code.Make(code.OpNull), code.Make(code.OpTry, 7), code.Make(code.OpPop), code.Make(code.OpReturn))), nil,
+			"main: offset 6: OpPop takes 1 values from the stack, there are 0"},
+		{main(instructions(code.Make(code.OpNull), code.Make(code.OpPop))), nil,
+			"main: instructions don't end with a return or a jump"},
+		{main(instructions(code.Make(code.OpNull), code.Make(code.OpTailCall, 0), code.Make(code.OpReturnValue))), nil,
+			"main: offset 1: OpTailCall in the main function"},
+		// the value is pushed only when the local is defined and the op jumps
+		{valid, []object.Object{&object.CompiledFunction{Instructions: instructions(code.Make(code.OpGetLocalOrOuter, 0, 7), code.Make(code.OpReturnValue)), Locals: []string{"x"}}},
+			"constant 0: offset 7: the stack differs between the ways the instruction is reached"},
+		{valid, []object.Object{&object.CompiledFunction{Instructions: instructions(code.Make(code.OpReturn))}},
+			"constant 0: offset 0: OpReturn outside of the main function"},
+		{valid, []object.Object{&object.CompiledFunction{Instructions: instructions(code.Make(code.OpGetCell, 0), code.Make(code.OpReturnValue)), Locals: []string{"x"}}},
+			"constant 0: offset 0: OpGetCell accesses local 0, which is not a cell"},
+		{valid, []object.Object{&object.CompiledFunction{Instructions: instructions(code.Make(code.OpNewCell, 0), code.Make(code.OpGetLocal, 0), code.Make(code.OpReturnValue)), Locals: []string{"x"}}},
+			"constant 0: offset 3: OpGetLocal accesses local 0, which is a cell"},
+		{&object.CompiledFunction{Instructions: valid.Instructions, Locals: []string{"x"}}, nil,
+			"main: main function with locals or free variables"},
+	}
+
+	for _, tt := range tests {
+		data, err := (&Bytecode{Main: tt.main, Constants: tt.constants}).MarshalBinary()
+		assert.NoError(t, err)
+		_, err = Load(data)
+		if assert.Error(t, err, tt.expected) {
+			assert.Equal(t, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	bytecode := testCompile(t, "let add = fn(a, b) { let c = a + b; fn() { c } };\nadd(1, \"x\")")
+	expected := `== main ==
+0000  1:11   OpClosure 1 0          ; fn add
+0005  1:1    OpDefineGlobal 1       ; add
+0008  2:1    OpGetGlobal 1          ; add
+0011  2:5    OpConstant 2           ; 1
+0014  2:8    OpConstant 3           ; "x"
+0017  2:1    OpCall 2
+0019  1:1    OpReturnValue
+0020  1:1    OpReturn
+
+== constant 0: <anonymous>() ==
+free: c
+0000  1:44   OpGetFreeOrOuter 0 10  ; c
+0007  1:44   OpGetGlobal 0          ; c
+0010  1:37   OpReturnValue
+
+== constant 1: add(a, b) ==
+locals: c
+0000  1:11   OpNewCell 2            ; c
+0003  1:30   OpGetLocal 0           ; a
+0006  1:34   OpGetLocal 1           ; b
+0009  1:30   OpAdd
+0010  1:22   OpDefineCell 2         ; c
+0013  1:37   OpLoadCell 2           ; c
+0016  1:37   OpClosure 0 1          ; fn
+0021  1:11   OpReturnValue
+`
+	assert.Equal(t, expected, Disassemble(bytecode))
+}
+
+func testCompile(t *testing.T, input string) *Bytecode {
+	program := parser.New(lexer.New(input)).ParseProgram()
+	bytecode, err := New().Compile(program)
+	assert.NoError(t, err, input)
+	return bytecode
+}
+
+func concat(instructions []code.Instructions) code.Instructions {
+	out := code.Instructions{}
+	for _, ins := range instructions {
+		out = append(out, ins...)
+	}
+	return out
+}
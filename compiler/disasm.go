@@ -0,0 +1,106 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"kjarmicki.github.com/monkey/code"
+	"kjarmicki.github.com/monkey/object"
+)
+
+/*
+ * Human-readable listing of the program: the main function followed by all the compiled function constants.
+ * Each instruction is printed with its offset, the source position it comes from and its operands, annotated
+ * with what they refer to (constants, variable names), e.g.
+ *
+ *   0003  2:1    OpGetGlobal 0          ; x
+ */
+func Disassemble(bytecode *Bytecode) string {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "== main ==\n")
+	disassembleFunction(&out, bytecode, bytecode.Main)
+	for i, constant := range bytecode.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		name := fn.Name
+		if name == "" {
+			name = "<anonymous>"
+		}
+		fmt.Fprintf(&out, "\n== constant %d: %s(%s) ==\n", i, name, strings.Join(fn.Locals[:fn.NumParameters], ", "))
+		if len(fn.Locals) > fn.NumParameters {
+			fmt.Fprintf(&out, "locals: %s\n", strings.Join(fn.Locals[fn.NumParameters:], ", "))
+		}
+		if len(fn.Free) > 0 {
+			fmt.Fprintf(&out, "free: %s\n", strings.Join(fn.Free, ", "))
+		}
+		disassembleFunction(&out, bytecode, fn)
+	}
+	return out.String()
+}
+
+func disassembleFunction(out *bytes.Buffer, bytecode *Bytecode, fn *object.CompiledFunction) {
+	ins := fn.Instructions
+	for offset := 0; offset < len(ins); {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			fmt.Fprintf(out, "%04d  ERROR: %s\n", offset, err)
+			return
+		}
+		operands, read := code.ReadOperands(def, ins[offset+1:])
+
+		position := "-"
+		if span := fn.SourceMap.Lookup(offset); span.IsValid() {
+			position = fmt.Sprintf("%d:%d", span.Start.Line, span.Start.Column)
+		}
+		instruction := def.Name
+		for _, operand := range operands {
+			instruction += fmt.Sprintf(" %d", operand)
+		}
+		line := fmt.Sprintf("%04d  %-6s %-22s", offset, position, instruction)
+		if comment := describeOperands(bytecode, fn, code.Opcode(ins[offset]), operands); comment != "" {
+			line += " ; " + comment
+		}
+		fmt.Fprintln(out, strings.TrimRight(line, " "))
+		offset += 1 + read
+	}
+}
+
+// what the operands refer to, empty for the instructions whose operands speak for themselves
+func describeOperands(bytecode *Bytecode, fn *object.CompiledFunction, op code.Opcode, operands []int) string {
+	name := func(names []string, index int) string {
+		if index < len(names) {
+			return names[index]
+		}
+		return "?"
+	}
+	switch op {
+	case code.OpConstant, code.OpError:
+		if operands[0] >= len(bytecode.Constants) {
+			return "?"
+		}
+		constant := bytecode.Constants[operands[0]]
+		if str, ok := constant.(*object.String); ok {
+			return fmt.Sprintf("%q", str.Value)
+		}
+		return constant.Inspect()
+	case code.OpClosure:
+		if operands[0] < len(bytecode.Constants) {
+			if closed, ok := bytecode.Constants[operands[0]].(*object.CompiledFunction); ok && closed.Name != "" {
+				return "fn " + closed.Name
+			}
+		}
+		return "fn"
+	case code.OpGetGlobal, code.OpDefineGlobal, code.OpAssignGlobal:
+		return name(bytecode.Globals, operands[0])
+	case code.OpGetLocal, code.OpDefineLocal, code.OpAssignLocal, code.OpGetCell, code.OpDefineCell, code.OpAssignCell,
+		code.OpGetLocalOrOuter, code.OpAssignLocalOrOuter, code.OpGetCellOrOuter, code.OpAssignCellOrOuter,
+		code.OpNewCell, code.OpLoadCell:
+		return name(fn.Locals, operands[0])
+	case code.OpGetFree, code.OpAssignFree, code.OpGetFreeOrOuter, code.OpAssignFreeOrOuter, code.OpLoadFreeCell:
+		return name(fn.Free, operands[0])
+	}
+	return ""
+}
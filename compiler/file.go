@@ -0,0 +1,477 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/big"
+
+	"kjarmicki.github.com/monkey/code"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/token"
+)
+
+/*
+ * Binary format of the compiled programs (.mkc files):
+ *
+ *   magic "MKBC", format version (uint16, big endian)
+ *   source files referenced by the source maps: count, strings
+ *   globals: count, names
+ *   constants: count, each a type tag followed by the value
+ *   main function
+ *   CRC-32 (IEEE) of everything before it (uint32, big endian)
+ *
+ * Counts and integers are varints, strings are their length followed by the bytes, big integers are a sign byte
+ * (1 for negative) followed by the magnitude. Functions are stored as their name, body source, number of parameters,
+ * names of the locals and of the free variables, instructions and the source map, whose spans refer to the source
+ * files by index.
+ */
+
+const (
+	Magic         = "MKBC"
+	FormatVersion = 3
+)
+
+// type tags of the constants
+const (
+	tagInteger byte = iota + 1
+	tagBigInteger
+	tagFloat
+	tagString
+	tagFunction
+)
+
+// upper limit for the counts and lengths read from a file, so that a corrupted one can't make the loader allocate
+// huge amounts of memory
+const maxCount = 1 << 24
+
+// whether the data starts like a compiled program, as opposed to a source code
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// encodes the program in the binary format
+func (b *Bytecode) MarshalBinary() ([]byte, error) {
+	e := &encoder{files: map[string]int{}}
+	e.collectFiles(b.Main)
+	for _, constant := range b.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			e.collectFiles(fn)
+		}
+	}
+
+	e.buf.WriteString(Magic)
+	e.buf.Write([]byte{FormatVersion >> 8, FormatVersion & 0xff})
+	e.strings(e.fileNames)
+	e.strings(b.Globals)
+	e.uvarint(uint64(len(b.Constants)))
+	for _, constant := range b.Constants {
+		if err := e.constant(constant); err != nil {
+			return nil, err
+		}
+	}
+	e.function(b.Main)
+
+	checksum := crc32.ChecksumIEEE(e.buf.Bytes())
+	binary.Write(&e.buf, binary.BigEndian, checksum)
+	return e.buf.Bytes(), nil
+}
+
+type encoder struct {
+	buf       bytes.Buffer
+	files     map[string]int
+	fileNames []string
+}
+
+func (e *encoder) collectFiles(fn *object.CompiledFunction) {
+	for _, entry := range fn.SourceMap {
+		file := entry.Span.Start.File
+		if _, ok := e.files[file]; !ok {
+			e.files[file] = len(e.fileNames)
+			e.fileNames = append(e.fileNames, file)
+		}
+	}
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (e *encoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) strings(ss []string) {
+	e.uvarint(uint64(len(ss)))
+	for _, s := range ss {
+		e.string(s)
+	}
+}
+
+func (e *encoder) constant(constant object.Object) error {
+	switch constant := constant.(type) {
+	case *object.Integer:
+		if constant.IsBig() {
+			e.buf.WriteByte(tagBigInteger)
+			var negative byte
+			if constant.Big.Sign() < 0 {
+				negative = 1
+			}
+			e.buf.WriteByte(negative)
+			e.string(string(constant.Big.Bytes()))
+		} else {
+			e.buf.WriteByte(tagInteger)
+			e.varint(constant.Value)
+		}
+	case *object.Float:
+		e.buf.WriteByte(tagFloat)
+		binary.Write(&e.buf, binary.BigEndian, math.Float64bits(constant.Value))
+	case *object.String:
+		e.buf.WriteByte(tagString)
+		e.string(constant.Value)
+	case *object.CompiledFunction:
+		e.buf.WriteByte(tagFunction)
+		e.function(constant)
+	default:
+		return fmt.Errorf("constant of type %s can't be serialized", constant.Type())
+	}
+	return nil
+}
+
+func (e *encoder) function(fn *object.CompiledFunction) {
+	e.string(fn.Name)
+	e.string(fn.Body)
+	e.uvarint(uint64(fn.NumParameters))
+	e.strings(fn.Locals)
+	e.strings(fn.Free)
+	e.string(string(fn.Instructions))
+	e.uvarint(uint64(len(fn.SourceMap)))
+	for _, entry := range fn.SourceMap {
+		e.uvarint(uint64(entry.Offset))
+		e.uvarint(uint64(e.files[entry.Span.Start.File]))
+		e.position(entry.Span.Start)
+		e.position(entry.Span.End)
+	}
+}
+
+func (e *encoder) position(p token.Position) {
+	e.uvarint(uint64(p.Offset))
+	e.uvarint(uint64(p.Line))
+	e.uvarint(uint64(p.Column))
+}
+
+/*
+ * Loads a program in the binary format. The file is validated before any of it is run: besides the checksum
+ * catching the corrupted files, every instruction has to be known, have its operands in place and refer to existing
+ * constants, variables and instruction offsets, and find the values it expects on the stack (see verifyFlow),
+ * so that the vm never reads past what's there.
+ */
+func Load(data []byte) (*Bytecode, error) {
+	if !IsBytecode(data) {
+		return nil, errors.New("not a compiled Monkey program")
+	}
+	if len(data) < len(Magic)+2+4 {
+		return nil, errors.New("truncated file")
+	}
+	if version := int(data[4])<<8 | int(data[5]); version != FormatVersion {
+		return nil, fmt.Errorf("unsupported format version %d, expected %d", version, FormatVersion)
+	}
+	payload, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("checksum mismatch, the file is corrupted")
+	}
+
+	d := &decoder{data: payload[len(Magic)+2:]}
+	d.files = d.strings()
+	bytecode := &Bytecode{Globals: d.strings()}
+	count := d.count()
+	for i := 0; i < count && d.err == nil; i++ {
+		bytecode.Constants = append(bytecode.Constants, d.constant())
+	}
+	bytecode.Main = d.function()
+	if d.err == nil && len(d.data) > 0 {
+		d.err = errors.New("unexpected data after the main function")
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := validate(bytecode); err != nil {
+		return nil, err
+	}
+	return bytecode, nil
+}
+
+// reads the values one after another, after the first error all the reads return zero values
+type decoder struct {
+	data  []byte
+	files []string
+	err   error
+}
+
+func (d *decoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data) == 0 {
+		d.fail("unexpected end of file")
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("unexpected end of file")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("unexpected end of file")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// counts and lengths, checked against the limit and the data left
+func (d *decoder) count() int {
+	v := d.uvarint()
+	if v > maxCount || v > uint64(len(d.data)) {
+		d.fail("invalid count %d", v)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) int() int {
+	v := d.uvarint()
+	if v > math.MaxInt32 {
+		d.fail("invalid number %d", v)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	if d.err != nil {
+		return nil
+	}
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) strings() []string {
+	n := d.count()
+	var ss []string
+	for i := 0; i < n && d.err == nil; i++ {
+		ss = append(ss, d.string())
+	}
+	return ss
+}
+
+func (d *decoder) constant() object.Object {
+	switch tag := d.byte(); tag {
+	case tagInteger:
+		return &object.Integer{Value: d.varint()}
+	case tagBigInteger:
+		negative := d.byte() == 1
+		value := new(big.Int).SetBytes(d.bytes())
+		if negative {
+			value.Neg(value)
+		}
+		return object.NewBigInteger(value)
+	case tagFloat:
+		var bits [8]byte
+		for i := range bits {
+			bits[i] = d.byte()
+		}
+		return &object.Float{Value: math.Float64frombits(binary.BigEndian.Uint64(bits[:]))}
+	case tagString:
+		return &object.String{Value: d.string()}
+	case tagFunction:
+		return d.function()
+	default:
+		d.fail("unknown constant type %d", tag)
+		return nil
+	}
+}
+
+func (d *decoder) function() *object.CompiledFunction {
+	fn := &object.CompiledFunction{
+		Name:          d.string(),
+		Body:          d.string(),
+		NumParameters: d.int(),
+		Locals:        d.strings(),
+		Free:          d.strings(),
+		Instructions:  code.Instructions(d.bytes()),
+	}
+	entries := d.count()
+	for i := 0; i < entries && d.err == nil; i++ {
+		entry := code.SourceEntry{Offset: d.int()}
+		file := d.int()
+		if d.err == nil && file >= len(d.files) {
+			d.fail("invalid source file index %d", file)
+			break
+		}
+		var fileName string
+		if d.err == nil {
+			fileName = d.files[file]
+		}
+		entry.Span.Start = d.position(fileName)
+		entry.Span.End = d.position(fileName)
+		fn.SourceMap = append(fn.SourceMap, entry)
+	}
+	return fn
+}
+
+func (d *decoder) position(file string) token.Position {
+	return token.Position{File: file, Offset: d.int(), Line: d.int(), Column: d.int()}
+}
+
+// checks that the functions can be run without the vm reading past the instructions, the constants or the variables
+func validate(bytecode *Bytecode) error {
+	if err := validateFunction(bytecode, bytecode.Main); err != nil {
+		return fmt.Errorf("main: %w", err)
+	}
+	for i, constant := range bytecode.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			if err := validateFunction(bytecode, fn); err != nil {
+				return fmt.Errorf("constant %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateFunction(bytecode *Bytecode, fn *object.CompiledFunction) error {
+	if fn.NumParameters > len(fn.Locals) {
+		return fmt.Errorf("%d parameters but only %d locals", fn.NumParameters, len(fn.Locals))
+	}
+	// the main function isn't called, it has no frame with the locals and no closure with the free variables
+	if fn == bytecode.Main && (len(fn.Locals) > 0 || len(fn.Free) > 0) {
+		return errors.New("main function with locals or free variables")
+	}
+	ins := fn.Instructions
+	if len(ins) == 0 {
+		return errors.New("no instructions")
+	}
+
+	starts := map[int]bool{}
+	var jumps []int
+	var last code.Opcode
+	for offset := 0; offset < len(ins); {
+		def, err := code.Lookup(ins[offset])
+		if err != nil {
+			return fmt.Errorf("offset %d: %w", offset, err)
+		}
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if offset+1+width > len(ins) {
+			return fmt.Errorf("offset %d: %s is missing its operands", offset, def.Name)
+		}
+		operands, _ := code.ReadOperands(def, ins[offset+1:])
+		if err := validateOperands(bytecode, fn, code.Opcode(ins[offset]), operands); err != nil {
+			return fmt.Errorf("offset %d: %s %w", offset, def.Name, err)
+		}
+		switch op := code.Opcode(ins[offset]); op {
+		case code.OpJump, code.OpJumpIfFalsy, code.OpJumpIfFalsyKeep, code.OpJumpIfTruthyKeep, code.OpTry, code.OpIterNext:
+			jumps = append(jumps, operands[0])
+		case code.OpGetLocalOrOuter, code.OpAssignLocalOrOuter, code.OpGetCellOrOuter, code.OpAssignCellOrOuter,
+			code.OpGetFreeOrOuter, code.OpAssignFreeOrOuter:
+			jumps = append(jumps, operands[1])
+		}
+		starts[offset] = true
+		last = code.Opcode(ins[offset])
+		offset += 1 + width
+	}
+	for _, target := range jumps {
+		if !starts[target] {
+			return fmt.Errorf("jump to %d, which is not the start of an instruction", target)
+		}
+	}
+	// the vm would run past the end otherwise
+	switch last {
+	case code.OpReturnValue, code.OpReturn, code.OpJump, code.OpRethrow, code.OpThrow, code.OpError:
+	default:
+		return errors.New("instructions don't end with a return or a jump")
+	}
+	return verifyFlow(fn, fn == bytecode.Main)
+}
+
+func validateOperands(bytecode *Bytecode, fn *object.CompiledFunction, op code.Opcode, operands []int) error {
+	inRange := func(index, length int, what string) error {
+		if index >= length {
+			return fmt.Errorf("refers to %s %d out of %d", what, index, length)
+		}
+		return nil
+	}
+	switch op {
+	case code.OpConstant:
+		return inRange(operands[0], len(bytecode.Constants), "constant")
+	case code.OpError:
+		if err := inRange(operands[0], len(bytecode.Constants), "constant"); err != nil {
+			return err
+		}
+		if _, ok := bytecode.Constants[operands[0]].(*object.String); !ok {
+			return errors.New("refers to a constant which is not a string")
+		}
+	case code.OpClosure:
+		if err := inRange(operands[0], len(bytecode.Constants), "constant"); err != nil {
+			return err
+		}
+		closed, ok := bytecode.Constants[operands[0]].(*object.CompiledFunction)
+		if !ok {
+			return errors.New("refers to a constant which is not a function")
+		}
+		if operands[1] != len(closed.Free) {
+			return fmt.Errorf("captures %d variables, the function has %d", operands[1], len(closed.Free))
+		}
+	case code.OpGetGlobal, code.OpDefineGlobal, code.OpAssignGlobal:
+		return inRange(operands[0], len(bytecode.Globals), "global")
+	case code.OpGetLocal, code.OpDefineLocal, code.OpAssignLocal, code.OpGetCell, code.OpDefineCell, code.OpAssignCell,
+		code.OpGetLocalOrOuter, code.OpAssignLocalOrOuter, code.OpGetCellOrOuter, code.OpAssignCellOrOuter,
+		code.OpNewCell, code.OpLoadCell:
+		return inRange(operands[0], len(fn.Locals), "local")
+	case code.OpGetFree, code.OpAssignFree, code.OpGetFreeOrOuter, code.OpAssignFreeOrOuter, code.OpLoadFreeCell:
+		return inRange(operands[0], len(fn.Free), "free variable")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package compiler
+
+import "kjarmicki.github.com/monkey/ast"
+
+// names the code declares with let, for and catch, in the order of the declarations, without the nested functions
+func declarations(body *ast.BlockStatement) []string {
+	var names []string
+	ast.Walk(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			names = append(names, node.Name.Value)
+		case *ast.ForExpression:
+			names = append(names, node.Variable.Value)
+		case *ast.TryExpression:
+			if node.Catch != nil {
+				names = append(names, node.CatchParameter.Value)
+			}
+		case *ast.FunctionLiteral:
+			return false
+		}
+		return true
+	})
+	return names
+}
+
+// names the function may refer to in the enclosing functions, including the ones of the functions nested in it:
+// the ones it uses without declaring them and the ones it declares with let, for and catch, which refer to
+// the outer variable until they're defined, but not the parameters
+func (c *Compiler) outerNames(fl *ast.FunctionLiteral) map[string]bool {
+	if outer, ok := c.outer[fl]; ok {
+		return outer
+	}
+	parameters := map[string]bool{}
+	for _, param := range fl.Parameters {
+		parameters[param.Value] = true
+	}
+
+	outer := map[string]bool{}
+	ast.Walk(fl.Body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.Identifier:
+			if !parameters[node.Value] {
+				outer[node.Value] = true
+			}
+		case *ast.FunctionLiteral:
+			for name := range c.outerNames(node) {
+				if !parameters[name] {
+					outer[name] = true
+				}
+			}
+			return false
+		}
+		return true
+	})
+	c.outer[fl] = outer
+	return outer
+}
+
+// locals of the function body captured by the functions nested in it
+func (c *Compiler) capturedNames(body *ast.BlockStatement) map[string]bool {
+	captured := map[string]bool{}
+	ast.Walk(body, func(node ast.Node) bool {
+		if fl, ok := node.(*ast.FunctionLiteral); ok {
+			for name := range c.outerNames(fl) {
+				captured[name] = true
+			}
+			return false
+		}
+		return true
+	})
+	return captured
+}
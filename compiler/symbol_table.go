@@ -0,0 +1,138 @@
+package compiler
+
+type SymbolScope string
+
+const (
+	GlobalScope SymbolScope = "GLOBAL" // stored in the environment by name
+	LocalScope  SymbolScope = "LOCAL"  // stored in a slot of the function's frame
+	FreeScope   SymbolScope = "FREE"   // captured from an enclosing function
+)
+
+type Symbol struct {
+	Name     string
+	Scope    SymbolScope
+	Index    int  // index of the name for globals, of the slot for locals and of the captured cell for free variables
+	Captured bool // local captured by a closure, kept in a cell so that the function and the closures share it
+}
+
+/*
+ * Names visible in a function (or the whole program for the global table). Functions declare all their locals up front,
+ * so the name means the same anywhere in the function body, just like with the environments of the evaluator,
+ * where a let anywhere in the function defines the variable in the function's environment.
+ * Names not found in any enclosing function are globals, defined on first use, because the global might be defined
+ * later in the program (or by the host) than the function using it.
+ * Until the let of a declared local runs, the name refers to the outer variable of the same name, see ResolveChain.
+ */
+type SymbolTable struct {
+	Outer *SymbolTable
+
+	store       map[string]Symbol
+	names       []string // of the globals or the locals, in the order of their indexes
+	parameters  int      // the first locals
+	FreeSymbols []Symbol // symbols of the enclosing function captured by this one, in the order of the free variables
+	free        []string
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{store: make(map[string]Symbol)}
+}
+
+func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
+	table := NewSymbolTable()
+	table.Outer = outer
+	return table
+}
+
+// defines the local (or the global, for the global table), redefining it returns the existing symbol
+func (s *SymbolTable) Define(name string, captured bool) Symbol {
+	if symbol, ok := s.store[name]; ok && symbol.Scope != FreeScope {
+		return symbol
+	}
+	symbol := Symbol{Name: name, Scope: LocalScope, Index: len(s.names), Captured: captured}
+	if s.Outer == nil {
+		symbol.Scope = GlobalScope
+		symbol.Captured = false
+	}
+	s.store[name] = symbol
+	s.names = append(s.names, name)
+	return symbol
+}
+
+// defines the parameter in a slot of its own even when the name repeats, the name then refers to the last one
+// (like in the evaluator, where the last argument bound to the name wins)
+func (s *SymbolTable) DefineParameter(name string, captured bool) Symbol {
+	symbol := Symbol{Name: name, Scope: LocalScope, Index: len(s.names), Captured: captured}
+	s.store[name] = symbol
+	s.names = append(s.names, name)
+	s.parameters += 1
+	return symbol
+}
+
+func (s *SymbolTable) Resolve(name string) Symbol {
+	if symbol, ok := s.store[name]; ok {
+		return symbol
+	}
+	if s.Outer == nil {
+		return s.Define(name, false)
+	}
+	symbol := s.Outer.Resolve(name)
+	if symbol.Scope == GlobalScope {
+		return symbol
+	}
+	return s.defineFree(symbol)
+}
+
+// the symbol of the name followed by the ones the name refers to while it's undefined: a local declared with let,
+// for or catch refers to the outer variable of the same name until it's defined (like in the evaluator), which may
+// be undefined too. The chain ends with a parameter, which is always defined, or with a global.
+func (s *SymbolTable) ResolveChain(name string) []Symbol {
+	symbol := s.Resolve(name)
+	switch {
+	case symbol.Scope == GlobalScope || symbol.Scope == LocalScope && symbol.Index < s.parameters:
+		return []Symbol{symbol}
+	case symbol.Scope == LocalScope:
+		return append([]Symbol{symbol}, s.resolveOuter(name)...)
+	}
+	// the free variable is the first one of the enclosing function's chain
+	return s.resolveOuter(name)
+}
+
+// the chain of the name in the enclosing function, captured by this one
+func (s *SymbolTable) resolveOuter(name string) []Symbol {
+	var symbols []Symbol
+	for _, symbol := range s.Outer.ResolveChain(name) {
+		if symbol.Scope != GlobalScope {
+			symbol = s.capture(symbol)
+		}
+		symbols = append(symbols, symbol)
+	}
+	return symbols
+}
+
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	symbol := s.capture(original)
+	s.store[original.Name] = symbol
+	return symbol
+}
+
+// the free variable of the symbol of the enclosing function, the same one however many times it's captured
+func (s *SymbolTable) capture(original Symbol) Symbol {
+	for i, free := range s.FreeSymbols {
+		if free == original {
+			return Symbol{Name: original.Name, Scope: FreeScope, Index: i}
+		}
+	}
+	s.FreeSymbols = append(s.FreeSymbols, original)
+	s.free = append(s.free, original.Name)
+	return Symbol{Name: original.Name, Scope: FreeScope, Index: len(s.FreeSymbols) - 1}
+}
+
+// names of the globals or the locals, in the order of their indexes
+func (s *SymbolTable) Names() []string {
+	return s.names
+}
+
+// names of the free variables, in the order of their indexes
+func (s *SymbolTable) FreeNames() []string {
+	return s.free
+}
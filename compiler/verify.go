@@ -0,0 +1,265 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+
+	"kjarmicki.github.com/monkey/code"
+	"kjarmicki.github.com/monkey/object"
+)
+
+// what the vm expects to find in a place of the stack, the values it only passes around are all alike
+type kind byte
+
+const (
+	valueKind    kind = iota
+	cellKind          // captured local, for OpClosure
+	errorKind         // raised error, for OpCatch and OpRethrow
+	iteratorKind      // state of a for loop, for OpIterNext
+)
+
+// state of the stack and of the try blocks of the function, before running an instruction
+type flowState struct {
+	stack    []kind // without the locals
+	handlers []flowHandler
+}
+
+type flowHandler struct {
+	target int
+	depth  int // of the stack at the start of the try, which the handler restores
+}
+
+func (s *flowState) equal(other *flowState) bool {
+	if len(s.stack) != len(other.stack) || len(s.handlers) != len(other.handlers) {
+		return false
+	}
+	for i := range s.stack {
+		if s.stack[i] != other.stack[i] {
+			return false
+		}
+	}
+	for i := range s.handlers {
+		if s.handlers[i] != other.handlers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *flowState) copy() *flowState {
+	return &flowState{
+		stack:    append([]kind{}, s.stack...),
+		handlers: append([]flowHandler{}, s.handlers...),
+	}
+}
+
+/*
+ * Follows every way through the function (the instructions are already known to be well formed) to check that
+ * the stack is the same whichever way an instruction is reached, that no instruction pops more than there is
+ * (or than the innermost try block restores) and that the instructions find the values they expect:
+ * cells for the closures, errors for the catch blocks and iterators for the loops. The locals kept in cells
+ * are the ones OpNewCell is applied to at the start of the function, only the cell ops can access them.
+ */
+func verifyFlow(fn *object.CompiledFunction, main bool) error {
+	ins := fn.Instructions
+	cells := map[int]bool{}
+	start := 0
+	for start < len(ins) && code.Opcode(ins[start]) == code.OpNewCell {
+		slot := int(code.ReadUint16(ins[start+1:]))
+		if cells[slot] {
+			return fmt.Errorf("offset %d: OpNewCell of local %d, which is already a cell", start, slot)
+		}
+		cells[slot] = true
+		start += 3
+	}
+	if start == len(ins) {
+		return errors.New("no instructions after the cells")
+	}
+
+	states := map[int]*flowState{start: {}}
+	pending := []int{start}
+	reach := func(offset int, state *flowState) error {
+		if offset >= len(ins) {
+			return errors.New("the code runs past the end of the instructions")
+		}
+		if known, ok := states[offset]; ok {
+			if !known.equal(state) {
+				return fmt.Errorf("offset %d: the stack differs between the ways the instruction is reached", offset)
+			}
+			return nil
+		}
+		states[offset] = state
+		pending = append(pending, offset)
+		return nil
+	}
+
+	for len(pending) > 0 {
+		offset := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		op := code.Opcode(ins[offset])
+		def, _ := code.Lookup(byte(op))
+		operands, read := code.ReadOperands(def, ins[offset+1:])
+		next := offset + 1 + read
+
+		state := states[offset].copy()
+		if err := verifyInstruction(op, operands, state, cells, main); err != nil {
+			return fmt.Errorf("offset %d: %s %w", offset, def.Name, err)
+		}
+		var err error
+		switch op {
+		case code.OpJump:
+			err = reach(operands[0], state)
+		case code.OpJumpIfFalsy:
+			state.stack = state.stack[:len(state.stack)-1]
+			if err = reach(next, state); err == nil {
+				err = reach(operands[0], state.copy())
+			}
+		case code.OpJumpIfFalsyKeep, code.OpJumpIfTruthyKeep:
+			err = reach(operands[0], state.copy())
+			state.stack = state.stack[:len(state.stack)-1]
+			if err == nil {
+				err = reach(next, state)
+			}
+		case code.OpIterNext:
+			err = reach(operands[0], state.copy())
+			state.stack = append(state.stack, valueKind)
+			if err == nil {
+				err = reach(next, state)
+			}
+		case code.OpGetLocalOrOuter, code.OpGetCellOrOuter, code.OpGetFreeOrOuter:
+			err = reach(next, state.copy())
+			state.stack = append(state.stack, valueKind)
+			if err == nil {
+				err = reach(operands[1], state)
+			}
+		case code.OpAssignLocalOrOuter, code.OpAssignCellOrOuter, code.OpAssignFreeOrOuter:
+			if err = reach(next, state); err == nil {
+				err = reach(operands[1], state.copy())
+			}
+		case code.OpTry:
+			// the handler is left before jumping to the target, with the error on the stack
+			handling := &flowState{stack: append(state.stack[:len(state.stack):len(state.stack)], errorKind), handlers: state.handlers}
+			state.handlers = append(state.handlers[:len(state.handlers):len(state.handlers)], flowHandler{target: operands[0], depth: len(state.stack)})
+			if err = reach(operands[0], handling); err == nil {
+				err = reach(next, state)
+			}
+		case code.OpReturnValue, code.OpReturn, code.OpRethrow, code.OpThrow, code.OpError:
+		default:
+			applyEffect(op, operands, state)
+			err = reach(next, state)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// number of the values the instruction takes from the stack, it pushes what stackEffect adds to them
+func stackInputs(op code.Opcode, operands []int) int {
+	switch op {
+	case code.OpPop, code.OpMinus, code.OpBang, code.OpJumpIfFalsy, code.OpJumpIfFalsyKeep, code.OpJumpIfTruthyKeep,
+		code.OpDefineGlobal, code.OpDefineLocal, code.OpDefineCell, code.OpAssignGlobal, code.OpAssignLocal,
+		code.OpAssignCell, code.OpAssignFree, code.OpAssignLocalOrOuter, code.OpAssignCellOrOuter,
+		code.OpAssignFreeOrOuter, code.OpReturnValue, code.OpCatch, code.OpRethrow, code.OpThrow, code.OpIter:
+		return 1
+	case code.OpDup2, code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpEqual, code.OpNotEqual,
+		code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual, code.OpIndex:
+		return 2
+	case code.OpSetIndex:
+		return 3
+	case code.OpClosure:
+		return operands[1]
+	case code.OpArray:
+		return operands[0]
+	case code.OpHash:
+		return 2 * operands[0]
+	case code.OpCall, code.OpTailCall:
+		return operands[0] + 1
+	case code.OpIterNext:
+		// it only looks at the iterator
+		return 1
+	}
+	return 0
+}
+
+func verifyInstruction(op code.Opcode, operands []int, state *flowState, cells map[int]bool, main bool) error {
+	inputs := stackInputs(op, operands)
+	floor := 0
+	if len(state.handlers) > 0 {
+		floor = state.handlers[len(state.handlers)-1].depth
+	}
+	if len(state.stack)-inputs < floor {
+		return fmt.Errorf("takes %d values from the stack, there are %d", inputs, len(state.stack)-floor)
+	}
+	top := func(expected kind, what string) error {
+		if state.stack[len(state.stack)-1] != expected {
+			return fmt.Errorf("expects %s on top of the stack", what)
+		}
+		return nil
+	}
+
+	switch op {
+	case code.OpCatch, code.OpRethrow:
+		return top(errorKind, "an error")
+	case code.OpIterNext:
+		return top(iteratorKind, "an iterator")
+	case code.OpClosure:
+		for _, k := range state.stack[len(state.stack)-inputs:] {
+			if k != cellKind {
+				return errors.New("expects the captured cells on the stack")
+			}
+		}
+	case code.OpGetLocal, code.OpDefineLocal, code.OpAssignLocal, code.OpGetLocalOrOuter, code.OpAssignLocalOrOuter:
+		if cells[operands[0]] {
+			return fmt.Errorf("accesses local %d, which is a cell", operands[0])
+		}
+	case code.OpGetCell, code.OpDefineCell, code.OpAssignCell, code.OpGetCellOrOuter, code.OpAssignCellOrOuter,
+		code.OpLoadCell:
+		if !cells[operands[0]] {
+			return fmt.Errorf("accesses local %d, which is not a cell", operands[0])
+		}
+	case code.OpNewCell:
+		return errors.New("used after the start of the function")
+	case code.OpPopTry:
+		if len(state.handlers) == 0 {
+			return errors.New("outside of a try block")
+		}
+	case code.OpTailCall:
+		// the main function has no frame of a called function to replace
+		if main {
+			return errors.New("in the main function")
+		}
+		// the handlers would be left pointing at the code of the replaced function
+		if len(state.handlers) > 0 {
+			return errors.New("inside of a try block")
+		}
+	case code.OpReturn:
+		// functions always return a value
+		if !main {
+			return errors.New("outside of the main function")
+		}
+	}
+	return nil
+}
+
+// changes the state as the instruction does when it doesn't jump
+func applyEffect(op code.Opcode, operands []int, state *flowState) {
+	inputs := stackInputs(op, operands)
+	taken := append([]kind{}, state.stack[len(state.stack)-inputs:]...)
+	state.stack = state.stack[:len(state.stack)-inputs]
+	switch op {
+	case code.OpDup2:
+		state.stack = append(state.stack, taken[0], taken[1], taken[0], taken[1])
+	case code.OpLoadCell, code.OpLoadFreeCell:
+		state.stack = append(state.stack, cellKind)
+	case code.OpIter:
+		state.stack = append(state.stack, iteratorKind)
+	case code.OpPopTry:
+		state.handlers = state.handlers[:len(state.handlers)-1]
+	default:
+		for i := 0; i < inputs+stackEffect(op, operands); i++ {
+			state.stack = append(state.stack, valueKind)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package diagnostic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"kjarmicki.github.com/monkey/token"
+)
+
+/*
+ * Diagnostics are structured problem reports produced while processing the source code (e.g. by the parser).
+ * They carry enough information for the host to present them however it wants: in the REPL, in an editor or in CI logs.
+ */
+
+type Severity int
+
+const (
+	ERROR Severity = iota
+	WARNING
+	NOTE
+)
+
+func (s Severity) String() string {
+	switch s {
+	case ERROR:
+		return "error"
+	case WARNING:
+		return "warning"
+	case NOTE:
+		return "note"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+// stable identifier of the kind of the problem, so hosts can match on it instead of parsing messages
+type Code string
+
+const (
+	UNEXPECTED_TOKEN     Code = "E0001" // a specific token was expected, but something else was found
+	NO_PREFIX_PARSE      Code = "E0002" // token can't start an expression
+	INVALID_INTEGER      Code = "E0003" // integer literal can't be represented
+	INVALID_FLOAT        Code = "E0004" // float literal can't be represented
+	UNTERMINATED_STRING  Code = "E0005" // input ended inside of a string
+	UNTERMINATED_COMMENT Code = "E0006" // input ended inside of a block comment
+	INVALID_ESCAPE       Code = "E0007" // unknown or malformed escape sequence in a string
+	ILLEGAL_CHARACTER    Code = "E0008" // character that can't start any token
+	OUTSIDE_LOOP         Code = "E0009" // break or continue used outside of a loop body
+	INVALID_ASSIGNMENT   Code = "E0010" // left side of an assignment is not a variable or an index expression
+	UNDEFINED_VARIABLE   Code = "E0011" // variable isn't declared anywhere it could be seen from
+	USED_BEFORE_DEFINED  Code = "E0012" // variable is used before the let defining it
+)
+
+type Diagnostic struct {
+	Severity Severity
+	Code     Code
+	Message  string
+	Span     token.Span
+	Expected []token.TokenType // token types that would be accepted, if applicable
+	Actual   token.TokenType   // token type that was found, if applicable
+	Hint     string            // optional suggestion on how to fix the problem
+}
+
+// single line form, e.g. "1:5: error[E0001]: expected next token to be =, got INT instead"
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s[%s]: %s", d.Span, d.Severity, d.Code, d.Message)
+}
+
+func (d *Diagnostic) Error() string {
+	return d.String()
+}
+
+// writes the diagnostic together with the offending source line and a caret underline, e.g.:
+//
+//	error[E0001]: expected next token to be =, got INT instead
+//	 --> main.mk:1:7
+//	  |
+//	1 | let x 5;
+//	  |       ^
+//	  = hint: ...
+func Render(out io.Writer, source string, d *Diagnostic) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s[%s]: %s\n", d.Severity, d.Code, d.Message)
+	fmt.Fprintf(&buf, " --> %s\n", d.Span.Start)
+
+	line, ok := sourceLine(source, d.Span.Start.Line)
+	if ok {
+		lineNo := fmt.Sprintf("%d", d.Span.Start.Line)
+		gutter := strings.Repeat(" ", len(lineNo))
+		fmt.Fprintf(&buf, "%s |\n", gutter)
+		fmt.Fprintf(&buf, "%s | %s\n", lineNo, line)
+		fmt.Fprintf(&buf, "%s | %s\n", gutter, underline(line, d.Span))
+		if d.Hint != "" {
+			fmt.Fprintf(&buf, "%s = hint: %s\n", gutter, d.Hint)
+		}
+	} else if d.Hint != "" {
+		fmt.Fprintf(&buf, " = hint: %s\n", d.Hint)
+	}
+	out.Write(buf.Bytes())
+}
+
+// renders all diagnostics, separated with empty lines
+func RenderAll(out io.Writer, source string, diagnostics []*Diagnostic) {
+	for i, d := range diagnostics {
+		if i > 0 {
+			io.WriteString(out, "\n")
+		}
+		Render(out, source, d)
+	}
+}
+
+// returns given line (starting at 1) without the line terminator
+func sourceLine(source string, line int) (string, bool) {
+	if line < 1 {
+		return "", false
+	}
+	lines := strings.Split(source, "\n")
+	if line > len(lines) {
+		return "", false
+	}
+	return strings.TrimRight(lines[line-1], "\r"), true
+}
+
+// carets under the part of the line covered by the span, at least one caret is always printed
+func underline(line string, span token.Span) string {
+	startCol := span.Start.Column
+	width := 1
+	if span.End.Line == span.Start.Line && span.End.Column > startCol {
+		width = span.End.Column - startCol
+	} else if span.End.Line > span.Start.Line {
+		// multi-line span, underline till the end of the first line
+		width = len([]rune(line)) - startCol + 1
+	}
+	if width < 1 {
+		width = 1
+	}
+
+	var out strings.Builder
+	for i, r := range []rune(line) {
+		if i >= startCol-1 {
+			break
+		}
+		// keep tabs so the carets line up with what's displayed above
+		if r == '\t' {
+			out.WriteRune('\t')
+		} else {
+			out.WriteRune(' ')
+		}
+	}
+	for out.Len() < startCol-1 {
+		out.WriteRune(' ')
+	}
+	out.WriteString(strings.Repeat("^", width))
+	return out.String()
+}
@@ -0,0 +1,82 @@
+package diagnostic
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/token"
+)
+
+func TestString(t *testing.T) {
+	d := &Diagnostic{
+		Severity: ERROR,
+		Code:     UNEXPECTED_TOKEN,
+		Message:  "expected next token to be =, got INT instead",
+		Span:     span(1, 7, 1, 8),
+	}
+
+	assert.Equal(t, "1:7: error[E0001]: expected next token to be =, got INT instead", d.String())
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		source     string
+		diagnostic *Diagnostic
+		expected   string
+	}{
+		{
+			"let x 5;",
+			&Diagnostic{
+				Severity: ERROR,
+				Code:     UNEXPECTED_TOKEN,
+				Message:  "expected next token to be =, got INT instead",
+				Span:     span(1, 7, 1, 8),
+				Hint:     "bindings need a value, e.g. let x = 5;",
+			},
+			"error[E0001]: expected next token to be =, got INT instead\n" +
+				" --> 1:7\n" +
+				"  |\n" +
+				"1 | let x 5;\n" +
+				"  |       ^\n" +
+				"  = hint: bindings need a value, e.g. let x = 5;\n",
+		},
+		{
+			"let a = 1;\n\tfoobar + 2;",
+			&Diagnostic{
+				Severity: WARNING,
+				Code:     NO_PREFIX_PARSE,
+				Message:  "something is off",
+				Span:     span(2, 2, 2, 8),
+			},
+			"warning[E0002]: something is off\n" +
+				" --> 2:2\n" +
+				"  |\n" +
+				"2 | \tfoobar + 2;\n" +
+				"  | \t^^^^^^\n",
+		},
+		{
+			"",
+			&Diagnostic{
+				Severity: ERROR,
+				Code:     NO_PREFIX_PARSE,
+				Message:  "no position",
+			},
+			"error[E0002]: no position\n" +
+				" --> -\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		Render(&out, tt.source, tt.diagnostic)
+		assert.Equal(t, tt.expected, out.String())
+	}
+}
+
+func span(startLine, startCol, endLine, endCol int) token.Span {
+	return token.Span{
+		Start: token.Position{Line: startLine, Column: startCol},
+		End:   token.Position{Line: endLine, Column: endCol},
+	}
+}
@@ -0,0 +1,212 @@
+package evaluator
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"kjarmicki.github.com/monkey/object"
+)
+
+// builtins declare their parameters, the arguments are checked against them before the builtin is called,
+// so the functions below can rely on getting the right number of arguments of the right types
+var builtins = map[string]*object.Builtin{
+	"len": {
+		Doc: "number of characters in the string or elements in the array",
+		Signature: &object.Signature{
+			Params:  []object.Param{param("value", object.STRING_OBJ, object.ARRAY_OBJ)},
+			Returns: "INTEGER",
+		},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			if str, ok := args[0].(*object.String); ok {
+				return &object.Integer{Value: int64(utf8.RuneCountInString(str.Value))}
+			}
+			return &object.Integer{Value: int64(len(args[0].(*object.Array).Elements))}
+		},
+	},
+
+	"first": {
+		Doc: "first element of the array, null when it's empty",
+		Signature: &object.Signature{
+			Params:  []object.Param{param("array", object.ARRAY_OBJ)},
+			Returns: "ANY",
+		},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			arr := args[0].(*object.Array)
+			if len(arr.Elements) > 0 {
+				return arr.Elements[0]
+			}
+			return NULL
+		},
+	},
+
+	"last": {
+		Doc: "last element of the array, null when it's empty",
+		Signature: &object.Signature{
+			Params:  []object.Param{param("array", object.ARRAY_OBJ)},
+			Returns: "ANY",
+		},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			arr := args[0].(*object.Array)
+			length := len(arr.Elements)
+			if len(arr.Elements) > 0 {
+				return arr.Elements[length-1]
+			}
+			return NULL
+		},
+	},
+
+	"rest": {
+		Doc: "new array with all the elements but the first one, null when the array is empty",
+		Signature: &object.Signature{
+			Params:  []object.Param{param("array", object.ARRAY_OBJ)},
+			Returns: "ARRAY | NULL",
+		},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			arr := args[0].(*object.Array)
+			length := len(arr.Elements)
+			if len(arr.Elements) > 0 {
+				if err := rt.Allocate(object.ArraySize(length - 1)); err != nil {
+					return err
+				}
+				newElements := make([]object.Object, length-1)
+				copy(newElements, arr.Elements[1:length])
+				return &object.Array{Elements: newElements}
+			}
+			return NULL
+		},
+	},
+
+	"push": {
+		Doc: "new array with the value added at the end, the original array is left as it was",
+		Signature: &object.Signature{
+			Params:  []object.Param{param("array", object.ARRAY_OBJ), param("value")},
+			Returns: "ARRAY",
+		},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			arr := args[0].(*object.Array)
+			length := len(arr.Elements) + 1
+			if err := rt.Allocate(object.ArraySize(length)); err != nil {
+				return err
+			}
+			newElements := make([]object.Object, length)
+			copy(newElements, arr.Elements)
+			newElements[length-1] = args[1]
+			return &object.Array{Elements: newElements}
+		},
+	},
+
+	"int": {
+		Doc: "converts the value to an integer, floats are truncated towards zero",
+		Signature: &object.Signature{
+			Params:  []object.Param{param("value", object.INTEGER_OBJ, object.FLOAT_OBJ, object.STRING_OBJ)},
+			Returns: "INTEGER",
+		},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			switch arg := args[0].(type) {
+			case *object.Float:
+				if math.IsNaN(arg.Value) || math.IsInf(arg.Value, 0) {
+					return newError("cannot convert %s to INTEGER", arg.Inspect())
+				}
+				// truncates towards zero
+				value, _ := big.NewFloat(arg.Value).Int(nil)
+				return object.NewBigInteger(value)
+			case *object.String:
+				value, ok := new(big.Int).SetString(strings.TrimSpace(arg.Value), 10)
+				if !ok {
+					return newError("cannot convert %q to INTEGER", arg.Value)
+				}
+				return object.NewBigInteger(value)
+			default:
+				return arg
+			}
+		},
+	},
+
+	"float": {
+		Doc: "converts the value to a float",
+		Signature: &object.Signature{
+			Params:  []object.Param{param("value", object.INTEGER_OBJ, object.FLOAT_OBJ, object.STRING_OBJ)},
+			Returns: "FLOAT",
+		},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			switch arg := args[0].(type) {
+			case *object.Integer:
+				return &object.Float{Value: arg.Float()}
+			case *object.String:
+				value, err := strconv.ParseFloat(strings.TrimSpace(arg.Value), 64)
+				if err != nil {
+					return newError("cannot convert %q to FLOAT", arg.Value)
+				}
+				return &object.Float{Value: value}
+			default:
+				return arg
+			}
+		},
+	},
+
+	"puts": {
+		Doc: "prints the values, one per line",
+		Signature: &object.Signature{
+			Params:  []object.Param{{Name: "values", Variadic: true}},
+			Returns: "NULL",
+		},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			for _, arg := range args {
+				fmt.Fprintln(rt.Stdout, arg.Inspect())
+			}
+			return NULL
+		},
+	},
+
+	"readline": {
+		Doc:       "next line of the standard input without the line terminator, null at the end of the input",
+		Signature: &object.Signature{Returns: "STRING | NULL"},
+		Fn: func(rt *object.Runtime, args ...object.Object) object.Object {
+			line, err := rt.StdinReader().ReadString('\n')
+			if err != nil && line == "" {
+				if err == io.EOF {
+					return NULL
+				}
+				return newError("could not read the input: %s", err)
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if err := rt.Allocate(object.StringSize(len(line))); err != nil {
+				return err
+			}
+			return &object.String{Value: line}
+		},
+	},
+}
+
+func init() {
+	for name, builtin := range builtins {
+		builtin.Name = name
+	}
+}
+
+// required parameter accepting the given types, or any type when none are given
+func param(name string, types ...object.ObjectType) object.Param {
+	return object.Param{Name: name, Types: types}
+}
+
+// builtin function available to all the code under the given name
+func LookupBuiltin(name string) (*object.Builtin, bool) {
+	builtin, ok := builtins[name]
+	return builtin, ok
+}
+
+// all the builtins, sorted by name
+func Builtins() []*object.Builtin {
+	all := make([]*object.Builtin, 0, len(builtins))
+	for _, builtin := range builtins {
+		all = append(all, builtin)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
@@ -1,130 +1,77 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
 
 	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/diagnostic"
 	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/resolver"
+	"kjarmicki.github.com/monkey/token"
 )
 
 var (
 	TRUE  = &object.Boolean{Value: true}
 	FALSE = &object.Boolean{Value: false}
 	NULL  = &object.Null{}
-)
-
-var builtins = map[string]*object.Builtin{
-	"len": {
-		Fn: func(args ...object.Object) object.Object {
-			arg := args[0]
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1", len(args))
-			}
-			if str, ok := arg.(*object.String); ok {
-				return &object.Integer{Value: int64(len(str.Value))}
-			}
-			if arr, ok := arg.(*object.Array); ok {
-				return &object.Integer{Value: int64(len(arr.Elements))}
-			}
-			return newError("argument to `len` not supported, got %s", arg.Type())
-		},
-	},
-
-	"first": {
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1", len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `first` must be ARRAY, got %s", args[0].Type())
-			}
-			arr := args[0].(*object.Array)
-			if len(arr.Elements) > 0 {
-				return arr.Elements[0]
-			}
-			return NULL
-		},
-	},
 
-	"last": {
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1", len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `last` must be ARRAY, got %s", args[0].Type())
-			}
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements)
-			if len(arr.Elements) > 0 {
-				return arr.Elements[length-1]
-			}
-			return NULL
-		},
-	},
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
+)
 
-	"rest": {
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1", len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
-			}
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements)
-			if len(arr.Elements) > 0 {
-				newElements := make([]object.Object, length-1)
-				copy(newElements, arr.Elements[1:length])
-				return &object.Array{Elements: newElements}
-			}
-			return NULL
-		},
-	},
+// evaluates the node as a new run, which is stopped with an error once the context is done
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment) object.Object {
+	defer env.Runtime().Begin(ctx)()
+	return Eval(node, env)
+}
 
-	"push": {
-		Fn: func(args ...object.Object) object.Object {
-			if len(args) != 2 {
-				return newError("wrong number of arguments. got=%d, want=2", len(args))
-			}
-			if args[0].Type() != object.ARRAY_OBJ {
-				return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
-			}
-			arr := args[0].(*object.Array)
-			length := len(arr.Elements) + 1
-			newElements := make([]object.Object, length)
-			copy(newElements, arr.Elements)
-			newElements[length-1] = args[1]
-			return &object.Array{Elements: newElements}
-		},
-	},
-
-	"puts": {
-		Fn: func(args ...object.Object) object.Object {
-			for _, arg := range args {
-				fmt.Println(arg.Inspect())
-			}
-			return NULL
-		},
-	},
+// resolves the variables of the program to be run in the environment, see resolver.Resolve.
+// The program runs without being resolved too, looking all the variables up by name.
+func Resolve(program *ast.Program, env *object.Environment) []*diagnostic.Diagnostic {
+	return resolver.Resolve(program, func(name string) bool {
+		if _, ok := env.Get(name); ok {
+			return true
+		}
+		_, ok := builtins[name]
+		return ok
+	})
 }
 
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	if err := env.Runtime().Step(); err != nil {
+		err.Span = node.Span()
+		return err
+	}
+	result := evalNode(node, env)
+	// errors are created deep down without knowing where they happened,
+	// so the innermost node they pass through marks their location
+	if err, ok := result.(*object.Error); ok && !err.Span.IsValid() {
+		err.Span = node.Span()
+	}
+	return result
+}
+
+func evalNode(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
 		return evalProgram(node.Statements, env)
 	case *ast.LetStatement:
+		// the value can end with a signal (e.g. break in an if), which must go on instead of being bound
 		val := Eval(node.Value, env)
-		if isError(val) {
+		if isSignal(val) {
 			return val
 		}
-		env.Set(node.Name.Value, val)
+		define(env, node.Name, val)
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Body: body, Env: env}
+		return &object.Function{Parameters: params, Body: body, Env: env, Name: node.Name, Locals: len(node.Locals)}
 	case *ast.CallExpression:
 		function := Eval(node.Function, env)
 		if isError(function) {
@@ -134,13 +81,26 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return applyFunction(function, args)
+		if function, ok := function.(*object.Function); ok && node.Tail && checkArguments(function, args) == nil {
+			return &tailCall{function: function, args: args, callSite: node.Span()}
+		}
+		return applyFunction(function, args, env, node.Span())
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
 		if isError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return newThrownError(val)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 	case *ast.ExpressionStatement:
 		return Eval(node.Expression, env)
 	case *ast.BlockStatement:
@@ -161,6 +121,12 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalHashLiteral(node, env)
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
+	case *ast.WhileExpression:
+		return evalWhileExpression(node, env)
+	case *ast.ForExpression:
+		return evalForExpression(node, env)
+	case *ast.TryExpression:
+		return evalTryExpression(node, env)
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
 		if isError(right) {
@@ -168,20 +134,33 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		}
 		return evalPrefixExpression(node.Operator, right)
 	case *ast.InfixExpression:
-		right := Eval(node.Right, env)
-		if isError(right) {
-			return right
-		}
 		left := Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, left, env)
+		}
+		right := Eval(node.Right, env)
+		if isError(right) {
+			return right
+		}
+		return evalInfixExpression(env.Runtime(), node.Operator, left, right)
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
 	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			return object.NewBigInteger(node.Big)
+		}
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 	case *ast.StringLiteral:
+		if err := env.Runtime().Allocate(object.StringSize(len(node.Value))); err != nil {
+			return err
+		}
 		return &object.String{Value: node.Value}
 	}
 	return nil
@@ -215,13 +194,15 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 			return result.Value
 		case *object.Error:
 			return result
+		case *object.Break, *object.Continue:
+			return newError("%s outside of a loop", result.Inspect())
 		}
 	}
 	return result
 }
 
 func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
-	if val, ok := env.Get(node.Value); ok {
+	if val, ok := lookupVariable(node, env); ok {
 		return val
 	}
 	if builtin, ok := builtins[node.Value]; ok {
@@ -234,21 +215,30 @@ func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) obje
 	var result object.Object
 	for _, statement := range block.Statements {
 		result = Eval(statement, env)
-		if result != nil {
-			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
-				return result
-			}
+		// signals are passed up to whoever handles them: a function call, a loop or the program
+		if isSignal(result) {
+			return result
 		}
 	}
 	return result
 }
 
+func isSignal(obj object.Object) bool {
+	if obj == nil {
+		return false
+	}
+	t := obj.Type()
+	return t == object.RETURN_VALUE_OBJ || t == object.ERROR_OBJ || t == object.BREAK_OBJ || t == object.CONTINUE_OBJ
+}
+
 func evalArrayLiteral(al *ast.ArrayLiteral, env *object.Environment) object.Object {
 	elements := evalExpressions(al.Elements, env)
 	if len(elements) == 1 && isError(elements[0]) {
 		return elements[0]
 	}
+	if err := env.Runtime().Allocate(object.ArraySize(len(elements))); err != nil {
+		return err
+	}
 	return &object.Array{Elements: elements}
 }
 
@@ -265,16 +255,20 @@ func evalIndexExpression(left, index object.Object) object.Object {
 
 func evalArrayIndexExpression(left, index object.Object) object.Object {
 	arr := left.(*object.Array)
-	idx := index.(*object.Integer).Value
+	integer := index.(*object.Integer)
+	idx := integer.Value
 	max := int64(len(arr.Elements) - 1)
 
-	if idx < 0 || idx > max {
+	if integer.IsBig() || idx < 0 || idx > max {
 		return NULL
 	}
 	return arr.Elements[idx]
 }
 
 func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
+	if err := env.Runtime().Allocate(object.HashSize(len(node.Pairs))); err != nil {
+		return err
+	}
 	pairs := make(map[object.HashKey]object.HashPair)
 
 	for key, value := range node.Pairs {
@@ -325,6 +319,248 @@ func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Obje
 	return NULL
 }
 
+// loops are expressions evaluating to null, their bodies share the scope with the surrounding code like if's do
+func evalWhileExpression(we *ast.WhileExpression, env *object.Environment) object.Object {
+	for {
+		condition := Eval(we.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return NULL
+		}
+		if result, done := evalLoopBody(we.Body, env); done {
+			return result
+		}
+	}
+}
+
+func evalForExpression(fe *ast.ForExpression, env *object.Environment) object.Object {
+	iterable := Eval(fe.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
+	items, err := iterationItems(env.Runtime(), iterable)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		define(env, fe.Variable, item)
+		if result, done := evalLoopBody(fe.Body, env); done {
+			return result
+		}
+	}
+	return NULL
+}
+
+// runs one iteration, done is true when the loop should stop and return the result
+func evalLoopBody(body *ast.BlockStatement, env *object.Environment) (result object.Object, done bool) {
+	switch result := Eval(body, env).(type) {
+	case *object.ReturnValue, *object.Error:
+		return result, true
+	case *object.Break:
+		return NULL, true
+	default:
+		return nil, false
+	}
+}
+
+// arrays yield their elements, strings their characters and hashes their keys (in order, see Hash.SortedPairs)
+func iterationItems(rt *object.Runtime, iterable object.Object) ([]object.Object, *object.Error) {
+	switch iterable := iterable.(type) {
+	case *object.Array:
+		if err := rt.Allocate(object.ArraySize(len(iterable.Elements))); err != nil {
+			return nil, err
+		}
+		items := make([]object.Object, len(iterable.Elements))
+		copy(items, iterable.Elements)
+		return items, nil
+	case *object.String:
+		items := make([]object.Object, 0, len(iterable.Value))
+		for _, ch := range iterable.Value {
+			if err := rt.Allocate(object.StringSize(utf8.RuneLen(ch))); err != nil {
+				return nil, err
+			}
+			items = append(items, &object.String{Value: string(ch)})
+		}
+		return items, nil
+	case *object.Hash:
+		if err := rt.Allocate(object.ArraySize(len(iterable.Pairs))); err != nil {
+			return nil, err
+		}
+		pairs := iterable.SortedPairs()
+		items := make([]object.Object, len(pairs))
+		for i, pair := range pairs {
+			items[i] = pair.Key
+		}
+		return items, nil
+	default:
+		return nil, newError("cannot iterate over %s", iterable.Type())
+	}
+}
+
+// evaluates to the value of the body or, when the body fails, of the catch block. The finally block runs in any case,
+// its value is discarded unless it errors, returns or breaks out, which replaces the result.
+// Errors stopping the run skip both catch and finally.
+func evalTryExpression(te *ast.TryExpression, env *object.Environment) object.Object {
+	result := Eval(te.Body, env)
+	if err, ok := result.(*object.Error); ok && err.Catchable() && te.Catch != nil {
+		caught := caughtError(env.Runtime(), err)
+		if isError(caught) {
+			return caught
+		}
+		// like the loop variables, the caught error is bound in the enclosing environment
+		define(env, te.CatchParameter, caught)
+		result = Eval(te.Catch, env)
+	}
+
+	if err, ok := result.(*object.Error); ok && !err.Catchable() {
+		return err
+	}
+	if te.Finally != nil {
+		if finally := Eval(te.Finally, env); isSignal(finally) {
+			return finally
+		}
+	}
+	if result == nil {
+		return NULL
+	}
+	return result
+}
+
+// caught errors are hashes: {"message": ..., "kind": ..., "stack": [...], "value": ...}, where kind is "THROWN"
+// for the values given to throw (which are under "value") and "ERROR" for the errors raised by the interpreter
+func caughtError(rt *object.Runtime, err *object.Error) object.Object {
+	if allocErr := rt.Allocate(object.HashSize(4)); allocErr != nil {
+		return allocErr
+	}
+	kind := "ERROR"
+	if err.Kind != "" {
+		kind = string(err.Kind)
+	}
+	value := err.Value
+	if value != nil {
+		kind = "THROWN"
+	} else {
+		value = NULL
+	}
+	stack := []object.Object{}
+	for _, line := range err.StackTrace() {
+		stack = append(stack, &object.String{Value: line})
+	}
+
+	pairs := make(map[object.HashKey]object.HashPair)
+	for _, pair := range []object.HashPair{
+		{Key: &object.String{Value: "message"}, Value: &object.String{Value: err.Message}},
+		{Key: &object.String{Value: "kind"}, Value: &object.String{Value: kind}},
+		{Key: &object.String{Value: "stack"}, Value: &object.Array{Elements: stack}},
+		{Key: &object.String{Value: "value"}, Value: value},
+	} {
+		pairs[pair.Key.(*object.String).HashKey()] = pair
+	}
+	return &object.Hash{Pairs: pairs}
+}
+
+// thrown values become ordinary errors, strings are the message as they are, hashes can give it under "message"
+// (so that a caught error can be thrown again), anything else is shown as printed
+func newThrownError(value object.Object) *object.Error {
+	message := value.Inspect()
+	if hash, ok := value.(*object.Hash); ok {
+		key := &object.String{Value: "message"}
+		if pair, ok := hash.Pairs[key.HashKey()]; ok {
+			if str, ok := pair.Value.(*object.String); ok {
+				message = str.Value
+			}
+		}
+	}
+	return &object.Error{Message: message, Value: value}
+}
+
+// assignment evaluates to the assigned value. Variables must already be defined (with let),
+// the closest binding gets updated, so closures can modify the variables of the enclosing functions.
+func evalAssignExpression(ae *ast.AssignExpression, env *object.Environment) object.Object {
+	switch target := ae.Target.(type) {
+	case *ast.Identifier:
+		current, defined := lookupVariable(target, env)
+		if !defined {
+			return newError("cannot assign to undefined variable: %s", target.Value)
+		}
+		val := evalAssignedValue(ae, current, env)
+		if isSignal(val) {
+			return val
+		}
+		if binding := currentBinding(target, env); binding.Local {
+			return env.SetLocal(binding.Depth, binding.Slot, val)
+		}
+		env.Assign(target.Value, val)
+		return val
+	case *ast.IndexExpression:
+		left := Eval(target.Left, env)
+		if isError(left) {
+			return left
+		}
+		index := Eval(target.Index, env)
+		if isError(index) {
+			return index
+		}
+		var current object.Object
+		if ae.Operator != "=" {
+			current = evalIndexExpression(left, index)
+			if isError(current) {
+				return current
+			}
+		}
+		val := evalAssignedValue(ae, current, env)
+		if isSignal(val) {
+			return val
+		}
+		return evalIndexAssignment(env.Runtime(), left, index, val)
+	default:
+		return newError("cannot assign to %s", ae.Target.String())
+	}
+}
+
+// value of the right side, combined with the current value for the compound operators (+= etc.)
+func evalAssignedValue(ae *ast.AssignExpression, current object.Object, env *object.Environment) object.Object {
+	val := Eval(ae.Value, env)
+	if isSignal(val) || ae.Operator == "=" {
+		return val
+	}
+	operator := strings.TrimSuffix(ae.Operator, "=")
+	return evalInfixExpression(env.Runtime(), operator, current, val)
+}
+
+// arrays and hashes are modified in place, so all the references to them see the change
+func evalIndexAssignment(rt *object.Runtime, left, index, val object.Object) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		integer, ok := index.(*object.Integer)
+		if !ok {
+			return newError("array index must be INTEGER, got %s", index.Type())
+		}
+		if integer.IsBig() || integer.Value < 0 || integer.Value >= int64(len(left.Elements)) {
+			return newError("index out of range: %s (length %d)", integer.Inspect(), len(left.Elements))
+		}
+		left.Elements[integer.Value] = val
+		return val
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		hashKey := key.HashKey()
+		if _, exists := left.Pairs[hashKey]; !exists {
+			if err := rt.Allocate(object.PairSize); err != nil {
+				return err
+			}
+		}
+		left.Pairs[hashKey] = object.HashPair{Key: index, Value: val}
+		return val
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+}
+
 func isTruthy(obj object.Object) bool {
 	return obj != FALSE && obj != NULL
 }
@@ -340,37 +576,94 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 	}
 }
 
-func evalInfixExpression(operator string, left, right object.Object) object.Object {
+func evalInfixExpression(rt *object.Runtime, operator string, left, right object.Object) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
+	case isNumber(left) && isNumber(right):
+		// mixed arithmetic: as soon as one side is a float, both sides are treated as floats
+		return evalFloatInfixExpression(operator, left, right)
 	case left.Type() == object.BOOLEAN_OBJ && right.Type() == object.BOOLEAN_OBJ:
 		return evalBooleanInfixExpression(operator, left, right)
 	case left.Type() != right.Type():
 		return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
-		return evalStringInfixExpression(operator, left, right)
+		return evalStringInfixExpression(rt, operator, left, right)
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
+// && and || short-circuit: the right side is evaluated only when the left one doesn't decide the result.
+// The result is the operand that decided it rather than a boolean, e.g. 1 && "a" is "a" (only false and null are falsy).
+func evalLogicalExpression(node *ast.InfixExpression, left object.Object, env *object.Environment) object.Object {
+	if isTruthy(left) == (node.Operator == "||") {
+		return left
+	}
+	return Eval(node.Right, env)
+}
+
+// integers never overflow, results that don't fit in int64 are promoted to big integers
 func evalIntegerInfixExpression(operator string, left, right object.Object) object.Object {
-	leftVal := left.(*object.Integer).Value
-	rightVal := right.(*object.Integer).Value
+	leftVal := left.(*object.Integer)
+	rightVal := right.(*object.Integer)
+	switch operator {
+	case "+":
+		return leftVal.Add(rightVal)
+	case "-":
+		return leftVal.Sub(rightVal)
+	case "*":
+		return leftVal.Mul(rightVal)
+	case "/":
+		if rightVal.IsZero() {
+			return newError("division by zero")
+		}
+		return leftVal.Quo(rightVal)
+	case "%":
+		if rightVal.IsZero() {
+			return newError("division by zero")
+		}
+		return leftVal.Rem(rightVal)
+	case "<":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) < 0)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) > 0)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) <= 0)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) >= 0)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) == 0)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal.Cmp(rightVal) != 0)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+// IEEE 754 semantics, e.g. 1.0 / 0 is +Inf rather than an error
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		return &object.Float{Value: leftVal + rightVal}
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		return &object.Float{Value: leftVal - rightVal}
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		return &object.Float{Value: leftVal * rightVal}
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -380,6 +673,21 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	}
 }
 
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return obj.Float()
+	case *object.Float:
+		return obj.Value
+	default:
+		return math.NaN()
+	}
+}
+
 // using pointer comparison as opposed to value comparison because boolean objects are singletons
 func evalBooleanInfixExpression(operator string, left, right object.Object) object.Object {
 	switch operator {
@@ -392,11 +700,14 @@ func evalBooleanInfixExpression(operator string, left, right object.Object) obje
 	}
 }
 
-func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
+func evalStringInfixExpression(rt *object.Runtime, operator string, left, right object.Object) object.Object {
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
 	switch operator {
 	case "+":
+		if err := rt.Allocate(object.StringSize(len(leftVal) + len(rightVal))); err != nil {
+			return err
+		}
 		return &object.String{Value: leftVal + rightVal}
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
@@ -417,11 +728,14 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 }
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		return right.Neg()
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
 }
 
 // used to parse function's arguments
@@ -438,29 +752,148 @@ func evalExpressions(expressions []ast.Expression, env *object.Environment) []ob
 	return result
 }
 
-// calls the function (evaluates function body) with the given arguments
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// calls a Monkey function or a builtin from outside of the evaluated code (e.g. by a Go host application),
+// env is the environment whose runtime builtins get
+func Apply(ctx context.Context, fn object.Object, args []object.Object, env *object.Environment) object.Object {
+	defer env.Runtime().Begin(ctx)()
+	return applyFunction(fn, args, env, token.Span{})
+}
+
+// calls the function and records the call on the stack of the error it results in, if any.
+// The errors raised before the body of a function starts (wrong arguments, too deep calls) get no frame of the function.
+func applyFunction(fn object.Object, args []object.Object, env *object.Environment, callSite token.Span) object.Object {
+	if function, ok := fn.(*object.Function); ok {
+		if err := checkArguments(function, args); err != nil {
+			return err
+		}
+		rt := env.Runtime()
+		if err := rt.EnterCall(); err != nil {
+			return err
+		}
+		defer rt.LeaveCall()
+	}
+	result := callFunction(fn, args, env)
+	if err, ok := result.(*object.Error); ok {
+		switch function := fn.(type) {
+		case *object.Function:
+			err.Stack = append(err.Stack, object.Frame{Function: function.Name, CallSite: callSite})
+		case *object.Builtin:
+			err.Stack = append(err.Stack, object.Frame{Function: function.Name, Builtin: true, CallSite: callSite})
+		}
+	}
+	return result
+}
+
+// calls the function (evaluates function body) with the given arguments, env is the environment of the caller.
+// The call of a Monkey function is already checked and entered by applyFunction.
+func callFunction(fn object.Object, args []object.Object, env *object.Environment) object.Object {
 	switch function := fn.(type) {
 	case *object.Function:
-		extendedEnv := extendFunctionEnv(function, args)
-		evaluated := Eval(function.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		result := evalFunctionBody(function, args)
+		// tail calls are made here, after the calling function has returned, so they don't grow the stack.
+		// Only the first and the last of the calls are remembered, errors get the frames of the function called last
+		// and of the one calling it (reached from the first call), the ones in between are elided.
+		var first token.Span
+		caller, calls := function, 0
+		for {
+			call, ok := result.(*tailCall)
+			if !ok {
+				return result
+			}
+			if calls == 0 {
+				first = call.callSite
+			}
+			calls += 1
+			result = evalFunctionBody(call.function, call.args)
+			if err, ok := result.(*object.Error); ok {
+				err.Stack = append(err.Stack, object.Frame{Function: call.function.Name, CallSite: call.callSite})
+				if calls > 1 {
+					err.Stack = append(err.Stack, object.Frame{Function: caller.Name, CallSite: first, Elided: calls > 2})
+				}
+			}
+			caller = call.function
+		}
 	case *object.Builtin:
-		return function.Fn(args...)
+		if function.Signature != nil {
+			if err := function.Signature.Check(function.Name, args); err != nil {
+				return err
+			}
+		}
+		return function.Fn(env.Runtime(), args...)
 	default:
 		return newError("not a function: %s", fn.Type())
 	}
 }
 
+func checkArguments(function *object.Function, args []object.Object) *object.Error {
+	if len(args) < len(function.Parameters) {
+		return newError("wrong number of arguments. got=%d, want=%d", len(args), len(function.Parameters))
+	}
+	return nil
+}
+
+// value of the function's body, which is a tail call when the function ends with one
+func evalFunctionBody(function *object.Function, args []object.Object) object.Object {
+	evaluated := Eval(function.Body, extendFunctionEnv(function, args))
+	if evaluated == BREAK || evaluated == CONTINUE {
+		return newError("%s outside of a loop", evaluated.Inspect())
+	}
+	return unwrapReturnValue(evaluated)
+}
+
+// call whose result is the result of the calling function (marked by the parser as ast.CallExpression.Tail).
+// Instead of being made right away, it's returned from the calling function and made by callFunction.
+type tailCall struct {
+	function *object.Function
+	args     []object.Object
+	callSite token.Span
+}
+
+func (tc *tailCall) Type() object.ObjectType {
+	return "TAIL_CALL"
+}
+
+func (tc *tailCall) Inspect() string {
+	return "tail call"
+}
+
 // creates a new environment based on the function's environment and the given arguments
 func extendFunctionEnv(function *object.Function, args []object.Object) *object.Environment {
-	env := object.NewEnclosedEnvironment(function.Env)
+	env := object.NewFunctionEnvironment(function.Env, function.Locals)
 	for i, param := range function.Parameters {
-		env.Set(param.Value, args[i])
+		define(env, param, args[i])
 	}
 	return env
 }
 
+// binds the declared variable, in its slot when the resolver gave it one
+func define(env *object.Environment, name *ast.Identifier, val object.Object) {
+	if name.Binding.Local {
+		env.SetLocal(0, name.Binding.Slot, val)
+	} else {
+		env.Set(name.Value, val)
+	}
+}
+
+// value of the variable (without the builtins), false when it's not defined
+func lookupVariable(name *ast.Identifier, env *object.Environment) (object.Object, bool) {
+	binding := currentBinding(name, env)
+	if binding.Local {
+		return env.Local(binding.Depth, binding.Slot), true
+	}
+	return env.Get(name.Value)
+}
+
+// binding the name refers to. The slot of a local is empty until its declaration runs, which might never happen
+// (e.g. when it's in a branch that wasn't taken), till then the name refers to the outer variable with the same name.
+func currentBinding(name *ast.Identifier, env *object.Environment) *ast.Binding {
+	binding := &name.Binding
+	for binding.Local && env.Local(binding.Depth, binding.Slot) == nil {
+		binding = binding.Outer
+	}
+	return binding
+}
+
 // return value can be either a return value object or the actual value
 func unwrapReturnValue(obj object.Object) object.Object {
 	if returnValue, ok := obj.(*object.ReturnValue); ok {
@@ -1,7 +1,11 @@
 package evaluator
 
 import (
+	"bytes"
+	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"kjarmicki.github.com/monkey/lexer"
@@ -29,6 +33,11 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"7 % -3", 1},
+		{"1 + 10 % 4 * 2", 5},
+		{"99999999999999999999 % 7", 1},
 	}
 
 	for _, tt := range tests {
@@ -37,6 +46,91 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 }
 
+func TestEvalBigIntegerExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"9223372036854775807 + 1", "9223372036854775808"},
+		{"-9223372036854775807 - 2", "-9223372036854775809"},
+		{"9223372036854775807 * 9223372036854775807", "85070591730234615847396907784232501249"},
+		{"99999999999999999999", "99999999999999999999"},
+		{"-99999999999999999999", "-99999999999999999999"},
+		{"99999999999999999999 / 10", "9999999999999999999"},
+		{"99999999999999999999 - 99999999999999999998", "1"},
+		{"int(1e20)", "100000000000000000000"},
+		{`int("123456789012345678901234567890")`, "123456789012345678901234567890"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		integer, ok := evaluated.(*object.Integer)
+		assert.True(t, ok, tt.input)
+		assert.Equal(t, tt.expected, integer.Inspect(), tt.input)
+	}
+}
+
+func TestEvalBigIntegerDemotion(t *testing.T) {
+	evaluated := testEval("(9223372036854775807 + 10) - 10")
+	testIntegerObject(t, evaluated, 9223372036854775807)
+	assert.False(t, evaluated.(*object.Integer).IsBig())
+}
+
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"1.5", 1.5},
+		{"-2.5", -2.5},
+		{"1.5 + 1.5", 3},
+		{"7 / 2.0", 3.5},
+		{"7.0 / 2", 3.5},
+		{"0.1 * 3", 0.30000000000000004},
+		{"10 - 0.5", 9.5},
+		{"2 * (1.25 + 1)", 4.5},
+		{"1e3 + 1", 1001},
+		{"7.5 % 2", 1.5},
+		{"-7.5 % 2", -1.5},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestEvalMixedComparisons(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"2 == 2.0", true},
+		{"2.0 != 2", false},
+		{"0.1 + 0.2 == 0.3", false},
+		{"1.5 > 1.5", false},
+		{"99999999999999999999 > 9223372036854775807", true},
+		{"-99999999999999999999 < 1", true},
+		{"99999999999999999999 == 99999999999999999999", true},
+		{"-99999999999999999999 < 0.5", true},
+		{"100000000000000000000 == 1e20", true},
+		{"1 <= 1", true},
+		{"1 <= 0", false},
+		{"2 >= 1", true},
+		{"1 >= 2", false},
+		{"1.5 <= 2", true},
+		{"2.0 >= 2", true},
+		{"99999999999999999999 >= 99999999999999999999", true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -138,6 +232,242 @@ func TestReturnStatements(t *testing.T) {
 	}
 }
 
+// the left operand is evaluated first (it used to be the right one)
+func TestOperandEvaluationOrder(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let order = []; let f = fn(v) { order = push(order, v); v }; f(1) + f(2); order", "[1, 2]"},
+		{"let order = []; let f = fn(v) { order = push(order, v); v }; f(1) * f(2) - f(3); order", "[1, 2, 3]"},
+		{"let x = 1; x + (x = 5)", "6"},
+		{"let x = 1; (x = 5) + x", "10"},
+		{`let f = fn() { throw "left" }; let g = fn() { throw "right" }; try { f() + g() } catch (e) { e["message"] }`, "left"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, testEval(tt.input).Inspect(), tt.input)
+	}
+}
+
+func TestLogicalExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 < 2 && 2 < 3", true},
+		{"1 > 2 || 2 > 3", false},
+		{"1 && 2", 2},
+		{"if (false) { 1 } || 5", 5},
+		{"0 || 5", 0},
+		{"false && 5", false},
+		{"if (false) { 1 } && 5", nil},
+		// the right side must not be evaluated when the left one decides the result
+		{"let x = 1; false && (x = 2); x", 1},
+		{"let x = 1; true || (x = 2); x", 1},
+		{"let x = 1; true && (x = 2); x", 2},
+		{"let x = 1; false || (x = 2); x", 2},
+		{"false && 1 + true", false},
+		{"true || 1 + true", true},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestWhileExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"let i = 0; while (i < 10) { let i = i + 1; }; i", 10},
+		{"let i = 0; while (false) { let i = i + 1; }; i", 0},
+		{"while (false) { 1 }", nil},
+		{"let i = 0; while (true) { let i = i + 1; if (i > 4) { break; } }; i", 5},
+		{`
+			let i = 0;
+			let sum = 0;
+			while (i < 10) {
+				let i = i + 1;
+				if (i > 5) { continue; }
+				let sum = sum + i;
+			}
+			sum
+		`, 15},
+		{"let f = fn() { let i = 0; while (true) { let i = i + 1; if (i == 3) { return i * 10; } } }; f()", 30},
+		{"let i = 0; while (i < 100000) { let i = i + 1; }; i", 100000},
+		// the signals go on instead of being stored in the variables
+		{"let i = 0; while (true) { let x = if (true) { break }; i = 1 }; i", 0},
+		{"let i = 0; while (i < 3) { i += 1; let x = if (true) { continue }; i = 10 }; i", 3},
+		{"let x = 0; while (true) { x = if (true) { break }; x = 2 }; x", 0},
+		{"let f = fn() { let x = if (true) { return 5 }; 1 }; f()", 5},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if expected, ok := tt.expected.(int); ok {
+			testIntegerObject(t, evaluated, int64(expected))
+		} else {
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"try { 1 } catch (e) { 2 }", 1},
+		{"try { 1 + true } catch (e) { 2 }", 2},
+		{`try { 1 + true } catch (e) { e["message"] }`, "type mismatch: INTEGER + BOOLEAN"},
+		{`try { 1 + true } catch (e) { e["kind"] }`, "ERROR"},
+		{`try { len(1) } catch (e) { e["message"] }`, "argument `value` to `len` must be STRING or ARRAY, got INTEGER"},
+		{`try { throw "boom" } catch (e) { e["message"] }`, "boom"},
+		{`try { throw "boom" } catch (e) { e["kind"] }`, "THROWN"},
+		{`try { throw 42 } catch (e) { e["value"] }`, 42},
+		{`try { throw {"message": "custom", "code": 7} } catch (e) { e["message"] + " " + e["value"]["message"] }`, "custom custom"},
+		{`try { try { throw "inner" } catch (e) { throw e } } catch (e) { e["message"] }`, "inner"},
+		{`try { 1 + true } catch (e) { e["value"] }`, nil},
+		{"let f = fn() { throw 1 }; let g = fn() { 1 + f() }; try { g() } catch (e) { len(e[\"stack\"]) }", 3},
+		{"let f = fn() { 1 + f() }; try { f() } catch (e) { e[\"kind\"] }", "STACK_OVERFLOW"},
+		{"let log = []; try { log = push(log, 1) } finally { log = push(log, 2) }; log", "[1, 2]"},
+		{"let log = []; try { try { throw 1 } finally { log = push(log, \"finally\") } } catch (e) { log = push(log, \"catch\") }; log", "[finally, catch]"},
+		{"try { 1 } finally { 2 }", 1},
+		{"try { throw 1 } catch (e) { 2 } finally { 3 }", 2},
+		{"try { 1 } finally { throw \"from finally\" }", "ERROR: 1:21: from finally"},
+		{"try { throw 1 } catch (e) { throw 2 }", "ERROR: 1:29: 2"},
+		{"try { throw 1 } finally { 2 }", "ERROR: 1:7: 1"},
+		{"let f = fn() { try { return 1 } finally { return 2 } }; f()", 2},
+		{"let f = fn() { try { return 1 } catch (e) { 2 }; 3 }; f()", 1},
+		{"let i = 0; while (true) { try { i += 1; if (i > 2) { break } } finally { i += 10 } }; i", 22},
+		{"try { 1 + true } catch (e) { 2 }; e[\"kind\"]", "ERROR"},
+		{"try {} finally {}", nil},
+		{"throw \"uncaught\"", "ERROR: 1:1: uncaught"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if err, ok := evaluated.(*object.Error); ok {
+				assert.Equal(t, expected, err.Inspect(), tt.input)
+			} else {
+				assert.Equal(t, expected, evaluated.Inspect(), tt.input)
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestTryDoesNotCatchStoppedRuns(t *testing.T) {
+	program := parser.New(lexer.New(`let log = []; try { while (true) {} } catch (e) { log = push(log, "catch") } finally { log = push(log, "finally") }`)).ParseProgram()
+	runtime := object.NewRuntime(nil, nil, nil)
+	runtime.Limits = object.Limits{MaxSteps: 1000}
+	env := object.NewEnvironmentWithRuntime(runtime)
+
+	evaluated := EvalContext(context.Background(), program, env)
+	err, ok := evaluated.(*object.Error)
+	if assert.True(t, ok) {
+		assert.Equal(t, object.STEP_LIMIT_ERROR, err.Kind)
+	}
+	log, _ := env.Get("log")
+	assert.Equal(t, "[]", log.Inspect())
+}
+
+func TestForExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"let sum = 0; for (x in [1, 2, 3]) { let sum = sum + x; }; sum", 6},
+		{"let sum = 0; for (x in []) { let sum = sum + x; }; sum", 0},
+		{"for (x in [1, 2, 3]) { x }", nil},
+		{"let sum = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { break; } let sum = sum + x; }; sum", 3},
+		{"let sum = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { continue; } let sum = sum + x; }; sum", 7},
+		{`let s = ""; for (ch in "zażółć") { let s = ch + s; }; s`, "ćłóżaz"},
+		{`let s = ""; for (k in {"b": 2, "a": 1, "c": 3}) { let s = s + k; }; s`, "abc"},
+		{`let h = {"b": 2, "a": 1}; let sum = 0; for (k in h) { let sum = sum + h[k]; }; sum`, 3},
+		{"let f = fn(xs) { for (x in xs) { if (x > 1) { return x; } } }; f([1, 5, 7])", 5},
+		{"let sum = 0; for (xs in [[1, 2], [3]]) { for (x in xs) { if (x == 2) { break; } let sum = sum + x; } }; sum", 4},
+		{"let x = 10; for (x in [1, 2]) {}; x", 2},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			assert.True(t, ok, "object is not String. got=%T (%+v)", evaluated, evaluated)
+			assert.Equal(t, expected, str.Value)
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = 2", 2},
+		{"let x = 1; let y = 1; x = y = 5; x + y", 10},
+		{"let x = 10; x += 5; x", 15},
+		{"let x = 10; x -= 5; x", 5},
+		{"let x = 10; x *= 5; x", 50},
+		{"let x = 10; x /= 5; x", 2},
+		{"let x = 1; x += 0.5; x", 1.5},
+		{`let s = "a"; s += "b"; s`, "ab"},
+		{"let x = 1; let f = fn() { x = 2 }; f(); x", 2},
+		{"let x = 1; let f = fn() { let x = 5; x = 2 }; f(); x", 1},
+		{"let counter = fn() { let n = 0; fn() { n += 1 } }(); counter(); counter(); counter()", 3},
+		{"let i = 0; let sum = 0; while (i < 5) { i += 1; sum += i; }; sum", 15},
+		{"let sum = 0; for (x in [1, 2, 3]) { sum += x }; sum", 6},
+		{"let arr = [1, 2, 3]; arr[0] = 5; arr[0] + arr[1]", 7},
+		{"let arr = [1, 2, 3]; arr[2] *= 10; arr[2]", 30},
+		{"let arr = [1, 2, 3]; let other = arr; arr[1] = 0; other[1]", 0},
+		{"let arr = [[1], [2]]; arr[1][0] = 7; arr[1][0]", 7},
+		{`let h = {"a": 1}; h["a"] = 2; h["a"]`, 2},
+		{`let h = {}; h["b"] = 3; h["b"]`, 3},
+		{`let h = {"a": 1}; h["a"] += 1; h["a"]`, 2},
+		{`let h = {}; h[1] = "one"; h[1.0]`, "one"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			testFloatObject(t, evaluated, expected)
+		case string:
+			str, ok := evaluated.(*object.String)
+			assert.True(t, ok, "object is not String. got=%T (%+v)", evaluated, evaluated)
+			assert.Equal(t, expected, str.Value)
+		}
+	}
+}
+
 func TestErrorHandling(t *testing.T) {
 	tests := []struct {
 		input           string
@@ -189,6 +519,70 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			"1 / 0",
+			"division by zero",
+		},
+		{
+			"1.5 + true",
+			"type mismatch: FLOAT + BOOLEAN",
+		},
+		{
+			"5 % 0",
+			"division by zero",
+		},
+		{
+			"true && 1 + true",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"true <= false",
+			"unknown operator: BOOLEAN <= BOOLEAN",
+		},
+		{
+			"x = 5",
+			"cannot assign to undefined variable: x",
+		},
+		{
+			"len = 5",
+			"cannot assign to undefined variable: len",
+		},
+		{
+			"let x = true; x += 1",
+			"type mismatch: BOOLEAN + INTEGER",
+		},
+		{
+			"let arr = [1]; arr[1] = 5",
+			"index out of range: 1 (length 1)",
+		},
+		{
+			"let arr = [1]; arr[-1] = 5",
+			"index out of range: -1 (length 1)",
+		},
+		{
+			`let arr = [1]; arr["0"] = 5`,
+			"array index must be INTEGER, got STRING",
+		},
+		{
+			`let s = "abc"; s[0] = "x"`,
+			"index assignment not supported: STRING",
+		},
+		{
+			`let h = {}; h[fn() {}] = 1`,
+			"unusable as hash key: FUNCTION",
+		},
+		{
+			`let h = {}; h["a"] += 1`,
+			"type mismatch: NULL + INTEGER",
+		},
+		{
+			"for (x in 5) { x }",
+			"cannot iterate over INTEGER",
+		},
+		{
+			"while (true) { 1 + true }",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
 	}
 
 	for _, tt := range tests {
@@ -199,6 +593,25 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedPosition string
+	}{
+		{"foobar", "1:1"},
+		{"let x = 1;\nlet y = x + z;", "2:13"},
+		{"let f = fn(a) {\n  a + true\n};\nf(1)", "2:3"},
+		{"len(1)", "1:1"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		assert.True(t, ok)
+		assert.Equal(t, tt.expectedPosition, errObj.Span.String())
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -245,6 +658,50 @@ func TestFunctionApplication(t *testing.T) {
 	}
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"let count = fn(n) { if (n == 0) { \"done\" } else { count(n - 1) } }; count(100000)", "done"},
+		{"let sum = fn(n, acc) { if (n == 0) { return acc }; return sum(n - 1, acc + n) }; sum(100000, 0)", 5000050000},
+		{"let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; even(100001)", false},
+		{"let f = fn(n) { while (true) { if (n == 0) { return 0 }; return f(n - 1) } }; f(100000)", 0},
+		{"let f = fn(n, g) { if (n == 0) { g() } else { f(n - 1, g) } }; f(100000, fn() { 7 })", 7},
+		{"let f = fn(n) { if (n == 0) { len([1, 2]) } else { f(n - 1) } }; f(100000)", 2},
+		{`
+			let reduce = fn(arr, initial, f) {
+				let iter = fn(arr, result) {
+					if (len(arr) == 0) { result } else { iter(rest(arr), f(result, first(arr))) }
+				};
+				iter(arr, initial)
+			};
+			let map = fn(arr, f) { reduce(arr, [], fn(acc, x) { push(acc, f(x)) }) };
+			let range = fn(n, acc) { if (n == 0) { acc } else { range(n - 1, push(acc, n)) } };
+			reduce(map(range(1000, []), fn(x) { x * 2 }), 0, fn(acc, x) { acc + x })
+		`, 1001000},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		runtime := object.NewRuntime(nil, nil, nil)
+		// tail calls don't add to the depth of the calls
+		runtime.Limits = object.Limits{MaxDepth: 10}
+		evaluated := Eval(program, object.NewEnvironmentWithRuntime(runtime))
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			str, ok := evaluated.(*object.String)
+			if assert.True(t, ok, "object is not String. got=%T (%+v)", evaluated, evaluated) {
+				assert.Equal(t, expected, str.Value)
+			}
+		}
+	}
+}
+
 func TestClosures(t *testing.T) {
 	input := `
 		let newAdder = fn(x) {
@@ -257,6 +714,48 @@ func TestClosures(t *testing.T) {
 	testIntegerObject(t, testEval(input), 4)
 }
 
+func TestResolvedVariables(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"let counter = fn() { let n = 0; fn() { n = n + 1 } }; let c = counter(); c(); c()", 2},
+		{"let f = fn(a) { let g = fn(b) { fn() { a * b } }; g(3)() }; f(2)", 6},
+		{"let f = fn(n, acc) { if (n == 0) { acc } else { let m = n - 1; f(m, acc + n) } }; f(4, 0)", 10},
+		{"let f = fn(len) { len }; f(3)", 3},
+		{"let f = fn() { for (x in [1, 2]) { let last = x }; last }; f()", 2},
+		{"let f = fn() { try { throw 5 } catch (e) { 1 }; e[\"value\"] }; f()", 5},
+		// the declaration in the branch that wasn't taken leaves the slot empty
+		{"let f = fn() { if (false) { let a = 1 }; a }; f()", "identifier not found: a"},
+		{"let f = fn() { if (false) { let a = 1 }; a = 2 }; f()", "cannot assign to undefined variable: a"},
+		{"let f = fn() { if (false) { let len = 1 }; len([1]) }; f()", 1},
+		// until then the name refers to the outer variable, as it did before the variables were resolved
+		{"let x = 1; let f = fn(c) { if (c) { let x = 2 }; x }; f(false)", 1},
+		{"let x = 1; let f = fn(c) { if (c) { let x = 2 }; x }; f(true)", 2},
+		{"let x = 1; let g = fn() { let x = x + 1; x }; g() * 10 + x", 21},
+		{"let f = fn(a) { fn() { let r = a; let a = 5; r + a } }; f(1)()", 6},
+		{"let x = 1; let f = fn() { if (false) { let x = 0 }; x = 2 }; f(); x", 2},
+		// reported before anything runs
+		{"puts(1); let f = fn() { x }", "identifier not found: x"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if message, ok := tt.expected.(string); ok {
+			errObj, ok := evaluated.(*object.Error)
+			if assert.True(t, ok, tt.input) {
+				assert.Equal(t, message, errObj.Message, tt.input)
+			}
+			continue
+		}
+		testIntegerObject(t, evaluated, int64(tt.expected.(int)))
+	}
+
+	// programs that weren't resolved look all the variables up by name
+	program := parser.New(lexer.New("let f = fn(a) { let b = a + 1; fn() { a + b } }; f(1)()")).ParseProgram()
+	testIntegerObject(t, Eval(program, object.NewEnvironment()), 3)
+}
+
 func TestStringLiteral(t *testing.T) {
 	input := `"Hello World"`
 
@@ -284,9 +783,11 @@ func TestBuilinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
+		{`len("zażółć")`, 6},
 		{`len([1, 2])`, 2},
-		{`len(1)`, "argument to `len` not supported, got INTEGER"},
-		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
+		{`len(1)`, "argument `value` to `len` must be STRING or ARRAY, got INTEGER"},
+		{`len("one", "two")`, "wrong number of arguments to `len`: got=2, want=1"},
+		{`len()`, "wrong number of arguments to `len`: got=0, want=1"},
 		// first
 		{`first([1, 2, 3])`, 1},
 		{`first([])`, nil},
@@ -299,6 +800,22 @@ func TestBuilinFunctions(t *testing.T) {
 		// push
 		{`push([1, 2, 3], 4)`, []int{1, 2, 3, 4}},
 		{`push([], 1)`, []int{1}},
+		{`push(1, 2)`, "argument `array` to `push` must be ARRAY, got INTEGER"},
+		{`push([])`, "wrong number of arguments to `push`: got=1, want=2"},
+		// int
+		{`int(3.99)`, 3},
+		{`int(-3.99)`, -3},
+		{`int(5)`, 5},
+		{`int(" 42 ")`, 42},
+		{`int("4.2")`, `cannot convert "4.2" to INTEGER`},
+		{`int(true)`, "argument `value` to `int` must be INTEGER, FLOAT or STRING, got BOOLEAN"},
+		// float
+		{`float(2)`, 2.0},
+		{`float(2.5)`, 2.5},
+		{`float("1e-3")`, 0.001},
+		{`float("abc")`, `cannot convert "abc" to FLOAT`},
+		// readline
+		{`readline(1)`, "wrong number of arguments to `readline`: got=1, want=0"},
 	}
 
 	for _, tt := range tests {
@@ -307,6 +824,8 @@ func TestBuilinFunctions(t *testing.T) {
 		switch expected := tt.expected.(type) {
 		case int:
 			testIntegerObject(t, evaluated, int64(expected))
+		case float64:
+			testFloatObject(t, evaluated, expected)
 		case string:
 			errObj, ok := evaluated.(*object.Error)
 			assert.True(t, ok)
@@ -428,7 +947,8 @@ func TestHashLiterals(t *testing.T) {
 		"thr" + "ee": 6 / 2,
 		4: 4,
 		true: 5,
-		false: 6
+		false: 6,
+		1.5: 7
 	}`
 
 	evaluated := testEval(input)
@@ -440,6 +960,7 @@ func TestHashLiterals(t *testing.T) {
 		(&object.String{Value: "two"}).HashKey():   2,
 		(&object.String{Value: "three"}).HashKey(): 3,
 		(&object.Integer{Value: 4}).HashKey():      4,
+		(&object.Float{Value: 1.5}).HashKey():      7,
 		TRUE.HashKey():                             5,
 		FALSE.HashKey():                            6,
 	}
@@ -485,6 +1006,18 @@ func TestHashIndexExpressions(t *testing.T) {
 			`{false: 5}[false]`,
 			5,
 		},
+		{
+			`{1.5: 5}[1.5]`,
+			5,
+		},
+		{
+			`{2: 5}[2.0]`,
+			5,
+		},
+		{
+			`{99999999999999999999: 5}[99999999999999999998 + 1]`,
+			5,
+		},
 	}
 
 	for _, tt := range tests {
@@ -503,6 +1036,9 @@ func testEval(input string) object.Object {
 	p := parser.New(l)
 	program := p.ParseProgram()
 	env := object.NewEnvironment()
+	if diagnostics := Resolve(program, env); len(diagnostics) > 0 {
+		return &object.Error{Message: diagnostics[0].Message, Span: diagnostics[0].Span}
+	}
 	return Eval(program, env)
 }
 
@@ -512,6 +1048,12 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) {
 	assert.Equal(t, result.Value, expected)
 }
 
+func testFloatObject(t *testing.T, obj object.Object, expected float64) {
+	result, ok := obj.(*object.Float)
+	assert.True(t, ok)
+	assert.Equal(t, result.Value, expected)
+}
+
 func testBooleanObject(t *testing.T, obj object.Object, expected bool) {
 	result, ok := obj.(*object.Boolean)
 	assert.True(t, ok)
@@ -521,3 +1063,161 @@ func testBooleanObject(t *testing.T, obj object.Object, expected bool) {
 func testNullObject(t *testing.T, obj object.Object) {
 	assert.Equal(t, obj, NULL)
 }
+
+func TestBuiltinIO(t *testing.T) {
+	tests := []struct {
+		input          string
+		stdin          string
+		expected       any
+		expectedStdout string
+	}{
+		{`puts("hello", 1, [true])`, "", nil, "hello\n1\n[true]\n"},
+		{`let f = fn(x) { puts(x) }; f("from a function")`, "", nil, "from a function\n"},
+		{`readline()`, "first\r\nsecond", "first", ""},
+		{`readline(); readline()`, "first\nsecond", "second", ""},
+		{`readline(); readline()`, "only\n", nil, ""},
+		{`let sum = 0; let line = readline(); while (line) { sum += int(line); line = readline() }; sum`, "1\n2\n3\n", 6, ""},
+	}
+
+	for _, tt := range tests {
+		var stdout bytes.Buffer
+		l := lexer.New(tt.input)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		env := object.NewEnvironmentWithRuntime(object.NewRuntime(strings.NewReader(tt.stdin), &stdout, nil))
+
+		evaluated := Eval(program, env)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			assert.True(t, ok, "object is not String. got=%T (%+v)", evaluated, evaluated)
+			assert.Equal(t, expected, str.Value)
+		default:
+			testNullObject(t, evaluated)
+		}
+		assert.Equal(t, tt.expectedStdout, stdout.String(), tt.input)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelExpired()
+
+	tests := []struct {
+		input           string
+		ctx             context.Context
+		limits          object.Limits
+		expectedKind    object.ErrorKind
+		expectedMessage string
+	}{
+		{"let f = fn() { 1 + f() }; f()", context.Background(), object.Limits{}, object.STACK_OVERFLOW_ERROR, "stack overflow: maximum call depth of 10000 exceeded"},
+		{"let f = fn(n) { if (n > 0) { 1 + f(n - 1) } }; f(5)", context.Background(), object.Limits{MaxDepth: 5}, object.STACK_OVERFLOW_ERROR, "stack overflow: maximum call depth of 5 exceeded"},
+		{"while (true) {}", context.Background(), object.Limits{MaxSteps: 1000}, object.STEP_LIMIT_ERROR, "step limit of 1000 exceeded"},
+		{"while (true) {}", expired, object.Limits{}, object.TIMEOUT_ERROR, "evaluation timed out"},
+		{"1 + 2", cancelled, object.Limits{}, object.CANCELLED_ERROR, "evaluation cancelled"},
+		{`let s = "abc"; while (true) { s += s }`, context.Background(), object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR, "memory limit of 1048576 bytes exceeded"},
+		{"let a = []; while (true) { a = push(a, 1) }", context.Background(), object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR, "memory limit of 1048576 bytes exceeded"},
+		{"let h = {}; let i = 0; while (true) { h[i] = i; i += 1 }", context.Background(), object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR, "memory limit of 1048576 bytes exceeded"},
+		{`for (c in "a long string") { [c, c, c] }`, context.Background(), object.Limits{MaxMemory: 500}, object.MEMORY_LIMIT_ERROR, "memory limit of 500 bytes exceeded"},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		runtime := object.NewRuntime(nil, nil, nil)
+		runtime.Limits = tt.limits
+		env := object.NewEnvironmentWithRuntime(runtime)
+
+		evaluated := EvalContext(tt.ctx, program, env)
+		err, ok := evaluated.(*object.Error)
+		if assert.True(t, ok, "no error object returned for %s. got=%T(%+v)", tt.input, evaluated, evaluated) {
+			assert.Equal(t, tt.expectedKind, err.Kind, tt.input)
+			assert.Contains(t, err.Message, tt.expectedMessage, tt.input)
+		}
+	}
+}
+
+func TestLimitsApplyToEachRun(t *testing.T) {
+	runtime := object.NewRuntime(nil, nil, nil)
+	runtime.Limits = object.Limits{MaxSteps: 200, MaxDepth: 10}
+	env := object.NewEnvironmentWithRuntime(runtime)
+	define := parser.New(lexer.New("let f = fn(n) { if (n > 0) { 0 + f(n - 1) } else { n } }")).ParseProgram()
+	call := parser.New(lexer.New("f(5)")).ParseProgram()
+	overflow := parser.New(lexer.New("f(20)")).ParseProgram()
+
+	EvalContext(context.Background(), define, env)
+	// the failed run leaves neither the call depth nor the steps behind
+	assert.Equal(t, object.STACK_OVERFLOW_ERROR, EvalContext(context.Background(), overflow, env).(*object.Error).Kind)
+	for i := 0; i < 5; i++ {
+		testIntegerObject(t, EvalContext(context.Background(), call, env), 0)
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"1 + 2", 0},
+		{`"abc" + "def"`, object.StringSize(3)*2 + object.StringSize(6)},
+		{"[1, 2, 3]", object.ArraySize(3)},
+		{"push([1], 2)", object.ArraySize(1) + object.ArraySize(2)},
+		{`let h = {"a": 1}; h["a"] = 2; h["b"] = 3`, object.StringSize(1)*3 + object.HashSize(1) + object.PairSize},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		env := object.NewEnvironmentWithRuntime(object.NewRuntime(nil, nil, nil))
+		EvalContext(context.Background(), program, env)
+		assert.Equal(t, tt.expected, env.Runtime().Usage().Memory, tt.input)
+	}
+}
+
+func TestErrorStack(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string // frames as function name, "builtin" for builtins and the call site
+	}{
+		{"1 + true", nil},
+		{
+			"let add = fn(a, b) { a + b };\nlet twice = fn(x) { add(x, true) };\ntwice(1)",
+			[]string{"add 2:21", "twice 3:1"},
+		},
+		{"let f = fn() { len(1) };\n[f][0]()", []string{"len builtin 1:16", "f 2:1"}},
+		{"fn() { 1 + true }()", []string{" 1:1"}},
+		{
+			"let h = fn() { 1 + true };\nlet g = fn() { h() };\nlet f = fn() { g() };\nf()",
+			[]string{"h 2:16", "g 3:16", "f 4:1"},
+		},
+		{
+			"let h = fn() { 1 + true };\nlet g = fn() { h() };\nlet k = fn() { g() };\nlet f = fn() { k() };\nf()",
+			[]string{"h 2:16", "g 4:16 elided", "f 5:1"},
+		},
+		// errors raised before the body starts are the caller's
+		{"let f = fn(a) { a };\nf()", nil},
+		{"let g = fn(a) { a };\nlet f = fn() { g() };\nf()", []string{"f 3:1"}},
+	}
+
+	for _, tt := range tests {
+		err, ok := testEval(tt.input).(*object.Error)
+		if !assert.True(t, ok, tt.input) {
+			continue
+		}
+		var frames []string
+		for _, frame := range err.Stack {
+			description := frame.Function
+			if frame.Builtin {
+				description += " builtin"
+			}
+			description += " " + frame.CallSite.Start.String()
+			if frame.Elided {
+				description += " elided"
+			}
+			frames = append(frames, description)
+		}
+		assert.Equal(t, tt.expected, frames, tt.input)
+	}
+}
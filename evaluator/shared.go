@@ -0,0 +1,39 @@
+package evaluator
+
+import "kjarmicki.github.com/monkey/object"
+
+// semantics of the operations shared with the bytecode vm, so that both give the same results
+
+func InfixOperation(rt *object.Runtime, operator string, left, right object.Object) object.Object {
+	return evalInfixExpression(rt, operator, left, right)
+}
+
+func PrefixOperation(operator string, right object.Object) object.Object {
+	return evalPrefixExpression(operator, right)
+}
+
+func IndexOperation(left, index object.Object) object.Object {
+	return evalIndexExpression(left, index)
+}
+
+func IndexAssignment(rt *object.Runtime, left, index, val object.Object) object.Object {
+	return evalIndexAssignment(rt, left, index, val)
+}
+
+func IsTruthy(obj object.Object) bool {
+	return isTruthy(obj)
+}
+
+func IterationItems(rt *object.Runtime, iterable object.Object) ([]object.Object, *object.Error) {
+	return iterationItems(rt, iterable)
+}
+
+// hash the catch block gets for the error
+func CaughtError(rt *object.Runtime, err *object.Error) object.Object {
+	return caughtError(rt, err)
+}
+
+// error raised by throw with the value
+func ThrownError(value object.Object) *object.Error {
+	return newThrownError(value)
+}
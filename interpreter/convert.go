@@ -0,0 +1,530 @@
+package interpreter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/object"
+)
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	runtimeType = reflect.TypeOf(&object.Runtime{})
+	bigType     = reflect.TypeOf(&big.Int{})
+)
+
+/*
+ * Converts the Go value to a Monkey object:
+ *
+ *	nil                              null
+ *	bool                             boolean
+ *	int, int8 ... uint64, *big.Int   integer
+ *	float32, float64                 float
+ *	string                           string
+ *	slices and arrays                array, elements converted recursively
+ *	maps                             hash, keys have to convert to strings, integers, floats or booleans
+ *	functions                        builtin, see below
+ *	object.Object                    left as is
+ *
+ * Functions get their arguments converted to the types of their parameters (ToGo for interface parameters,
+ * parameters of object types get the objects as they are, function parameters get Go functions calling the Monkey
+ * functions) and may take *object.Runtime as the first parameter to do I/O. They may return nothing, a value, an error or a value and an error; a non-nil error becomes a Monkey error.
+ * The number and types of the arguments are checked against a signature derived from the parameters.
+ */
+func ToObject(value any) (object.Object, error) {
+	switch value := value.(type) {
+	case nil:
+		return evaluator.NULL, nil
+	case object.Object:
+		return value, nil
+	case bool:
+		if value {
+			return evaluator.TRUE, nil
+		}
+		return evaluator.FALSE, nil
+	case string:
+		return &object.String{Value: value}, nil
+	case *big.Int:
+		if value == nil {
+			return evaluator.NULL, nil
+		}
+		return object.NewBigInteger(value), nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return object.NewBigInteger(new(big.Int).SetUint64(v.Uint())), nil
+		}
+		return &object.Integer{Value: int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: v.Float()}, nil
+	case reflect.String:
+		return &object.String{Value: v.String()}, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return evaluator.NULL, nil
+		}
+		elements := make([]object.Object, v.Len())
+		for i := range elements {
+			element, err := ToObject(v.Index(i).Interface())
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+			elements[i] = element
+		}
+		return &object.Array{Elements: elements}, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return evaluator.NULL, nil
+		}
+		pairs := make(map[object.HashKey]object.HashPair, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := ToObject(iter.Key().Interface())
+			if err != nil {
+				return nil, fmt.Errorf("key %v: %w", iter.Key(), err)
+			}
+			hashable, ok := key.(object.Hashable)
+			if !ok {
+				return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			}
+			val, err := ToObject(iter.Value().Interface())
+			if err != nil {
+				return nil, fmt.Errorf("value of %v: %w", iter.Key(), err)
+			}
+			pairs[hashable.HashKey()] = object.HashPair{Key: key, Value: val}
+		}
+		return &object.Hash{Pairs: pairs}, nil
+	case reflect.Func:
+		if v.IsNil() {
+			return evaluator.NULL, nil
+		}
+		return wrapFunc("", v)
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return evaluator.NULL, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %T to a Monkey value", value)
+}
+
+/*
+ * Converts the Monkey object to a Go value:
+ *
+ *	null                  nil
+ *	boolean               bool
+ *	integer               int64, *big.Int when it doesn't fit
+ *	float                 float64
+ *	string                string
+ *	array                 []any
+ *	hash                  map[string]any, keys other than strings are turned into strings the way Monkey prints them
+ *	function, builtin     func(args ...any) (any, error), arguments are converted by ToObject
+ *
+ * Anything else (e.g. an error) is returned as is. Arrays and hashes containing themselves become slices and maps
+ * containing themselves. The builtins run with the runtime connected to the standard streams of the process,
+ * Interpreter.ToGo gives them the interpreter's one.
+ */
+func ToGo(obj object.Object) any {
+	return toGo(obj, object.DefaultRuntime(), map[object.Object]any{})
+}
+
+// rt is the runtime of the converted builtins, converted are the arrays and hashes already converted
+// (or being converted), so that the cycles are kept
+func toGo(obj object.Object, rt *object.Runtime, converted map[object.Object]any) any {
+	if value, ok := converted[obj]; ok {
+		return value
+	}
+	switch obj := obj.(type) {
+	case *object.Null:
+		return nil
+	case *object.Boolean:
+		return obj.Value
+	case *object.Integer:
+		if obj.IsBig() {
+			return obj.Big
+		}
+		return obj.Value
+	case *object.Float:
+		return obj.Value
+	case *object.String:
+		return obj.Value
+	case *object.Array:
+		elements := make([]any, len(obj.Elements))
+		converted[obj] = elements
+		for i, element := range obj.Elements {
+			elements[i] = toGo(element, rt, converted)
+		}
+		return elements
+	case *object.Hash:
+		pairs := make(map[string]any, len(obj.Pairs))
+		converted[obj] = pairs
+		for _, pair := range obj.Pairs {
+			key := pair.Key.Inspect()
+			if str, ok := pair.Key.(*object.String); ok {
+				key = str.Value
+			}
+			pairs[key] = toGo(pair.Value, rt, converted)
+		}
+		return pairs
+	case *object.Function, *object.Builtin:
+		return callable(obj, rt)
+	}
+	return obj
+}
+
+// Go function calling the Monkey function, rt is the runtime of the builtins
+func callable(fn object.Object, rt *object.Runtime) func(args ...any) (any, error) {
+	env := callEnvironment(fn, rt)
+	return func(args ...any) (any, error) {
+		objects, err := toObjects(args)
+		if err != nil {
+			return nil, err
+		}
+		res, err := result(evaluator.Apply(context.Background(), fn, objects, env))
+		if err != nil {
+			return nil, err
+		}
+		return toGo(res, rt, map[object.Object]any{}), nil
+	}
+}
+
+// environment to apply the function in, the functions run with the runtime of the environment they were defined in
+func callEnvironment(fn object.Object, rt *object.Runtime) *object.Environment {
+	if function, ok := fn.(*object.Function); ok {
+		return function.Env
+	}
+	return object.NewEnvironmentWithRuntime(rt)
+}
+
+// panicked with by the Go functions calling the Monkey functions (see goFunc) which have no error result to return
+// the error with, the builtin that got the function turns it back into the error
+type callbackError struct {
+	err *object.Error
+}
+
+/*
+ * Go function of the type calling the Monkey function, the arguments are converted by ToObject and the result
+ * by toGoValue. Errors are returned as the error result, the functions without one panic with them, so that
+ * the error still reaches the Monkey code that called the builtin.
+ */
+func goFunc(fn object.Object, t reflect.Type, rt *object.Runtime) (reflect.Value, error) {
+	if t.NumOut() > 2 || t.NumOut() == 2 && t.Out(1) != errorType {
+		return reflect.Value{}, fmt.Errorf("cannot use %s as %s, it can return at most a value and an error", fn.Type(), t)
+	}
+	withError := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+	withValue := t.NumOut() > 0 && t.Out(0) != errorType
+	env := callEnvironment(fn, rt)
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		if t.IsVariadic() {
+			variadic := in[len(in)-1]
+			in = in[:len(in)-1]
+			for i := 0; i < variadic.Len(); i++ {
+				in = append(in, variadic.Index(i))
+			}
+		}
+		args := make([]any, len(in))
+		for i, arg := range in {
+			args[i] = arg.Interface()
+		}
+
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		res := object.Object(evaluator.NULL)
+		objects, err := toObjects(args)
+		if err != nil {
+			res = &object.Error{Message: err.Error()}
+		} else if applied := evaluator.Apply(context.Background(), fn, objects, env); applied != nil {
+			res = applied
+		}
+		if _, failed := res.(*object.Error); !failed && withValue {
+			if value, err := toGoValue(res, t.Out(0), rt); err != nil {
+				res = &object.Error{Message: fmt.Sprintf("result: %s", err)}
+			} else {
+				out[0] = value
+			}
+		}
+		if monkeyErr, ok := res.(*object.Error); ok {
+			if !withError {
+				panic(callbackError{err: monkeyErr})
+			}
+			_, err := result(monkeyErr)
+			out[len(out)-1] = reflect.ValueOf(&err).Elem()
+		}
+		return out
+	}), nil
+}
+
+func toObjects(values []any) ([]object.Object, error) {
+	objects := make([]object.Object, len(values))
+	for i, value := range values {
+		obj, err := ToObject(value)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		objects[i] = obj
+	}
+	return objects, nil
+}
+
+// builtin calling the Go function, name is used in the error messages when known
+func wrapFunc(name string, fn reflect.Value) (*object.Builtin, error) {
+	switch f := fn.Interface().(type) {
+	case object.BuiltinFunction:
+		return &object.Builtin{Fn: f, Name: name}, nil
+	case func(*object.Runtime, ...object.Object) object.Object:
+		return &object.Builtin{Fn: f, Name: name}, nil
+	}
+
+	t := fn.Type()
+	switch {
+	case t.NumOut() > 2:
+		return nil, fmt.Errorf("function can return at most a value and an error, got %s", t)
+	case t.NumOut() == 2 && t.Out(1) != errorType:
+		return nil, fmt.Errorf("second result of the function has to be an error, got %s", t)
+	}
+
+	params := make([]reflect.Type, t.NumIn())
+	for i := range params {
+		params[i] = t.In(i)
+	}
+	withRuntime := len(params) > 0 && params[0] == runtimeType
+	if withRuntime {
+		params = params[1:]
+	}
+	var variadic reflect.Type
+	if t.IsVariadic() {
+		variadic = params[len(params)-1].Elem()
+		params = params[:len(params)-1]
+	}
+
+	signature := &object.Signature{Params: make([]object.Param, len(params)), Returns: returns(t)}
+	for i, param := range params {
+		signature.Params[i] = object.Param{Name: fmt.Sprintf("arg%d", i+1), Types: acceptedTypes(param)}
+	}
+	if variadic != nil {
+		signature.Params = append(signature.Params, object.Param{Name: "args", Types: acceptedTypes(variadic), Variadic: true})
+	}
+
+	// named like in the errors of the signature
+	describe := func(i int) string {
+		param := signature.Params[len(signature.Params)-1]
+		if i < len(params) {
+			param = signature.Params[i]
+		}
+		if name == "" {
+			return fmt.Sprintf("argument `%s`", param.Name)
+		}
+		return fmt.Sprintf("argument `%s` to `%s`", param.Name, name)
+	}
+
+	// the signature takes care of the number and types of the arguments, the conversion can still fail
+	// on the values themselves, e.g. when they are out of range
+	return &object.Builtin{Name: name, Signature: signature, Fn: func(rt *object.Runtime, args ...object.Object) (res object.Object) {
+		defer func() {
+			if r := recover(); r != nil {
+				callback, ok := r.(callbackError)
+				if !ok {
+					panic(r)
+				}
+				res = callback.err
+			}
+		}()
+		in := make([]reflect.Value, 0, len(args)+1)
+		if withRuntime {
+			in = append(in, reflect.ValueOf(rt))
+		}
+		for i, arg := range args {
+			paramType := variadic
+			if i < len(params) {
+				paramType = params[i]
+			}
+			value, err := toGoValue(arg, paramType, rt)
+			if err != nil {
+				return &object.Error{Message: fmt.Sprintf("%s: %s", describe(i), err)}
+			}
+			in = append(in, value)
+		}
+		return fromResults(fn.Call(in))
+	}}, nil
+}
+
+// Monkey types toGoValue can convert to the Go type, nil when it can be anything
+func acceptedTypes(t reflect.Type) []object.ObjectType {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return []object.ObjectType{object.INTEGER_OBJ}
+	case reflect.Float32, reflect.Float64:
+		return []object.ObjectType{object.INTEGER_OBJ, object.FLOAT_OBJ}
+	case reflect.String:
+		return []object.ObjectType{object.STRING_OBJ}
+	case reflect.Bool:
+		return []object.ObjectType{object.BOOLEAN_OBJ}
+	case reflect.Slice:
+		return []object.ObjectType{object.ARRAY_OBJ, object.NULL_OBJ}
+	case reflect.Map:
+		return []object.ObjectType{object.HASH_OBJ, object.NULL_OBJ}
+	case reflect.Func:
+		return []object.ObjectType{object.FUNCTION_OBJ, object.BUILTIN_OBJ, object.NULL_OBJ}
+	case reflect.Pointer:
+		if t == bigType {
+			return []object.ObjectType{object.INTEGER_OBJ, object.NULL_OBJ}
+		}
+	}
+	return nil
+}
+
+// what the Go function returns, for the help text, empty when it can be anything
+func returns(t reflect.Type) string {
+	if t.NumOut() == 0 || t.Out(0) == errorType {
+		return string(object.NULL_OBJ)
+	}
+	switch out := t.Out(0); out.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return string(object.INTEGER_OBJ)
+	case reflect.Float32, reflect.Float64:
+		return string(object.FLOAT_OBJ)
+	case reflect.String:
+		return string(object.STRING_OBJ)
+	case reflect.Bool:
+		return string(object.BOOLEAN_OBJ)
+	case reflect.Slice, reflect.Array:
+		return string(object.ARRAY_OBJ)
+	case reflect.Map:
+		return string(object.HASH_OBJ)
+	case reflect.Func:
+		return string(object.BUILTIN_OBJ)
+	case reflect.Pointer:
+		if out == bigType {
+			return string(object.INTEGER_OBJ)
+		}
+	}
+	return ""
+}
+
+func fromResults(out []reflect.Value) object.Object {
+	if len(out) > 0 && out[len(out)-1].Type() == errorType {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return &object.Error{Message: err.Error()}
+		}
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return evaluator.NULL
+	}
+	obj, err := ToObject(out[0].Interface())
+	if err != nil {
+		return &object.Error{Message: fmt.Sprintf("result: %s", err)}
+	}
+	return obj
+}
+
+var errOverflow = errors.New("value out of range")
+
+// converts the object to a Go value of the given type, rt is the runtime of the converted builtins
+func toGoValue(obj object.Object, t reflect.Type, rt *object.Runtime) (reflect.Value, error) {
+	if obj == evaluator.NULL {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Slice, reflect.Map, reflect.Func:
+			return reflect.Zero(t), nil
+		}
+	}
+	// any gets the plain Go value, object types (including the Object interface) get the object itself
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		return reflect.ValueOf(toGo(obj, rt, map[object.Object]any{})), nil
+	}
+	if reflect.TypeOf(obj).AssignableTo(t) {
+		return reflect.ValueOf(obj), nil
+	}
+
+	value := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if integer, ok := obj.(*object.Integer); ok {
+			if integer.IsBig() || value.OverflowInt(integer.Value) {
+				return value, errOverflow
+			}
+			value.SetInt(integer.Value)
+			return value, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if integer, ok := obj.(*object.Integer); ok {
+			n := integer.BigValue()
+			if !n.IsUint64() || value.OverflowUint(n.Uint64()) {
+				return value, errOverflow
+			}
+			value.SetUint(n.Uint64())
+			return value, nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch number := obj.(type) {
+		case *object.Float:
+			value.SetFloat(number.Value)
+			return value, nil
+		case *object.Integer:
+			f, _ := new(big.Float).SetInt(number.BigValue()).Float64()
+			value.SetFloat(f)
+			return value, nil
+		}
+	case reflect.String:
+		if str, ok := obj.(*object.String); ok {
+			value.SetString(str.Value)
+			return value, nil
+		}
+	case reflect.Bool:
+		if boolean, ok := obj.(*object.Boolean); ok {
+			value.SetBool(boolean.Value)
+			return value, nil
+		}
+	case reflect.Pointer:
+		if integer, ok := obj.(*object.Integer); ok && t == bigType {
+			return reflect.ValueOf(integer.BigValue()), nil
+		}
+	case reflect.Slice:
+		if arr, ok := obj.(*object.Array); ok {
+			value = reflect.MakeSlice(t, len(arr.Elements), len(arr.Elements))
+			for i, element := range arr.Elements {
+				converted, err := toGoValue(element, t.Elem(), rt)
+				if err != nil {
+					return value, fmt.Errorf("element %d: %w", i, err)
+				}
+				value.Index(i).Set(converted)
+			}
+			return value, nil
+		}
+	case reflect.Func:
+		switch obj.(type) {
+		case *object.Function, *object.Builtin:
+			return goFunc(obj, t, rt)
+		}
+	case reflect.Map:
+		if hash, ok := obj.(*object.Hash); ok {
+			value = reflect.MakeMapWithSize(t, len(hash.Pairs))
+			for _, pair := range hash.SortedPairs() {
+				key, err := toGoValue(pair.Key, t.Key(), rt)
+				if err != nil {
+					return value, fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+				}
+				val, err := toGoValue(pair.Value, t.Elem(), rt)
+				if err != nil {
+					return value, fmt.Errorf("value of %s: %w", pair.Key.Inspect(), err)
+				}
+				value.SetMapIndex(key, val)
+			}
+			return value, nil
+		}
+	}
+	return value, fmt.Errorf("cannot use %s as %s", obj.Type(), t)
+}
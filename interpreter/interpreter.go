@@ -0,0 +1,193 @@
+package interpreter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"kjarmicki.github.com/monkey/diagnostic"
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/lexer"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/parser"
+	"kjarmicki.github.com/monkey/token"
+)
+
+/*
+ * Interpreter embeddable in Go applications. All the code run by one interpreter shares its global environment,
+ * so the host can define globals and functions, run scripts that use them and then call back into the functions
+ * the scripts defined:
+ *
+ *	interp := interpreter.New(interpreter.Options{Stdout: &out})
+ *	interp.Register("greet", func(name string) string { return "hello " + name })
+ *	interp.Run(ctx, `let twice = fn(x) { x * 2 }; puts(greet("monkey"))`)
+ *	result, err := interp.Call("twice", 21)
+ */
+type Interpreter struct {
+	env *object.Environment
+}
+
+type Options struct {
+	Stdin  io.Reader // where readline() reads from, defaults to the standard input of the process
+	Stdout io.Writer // where puts() writes to, defaults to the standard output of the process
+	Stderr io.Writer // defaults to the standard error of the process
+	Limits object.Limits
+}
+
+// returned by Run when the source couldn't be parsed or resolved (e.g. it uses undefined variables)
+type SyntaxError struct {
+	Source      string
+	Diagnostics []*diagnostic.Diagnostic
+}
+
+func (e *SyntaxError) Error() string {
+	messages := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		messages[i] = d.String()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// returned when the evaluation results in a Monkey error
+type RuntimeError struct {
+	Message string
+	Span    token.Span       // where the error happened, if known
+	Kind    object.ErrorKind // set when the evaluation was stopped by the context or the limits
+	Stack   []object.Frame   // calls the error propagated out of, the innermost first
+	Value   object.Object    // value given to throw, nil for the errors raised by the interpreter itself
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Span.IsValid() {
+		return fmt.Sprintf("%s: %s", e.Span.Start, e.Message)
+	}
+	return e.Message
+}
+
+// traceback of the error, see object.Error.StackTrace
+func (e *RuntimeError) StackTrace() []string {
+	return (&object.Error{Message: e.Message, Span: e.Span, Stack: e.Stack}).StackTrace()
+}
+
+// errors stopped by the context unwrap to the context errors, so they can be checked with errors.Is
+func (e *RuntimeError) Unwrap() error {
+	switch e.Kind {
+	case object.TIMEOUT_ERROR:
+		return context.DeadlineExceeded
+	case object.CANCELLED_ERROR:
+		return context.Canceled
+	}
+	return nil
+}
+
+func New(options Options) *Interpreter {
+	stdin, stdout, stderr := options.Stdin, options.Stdout, options.Stderr
+	if stdin == nil {
+		stdin = os.Stdin
+	}
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	runtime := object.NewRuntime(stdin, stdout, stderr)
+	runtime.Limits = options.Limits
+	return &Interpreter{env: object.NewEnvironmentWithRuntime(runtime)}
+}
+
+// parses and evaluates the source in the global environment and returns the value of the last statement.
+// The evaluation is stopped with a RuntimeError once the context is done or one of the limits is exceeded.
+func (i *Interpreter) Run(ctx context.Context, source string) (object.Object, error) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if errors := p.Errors(); len(errors) > 0 {
+		return nil, &SyntaxError{Source: source, Diagnostics: errors}
+	}
+	if diagnostics := evaluator.Resolve(program, i.env); len(diagnostics) > 0 {
+		return nil, &SyntaxError{Source: source, Diagnostics: diagnostics}
+	}
+	return result(evaluator.EvalContext(ctx, program, i.env))
+}
+
+// calls the global function (a Monkey function or a builtin) with the arguments converted by ToObject
+func (i *Interpreter) Call(fnName string, args ...any) (object.Object, error) {
+	return i.CallContext(context.Background(), fnName, args...)
+}
+
+// like Call, but the call is stopped once the context is done
+func (i *Interpreter) CallContext(ctx context.Context, fnName string, args ...any) (object.Object, error) {
+	fn, ok := i.env.Get(fnName)
+	if !ok {
+		builtin, ok := evaluator.LookupBuiltin(fnName)
+		if !ok {
+			return nil, fmt.Errorf("undefined function: %s", fnName)
+		}
+		fn = builtin
+	}
+	if fn.Type() != object.FUNCTION_OBJ && fn.Type() != object.BUILTIN_OBJ {
+		return nil, fmt.Errorf("not a function: %s is %s", fnName, fn.Type())
+	}
+	objects, err := toObjects(args)
+	if err != nil {
+		return nil, fmt.Errorf("calling %s: %w", fnName, err)
+	}
+	return result(evaluator.Apply(ctx, fn, objects, i.env))
+}
+
+// defines the global, the value is converted by ToObject
+func (i *Interpreter) Set(name string, value any) error {
+	obj, err := ToObject(value)
+	if err != nil {
+		return fmt.Errorf("setting %s: %w", name, err)
+	}
+	i.env.Set(name, obj)
+	return nil
+}
+
+func (i *Interpreter) Get(name string) (object.Object, bool) {
+	return i.env.Get(name)
+}
+
+// makes the Go function callable from Monkey code under the given name, see ToObject for how it's wrapped.
+// Unlike Set, the function's name shows up in the errors about its arguments.
+func (i *Interpreter) Register(name string, fn any) error {
+	value := reflect.ValueOf(fn)
+	if value.Kind() != reflect.Func || value.IsNil() {
+		return fmt.Errorf("registering %s: expected a function, got %T", name, fn)
+	}
+	builtin, err := wrapFunc(name, value)
+	if err != nil {
+		return fmt.Errorf("registering %s: %w", name, err)
+	}
+	i.env.Set(name, builtin)
+	return nil
+}
+
+// like the package's ToGo, but the builtins run with the interpreter's runtime (its streams and limits)
+func (i *Interpreter) ToGo(obj object.Object) any {
+	return toGo(obj, i.env.Runtime(), map[object.Object]any{})
+}
+
+func (i *Interpreter) Limits() object.Limits {
+	return i.env.Runtime().Limits
+}
+
+// resources used by the current run, or by the last one when none is in progress
+func (i *Interpreter) Usage() object.Usage {
+	return i.env.Runtime().Usage()
+}
+
+// turns Monkey errors into Go errors, an empty program results in null
+func result(obj object.Object) (object.Object, error) {
+	if obj == nil {
+		return evaluator.NULL, nil
+	}
+	if err, ok := obj.(*object.Error); ok {
+		return nil, &RuntimeError{Message: err.Message, Span: err.Span, Kind: err.Kind, Stack: err.Stack, Value: err.Value}
+	}
+	return obj, nil
+}
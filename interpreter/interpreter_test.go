@@ -0,0 +1,360 @@
+package interpreter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/object"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		input         string
+		expected      any
+		expectedError string
+	}{
+		{"1 + 2", int64(3), ""},
+		{"", nil, ""},
+		{`let a = [1, "two", {"three": 3.0}]; a`, []any{int64(1), "two", map[string]any{"three": 3.0}}, ""},
+		{"let x = ;", nil, "1:9: error[E0002]: no prefix parse function for ; found"},
+		{"1 + true", nil, "1:1: type mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		interp := New(Options{})
+		result, err := interp.Run(context.Background(), tt.input)
+		if tt.expectedError != "" {
+			assert.EqualError(t, err, tt.expectedError, tt.input)
+			continue
+		}
+		assert.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expected, ToGo(result), tt.input)
+	}
+}
+
+func TestRunErrorTypes(t *testing.T) {
+	interp := New(Options{})
+
+	_, err := interp.Run(context.Background(), "let = 1")
+	var syntaxErr *SyntaxError
+	assert.True(t, errors.As(err, &syntaxErr))
+
+	// undefined variables are reported before anything runs
+	_, err = interp.Run(context.Background(), `puts("a"); unknown`)
+	assert.True(t, errors.As(err, &syntaxErr))
+	assert.Equal(t, "identifier not found: unknown", syntaxErr.Diagnostics[0].Message)
+
+	_, err = interp.Run(context.Background(), "1 + true")
+	var runtimeErr *RuntimeError
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, "type mismatch: INTEGER + BOOLEAN", runtimeErr.Message)
+
+	_, err = interp.Run(context.Background(), "let f = fn() { g() }; let g = fn() { 1 + true }")
+	assert.NoError(t, err)
+	_, err = interp.Call("f")
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, []string{"at g (1:38)", "at f (1:16)"}, runtimeErr.StackTrace())
+
+	_, err = interp.Run(context.Background(), `throw {"code": 3}`)
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, map[string]any{"code": int64(3)}, ToGo(runtimeErr.Value))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = interp.Run(ctx, "1")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestLimits(t *testing.T) {
+	interp := New(Options{Limits: object.Limits{MaxSteps: 10000, MaxDepth: 50}})
+	_, err := interp.Run(context.Background(), "let loop = fn() { while (true) {} }; let recurse = fn(n) { 1 + recurse(n + 1) }")
+	assert.NoError(t, err)
+
+	var runtimeErr *RuntimeError
+	_, err = interp.Call("loop")
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, object.STEP_LIMIT_ERROR, runtimeErr.Kind)
+
+	_, err = interp.Call("recurse", 0)
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, object.STACK_OVERFLOW_ERROR, runtimeErr.Kind)
+
+	quota := New(Options{Limits: object.Limits{MaxMemory: 1000}})
+	_, err = quota.Run(context.Background(), `let s = "abc"; while (true) { s += s }`)
+	assert.True(t, errors.As(err, &runtimeErr))
+	assert.Equal(t, object.MEMORY_LIMIT_ERROR, runtimeErr.Kind)
+	assert.Greater(t, quota.Usage().Memory, quota.Limits().MaxMemory)
+
+	unlimited := New(Options{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = unlimited.Run(ctx, "while (true) {}")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), "evaluation timed out")
+}
+
+func TestGlobalsAreShared(t *testing.T) {
+	var out bytes.Buffer
+	interp := New(Options{Stdout: &out})
+
+	assert.NoError(t, interp.Set("greeting", "hello"))
+	_, err := interp.Run(context.Background(), `let name = "monkey"; puts(greeting + " " + name)`)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello monkey\n", out.String())
+
+	name, ok := interp.Get("name")
+	assert.True(t, ok)
+	assert.Equal(t, "monkey", ToGo(name))
+	_, ok = interp.Get("missing")
+	assert.False(t, ok)
+
+	assert.EqualError(t, interp.Set("invalid", struct{}{}), "setting invalid: cannot convert struct {} to a Monkey value")
+}
+
+func TestCall(t *testing.T) {
+	interp := New(Options{})
+	_, err := interp.Run(context.Background(), `
+		let add = fn(a, b) { a + b };
+		let keys = fn(h) { let result = []; for (k in h) { result = push(result, k) }; result };
+		let notAFunction = 1;
+	`)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		fnName        string
+		args          []any
+		expected      any
+		expectedError string
+	}{
+		{"add", []any{1, 2}, int64(3), ""},
+		{"add", []any{"a", "b"}, "ab", ""},
+		{"add", []any{1.5, int8(2)}, 3.5, ""},
+		{"keys", []any{map[string]int{"b": 2, "a": 1}}, []any{"a", "b"}, ""},
+		{"len", []any{[]string{"x", "y"}}, int64(2), ""},
+		{"add", []any{1}, nil, "wrong number of arguments. got=1, want=2"},
+		{"add", []any{1, true}, nil, "2:24: type mismatch: INTEGER + BOOLEAN"},
+		{"add", []any{1, struct{}{}}, nil, "calling add: argument 2: cannot convert struct {} to a Monkey value"},
+		{"missing", nil, nil, "undefined function: missing"},
+		{"notAFunction", nil, nil, "not a function: notAFunction is INTEGER"},
+	}
+
+	for _, tt := range tests {
+		result, err := interp.Call(tt.fnName, tt.args...)
+		if tt.expectedError != "" {
+			assert.EqualError(t, err, tt.expectedError, tt.fnName)
+			continue
+		}
+		assert.NoError(t, err, tt.fnName)
+		assert.Equal(t, tt.expected, ToGo(result), tt.fnName)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	var out bytes.Buffer
+	interp := New(Options{Stdout: &out})
+	assert.NoError(t, interp.Register("repeat", strings.Repeat))
+	assert.NoError(t, interp.Register("sum", func(numbers ...float64) float64 {
+		total := 0.0
+		for _, n := range numbers {
+			total += n
+		}
+		return total
+	}))
+	assert.NoError(t, interp.Register("divide", func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, errors.New("cannot divide by zero")
+		}
+		return a / b, nil
+	}))
+	assert.NoError(t, interp.Register("describe", func(v any) string { return fmt.Sprintf("%T", v) }))
+	assert.NoError(t, interp.Register("lengths", func(words []string) map[string]int {
+		result := map[string]int{}
+		for _, w := range words {
+			result[w] = len(w)
+		}
+		return result
+	}))
+	assert.NoError(t, interp.Register("log", func(rt *object.Runtime, message string) {
+		fmt.Fprintf(rt.Stdout, "log: %s\n", message)
+	}))
+	assert.NoError(t, interp.Register("native", func(rt *object.Runtime, args ...object.Object) object.Object {
+		return &object.Integer{Value: int64(len(args))}
+	}))
+	assert.NoError(t, interp.Register("typeOf", func(obj object.Object) string { return string(obj.Type()) }))
+	assert.NoError(t, interp.Register("bytes", func(values ...uint8) int { return len(values) }))
+
+	tests := []struct {
+		input         string
+		expected      any
+		expectedError string
+	}{
+		{`repeat("ab", 3)`, "ababab", ""},
+		{`sum()`, 0.0, ""},
+		{`sum(1, 2.5, 3)`, 6.5, ""},
+		{`divide(7, 2)`, int64(3), ""},
+		{`describe([1, "a"])`, "[]interface {}", ""},
+		{`describe(99999999999999999999)`, "*big.Int", ""},
+		{`lengths(["a", "abc"])["abc"]`, int64(3), ""},
+		{`log("message")`, nil, ""},
+		{`native(1, 2, 3)`, int64(3), ""},
+		{`typeOf(fn() {})`, "FUNCTION", ""},
+		{`divide(1, 0)`, nil, "1:1: cannot divide by zero"},
+		{`repeat("ab")`, nil, "1:1: wrong number of arguments to `repeat`: got=1, want=2"},
+		{`repeat("ab", "3")`, nil, "1:1: argument `arg2` to `repeat` must be INTEGER, got STRING"},
+		{`divide(99999999999999999999, 1)`, nil, "1:1: argument `arg1` to `divide`: value out of range"},
+		{`lengths([1])`, nil, "1:1: argument `arg1` to `lengths`: element 0: cannot use INTEGER as string"},
+		{`bytes(1, 300)`, nil, "1:1: argument `args` to `bytes`: value out of range"},
+	}
+
+	for _, tt := range tests {
+		result, err := interp.Run(context.Background(), tt.input)
+		if tt.expectedError != "" {
+			assert.EqualError(t, err, tt.expectedError, tt.input)
+			continue
+		}
+		assert.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expected, ToGo(result), tt.input)
+	}
+	assert.Equal(t, "log: message\n", out.String())
+
+	repeat, _ := interp.Get("repeat")
+	assert.Equal(t, "repeat(arg1: STRING, arg2: INTEGER) -> STRING", repeat.(*object.Builtin).Help())
+	sum, _ := interp.Get("sum")
+	assert.Equal(t, "sum(...args: INTEGER | FLOAT) -> FLOAT", sum.(*object.Builtin).Help())
+
+	assert.EqualError(t, interp.Register("x", 1), "registering x: expected a function, got int")
+	assert.EqualError(t, interp.Register("x", func() (int, int) { return 0, 0 }),
+		"registering x: second result of the function has to be an error, got func() (int, int)")
+}
+
+func TestConversions(t *testing.T) {
+	big, _ := new(big.Int).SetString("99999999999999999999", 10)
+	tests := []struct {
+		value    any
+		expected string // inspected object
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int64(-5), "-5"},
+		{uint64(18446744073709551615), "18446744073709551615"},
+		{big, "99999999999999999999"},
+		{float32(1.5), "1.5"},
+		{"text", "text"},
+		{[]any{1, "a", nil}, `[1, a, null]`},
+		{[2]int{1, 2}, "[1, 2]"},
+		{map[string]any{"b": 1, "a": []int{2}}, "{a: [2], b: 1}"},
+		{map[int]bool{1: true}, "{1: true}"},
+		{func() {}, "builtin function"},
+	}
+
+	for _, tt := range tests {
+		obj, err := ToObject(tt.value)
+		assert.NoError(t, err, "%v", tt.value)
+		assert.Equal(t, tt.expected, obj.Inspect(), "%v", tt.value)
+	}
+
+	_, err := ToObject(map[string]any{"a": make(chan int)})
+	assert.EqualError(t, err, "value of a: cannot convert chan int to a Monkey value")
+	_, err = ToObject(map[[2]int]int{{1, 2}: 3})
+	assert.EqualError(t, err, "unusable as hash key: ARRAY")
+}
+
+func TestFunctionsConvertToGo(t *testing.T) {
+	interp := New(Options{})
+	result, err := interp.Run(context.Background(), `fn(x) { x * 2 }`)
+	assert.NoError(t, err)
+
+	double, ok := ToGo(result).(func(args ...any) (any, error))
+	assert.True(t, ok)
+	doubled, err := double(21)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), doubled)
+	_, err = double("a")
+	assert.EqualError(t, err, "1:9: type mismatch: STRING * INTEGER")
+
+	// collections containing themselves keep the cycles
+	result, err = interp.Run(context.Background(), `let a = [1]; a[0] = a; let h = {"a": a}; h["h"] = h`)
+	assert.NoError(t, err)
+	hash := ToGo(result).(map[string]any)
+	assert.Equal(t, reflect.ValueOf(hash).Pointer(), reflect.ValueOf(hash["h"]).Pointer())
+	array := hash["a"].([]any)
+	assert.Equal(t, reflect.ValueOf(array).Pointer(), reflect.ValueOf(array[0]).Pointer())
+
+	// Go functions survive the round trip through Monkey
+	obj, err := ToObject(func(a, b string) string { return a + b })
+	assert.NoError(t, err)
+	concat := ToGo(obj).(func(args ...any) (any, error))
+	concatenated, err := concat("a", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "ab", concatenated)
+}
+
+// the builtins converted to Go functions write to the interpreter's streams
+func TestBuiltinsConvertToGoWithTheRuntime(t *testing.T) {
+	var out bytes.Buffer
+	interp := New(Options{Stdout: &out})
+	assert.NoError(t, interp.Register("greet", func(f any) (any, error) {
+		return f.(func(args ...any) (any, error))("hello")
+	}))
+	_, err := interp.Run(context.Background(), `greet(puts)`)
+	assert.NoError(t, err)
+
+	puts, _ := evaluator.LookupBuiltin("puts")
+	_, err = interp.ToGo(puts).(func(args ...any) (any, error))("again")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\nagain\n", out.String())
+}
+
+func TestGoFunctionsTakeMonkeyFunctions(t *testing.T) {
+	var out bytes.Buffer
+	interp := New(Options{Stdout: &out})
+	assert.NoError(t, interp.Register("apply", func(f func(int) int, x int) int { return f(x) }))
+	assert.NoError(t, interp.Register("check", func(f func(...string) (bool, error)) (string, error) {
+		ok, err := f("a", "b")
+		if err != nil {
+			return "", fmt.Errorf("check failed: %w", err)
+		}
+		return fmt.Sprint(ok), nil
+	}))
+	assert.NoError(t, interp.Register("each", func(f func(string), words []string) {
+		for _, w := range words {
+			f(w)
+		}
+	}))
+
+	tests := []struct {
+		input         string
+		expected      any
+		expectedError string
+	}{
+		{`apply(fn(x) { x * 2 }, 21)`, int64(42), ""},
+		{`apply(fn(x) { len([x, x]) }, 5)`, int64(2), ""},
+		{`check(fn(a, b) { len(a) == len(b) })`, "true", ""},
+		{`each(puts, ["a", "b"])`, nil, ""},
+		{`apply(1, 1)`, nil, "1:1: argument `arg1` to `apply` must be FUNCTION, BUILTIN or NULL, got INTEGER"},
+		{`apply(fn(x) { x + true }, 1)`, nil, "1:15: type mismatch: INTEGER + BOOLEAN"},
+		{`try { apply(fn(x) { throw "stop" }, 1) } catch (e) { e["message"] }`, "stop", ""},
+		{`apply(fn(x) { "a" }, 1)`, nil, "1:1: result: cannot use STRING as int"},
+		{`check(fn(a, b) { a })`, nil, "1:1: check failed: result: cannot use STRING as bool"},
+	}
+
+	for _, tt := range tests {
+		result, err := interp.Run(context.Background(), tt.input)
+		if tt.expectedError != "" {
+			assert.EqualError(t, err, tt.expectedError, tt.input)
+			continue
+		}
+		assert.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expected, ToGo(result), tt.input)
+	}
+	assert.Equal(t, "a\nb\n", out.String())
+}
@@ -1,42 +1,130 @@
 package lexer
 
-import "kjarmicki.github.com/monkey/token"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"kjarmicki.github.com/monkey/diagnostic"
+	"kjarmicki.github.com/monkey/token"
+)
+
+// lexer works on runes (UTF-8 decoded), positions are byte offsets and columns are counted in runes
 type Lexer struct {
 	input        string
+	file         string
 	position     int  // position of the current char
 	readPosition int  // position after the current char
-	ch           byte // current char
+	ch           rune // current char
+	line         int  // line of the current char
+	column       int  // column of the current char
+
+	start  token.Position // where the token being read started
+	errors []*diagnostic.Diagnostic
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewFile("", input)
+}
+
+// same as New, but positions of the tokens will also carry the file name
+func NewFile(file, input string) *Lexer {
+	l := &Lexer{input: input, file: file, line: 1}
 	l.readChar()
 	return l
 }
 
 func (l *Lexer) readChar() {
+	if l.readPosition > len(l.input) {
+		// already at the end of input, stay there so positions don't drift
+		return
+	}
+	if l.ch == '\n' {
+		l.line += 1
+		l.column = 1
+	} else {
+		l.column += 1
+	}
+	l.position = l.readPosition
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
+		l.readPosition += 1
 	} else {
-		l.ch = l.input[l.readPosition]
+		ch, width := utf8.DecodeRuneInString(l.input[l.readPosition:])
+		l.ch = ch
+		l.readPosition += width
 	}
-	l.position = l.readPosition
-	l.readPosition += 1
 }
 
-func (l *Lexer) peekChar() byte {
-	if l.readPosition >= len(l.input) {
+func (l *Lexer) peekChar() rune {
+	return l.charAt(l.readPosition)
+}
+
+// char at the given byte position, without moving the lexer there
+func (l *Lexer) charAt(position int) rune {
+	if position >= len(l.input) {
 		return 0
-	} else {
-		return l.input[l.readPosition]
 	}
+	ch, _ := utf8.DecodeRuneInString(l.input[position:])
+	return ch
+}
+
+func (l *Lexer) atEOF() bool {
+	return l.position >= len(l.input)
+}
+
+// problems found in the input so far
+func (l *Lexer) Errors() []*diagnostic.Diagnostic {
+	return l.errors
+}
+
+func (l *Lexer) addError(code diagnostic.Code, span token.Span, format string, args ...any) {
+	l.errors = append(l.errors, &diagnostic.Diagnostic{
+		Severity: diagnostic.ERROR,
+		Code:     code,
+		Message:  fmt.Sprintf(format, args...),
+		Span:     span,
+		Actual:   token.ILLEGAL,
+	})
+}
+
+// span of the current char
+func (l *Lexer) charSpan() token.Span {
+	end := l.pos()
+	end.Offset = l.readPosition
+	end.Column += 1
+	return token.Span{Start: l.pos(), End: end}
+}
+
+// position of the current char
+func (l *Lexer) pos() token.Position {
+	return token.Position{File: l.file, Offset: l.position, Line: l.line, Column: l.column}
 }
 
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+	for {
+		l.skipWhitespace()
+		start := l.pos()
+		l.start = start
+		var tok token.Token
+		if l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*') {
+			var isToken bool
+			tok, isToken = l.readComment()
+			if !isToken {
+				continue
+			}
+		} else {
+			tok = l.readToken()
+		}
+		tok.Span = token.Span{Start: start, End: l.pos()}
+		return tok
+	}
+}
 
-	l.skipWhitespace()
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
 
 	switch l.ch {
 	case '=':
@@ -51,7 +139,7 @@ func (l *Lexer) NextToken() token.Token {
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		tok = l.readOperator(token.MINUS, token.MINUS_ASSIGN)
 	case '!':
 		if l.peekChar() == '=' {
 			ch := l.ch
@@ -62,13 +150,26 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.BANG, l.ch)
 		}
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		tok = l.readOperator(token.SLASH, token.SLASH_ASSIGN)
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		tok = l.readOperator(token.ASTERISK, token.ASTERISK_ASSIGN)
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		tok = l.readOperator(token.LT, token.LT_EQ)
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		tok = l.readOperator(token.GT, token.GT_EQ)
+	case '&', '|':
+		if l.peekChar() != l.ch {
+			tok = newToken(token.ILLEGAL, l.ch)
+			l.addError(diagnostic.ILLEGAL_CHARACTER, l.charSpan(), "unexpected character %q, did you mean %q?", l.ch, string(l.ch)+string(l.ch))
+			break
+		}
+		tok = token.Token{Type: token.AND, Literal: "&&"}
+		if l.ch == '|' {
+			tok = token.Token{Type: token.OR, Literal: "||"}
+		}
+		l.readChar()
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
@@ -76,7 +177,7 @@ func (l *Lexer) NextToken() token.Token {
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		tok = l.readOperator(token.PLUS, token.PLUS_ASSIGN)
 	case '{':
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
@@ -88,9 +189,21 @@ func (l *Lexer) NextToken() token.Token {
 	case ':':
 		tok = newToken(token.COLON, l.ch)
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		value, ok := l.readString()
+		if ok {
+			tok.Type = token.STRING
+			tok.Literal = value
+		} else {
+			tok.Type = token.ILLEGAL
+			tok.Literal = l.input[l.start.Offset:l.position]
+			l.addError(diagnostic.UNTERMINATED_STRING, token.Span{Start: l.start, End: l.pos()}, "unterminated string")
+		}
 	case 0:
+		if !l.atEOF() {
+			tok = newToken(token.ILLEGAL, l.ch)
+			l.addError(diagnostic.ILLEGAL_CHARACTER, l.charSpan(), "unexpected character %q", l.ch)
+			break
+		}
 		tok.Literal = ""
 		tok.Type = token.EOF
 	default:
@@ -99,58 +212,215 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.LookupIdent(tok.Literal)
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Literal = l.readNumber()
-			tok.Type = token.INT
+			tok.Literal, tok.Type = l.readNumber()
 			return tok
 		} else {
 			tok = newToken(token.ILLEGAL, l.ch)
+			if l.ch == utf8.RuneError && l.readPosition-l.position == 1 {
+				tok.Literal = l.input[l.position:l.readPosition]
+				l.addError(diagnostic.ILLEGAL_CHARACTER, l.charSpan(), "invalid UTF-8 encoding")
+			} else {
+				l.addError(diagnostic.ILLEGAL_CHARACTER, l.charSpan(), "unexpected character %q", l.ch)
+			}
 		}
 	}
 	l.readChar()
 	return tok
 }
 
+// reads an operator, or its variant followed by = (+ or +=, < or <=)
+func (l *Lexer) readOperator(operator, assignment token.TokenType) token.Token {
+	if l.peekChar() != '=' {
+		return newToken(operator, l.ch)
+	}
+	ch := l.ch
+	l.readChar()
+	return token.Token{Type: assignment, Literal: string(ch) + string(l.ch)}
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		l.readChar()
 	}
 }
 
+// reads a comment starting at the current char. Doc comments and unterminated block comments
+// are turned into tokens, all the other comments are skipped (isToken is false then).
+func (l *Lexer) readComment() (tok token.Token, isToken bool) {
+	switch {
+	case strings.HasPrefix(l.input[l.position:], "///") && !strings.HasPrefix(l.input[l.position:], "////"):
+		text := l.readLineComment()
+		text = strings.TrimPrefix(text[len("///"):], " ")
+		return token.Token{Type: token.DOC_COMMENT, Literal: text}, true
+	case l.peekChar() == '/':
+		l.readLineComment()
+		return tok, false
+	default:
+		if !l.skipBlockComment() {
+			l.addError(diagnostic.UNTERMINATED_COMMENT, token.Span{Start: l.start, End: l.pos()}, "unterminated block comment")
+			return token.Token{Type: token.ILLEGAL, Literal: "/*"}, true
+		}
+		return tok, false
+	}
+}
+
+// reads until the end of the line, the newline itself is left for skipWhitespace
+func (l *Lexer) readLineComment() string {
+	position := l.position
+	for l.ch != '\n' && !l.atEOF() {
+		l.readChar()
+	}
+	return strings.TrimRight(l.input[position:l.position], "\r")
+}
+
+// skips /* */ comment, block comments can be nested: /* outer /* inner */ still outer */
+// returns false if the input ended before the comment was closed
+func (l *Lexer) skipBlockComment() bool {
+	depth := 0
+	for !l.atEOF() {
+		switch {
+		case l.ch == '/' && l.peekChar() == '*':
+			depth += 1
+			l.readChar()
+		case l.ch == '*' && l.peekChar() == '/':
+			depth -= 1
+			l.readChar()
+		}
+		l.readChar()
+		if depth == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// identifiers start with a letter (any Unicode letter) or underscore, and may contain digits later on
 func (l *Lexer) readIdentifier() string {
 	position := l.position
-	for isLetter(l.ch) {
+	for isLetter(l.ch) || unicode.IsDigit(l.ch) {
 		l.readChar()
 	}
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readNumber() string {
+// reads integers (42) and floats (4.2, 42e3, 4.2E-1); a dot or an exponent
+// makes the number a float only when it's followed by digits
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	position := l.position
+	tokenType := token.TokenType(token.INT)
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+		l.readDigits()
+	}
+
+	if l.ch == 'e' || l.ch == 'E' {
+		exponent := 1
+		if next := l.peekChar(); next == '+' || next == '-' {
+			exponent = 2
+		}
+		if isDigit(l.charAt(l.position + exponent)) {
+			tokenType = token.FLOAT
+			for i := 0; i < exponent; i++ {
+				l.readChar()
+			}
+			l.readDigits()
+		}
+	}
+
+	return l.input[position:l.position], tokenType
+}
+
+func (l *Lexer) readDigits() {
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
 }
 
-func (l *Lexer) readString() string {
-	position := l.position + 1
+// reads the string up to the closing quote (which is left as the current char), processing escape sequences.
+// Returns false if the input ended before the string was closed.
+func (l *Lexer) readString() (string, bool) {
+	var out strings.Builder
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+		switch {
+		case l.atEOF():
+			return out.String(), false
+		case l.ch == '"':
+			return out.String(), true
+		case l.ch == '\\':
+			l.readEscape(&out)
+		default:
+			out.WriteRune(l.ch)
 		}
 	}
-	return l.input[position:l.position]
 }
 
-func isLetter(ch byte) bool {
-	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
+var escapes = map[rune]rune{
+	'n':  '\n',
+	't':  '\t',
+	'r':  '\r',
+	'0':  0,
+	'"':  '"',
+	'\\': '\\',
 }
 
-func isDigit(ch byte) bool {
+// reads the escape sequence starting at the current backslash, leaving its last char as the current one.
+// Supported escapes: \n \t \r \0 \" \\ and \u{XXXX} (1 to 6 hex digits of a Unicode code point).
+func (l *Lexer) readEscape(out *strings.Builder) {
+	start := l.pos()
+	l.readChar()
+	if l.atEOF() {
+		return
+	}
+	if escaped, ok := escapes[l.ch]; ok {
+		out.WriteRune(escaped)
+		return
+	}
+	if l.ch != 'u' {
+		l.addError(diagnostic.INVALID_ESCAPE, token.Span{Start: start, End: l.charSpan().End}, "unknown escape sequence \\%c", l.ch)
+		out.WriteRune(l.ch)
+		return
+	}
+
+	if l.peekChar() != '{' {
+		l.addError(diagnostic.INVALID_ESCAPE, token.Span{Start: start, End: l.charSpan().End}, "unicode escape must look like \\u{1F600}")
+		return
+	}
+	l.readChar()
+	var digits strings.Builder
+	for isHexDigit(l.peekChar()) {
+		l.readChar()
+		digits.WriteRune(l.ch)
+	}
+	if l.peekChar() != '}' {
+		l.addError(diagnostic.INVALID_ESCAPE, token.Span{Start: start, End: l.charSpan().End}, "unicode escape must look like \\u{1F600}")
+		return
+	}
+	l.readChar()
+
+	code, err := strconv.ParseUint(digits.String(), 16, 32)
+	if err != nil || digits.Len() > 6 || !utf8.ValidRune(rune(code)) {
+		l.addError(diagnostic.INVALID_ESCAPE, token.Span{Start: start, End: l.charSpan().End}, "invalid unicode code point \\u{%s}", digits.String())
+		return
+	}
+	out.WriteRune(rune(code))
+}
+
+func isLetter(ch rune) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' || (ch >= utf8.RuneSelf && unicode.IsLetter(ch))
+}
+
+func isDigit(ch rune) bool {
 	return '0' <= ch && ch <= '9'
 }
 
-func newToken(tokenType token.TokenType, ch byte) token.Token {
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+func newToken(tokenType token.TokenType, ch rune) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
@@ -96,7 +96,7 @@ let result = add(five, ten);`
 }
 
 func TestNextTokenOperators(t *testing.T) {
-	input := `!-/*5
+	input := `!-/ *5
 5 < 10 > 5`
 
 	tests := []struct {
@@ -165,9 +165,81 @@ func TestNextTokenKeywords(t *testing.T) {
 	}
 }
 
+func TestNextTokenExceptionKeywords(t *testing.T) {
+	input := `try { throw e } catch (e) {} finally {}`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.TRY, "try"},
+		{token.LBRACE, "{"},
+		{token.THROW, "throw"},
+		{token.IDENT, "e"},
+		{token.RBRACE, "}"},
+		{token.CATCH, "catch"},
+		{token.LPAREN, "("},
+		{token.IDENT, "e"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.FINALLY, "finally"},
+		{token.LBRACE, "{"},
+		{token.RBRACE, "}"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for _, tt := range tests {
+		tok := l.NextToken()
+		assert.Equal(t, tt.expectedType, tok.Type)
+		assert.Equal(t, tt.expectedLiteral, tok.Literal)
+	}
+}
+
+func TestNextTokenLoopKeywords(t *testing.T) {
+	input := `while (true) { break; } for (x in xs) { continue; }`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.WHILE, "while"},
+		{token.LPAREN, "("},
+		{token.TRUE, "true"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.BREAK, "break"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.FOR, "for"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.IN, "in"},
+		{token.IDENT, "xs"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.CONTINUE, "continue"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for _, tt := range tests {
+		tok := l.NextToken()
+		assert.Equal(t, tt.expectedType, tok.Type)
+		assert.Equal(t, tt.expectedLiteral, tok.Literal)
+	}
+}
+
 func TestNextTokenLongOperators(t *testing.T) {
 	input := `10 == 10;
-	5 != 10;`
+	5 != 10;
+	x += 1 -= 2 *= 3 /= 4 = 5;
+	a <= b >= c && d || e % f;`
 
 	tests := []struct {
 		expectedType    token.TokenType
@@ -181,6 +253,30 @@ func TestNextTokenLongOperators(t *testing.T) {
 		{token.NOT_EQ, "!="},
 		{token.INT, "10"},
 		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.PLUS_ASSIGN, "+="},
+		{token.INT, "1"},
+		{token.MINUS_ASSIGN, "-="},
+		{token.INT, "2"},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.INT, "3"},
+		{token.SLASH_ASSIGN, "/="},
+		{token.INT, "4"},
+		{token.ASSIGN, "="},
+		{token.INT, "5"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.LT_EQ, "<="},
+		{token.IDENT, "b"},
+		{token.GT_EQ, ">="},
+		{token.IDENT, "c"},
+		{token.AND, "&&"},
+		{token.IDENT, "d"},
+		{token.OR, "||"},
+		{token.IDENT, "e"},
+		{token.PERCENT, "%"},
+		{token.IDENT, "f"},
+		{token.SEMICOLON, ";"},
 		{token.EOF, ""},
 	}
 
@@ -265,3 +361,231 @@ func TestNextTokenHash(t *testing.T) {
 		assert.Equal(t, tt.expectedLiteral, tok.Literal)
 	}
 }
+
+func TestNextTokenSpans(t *testing.T) {
+	input := `let x = 10;
+	"ab" == y`
+
+	tests := []struct {
+		expectedType  token.TokenType
+		expectedStart token.Position
+		expectedEnd   token.Position
+	}{
+		{token.LET, token.Position{Offset: 0, Line: 1, Column: 1}, token.Position{Offset: 3, Line: 1, Column: 4}},
+		{token.IDENT, token.Position{Offset: 4, Line: 1, Column: 5}, token.Position{Offset: 5, Line: 1, Column: 6}},
+		{token.ASSIGN, token.Position{Offset: 6, Line: 1, Column: 7}, token.Position{Offset: 7, Line: 1, Column: 8}},
+		{token.INT, token.Position{Offset: 8, Line: 1, Column: 9}, token.Position{Offset: 10, Line: 1, Column: 11}},
+		{token.SEMICOLON, token.Position{Offset: 10, Line: 1, Column: 11}, token.Position{Offset: 11, Line: 1, Column: 12}},
+		{token.STRING, token.Position{Offset: 13, Line: 2, Column: 2}, token.Position{Offset: 17, Line: 2, Column: 6}},
+		{token.EQ, token.Position{Offset: 18, Line: 2, Column: 7}, token.Position{Offset: 20, Line: 2, Column: 9}},
+		{token.IDENT, token.Position{Offset: 21, Line: 2, Column: 10}, token.Position{Offset: 22, Line: 2, Column: 11}},
+		{token.EOF, token.Position{Offset: 22, Line: 2, Column: 11}, token.Position{Offset: 22, Line: 2, Column: 11}},
+		{token.EOF, token.Position{Offset: 22, Line: 2, Column: 11}, token.Position{Offset: 22, Line: 2, Column: 11}},
+	}
+
+	l := New(input)
+
+	for _, tt := range tests {
+		tok := l.NextToken()
+		assert.Equal(t, tt.expectedType, tok.Type)
+		assert.Equal(t, tt.expectedStart, tok.Span.Start)
+		assert.Equal(t, tt.expectedEnd, tok.Span.End)
+	}
+}
+
+func TestNextTokenFile(t *testing.T) {
+	l := NewFile("main.mk", "\n  foo")
+
+	tok := l.NextToken()
+	assert.Equal(t, "main.mk:2:3", tok.Span.Start.String())
+}
+
+func TestNextTokenComments(t *testing.T) {
+	input := `// line comment
+let x = 5; // trailing comment
+/* block
+   comment */
+let y /* inline */ = 10 / 2;
+/* outer /* nested */ still a comment */
+/// documents z
+/// over two lines
+let z = 1;
+//// not a doc comment
+x`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LET, "let"},
+		{token.IDENT, "x"},
+		{token.ASSIGN, "="},
+		{token.INT, "5"},
+		{token.SEMICOLON, ";"},
+		{token.LET, "let"},
+		{token.IDENT, "y"},
+		{token.ASSIGN, "="},
+		{token.INT, "10"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.DOC_COMMENT, "documents z"},
+		{token.DOC_COMMENT, "over two lines"},
+		{token.LET, "let"},
+		{token.IDENT, "z"},
+		{token.ASSIGN, "="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "x"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for _, tt := range tests {
+		tok := l.NextToken()
+		assert.Equal(t, tt.expectedType, tok.Type)
+		assert.Equal(t, tt.expectedLiteral, tok.Literal)
+	}
+}
+
+func TestNextTokenUnterminatedBlockComment(t *testing.T) {
+	l := New("1 /* never /* closed */")
+
+	assert.Equal(t, "1", l.NextToken().Literal)
+	tok := l.NextToken()
+	assert.Equal(t, token.TokenType(token.ILLEGAL), tok.Type)
+	assert.Equal(t, "1:3", tok.Span.String())
+	assert.Equal(t, token.TokenType(token.EOF), l.NextToken().Type)
+}
+
+func TestNextTokenNumbers(t *testing.T) {
+	input := `5 1.5 0.25 1e-9 2.5E+3 3e7 7.foo 1e 2.x`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INT, "5"},
+		{token.FLOAT, "1.5"},
+		{token.FLOAT, "0.25"},
+		{token.FLOAT, "1e-9"},
+		{token.FLOAT, "2.5E+3"},
+		{token.FLOAT, "3e7"},
+		{token.INT, "7"},
+		{token.ILLEGAL, "."},
+		{token.IDENT, "foo"},
+		{token.INT, "1"},
+		{token.IDENT, "e"},
+		{token.INT, "2"},
+		{token.ILLEGAL, "."},
+		{token.IDENT, "x"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for _, tt := range tests {
+		tok := l.NextToken()
+		assert.Equal(t, tt.expectedType, tok.Type)
+		assert.Equal(t, tt.expectedLiteral, tok.Literal)
+	}
+}
+
+func TestNextTokenStringEscapes(t *testing.T) {
+	input := `"a\nb" "tab\there" "quote: \"" "back\\slash" "nul\0" "smile \u{1F600}" "\u{105}"`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.STRING, "a\nb"},
+		{token.STRING, "tab\there"},
+		{token.STRING, `quote: "`},
+		{token.STRING, `back\slash`},
+		{token.STRING, "nul\x00"},
+		{token.STRING, "smile 😀"},
+		{token.STRING, "ą"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for _, tt := range tests {
+		tok := l.NextToken()
+		assert.Equal(t, tt.expectedType, tok.Type)
+		assert.Equal(t, tt.expectedLiteral, tok.Literal)
+	}
+	assert.Empty(t, l.Errors())
+}
+
+func TestNextTokenUnicode(t *testing.T) {
+	input := `let zażółć = "gęślą jaźń"; π2 + _x`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		expectedColumn  int
+	}{
+		{token.LET, "let", 1},
+		{token.IDENT, "zażółć", 5},
+		{token.ASSIGN, "=", 12},
+		{token.STRING, "gęślą jaźń", 14},
+		{token.SEMICOLON, ";", 26},
+		{token.IDENT, "π2", 28},
+		{token.PLUS, "+", 31},
+		{token.IDENT, "_x", 33},
+		{token.EOF, "", 35},
+	}
+
+	l := New(input)
+
+	for _, tt := range tests {
+		tok := l.NextToken()
+		assert.Equal(t, tt.expectedType, tok.Type)
+		assert.Equal(t, tt.expectedLiteral, tok.Literal)
+		assert.Equal(t, tt.expectedColumn, tok.Span.Start.Column)
+	}
+	assert.Empty(t, l.Errors())
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{`"never closed`, `1:1: error[E0005]: unterminated string`},
+		{"x\n  \"abc\\", `2:3: error[E0005]: unterminated string`},
+		{`"bad \q escape"`, `1:6: error[E0007]: unknown escape sequence \q`},
+		{`"\u0041"`, `1:2: error[E0007]: unicode escape must look like \u{1F600}`},
+		{`"\u{1F600"`, `1:2: error[E0007]: unicode escape must look like \u{1F600}`},
+		{`"\u{110000}"`, `1:2: error[E0007]: invalid unicode code point \u{110000}`},
+		{`"\u{D800}"`, `1:2: error[E0007]: invalid unicode code point \u{D800}`},
+		{"1 @ 2", `1:3: error[E0008]: unexpected character '@'`},
+		{"a & b", `1:3: error[E0008]: unexpected character '&', did you mean "&&"?`},
+		{"a | b", `1:3: error[E0008]: unexpected character '|', did you mean "||"?`},
+		{"1 \xff 2", `1:3: error[E0008]: invalid UTF-8 encoding`},
+		{"/* open", `1:1: error[E0006]: unterminated block comment`},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		}
+		errors := l.Errors()
+		assert.Equal(t, 1, len(errors), tt.input)
+		assert.Equal(t, tt.expectedError, errors[0].String())
+	}
+}
+
+func TestNextTokenUnterminatedString(t *testing.T) {
+	l := New(`let s = "abc`)
+
+	l.NextToken()
+	l.NextToken()
+	l.NextToken()
+	tok := l.NextToken()
+	assert.Equal(t, token.TokenType(token.ILLEGAL), tok.Type)
+	assert.Equal(t, `"abc`, tok.Literal)
+	assert.Equal(t, token.TokenType(token.EOF), l.NextToken().Type)
+}
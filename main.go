@@ -1,13 +1,11 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
-	"kjarmicki.github.com/monkey/repl"
+	"kjarmicki.github.com/monkey/cli"
 )
 
 func main() {
-	fmt.Println("Monkey REPL ready")
-	repl.Start(os.Stdin, os.Stdout)
+	os.Exit(cli.Run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,61 @@
+package object
+
+import (
+	"strings"
+
+	"kjarmicki.github.com/monkey/code"
+)
+
+const (
+	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
+	CELL_OBJ              = "CELL"
+)
+
+// function compiled to bytecode, a constant the closures are created from
+type CompiledFunction struct {
+	Instructions  code.Instructions
+	SourceMap     code.SourceMap
+	NumParameters int
+	Locals        []string // names of the local variables, the parameters first
+	Free          []string // names of the variables captured from the enclosing functions
+	Name          string   // name the function was defined with, empty for anonymous functions
+	Body          string   // source of the body, for Inspect
+}
+
+func (cf *CompiledFunction) Type() ObjectType {
+	return COMPILED_FUNCTION_OBJ
+}
+
+func (cf *CompiledFunction) Inspect() string {
+	return "fn(" + strings.Join(cf.Locals[:cf.NumParameters], ", ") + ") {\n" + cf.Body + "\n}"
+}
+
+// variable shared by a function and the closures created in it, so that they all see the assignments
+type Cell struct {
+	Value Object // nil until the variable is defined
+}
+
+func (c *Cell) Type() ObjectType {
+	return CELL_OBJ
+}
+
+func (c *Cell) Inspect() string {
+	if c.Value == nil {
+		return "cell()"
+	}
+	return "cell(" + c.Value.Inspect() + ")"
+}
+
+// compiled function with the variables it captured, the bytecode counterpart of Function
+type Closure struct {
+	Fn   *CompiledFunction
+	Free []*Cell
+}
+
+func (c *Closure) Type() ObjectType {
+	return FUNCTION_OBJ
+}
+
+func (c *Closure) Inspect() string {
+	return c.Fn.Inspect()
+}
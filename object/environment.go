@@ -1,21 +1,46 @@
 package object
 
+import "sort"
+
+// enclosed environments share the runtime with the outer one
 func NewEnclosedEnvironment(outer *Environment) *Environment {
-	env := NewEnvironment()
+	env := NewEnvironmentWithRuntime(outer.runtime)
 	env.outer = outer
 	return env
 }
 
+// environment of a function call, with a slot for each of the function's locals (see ast.FunctionLiteral.Locals).
+// The names that weren't resolved to the slots are still stored by name.
+func NewFunctionEnvironment(outer *Environment, locals int) *Environment {
+	return &Environment{
+		slots:   make([]Object, locals),
+		outer:   outer,
+		runtime: outer.runtime,
+	}
+}
+
+// environment using the standard streams of the process
 func NewEnvironment() *Environment {
+	return NewEnvironmentWithRuntime(DefaultRuntime())
+}
+
+func NewEnvironmentWithRuntime(runtime *Runtime) *Environment {
 	return &Environment{
-		store: make(map[string]Object),
-		outer: nil,
+		store:   make(map[string]Object),
+		outer:   nil,
+		runtime: runtime,
 	}
 }
 
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store   map[string]Object
+	slots   []Object // locals of the function, nil until they're defined
+	outer   *Environment
+	runtime *Runtime
+}
+
+func (e *Environment) Runtime() *Runtime {
+	return e.runtime
 }
 
 func (e *Environment) Get(name string) (Object, bool) {
@@ -26,7 +51,50 @@ func (e *Environment) Get(name string) (Object, bool) {
 	return obj, ok
 }
 
+// names defined directly in this environment (not in the outer ones), sorted
+func (e *Environment) Names() []string {
+	names := make([]string, 0, len(e.store))
+	for name := range e.store {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (e *Environment) Set(name string, val Object) Object {
+	if e.store == nil {
+		e.store = make(map[string]Object)
+	}
 	e.store[name] = val
 	return val
 }
+
+// value of the local in the environment depth levels up, nil when it's not defined yet
+func (e *Environment) Local(depth, slot int) Object {
+	return e.enclosing(depth).slots[slot]
+}
+
+func (e *Environment) SetLocal(depth, slot int, val Object) Object {
+	e.enclosing(depth).slots[slot] = val
+	return val
+}
+
+func (e *Environment) enclosing(depth int) *Environment {
+	env := e
+	for ; depth > 0; depth-- {
+		env = env.outer
+	}
+	return env
+}
+
+// updates an existing binding, in this or in one of the outer environments.
+// Returns false if the name isn't defined anywhere.
+func (e *Environment) Assign(name string, val Object) bool {
+	for env := e; env != nil; env = env.outer {
+		if _, ok := env.store[name]; ok {
+			env.store[name] = val
+			return true
+		}
+	}
+	return false
+}
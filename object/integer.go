@@ -0,0 +1,149 @@
+package object
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/big"
+)
+
+// integers are plain int64 as long as they fit, and transparently switch to arbitrary precision when they don't.
+// All the operations below return normalized integers: Big is only ever set for values outside of the int64 range.
+type Integer struct {
+	Value int64
+	Big   *big.Int // set when the value doesn't fit in int64, Value is meaningless then
+}
+
+var (
+	minInt64 = big.NewInt(math.MinInt64)
+	maxInt64 = big.NewInt(math.MaxInt64)
+)
+
+// wraps the big integer, demoting it to int64 if it fits
+func NewBigInteger(value *big.Int) *Integer {
+	if value.Cmp(minInt64) >= 0 && value.Cmp(maxInt64) <= 0 {
+		return &Integer{Value: value.Int64()}
+	}
+	return &Integer{Big: value}
+}
+
+func (i *Integer) Inspect() string {
+	if i.IsBig() {
+		return i.Big.String()
+	}
+	return fmt.Sprintf("%d", i.Value)
+}
+
+func (i *Integer) Type() ObjectType {
+	return INTEGER_OBJ
+}
+
+func (i *Integer) HashKey() HashKey {
+	if i.IsBig() {
+		h := fnv.New64a()
+		if i.Big.Sign() < 0 {
+			h.Write([]byte{'-'})
+		}
+		h.Write(i.Big.Bytes())
+		return HashKey{Type: i.Type(), Value: h.Sum64()}
+	}
+	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
+}
+
+func (i *Integer) IsBig() bool {
+	return i.Big != nil
+}
+
+// value as a big integer, regardless of the representation. The result must not be modified.
+func (i *Integer) BigValue() *big.Int {
+	if i.IsBig() {
+		return i.Big
+	}
+	return big.NewInt(i.Value)
+}
+
+// nearest float, might lose precision (or become infinite) for big values
+func (i *Integer) Float() float64 {
+	if i.IsBig() {
+		f, _ := new(big.Float).SetInt(i.Big).Float64()
+		return f
+	}
+	return float64(i.Value)
+}
+
+func (i *Integer) Add(other *Integer) *Integer {
+	if !i.IsBig() && !other.IsBig() {
+		sum := i.Value + other.Value
+		// overflow happened if both operands have a different sign than the result
+		if (i.Value^sum)&(other.Value^sum) >= 0 {
+			return &Integer{Value: sum}
+		}
+	}
+	return NewBigInteger(new(big.Int).Add(i.BigValue(), other.BigValue()))
+}
+
+func (i *Integer) Sub(other *Integer) *Integer {
+	if !i.IsBig() && !other.IsBig() {
+		diff := i.Value - other.Value
+		if (i.Value^other.Value)&(i.Value^diff) >= 0 {
+			return &Integer{Value: diff}
+		}
+	}
+	return NewBigInteger(new(big.Int).Sub(i.BigValue(), other.BigValue()))
+}
+
+func (i *Integer) Mul(other *Integer) *Integer {
+	if !i.IsBig() && !other.IsBig() {
+		a, b := i.Value, other.Value
+		if a == 0 || b == 0 {
+			return &Integer{Value: 0}
+		}
+		product := a * b
+		if product/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64) {
+			return &Integer{Value: product}
+		}
+	}
+	return NewBigInteger(new(big.Int).Mul(i.BigValue(), other.BigValue()))
+}
+
+// truncated division (rounds towards zero), the divisor must not be zero
+func (i *Integer) Quo(other *Integer) *Integer {
+	if !i.IsBig() && !other.IsBig() && !(i.Value == math.MinInt64 && other.Value == -1) {
+		return &Integer{Value: i.Value / other.Value}
+	}
+	return NewBigInteger(new(big.Int).Quo(i.BigValue(), other.BigValue()))
+}
+
+// remainder of the truncated division, has the sign of i. The divisor must not be zero.
+func (i *Integer) Rem(other *Integer) *Integer {
+	if !i.IsBig() && !other.IsBig() {
+		return &Integer{Value: i.Value % other.Value}
+	}
+	return NewBigInteger(new(big.Int).Rem(i.BigValue(), other.BigValue()))
+}
+
+func (i *Integer) Neg() *Integer {
+	if !i.IsBig() && i.Value != math.MinInt64 {
+		return &Integer{Value: -i.Value}
+	}
+	return NewBigInteger(new(big.Int).Neg(i.BigValue()))
+}
+
+func (i *Integer) IsZero() bool {
+	return !i.IsBig() && i.Value == 0
+}
+
+// -1 if i < other, 0 if i == other, +1 if i > other
+func (i *Integer) Cmp(other *Integer) int {
+	if !i.IsBig() && !other.IsBig() {
+		switch {
+		case i.Value < other.Value:
+			return -1
+		case i.Value > other.Value:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return i.BigValue().Cmp(other.BigValue())
+}
@@ -0,0 +1,61 @@
+package object
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntegerArithmetic(t *testing.T) {
+	max := &Integer{Value: math.MaxInt64}
+	min := &Integer{Value: math.MinInt64}
+	one := &Integer{Value: 1}
+	minusOne := &Integer{Value: -1}
+
+	tests := []struct {
+		result   *Integer
+		expected string
+		isBig    bool
+	}{
+		{(&Integer{Value: 2}).Add(&Integer{Value: 3}), "5", false},
+		{max.Add(one), "9223372036854775808", true},
+		{min.Sub(one), "-9223372036854775809", true},
+		{max.Mul(&Integer{Value: 2}), "18446744073709551614", true},
+		{min.Mul(minusOne), "9223372036854775808", true},
+		{min.Quo(minusOne), "9223372036854775808", true},
+		{min.Neg(), "9223372036854775808", true},
+		{max.Add(one).Sub(one), "9223372036854775807", false},
+		{(&Integer{Value: -7}).Quo(&Integer{Value: 2}), "-3", false},
+		{(&Integer{Value: -7}).Rem(&Integer{Value: 2}), "-1", false},
+		{min.Rem(minusOne), "0", false},
+		{max.Add(one).Rem(&Integer{Value: 10}), "8", false},
+		{NewBigInteger(big.NewInt(42)), "42", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, tt.result.Inspect())
+		assert.Equal(t, tt.isBig, tt.result.IsBig())
+	}
+}
+
+func TestIntegerCmp(t *testing.T) {
+	big := (&Integer{Value: math.MaxInt64}).Add(&Integer{Value: 1})
+
+	assert.Equal(t, -1, (&Integer{Value: 1}).Cmp(&Integer{Value: 2}))
+	assert.Equal(t, 0, (&Integer{Value: 2}).Cmp(&Integer{Value: 2}))
+	assert.Equal(t, 1, big.Cmp(&Integer{Value: 2}))
+	assert.Equal(t, 0, big.Neg().Cmp(&Integer{Value: math.MinInt64}))
+	assert.Equal(t, -1, big.Neg().Sub(&Integer{Value: 1}).Cmp(&Integer{Value: math.MinInt64}))
+}
+
+func TestIntegerHashKey(t *testing.T) {
+	big1 := (&Integer{Value: math.MaxInt64}).Add(&Integer{Value: 1})
+	big2 := (&Integer{Value: math.MaxInt64}).Add(&Integer{Value: 1})
+
+	assert.Equal(t, big1.HashKey(), big2.HashKey())
+	assert.NotEqual(t, big1.HashKey(), big1.Neg().HashKey())
+	assert.Equal(t, big1.Sub(&Integer{Value: 1}).HashKey(), (&Integer{Value: math.MaxInt64}).HashKey())
+	assert.Equal(t, big1.HashKey(), (&Float{Value: 9223372036854775808}).HashKey())
+}
@@ -4,18 +4,26 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
 	"strings"
 
 	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/token"
 )
 
 type ObjectType string
 
 const (
 	INTEGER_OBJ      = "INTEGER"
+	FLOAT_OBJ        = "FLOAT"
 	BOOLEAN_OBJ      = "BOOLEAN"
 	NULL_OBJ         = "NULL"
 	RETURN_VALUE_OBJ = "RETURN"
+	BREAK_OBJ        = "BREAK"
+	CONTINUE_OBJ     = "CONTINUE"
 	ERROR_OBJ        = "ERROR"
 	FUNCTION_OBJ     = "FUNCTION"
 	STRING_OBJ       = "STRING"
@@ -34,20 +42,36 @@ type Object interface {
 	Inspect() string
 }
 
-type Integer struct {
-	Value int64
+type Float struct {
+	Value float64
 }
 
-func (i *Integer) Inspect() string {
-	return fmt.Sprintf("%d", i.Value)
+// floats always show they're floats (2.0 rather than 2), huge and tiny ones use the exponent notation
+func (f *Float) Inspect() string {
+	abs := math.Abs(f.Value)
+	var out string
+	if abs >= 1e21 || (abs < 1e-7 && abs != 0) {
+		out = strconv.FormatFloat(f.Value, 'e', -1, 64)
+	} else {
+		out = strconv.FormatFloat(f.Value, 'f', -1, 64)
+	}
+	if !strings.ContainsAny(out, ".eIN") {
+		out += ".0"
+	}
+	return out
 }
 
-func (i *Integer) Type() ObjectType {
-	return INTEGER_OBJ
+func (f *Float) Type() ObjectType {
+	return FLOAT_OBJ
 }
 
-func (i *Integer) HashKey() HashKey {
-	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
+// integral floats hash the same as the equal integers, because 1 == 1.0
+func (f *Float) HashKey() HashKey {
+	if f.Value == math.Trunc(f.Value) && !math.IsInf(f.Value, 0) {
+		value, _ := big.NewFloat(f.Value).Int(nil)
+		return NewBigInteger(value).HashKey()
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
 }
 
 type Boolean struct {
@@ -94,8 +118,64 @@ func (rv *ReturnValue) Inspect() string {
 	return rv.Value.Inspect()
 }
 
+// break and continue are signals passed up from the statement to the enclosing loop, like return values are
+type Break struct{}
+
+func (b *Break) Type() ObjectType {
+	return BREAK_OBJ
+}
+
+func (b *Break) Inspect() string {
+	return "break"
+}
+
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType {
+	return CONTINUE_OBJ
+}
+
+func (c *Continue) Inspect() string {
+	return "continue"
+}
+
+// kinds of errors that stop the evaluation for other reasons than a mistake in the code,
+// the host can tell them apart from the ordinary errors (which have no kind)
+type ErrorKind string
+
+const (
+	TIMEOUT_ERROR        ErrorKind = "TIMEOUT"
+	CANCELLED_ERROR      ErrorKind = "CANCELLED"
+	STACK_OVERFLOW_ERROR ErrorKind = "STACK_OVERFLOW"
+	STEP_LIMIT_ERROR     ErrorKind = "STEP_LIMIT"
+	MEMORY_LIMIT_ERROR   ErrorKind = "MEMORY_LIMIT"
+)
+
 type Error struct {
 	Message string
+	Span    token.Span // where the error happened, if known
+	Kind    ErrorKind  // empty for ordinary errors
+	Stack   []Frame    // calls the error propagated out of, the innermost first
+	Value   Object     // value given to throw, nil for the errors raised by the interpreter itself
+}
+
+// errors stopping the run (timeouts, exceeded limits) can't be caught by the code, otherwise it could ignore them
+func (e *Error) Catchable() bool {
+	switch e.Kind {
+	case TIMEOUT_ERROR, CANCELLED_ERROR, STEP_LIMIT_ERROR, MEMORY_LIMIT_ERROR:
+		return false
+	}
+	return true
+}
+
+// function call on the stack of an error
+type Frame struct {
+	Function string     // name of the called function, empty for anonymous functions
+	Builtin  bool       // builtins have no position of their own
+	CallSite token.Span // where the function was called from, invalid when called by the host
+
+	// the function was tail called at the end of a chain of tail calls, started at CallSite, whose other frames are lost
+	Elided bool
 }
 
 func (e *Error) Type() ObjectType {
@@ -103,13 +183,66 @@ func (e *Error) Type() ObjectType {
 }
 
 func (e *Error) Inspect() string {
+	if e.Span.IsValid() {
+		return fmt.Sprintf("ERROR: %s: %s", e.Span, e.Message)
+	}
 	return fmt.Sprintf("ERROR: %s", e.Message)
 }
 
+// traceback of the error, one line per frame, the innermost call first:
+//
+//	at add (main.mk:2:5)
+//	at twice (main.mk:6:3)
+//	at main.mk:9:1
+//
+// Positions are where the error happened in the function, the last line is the call made from the top level.
+// Runs of the same line (e.g. from a deep recursion) are collapsed, as are the frames lost to the tail calls.
+func (e *Error) StackTrace() []string {
+	var lines []string
+	location := e.Span
+	for _, frame := range e.Stack {
+		name := frame.Function
+		if name == "" {
+			name = "<anonymous>"
+		}
+		switch {
+		case frame.Builtin:
+			lines = append(lines, fmt.Sprintf("at %s (builtin)", name))
+		case location.IsValid():
+			lines = append(lines, fmt.Sprintf("at %s (%s)", name, location.Start))
+		default:
+			lines = append(lines, "at "+name)
+		}
+		if frame.Elided {
+			lines = append(lines, "... tail calls elided")
+		}
+		location = frame.CallSite
+	}
+	if len(e.Stack) > 0 && location.IsValid() {
+		lines = append(lines, "at "+location.Start.String())
+	}
+
+	var collapsed []string
+	for i := 0; i < len(lines); {
+		j := i + 1
+		for j < len(lines) && lines[j] == lines[i] {
+			j += 1
+		}
+		collapsed = append(collapsed, lines[i])
+		if repeats := j - i - 1; repeats > 0 {
+			collapsed = append(collapsed, fmt.Sprintf("... repeated %d more times", repeats))
+		}
+		i = j
+	}
+	return collapsed
+}
+
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment // function carries arount it's own environment to enable closures
+	Name       string       // name the function was defined with, empty for anonymous functions
+	Locals     int          // number of the slots of the function's environment, see ast.FunctionLiteral.Locals
 }
 
 func (f *Function) Type() ObjectType {
@@ -120,8 +253,8 @@ func (f *Function) Inspect() string {
 	var out bytes.Buffer
 
 	params := make([]string, len(f.Parameters))
-	for _, p := range f.Parameters {
-		params = append(params, p.String())
+	for i, p := range f.Parameters {
+		params[i] = p.String()
 	}
 	out.WriteString("fn")
 	out.WriteString("(")
@@ -150,10 +283,14 @@ func (s *String) HashKey() HashKey {
 	return HashKey{Type: s.Type(), Value: h.Sum64()}
 }
 
-type BuiltinFunction func(args ...Object) Object
+// builtins get the runtime of the caller, all their I/O has to go through it
+type BuiltinFunction func(rt *Runtime, args ...Object) Object
 
 type Builtin struct {
-	Fn BuiltinFunction
+	Fn        BuiltinFunction
+	Name      string
+	Signature *Signature // arguments are checked against it before Fn is called, unchecked when nil
+	Doc       string     // one line description, for the help text
 }
 
 func (b *Builtin) Type() ObjectType {
@@ -173,10 +310,19 @@ func (a *Array) Type() ObjectType {
 }
 
 func (a *Array) Inspect() string {
+	return a.inspect(nil)
+}
+
+// open are the collections being printed around this one, an array containing itself is printed as [...]
+func (a *Array) inspect(open []Object) string {
+	if isOpen(a, open) {
+		return "[...]"
+	}
+	open = append(open, a)
 	var out bytes.Buffer
 	elements := make([]string, len(a.Elements))
 	for i, e := range a.Elements {
-		elements[i] = e.Inspect()
+		elements[i] = inspectNested(e, open)
 	}
 	out.WriteString("[")
 	out.WriteString(strings.Join(elements, ", "))
@@ -202,13 +348,73 @@ func (h *Hash) Type() ObjectType {
 }
 
 func (h *Hash) Inspect() string {
+	return h.inspect(nil)
+}
+
+// like for the arrays, a hash containing itself is printed as {...}
+func (h *Hash) inspect(open []Object) string {
+	if isOpen(h, open) {
+		return "{...}"
+	}
+	open = append(open, h)
 	var out bytes.Buffer
 	var pairs []string
-	for _, p := range h.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s", p.Key.Inspect(), p.Value.Inspect()))
+	for _, p := range h.SortedPairs() {
+		pairs = append(pairs, fmt.Sprintf("%s: %s", p.Key.Inspect(), inspectNested(p.Value, open)))
 	}
 	out.WriteString("{")
 	out.WriteString(strings.Join(pairs, ", "))
 	out.WriteString("}")
 	return out.String()
 }
+
+// arrays and hashes are changed in place by the index assignments, so they can end up containing themselves
+func inspectNested(obj Object, open []Object) string {
+	switch obj := obj.(type) {
+	case *Array:
+		return obj.inspect(open)
+	case *Hash:
+		return obj.inspect(open)
+	}
+	return obj.Inspect()
+}
+
+func isOpen(collection Object, open []Object) bool {
+	for _, o := range open {
+		if o == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// pairs ordered by their keys, so that iterating over a hash or printing it is deterministic.
+// Keys are grouped by type first, then ordered by value.
+func (h *Hash) SortedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	for _, p := range h.Pairs {
+		pairs = append(pairs, p)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return lessKey(pairs[i].Key, pairs[j].Key)
+	})
+	return pairs
+}
+
+func lessKey(a, b Object) bool {
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+	switch a := a.(type) {
+	case *Integer:
+		return a.Cmp(b.(*Integer)) < 0
+	case *Float:
+		return a.Value < b.(*Float).Value
+	case *String:
+		return a.Value < b.(*String).Value
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	default:
+		return a.Inspect() < b.Inspect()
+	}
+}
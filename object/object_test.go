@@ -1,9 +1,11 @@
 package object
 
 import (
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/token"
 )
 
 func TestStringHashKey(t *testing.T) {
@@ -16,3 +18,183 @@ func TestStringHashKey(t *testing.T) {
 	assert.Equal(t, diff1.HashKey(), diff2.HashKey())
 	assert.NotEqual(t, hello1.HashKey(), diff1.HashKey())
 }
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{1.5, "1.5"},
+		{2, "2.0"},
+		{-3, "-3.0"},
+		{0, "0.0"},
+		{1500000.25, "1500000.25"},
+		{1e21, "1e+21"},
+		{1e-9, "1e-09"},
+		{math.Inf(1), "+Inf"},
+		{math.NaN(), "NaN"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, (&Float{Value: tt.value}).Inspect())
+	}
+}
+
+func TestFloatHashKey(t *testing.T) {
+	assert.Equal(t, (&Float{Value: 1.5}).HashKey(), (&Float{Value: 1.5}).HashKey())
+	assert.NotEqual(t, (&Float{Value: 1.5}).HashKey(), (&Float{Value: 2.5}).HashKey())
+	assert.Equal(t, (&Integer{Value: 2}).HashKey(), (&Float{Value: 2.0}).HashKey())
+}
+
+func TestHashInspectIsOrdered(t *testing.T) {
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	for _, key := range []Object{&String{Value: "b"}, &Integer{Value: 10}, &String{Value: "a"}, &Integer{Value: 2}, &Boolean{Value: true}} {
+		hash.Pairs[key.(Hashable).HashKey()] = HashPair{Key: key, Value: &Null{}}
+	}
+
+	assert.Equal(t, "{true: null, 2: null, 10: null, a: null, b: null}", hash.Inspect())
+}
+
+func TestInspectCycles(t *testing.T) {
+	array := &Array{Elements: []Object{&Integer{Value: 1}}}
+	array.Elements = append(array.Elements, array)
+	key := &String{Value: "self"}
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	hash.Pairs[key.HashKey()] = HashPair{Key: key, Value: hash}
+	other := &String{Value: "array"}
+	hash.Pairs[other.HashKey()] = HashPair{Key: other, Value: array}
+
+	assert.Equal(t, "[1, [...]]", array.Inspect())
+	assert.Equal(t, "{array: [1, [...]], self: {...}}", hash.Inspect())
+	// the same collection in several places isn't a cycle
+	assert.Equal(t, "[[1, [...]], [1, [...]]]", (&Array{Elements: []Object{array, array}}).Inspect())
+}
+
+func TestEnvironmentNames(t *testing.T) {
+	outer := NewEnvironment()
+	outer.Set("outer", &Null{})
+	env := NewEnclosedEnvironment(outer)
+	env.Set("b", &Null{})
+	env.Set("a", &Null{})
+
+	assert.Equal(t, []string{"a", "b"}, env.Names())
+}
+
+func TestEnvironmentLocals(t *testing.T) {
+	global := NewEnvironment()
+	outer := NewFunctionEnvironment(global, 2)
+	env := NewFunctionEnvironment(outer, 1)
+	one, two := &Integer{Value: 1}, &Integer{Value: 2}
+	outer.SetLocal(0, 1, one)
+	env.SetLocal(0, 0, two)
+	env.Set("unresolved", two)
+
+	assert.Same(t, one, env.Local(1, 1))
+	assert.Nil(t, env.Local(1, 0))
+	assert.Same(t, two, env.Local(0, 0))
+	assert.Same(t, two, outer.SetLocal(0, 0, two))
+	assert.Same(t, two, env.Local(1, 0))
+	assert.Same(t, global.Runtime(), env.Runtime())
+	value, ok := env.Get("unresolved")
+	assert.True(t, ok)
+	assert.Same(t, two, value)
+}
+
+func TestEnvironmentRuntime(t *testing.T) {
+	runtime := NewRuntime(nil, nil, nil)
+	env := NewEnclosedEnvironment(NewEnvironmentWithRuntime(runtime))
+
+	assert.Same(t, runtime, env.Runtime())
+	line, err := runtime.StdinReader().ReadString('\n')
+	assert.Equal(t, "", line)
+	assert.Error(t, err)
+	assert.NotNil(t, NewEnvironment().Runtime().Stdout)
+}
+
+func TestErrorStackTrace(t *testing.T) {
+	at := func(line, column int) token.Span {
+		return token.Span{Start: token.Position{File: "main.mk", Offset: column, Line: line, Column: column}}
+	}
+	tests := []struct {
+		err      *Error
+		expected []string
+	}{
+		{&Error{Message: "no calls", Span: at(1, 1)}, nil},
+		{
+			&Error{Span: at(2, 5), Stack: []Frame{{Function: "add", CallSite: at(6, 3)}, {Function: "", CallSite: at(9, 1)}}},
+			[]string{"at add (main.mk:2:5)", "at <anonymous> (main.mk:6:3)", "at main.mk:9:1"},
+		},
+		{
+			&Error{Span: at(1, 10), Stack: []Frame{{Function: "len", Builtin: true, CallSite: at(1, 10)}, {Function: "f", CallSite: at(2, 1)}}},
+			[]string{"at len (builtin)", "at f (main.mk:1:10)", "at main.mk:2:1"},
+		},
+		{
+			&Error{Span: at(1, 5), Stack: []Frame{{Function: "f", CallSite: at(1, 5)}, {Function: "f", CallSite: at(1, 5)}, {Function: "f", CallSite: at(3, 1)}}},
+			[]string{"at f (main.mk:1:5)", "... repeated 2 more times", "at main.mk:3:1"},
+		},
+		{
+			&Error{Span: at(1, 5), Stack: []Frame{{Function: "h", CallSite: at(2, 3)}, {Function: "g", CallSite: at(4, 3), Elided: true}, {Function: "f", CallSite: at(6, 1)}}},
+			[]string{"at h (main.mk:1:5)", "at g (main.mk:2:3)", "... tail calls elided", "at f (main.mk:4:3)", "at main.mk:6:1"},
+		},
+		{
+			&Error{Span: at(1, 5), Stack: []Frame{{Function: "called", CallSite: token.Span{}}}},
+			[]string{"at called (main.mk:1:5)"},
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, tt.err.StackTrace())
+	}
+}
+
+func TestSignatureCheck(t *testing.T) {
+	signature := &Signature{Params: []Param{
+		{Name: "text", Types: []ObjectType{STRING_OBJ}},
+		{Name: "count", Types: []ObjectType{INTEGER_OBJ, FLOAT_OBJ}, Optional: true},
+		{Name: "rest", Types: []ObjectType{STRING_OBJ}, Variadic: true},
+	}}
+	str, num := &String{Value: "a"}, &Integer{Value: 1}
+	tests := []struct {
+		signature *Signature
+		args      []Object
+		expected  string // error message, empty when the arguments match
+	}{
+		{signature, []Object{str}, ""},
+		{signature, []Object{str, num, str, str}, ""},
+		{signature, []Object{}, "wrong number of arguments to `f`: got=0, want at least 1"},
+		{signature, []Object{num}, "argument `text` to `f` must be STRING, got INTEGER"},
+		{signature, []Object{str, str}, "argument `count` to `f` must be INTEGER or FLOAT, got STRING"},
+		{signature, []Object{str, num, str, num}, "argument `rest` to `f` must be STRING, got INTEGER"},
+		{&Signature{}, []Object{str}, "wrong number of arguments to `f`: got=1, want=0"},
+		{&Signature{Params: []Param{{Name: "a"}, {Name: "b", Optional: true}}}, []Object{str, str, str}, "wrong number of arguments to `f`: got=3, want=1 to 2"},
+		{&Signature{Params: []Param{{Name: "a", Types: []ObjectType{STRING_OBJ, ARRAY_OBJ, HASH_OBJ}}}}, []Object{num}, "argument `a` to `f` must be STRING, ARRAY or HASH, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		err := tt.signature.Check("f", tt.args)
+		if tt.expected == "" {
+			assert.Nil(t, err)
+			continue
+		}
+		if assert.NotNil(t, err) {
+			assert.Equal(t, tt.expected, err.Message)
+		}
+	}
+}
+
+func TestBuiltinHelp(t *testing.T) {
+	builtin := &Builtin{
+		Name: "pad",
+		Doc:  "pads the text",
+		Signature: &Signature{
+			Params: []Param{
+				{Name: "text", Types: []ObjectType{STRING_OBJ}},
+				{Name: "width", Types: []ObjectType{INTEGER_OBJ}, Optional: true},
+				{Name: "values", Variadic: true},
+			},
+			Returns: "STRING",
+		},
+	}
+	assert.Equal(t, "pad(text: STRING, width?: INTEGER, ...values) -> STRING\n    pads the text", builtin.Help())
+	assert.Equal(t, "native(...)", (&Builtin{Name: "native"}).Help())
+}
@@ -0,0 +1,174 @@
+package object
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// used when Limits.MaxDepth is not set, low enough to never overflow the Go stack
+const DefaultMaxDepth = 10000
+
+// how often (in steps) the context is checked, checking it on every step would slow down the evaluation
+const contextCheckInterval = 1024
+
+// limits for the code run with the runtime, so that the host can safely run untrusted scripts
+type Limits struct {
+	MaxSteps  int64 // evaluation steps (evaluated nodes) per run, 0 means no limit
+	MaxDepth  int   // nested function calls, 0 means DefaultMaxDepth
+	MaxMemory int64 // approximate bytes allocated for strings, arrays and hashes per run, 0 means no limit
+}
+
+// resources used by the current run, or by the last one when none is in progress
+type Usage struct {
+	Steps  int64
+	Memory int64 // approximate bytes allocated for strings, arrays and hashes
+}
+
+// approximate sizes of the values, including the Go headers, used for the memory accounting.
+// Elements are accounted for separately, when they are created.
+const (
+	stringSize  = 32 // object and string header
+	arraySize   = 40 // object and slice header
+	hashSize    = 64 // object and map header
+	elementSize = 16 // interface value in an array
+	PairSize    = 64 // hash key, pair and map overhead
+)
+
+func StringSize(length int) int64 {
+	return stringSize + int64(length)
+}
+
+func ArraySize(length int) int64 {
+	return arraySize + elementSize*int64(length)
+}
+
+func HashSize(pairs int) int64 {
+	return hashSize + PairSize*int64(pairs)
+}
+
+// runtime is the context the code is executed in, shared by all the environments of one interpreter.
+// Builtins do all their I/O through it, so the host decides where the output goes.
+type Runtime struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	Limits Limits
+
+	stdin *bufio.Reader // created on first use, shared by all the reads so no buffered input is lost
+
+	// state of the current run
+	ctx    context.Context
+	steps  int64
+	memory int64
+	depth  int
+	active int // nesting level of runs, e.g. a Go function calling back into Monkey code starts a nested run
+}
+
+// streams left as nil are replaced with empty input / discarded output
+func NewRuntime(stdin io.Reader, stdout, stderr io.Writer) *Runtime {
+	if stdin == nil {
+		stdin = strings.NewReader("")
+	}
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	return &Runtime{Stdin: stdin, Stdout: stdout, Stderr: stderr}
+}
+
+// runtime connected to the standard streams of the process
+func DefaultRuntime() *Runtime {
+	return NewRuntime(os.Stdin, os.Stdout, os.Stderr)
+}
+
+// buffered standard input. Anything else reading from the same input (e.g. the REPL) should use this reader as well.
+func (rt *Runtime) StdinReader() *bufio.Reader {
+	if rt.stdin == nil {
+		rt.stdin = bufio.NewReader(rt.Stdin)
+	}
+	return rt.stdin
+}
+
+// starts a run: steps and allocations are counted from zero and the run is stopped once the context is done.
+// Nested runs are part of the outermost one, they share its context and counters.
+// The returned function has to be called when the run is over.
+func (rt *Runtime) Begin(ctx context.Context) (end func()) {
+	rt.active += 1
+	if rt.active == 1 {
+		rt.ctx = ctx
+		rt.steps = 0
+		rt.memory = 0
+		rt.depth = 0
+	}
+	return func() {
+		rt.active -= 1
+		if rt.active == 0 {
+			rt.ctx = nil
+		}
+	}
+}
+
+// counts an evaluation step, returns an error once the run has to stop.
+// Steps made outside of a run (without Begin) are counted as well, they just can't be cancelled.
+func (rt *Runtime) Step() *Error {
+	rt.steps += 1
+	if rt.Limits.MaxSteps > 0 && rt.steps > rt.Limits.MaxSteps {
+		return &Error{Kind: STEP_LIMIT_ERROR, Message: fmt.Sprintf("step limit of %d exceeded", rt.Limits.MaxSteps)}
+	}
+	if rt.ctx != nil && (rt.steps == 1 || rt.steps%contextCheckInterval == 0) {
+		select {
+		case <-rt.ctx.Done():
+			return contextError(rt.ctx.Err())
+		default:
+		}
+	}
+	return nil
+}
+
+// called on entering a function, every successful call has to be followed by LeaveCall
+func (rt *Runtime) EnterCall() *Error {
+	maxDepth := rt.Limits.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxDepth
+	}
+	if rt.depth >= maxDepth {
+		return &Error{Kind: STACK_OVERFLOW_ERROR, Message: fmt.Sprintf("stack overflow: maximum call depth of %d exceeded", maxDepth)}
+	}
+	rt.depth += 1
+	return nil
+}
+
+func (rt *Runtime) LeaveCall() {
+	rt.depth -= 1
+}
+
+// accounts bytes about to be allocated, returns an error if that would exceed the memory limit.
+// Called before allocating, so the oversized value is never created.
+func (rt *Runtime) Allocate(bytes int64) *Error {
+	rt.memory += bytes
+	if rt.Limits.MaxMemory > 0 && rt.memory > rt.Limits.MaxMemory {
+		return &Error{
+			Kind:    MEMORY_LIMIT_ERROR,
+			Message: fmt.Sprintf("memory limit of %d bytes exceeded: %d bytes allocated", rt.Limits.MaxMemory, rt.memory),
+		}
+	}
+	return nil
+}
+
+func (rt *Runtime) Usage() Usage {
+	return Usage{Steps: rt.steps, Memory: rt.memory}
+}
+
+func contextError(err error) *Error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Kind: TIMEOUT_ERROR, Message: "evaluation timed out"}
+	}
+	return &Error{Kind: CANCELLED_ERROR, Message: "evaluation cancelled"}
+}
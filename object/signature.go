@@ -0,0 +1,133 @@
+package object
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parameter of a builtin function
+type Param struct {
+	Name     string
+	Types    []ObjectType // accepted types, any type is accepted when empty
+	Optional bool         // can be left out, optional parameters come after all the required ones
+	Variadic bool         // takes all the remaining arguments, only the last parameter can be variadic
+}
+
+// declared parameters of a builtin, the arguments are checked against them before the builtin is called,
+// so the builtin itself can rely on getting the right number of arguments of the right types
+type Signature struct {
+	Params  []Param
+	Returns string // what the builtin returns, for the help text, e.g. "ARRAY | NULL"
+}
+
+// returns an error naming the builtin and the offending parameter when the arguments don't match
+func (s *Signature) Check(name string, args []Object) *Error {
+	if name == "" {
+		name = "<anonymous>"
+	}
+	required, max := 0, len(s.Params)
+	for _, param := range s.Params {
+		switch {
+		case param.Variadic:
+			max = -1
+		case !param.Optional:
+			required += 1
+		}
+	}
+	if len(args) < required || (max >= 0 && len(args) > max) {
+		return &Error{Message: fmt.Sprintf("wrong number of arguments to `%s`: got=%d, want%s", name, len(args), arity(required, max))}
+	}
+
+	for i, arg := range args {
+		param := s.Params[len(s.Params)-1]
+		if i < len(s.Params) {
+			param = s.Params[i]
+		}
+		if !param.accepts(arg) {
+			return &Error{Message: fmt.Sprintf("argument `%s` to `%s` must be %s, got %s", param.Name, name, oneOf(param.Types), arg.Type())}
+		}
+	}
+	return nil
+}
+
+func (p Param) accepts(arg Object) bool {
+	if len(p.Types) == 0 {
+		return true
+	}
+	for _, t := range p.Types {
+		if arg.Type() == t {
+			return true
+		}
+	}
+	return false
+}
+
+// e.g. push(array: ARRAY, value) -> ARRAY
+func (s *Signature) Format(name string) string {
+	params := make([]string, len(s.Params))
+	for i, param := range s.Params {
+		var out strings.Builder
+		if param.Variadic {
+			out.WriteString("...")
+		}
+		out.WriteString(param.Name)
+		if param.Optional {
+			out.WriteString("?")
+		}
+		if len(param.Types) > 0 {
+			out.WriteString(": " + strings.Join(typeNames(param.Types), " | "))
+		}
+		params[i] = out.String()
+	}
+	signature := fmt.Sprintf("%s(%s)", name, strings.Join(params, ", "))
+	if s.Returns != "" {
+		signature += " -> " + s.Returns
+	}
+	return signature
+}
+
+// e.g. =1, =1 to 2 or " at least 1", max is negative when there is no upper bound
+func arity(required, max int) string {
+	switch {
+	case max < 0:
+		return fmt.Sprintf(" at least %d", required)
+	case max == required:
+		return fmt.Sprintf("=%d", required)
+	default:
+		return fmt.Sprintf("=%d to %d", required, max)
+	}
+}
+
+// e.g. INTEGER, FLOAT or STRING
+func oneOf(types []ObjectType) string {
+	names := typeNames(types)
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+func typeNames(types []ObjectType) []string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = string(t)
+	}
+	return names
+}
+
+// signature of the builtin followed by its description, e.g.
+//
+//	len(value: STRING | ARRAY) -> INTEGER
+//	    number of characters in the string or elements in the array
+func (b *Builtin) Help() string {
+	var help string
+	if b.Signature != nil {
+		help = b.Signature.Format(b.Name)
+	} else {
+		help = b.Name + "(...)"
+	}
+	if b.Doc != "" {
+		help += "\n    " + b.Doc
+	}
+	return help
+}
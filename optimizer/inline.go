@@ -0,0 +1,176 @@
+package optimizer
+
+import (
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/token"
+)
+
+// functions bigger than that (in the number of nodes of their body) aren't inlined
+const maxInlinedNodes = 16
+
+// function whose calls can be replaced with its body
+type inlinable struct {
+	fn    *ast.FunctionLiteral
+	body  ast.Expression
+	after int // offset of the end of the let binding the function, only the calls following it are inlined
+}
+
+/*
+ * Functions bound with a top level let (so that the binding exists for all the code following it), whose body
+ * is a single expression made of operators, literals and the parameters. Such a body has no side effects and
+ * doesn't depend on anything else than the arguments, so it gives the same result wherever it's put.
+ * The name has to be declared only once in the whole program and never assigned to, so that it means the same
+ * function everywhere.
+ */
+func inlinableFunctions(program *ast.Program) map[string]*inlinable {
+	declared := map[string]int{}
+	assigned := map[string]bool{}
+	ast.Walk(program, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			declared[node.Name.Value] += 1
+		case *ast.FunctionLiteral:
+			for _, param := range node.Parameters {
+				declared[param.Value] += 1
+			}
+		case *ast.ForExpression:
+			declared[node.Variable.Value] += 1
+		case *ast.TryExpression:
+			if node.CatchParameter != nil {
+				declared[node.CatchParameter.Value] += 1
+			}
+		case *ast.AssignExpression:
+			if target, ok := node.Target.(*ast.Identifier); ok {
+				assigned[target.Value] = true
+			}
+		}
+		return true
+	})
+
+	functions := map[string]*inlinable{}
+	for _, statement := range program.Statements {
+		let, ok := statement.(*ast.LetStatement)
+		if !ok || declared[let.Name.Value] != 1 || assigned[let.Name.Value] {
+			continue
+		}
+		fn, ok := let.Value.(*ast.FunctionLiteral)
+		if !ok || len(fn.Body.Statements) != 1 {
+			continue
+		}
+		body, ok := fn.Body.Statements[0].(*ast.ExpressionStatement)
+		if !ok || !inlinableBody(fn, body.Expression) {
+			continue
+		}
+		functions[let.Name.Value] = &inlinable{fn: fn, body: body.Expression, after: let.Span().End.Offset}
+	}
+	return functions
+}
+
+func inlinableBody(fn *ast.FunctionLiteral, body ast.Expression) bool {
+	params := map[string]bool{}
+	for _, param := range fn.Parameters {
+		if params[param.Value] {
+			return false
+		}
+		params[param.Value] = true
+	}
+	nodes := 0
+	ok := body != nil
+	ast.Walk(body, func(node ast.Node) bool {
+		nodes += 1
+		switch node := node.(type) {
+		case *ast.Identifier:
+			ok = ok && params[node.Value]
+		case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean, *ast.PrefixExpression,
+			*ast.InfixExpression, *ast.IndexExpression:
+		default:
+			ok = false
+		}
+		return ok
+	})
+	return ok && nodes <= maxInlinedNodes
+}
+
+/*
+ * Body of the called function with the parameters replaced by the arguments, nil when the call can't be inlined.
+ * The arguments have to be literals or variables: evaluating them has no side effects, so it doesn't matter
+ * how many times and in what order the body evaluates them. A variable has to be used by the body though,
+ * otherwise an error for an undefined variable would be lost.
+ */
+func (o *optimizer) inline(call *ast.CallExpression) ast.Expression {
+	callee, ok := call.Function.(*ast.Identifier)
+	if !ok {
+		return nil
+	}
+	function, ok := o.inlinable[callee.Value]
+	if !ok || call.Span().Start.Offset < function.after || len(call.Arguments) != len(function.fn.Parameters) {
+		return nil
+	}
+
+	args := map[string]ast.Expression{}
+	used := map[string]bool{}
+	ast.Walk(function.body, func(node ast.Node) bool {
+		if identifier, ok := node.(*ast.Identifier); ok {
+			used[identifier.Value] = true
+		}
+		return true
+	})
+	for i, arg := range call.Arguments {
+		switch arg.(type) {
+		case *ast.Identifier:
+			if !used[function.fn.Parameters[i].Value] {
+				return nil
+			}
+		case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean:
+		default:
+			return nil
+		}
+		args[function.fn.Parameters[i].Value] = arg
+	}
+	return o.expression(substitute(function.body, args))
+}
+
+/*
+ * Copy of the body with the parameters replaced, the copy is optimized on its own, without changing the function.
+ * The arguments take the positions of the parameters they replace, so that the errors raised by the body point
+ * at the same places as when the function is called.
+ */
+func substitute(expression ast.Expression, args map[string]ast.Expression) ast.Expression {
+	switch node := expression.(type) {
+	case *ast.Identifier:
+		return copyLeaf(args[node.Value], node.Span())
+	case *ast.PrefixExpression:
+		return &ast.PrefixExpression{Token: node.Token, Operator: node.Operator, Right: substitute(node.Right, args)}
+	case *ast.InfixExpression:
+		return &ast.InfixExpression{Token: node.Token, Left: substitute(node.Left, args), Operator: node.Operator, Right: substitute(node.Right, args)}
+	case *ast.IndexExpression:
+		return &ast.IndexExpression{Token: node.Token, Left: substitute(node.Left, args), Index: substitute(node.Index, args), RBracket: node.RBracket}
+	}
+	return copyLeaf(expression, expression.Span())
+}
+
+func copyLeaf(expression ast.Expression, span token.Span) ast.Expression {
+	switch node := expression.(type) {
+	case *ast.Identifier:
+		copied := *node
+		copied.Token.Span = span
+		return &copied
+	case *ast.IntegerLiteral:
+		copied := *node
+		copied.Token.Span = span
+		return &copied
+	case *ast.FloatLiteral:
+		copied := *node
+		copied.Token.Span = span
+		return &copied
+	case *ast.StringLiteral:
+		copied := *node
+		copied.Token.Span = span
+		return &copied
+	case *ast.Boolean:
+		copied := *node
+		copied.Token.Span = span
+		return &copied
+	}
+	return expression
+}
@@ -0,0 +1,229 @@
+package optimizer
+
+import (
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/token"
+)
+
+/*
+ * Rewrites the syntax tree before it's evaluated or compiled, so that the work known upfront isn't repeated
+ * on every evaluation:
+ *
+ *   - constant folding: operators applied to integer, string and boolean literals are replaced with their result,
+ *     e.g. 2 * 60 * 60 becomes 7200. Operations failing at runtime (like 1 / 0) are left as they are.
+ *   - dead branches: if's with constant conditions lose the branch that never runs, as statements they're
+ *     replaced with the statements of the branch that does (blocks don't have their own scope).
+ *   - inlining: calls of small functions bound with a top level let are replaced with the function's body.
+ *
+ * The optimized program gives the same results as the original one, except for the errors raised by the inlined
+ * code: their tracebacks don't have the frame of the inlined function and an undefined variable passed to it
+ * is reported at the parameter's place in the function's body.
+ */
+func Optimize(program *ast.Program) *ast.Program {
+	o := &optimizer{inlinable: inlinableFunctions(program), rt: object.NewRuntime(nil, nil, nil)}
+	program.Statements = o.statements(program.Statements)
+	return program
+}
+
+type optimizer struct {
+	inlinable map[string]*inlinable
+	rt        *object.Runtime // for the folded operations, nothing folded is ever seen by the program's runtime
+}
+
+func (o *optimizer) statements(statements []ast.Statement) []ast.Statement {
+	var optimized []ast.Statement
+	for i, statement := range statements {
+		statement = o.statement(statement)
+		// the value of an if that isn't the last statement is discarded, so only the statements of the branch matter
+		if es, ok := statement.(*ast.ExpressionStatement); ok && i < len(statements)-1 {
+			if ie, ok := es.Expression.(*ast.IfExpression); ok {
+				if truthy, constant := constantCondition(ie.Condition); constant {
+					if truthy {
+						optimized = append(optimized, ie.Consequence.Statements...)
+					}
+					continue
+				}
+			}
+		}
+		optimized = append(optimized, statement)
+	}
+	return optimized
+}
+
+func (o *optimizer) statement(statement ast.Statement) ast.Statement {
+	switch statement := statement.(type) {
+	case *ast.ExpressionStatement:
+		statement.Expression = o.expression(statement.Expression)
+	case *ast.LetStatement:
+		statement.Value = o.expression(statement.Value)
+	case *ast.ReturnStatement:
+		statement.ReturnValue = o.expression(statement.ReturnValue)
+	case *ast.ThrowStatement:
+		statement.Value = o.expression(statement.Value)
+	case *ast.BlockStatement:
+		o.block(statement)
+	}
+	return statement
+}
+
+func (o *optimizer) block(block *ast.BlockStatement) {
+	if block != nil {
+		block.Statements = o.statements(block.Statements)
+	}
+}
+
+func (o *optimizer) expression(expression ast.Expression) ast.Expression {
+	switch node := expression.(type) {
+	case *ast.PrefixExpression:
+		node.Right = o.expression(node.Right)
+		return o.foldPrefix(node)
+	case *ast.InfixExpression:
+		node.Left = o.expression(node.Left)
+		node.Right = o.expression(node.Right)
+		return o.foldInfix(node)
+	case *ast.IfExpression:
+		node.Condition = o.expression(node.Condition)
+		o.block(node.Consequence)
+		o.block(node.Alternative)
+		eliminateDeadBranch(node)
+	case *ast.WhileExpression:
+		node.Condition = o.expression(node.Condition)
+		o.block(node.Body)
+	case *ast.ForExpression:
+		node.Iterable = o.expression(node.Iterable)
+		o.block(node.Body)
+	case *ast.TryExpression:
+		o.block(node.Body)
+		o.block(node.Catch)
+		o.block(node.Finally)
+	case *ast.AssignExpression:
+		if target, ok := node.Target.(*ast.IndexExpression); ok {
+			target.Left = o.expression(target.Left)
+			target.Index = o.expression(target.Index)
+		}
+		node.Value = o.expression(node.Value)
+	case *ast.FunctionLiteral:
+		o.block(node.Body)
+	case *ast.CallExpression:
+		node.Function = o.expression(node.Function)
+		for i, arg := range node.Arguments {
+			node.Arguments[i] = o.expression(arg)
+		}
+		if inlined := o.inline(node); inlined != nil {
+			return inlined
+		}
+	case *ast.ArrayLiteral:
+		for i, element := range node.Elements {
+			node.Elements[i] = o.expression(element)
+		}
+	case *ast.IndexExpression:
+		node.Left = o.expression(node.Left)
+		node.Index = o.expression(node.Index)
+	case *ast.HashLiteral:
+		pairs := make(map[ast.Expression]ast.Expression, len(node.Pairs))
+		for _, pair := range node.OrderedPairs() {
+			pairs[o.expression(pair[0])] = o.expression(pair[1])
+		}
+		node.Pairs = pairs
+	}
+	return expression
+}
+
+func (o *optimizer) foldPrefix(node *ast.PrefixExpression) ast.Expression {
+	right := constantValue(node.Right)
+	if right == nil {
+		return node
+	}
+	return literal(evaluator.PrefixOperation(node.Operator, right), node)
+}
+
+func (o *optimizer) foldInfix(node *ast.InfixExpression) ast.Expression {
+	left := constantValue(node.Left)
+	if left == nil {
+		return node
+	}
+	// && and || result in the operand deciding the result, which a constant left operand already knows
+	switch node.Operator {
+	case "&&":
+		if evaluator.IsTruthy(left) {
+			return node.Right
+		}
+		return node.Left
+	case "||":
+		if evaluator.IsTruthy(left) {
+			return node.Left
+		}
+		return node.Right
+	}
+	right := constantValue(node.Right)
+	if right == nil {
+		return node
+	}
+	return literal(evaluator.InfixOperation(o.rt, node.Operator, left, right), node)
+}
+
+// if's with a constant condition are left with the branch that runs, as the consequence.
+// The condition stays, so that the if still evaluates to null when no branch runs.
+func eliminateDeadBranch(node *ast.IfExpression) {
+	truthy, constant := constantCondition(node.Condition)
+	switch {
+	case !constant:
+	case truthy:
+		node.Alternative = nil
+	case node.Alternative != nil:
+		node.Condition = &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "true", Span: node.Condition.Span()}, Value: true}
+		node.Consequence = node.Alternative
+		node.Alternative = nil
+	default:
+		node.Consequence = &ast.BlockStatement{Token: node.Consequence.Token, RBrace: node.Consequence.RBrace}
+	}
+}
+
+func constantCondition(condition ast.Expression) (truthy bool, constant bool) {
+	if _, ok := condition.(*ast.FloatLiteral); ok {
+		return true, true
+	}
+	value := constantValue(condition)
+	if value == nil {
+		return false, false
+	}
+	return evaluator.IsTruthy(value), true
+}
+
+// value of the integer, string or boolean literal, nil for anything else
+func constantValue(expression ast.Expression) object.Object {
+	switch node := expression.(type) {
+	case *ast.IntegerLiteral:
+		if node.Big != nil {
+			return object.NewBigInteger(node.Big)
+		}
+		return &object.Integer{Value: node.Value}
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}
+	case *ast.Boolean:
+		if node.Value {
+			return evaluator.TRUE
+		}
+		return evaluator.FALSE
+	}
+	return nil
+}
+
+// literal with the folded value, spanning the folded expression. Anything else (e.g. an error) is left to runtime.
+func literal(value object.Object, folded ast.Expression) ast.Expression {
+	span := folded.Span()
+	switch value := value.(type) {
+	case *object.Integer:
+		return &ast.IntegerLiteral{Token: token.Token{Type: token.INT, Literal: value.Inspect(), Span: span}, Value: value.Value, Big: value.Big}
+	case *object.String:
+		return &ast.StringLiteral{Token: token.Token{Type: token.STRING, Literal: value.Value, Span: span}, Value: value.Value}
+	case *object.Boolean:
+		if value.Value {
+			return &ast.Boolean{Token: token.Token{Type: token.TRUE, Literal: "true", Span: span}, Value: true}
+		}
+		return &ast.Boolean{Token: token.Token{Type: token.FALSE, Literal: "false", Span: span}, Value: false}
+	}
+	return folded
+}
@@ -0,0 +1,134 @@
+package optimizer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/lexer"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/parser"
+)
+
+func TestConstantFolding(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"2 * 60 * 60", "7200"},
+		{"1 + 2 * 3 - 4 / 2", "5"},
+		{"-(5 + 5)", "-10"},
+		{`"a" + "b" + "c"`, "abc"},
+		{"1 < 2", "true"},
+		{"1 == 1", "true"},
+		{"!true", "false"},
+		{"!(1 == 2)", "true"},
+		{"9223372036854775807 + 1", "9223372036854775808"},
+		{"true && false", "false"},
+		{"false || 3", "3"},
+		{"true && x", "x"},
+		{"false && x", "false"},
+		{"x + 1 * 2", "(x + 2)"},
+		{"x * 2 * 3", "((x * 2) * 3)"},
+		{"1 / 0", "(1 / 0)"},
+		{`"a" * 3`, "(a * 3)"},
+		{"1 + true", "(1 + true)"},
+		{"1.5 + 1", "(1.5 + 1)"},
+		{"let x = 60 * 60;", "let x = 3600;"},
+		{"fn(a) { a + 2 * 3 }", "fn(a) (a + 6)"},
+		{"[1 + 1, {\"k\" + \"v\": 2 * 3}][0 + 0]", "([2, {kv: 6}][0])"},
+		{"f(1 + 1)", "f(2)"},
+		{"while (x < 10 * 10) { x = x + 2 * 2 }", "while(x < 100) (x = (x + 4))"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Optimize(parse(tt.input)).String(), tt.input)
+	}
+}
+
+func TestDeadBranchElimination(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"if (true) { 1 } else { 2 }", "iftrue 1"},
+		{"if (1 > 2) { 1 } else { 2 }", "iftrue 2"},
+		{"if (false) { 1 }", "iffalse "},
+		{"if (0) { 1 } else { 2 }", "if0 1"},
+		{"if (x) { 1 } else { 2 }", "ifx 1else 2"},
+		{"if (1 < 2) { puts(1); puts(2) }; 3", "puts(1)puts(2)3"},
+		{"if (false) { puts(1) } else { puts(2) }; 3", "puts(2)3"},
+		{"if (false) { puts(1) }; 3", "3"},
+		{"fn() { if (true) { let a = 1; } a }", "fn() let a = 1;a"},
+		{"if (true) { if (false) { 1 } else { 2 } }", "iftrue iftrue 2"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Optimize(parse(tt.input)).String(), tt.input)
+	}
+}
+
+func TestInlining(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let sq = fn(x) { x * x }; sq(3)", "let sq = fn(x) (x * x);9"},
+		{"let sq = fn(x) { x * x }; let a = 2; sq(a)", "let sq = fn(x) (x * x);let a = 2;(a * a)"},
+		{"let add = fn(a, b) { a + b }; add(1, add(2, 3))", "let add = fn(a, b) (a + b);6"},
+		{"let first = fn(a) { a[0] }; let xs = [1]; first(xs)", "let first = fn(a) (a[0]);let xs = [1];(xs[0])"},
+		{"let f = fn(a) { -a }; fn() { f(1) }", "let f = fn(a) (-a);fn() -1"},
+		{`let greet = fn(name) { "hi " + name }; greet("bob")`, "let greet = fn(name) (hi  + name);hi bob"},
+		// not inlined
+		{"let f = fn(x) { x }; f(g())", "let f = fn(x) x;f(g())"},
+		{"let f = fn(x) { x + y }; f(1)", "let f = fn(x) (x + y);f(1)"},
+		{"let f = fn(x) { puts(x) }; f(1)", "let f = fn(x) puts(x);f(1)"},
+		{"let f = fn(x) { let y = x; y }; f(1)", "let f = fn(x) let y = x;y;f(1)"},
+		{"let f = fn(x) { x }; f(1, 2)", "let f = fn(x) x;f(1, 2)"},
+		{"let f = fn(x) { 1 }; f(y)", "let f = fn(x) 1;f(y)"},
+		{"let f = fn(x, x) { x }; f(1, 2)", "let f = fn(x, x) x;f(1, 2)"},
+		{"let f = fn(x) { x }; f = fn(x) { 2 }; f(1)", "let f = fn(x) x;(f = fn(x) 2)f(1)"},
+		{"let f = fn(x) { x }; let g = fn(f) { f(1) }", "let f = fn(x) x;let g = fn(f) f(1);"},
+		{"f(1); let f = fn(x) { x };", "f(1)let f = fn(x) x;"},
+		{"let f = fn(x) { x + x + x + x + x + x + x + x + x }; f(1)", "let f = fn(x) ((((((((x + x) + x) + x) + x) + x) + x) + x) + x);f(1)"},
+		{"if (true) { let f = fn(x) { x } }; f(1)", "let f = fn(x) x;f(1)"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Optimize(parse(tt.input)).String(), tt.input)
+	}
+}
+
+func TestSameResults(t *testing.T) {
+	inputs := []string{
+		"let seconds = fn(hours) { hours * 60 * 60 }; let total = 0; let i = 0; while (i < 3) { total = total + seconds(i); i = i + 1 }; total",
+		"let sq = fn(x) { x * x }; let n = 3; [sq(n), sq(4), sq(n) + sq(n)]",
+		`let join = fn(a, b) { a + ", " + b }; join("a", "b")`,
+		"let second = fn(xs) { xs[1] }; let xs = [1, 2, 3]; second(xs) + second([4, 5])",
+		"if (1 > 2) { 1 } else { 2 }",
+		"if (false) { 1 }",
+		"let x = 1; if (true) { x = x + 1 }; x",
+		"let f = fn(x) { if (x > 1) { \"big\" } else { \"small\" } }; [f(1), f(2)]",
+		"let div = fn(a, b) { a / b }; div(1, 0)",
+		"let neg = fn(x) { -x }; neg(true)",
+		"let add = fn(a, b) { a + b }; let t = true; add(1, t)",
+		"let f = fn(a) { a[0] }; f(7)",
+		"true && 1 + 1",
+		"false || 2 * 2",
+		"9223372036854775807 * 2",
+		`"a" + 1`,
+		"try { throw 1 + 1 } catch (e) { e * 10 }",
+	}
+
+	for _, input := range inputs {
+		expected := evaluator.Eval(parse(input), object.NewEnvironment())
+		actual := evaluator.Eval(Optimize(parse(input)), object.NewEnvironment())
+		assert.Equal(t, expected.Type(), actual.Type(), input)
+		assert.Equal(t, expected.Inspect(), actual.Inspect(), input)
+	}
+}
+
+func parse(input string) *ast.Program {
+	return parser.New(lexer.New(input)).ParseProgram()
+}
@@ -1,10 +1,15 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
+	"sort"
 	"strconv"
+	"strings"
 
 	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/diagnostic"
 	"kjarmicki.github.com/monkey/lexer"
 	"kjarmicki.github.com/monkey/token"
 )
@@ -19,10 +24,13 @@ type (
 const (
 	_ int = iota
 	LOWEST
+	ASSIGN      // x = y or x += y
+	OR          // ||
+	AND         // &&
 	EQUALS      // ==
 	LESSGREATER // > or <
 	SUM         // +
-	PRODUCT     // *
+	PRODUCT     // * or %
 	PREFIX      // -x or !x
 	CALL        // myFunction(x)
 	INDEX       // array[index]
@@ -30,25 +38,49 @@ const (
 
 // this map defines which tokens have the same precedence
 var predences = map[token.TokenType]int{
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
+	token.ASSIGN:          ASSIGN,
+	token.PLUS_ASSIGN:     ASSIGN,
+	token.MINUS_ASSIGN:    ASSIGN,
+	token.ASTERISK_ASSIGN: ASSIGN,
+	token.SLASH_ASSIGN:    ASSIGN,
+	token.OR:              OR,
+	token.AND:             AND,
+	token.EQ:              EQUALS,
+	token.NOT_EQ:          EQUALS,
+	token.LT:              LESSGREATER,
+	token.GT:              LESSGREATER,
+	token.LT_EQ:           LESSGREATER,
+	token.GT_EQ:           LESSGREATER,
+	token.PLUS:            SUM,
+	token.MINUS:           SUM,
+	token.SLASH:           PRODUCT,
+	token.ASTERISK:        PRODUCT,
+	token.PERCENT:         PRODUCT,
+	token.LPAREN:          CALL,
+	token.LBRACKET:        INDEX,
 }
 
 type Parser struct {
 	l      *lexer.Lexer
-	errors []string
+	errors []*diagnostic.Diagnostic
 
 	curToken  token.Token
 	peekToken token.Token
 
+	// text of the doc comments that directly preceded curToken / peekToken
+	curDoc  string
+	peekDoc string
+
+	// panic mode: set after an error, cleared once the parser resynchronizes at a statement boundary.
+	// While panicking, follow-up errors caused by the first one are not reported.
+	panicking bool
+	// set when the statement that failed ended on the closing brace of the enclosing block
+	atBlockEnd bool
+
+	braceDepth int // number of currently open braces, including curToken
+	blockDepth int // braceDepth of the innermost block being parsed, 0 at the top level
+	loopDepth  int // number of loops enclosing curToken within the current function
+
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
 }
@@ -56,19 +88,23 @@ type Parser struct {
 func New(l *lexer.Lexer) *Parser {
 	p := &Parser{
 		l:      l,
-		errors: make([]string, 0),
+		errors: make([]*diagnostic.Diagnostic, 0),
 	}
 
 	// register prefix parsers
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
+	p.registerPrefix(token.WHILE, p.parseWhileExpression)
+	p.registerPrefix(token.FOR, p.parseForExpression)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
@@ -84,7 +120,17 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.OR, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.PLUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.MINUS_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASTERISK_ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.SLASH_ASSIGN, p.parseAssignExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
 
 	// read two tokens so curToken and peekToken are both set
@@ -102,18 +148,107 @@ func (p *Parser) registerInfix(tokenType token.TokenType, fn infixParseFn) {
 	p.infixParseFns[tokenType] = fn
 }
 
-func (p *Parser) Errors() []string {
-	return p.errors
+// lexer and parser errors, in the order they appear in the source
+func (p *Parser) Errors() []*diagnostic.Diagnostic {
+	lexerErrors := p.l.Errors()
+	if len(lexerErrors) == 0 {
+		return p.errors
+	}
+	errors := make([]*diagnostic.Diagnostic, 0, len(lexerErrors)+len(p.errors))
+	errors = append(errors, lexerErrors...)
+	errors = append(errors, p.errors...)
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errors[i].Span.Start.Offset < errors[j].Span.Start.Offset
+	})
+	return errors
+}
+
+func (p *Parser) addError(d *diagnostic.Diagnostic) {
+	if p.panicking {
+		return
+	}
+	p.panicking = true
+	// illegal tokens have already been reported by the lexer, with a better explanation
+	if d.Actual == token.ILLEGAL {
+		return
+	}
+	p.errors = append(p.errors, d)
+}
+
+// reports an error that doesn't break the structure of the code, so unlike addError
+// it doesn't put the parser into panic mode and parsing continues as usual
+func (p *Parser) reportError(d *diagnostic.Diagnostic) {
+	if p.panicking {
+		return
+	}
+	p.errors = append(p.errors, d)
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.addError(&diagnostic.Diagnostic{
+		Severity: diagnostic.ERROR,
+		Code:     diagnostic.UNEXPECTED_TOKEN,
+		Message:  fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type),
+		Span:     p.peekToken.Span,
+		Expected: []token.TokenType{t},
+		Actual:   p.peekToken.Type,
+		Hint:     expectedTokenHint(t, p.peekToken.Type),
+	})
+}
+
+// suggestions for the most common mistakes
+func expectedTokenHint(expected, actual token.TokenType) string {
+	if actual == token.EOF {
+		switch expected {
+		case token.RPAREN, token.RBRACE, token.RBRACKET:
+			return fmt.Sprintf("input ended early, is a closing %s missing?", expected)
+		}
+	}
+	switch expected {
+	case token.IDENT:
+		return "a name is required here, e.g. let x = 5;"
+	case token.ASSIGN:
+		return "bindings need a value, e.g. let x = 5;"
+	}
+	return ""
+}
+
+// reads the next token from the lexer, collecting doc comments in front of it on the way
+func (p *Parser) readToken() (token.Token, string) {
+	var docs []string
+	for {
+		tok := p.l.NextToken()
+		if tok.Type != token.DOC_COMMENT {
+			return tok, strings.Join(docs, "\n")
+		}
+		docs = append(docs, tok.Literal)
+	}
+}
+
+// same as peekError, but for the current token
+func (p *Parser) curError(t token.TokenType) {
+	p.addError(&diagnostic.Diagnostic{
+		Severity: diagnostic.ERROR,
+		Code:     diagnostic.UNEXPECTED_TOKEN,
+		Message:  fmt.Sprintf("expected %s, got %s instead", t, p.curToken.Type),
+		Span:     p.curToken.Span,
+		Expected: []token.TokenType{t},
+		Actual:   p.curToken.Type,
+		Hint:     expectedTokenHint(t, p.curToken.Type),
+	})
 }
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
-	p.peekToken = p.l.NextToken()
+	p.curDoc = p.peekDoc
+	p.peekToken, p.peekDoc = p.readToken()
+
+	switch {
+	case p.curTokenIs(token.LBRACE):
+		p.braceDepth += 1
+	case p.curTokenIs(token.RBRACE) && p.braceDepth > 0:
+		p.braceDepth -= 1
+	}
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
@@ -125,25 +260,81 @@ func (p *Parser) ParseProgram() *ast.Program {
 		if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
 		}
+		// stray closing brace at the top level, there's no block to end so just skip it
+		p.atBlockEnd = false
 		p.nextToken()
 	}
 
 	return program
 }
 
+// parses a single statement, leaving curToken on its last token.
+// If the statement is broken, nil is returned and the parser is resynchronized
+// so that the next statement can be parsed independently.
 func (p *Parser) parseStatement() ast.Statement {
+	var stmt ast.Statement
 	switch p.curToken.Type {
 	case token.LET:
-		return p.parseLetStatement()
+		if let := p.parseLetStatement(); let != nil {
+			stmt = let
+		}
 	case token.RETURN:
-		return p.parseReturnStatement()
+		if ret := p.parseReturnStatement(); ret != nil {
+			stmt = ret
+		}
+	case token.THROW:
+		if throw := p.parseThrowStatement(); throw != nil {
+			stmt = throw
+		}
+	case token.BREAK:
+		stmt = p.parseBreakStatement()
+	case token.CONTINUE:
+		stmt = p.parseContinueStatement()
 	default:
-		return p.parseExpressionStatement()
+		if exp := p.parseExpressionStatement(); exp != nil {
+			stmt = exp
+		}
+	}
+
+	if p.panicking {
+		p.synchronize()
+		return nil
+	}
+	return stmt
+}
+
+// skips tokens until a statement boundary of the enclosing block: right after a semicolon,
+// before let / return / throw / break / continue, or before the closing brace of the block. Never goes past EOF.
+// Braces opened by the broken statement itself are skipped as a whole. The broken statements don't take
+// their semicolon, so that the braces are counted from where the error was found (e.g. a closing brace).
+func (p *Parser) synchronize() {
+	p.panicking = false
+
+	// the statement broke on a closing brace that ends the enclosing block
+	if p.curTokenIs(token.RBRACE) && p.blockDepth > 0 && p.braceDepth < p.blockDepth {
+		p.atBlockEnd = true
+		return
+	}
+
+	for !p.curTokenIs(token.EOF) && !p.peekTokenIs(token.EOF) {
+		if p.braceDepth == p.blockDepth {
+			if p.curTokenIs(token.SEMICOLON) {
+				return
+			}
+			switch {
+			case p.peekTokenIs(token.LET), p.peekTokenIs(token.RETURN), p.peekTokenIs(token.THROW),
+				p.peekTokenIs(token.BREAK), p.peekTokenIs(token.CONTINUE):
+				return
+			case p.peekTokenIs(token.RBRACE) && p.blockDepth > 0:
+				return
+			}
+		}
+		p.nextToken()
 	}
 }
 
 func (p *Parser) parseLetStatement() *ast.LetStatement {
-	stmt := &ast.LetStatement{Token: p.curToken}
+	stmt := &ast.LetStatement{Token: p.curToken, Doc: p.curDoc}
 	if !p.expectPeek(token.IDENT) {
 		return nil
 	}
@@ -153,8 +344,12 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	}
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
+	// functions remember the name they were defined with, e.g. for stack traces
+	if function, ok := stmt.Value.(*ast.FunctionLiteral); ok {
+		function.Name = stmt.Name.Value
+	}
 
-	for !p.curTokenIs(token.SEMICOLON) {
+	if p.peekTokenIs(token.SEMICOLON) && !p.panicking {
 		p.nextToken()
 	}
 	return stmt
@@ -165,17 +360,60 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	p.nextToken()
 	stmt.ReturnValue = p.parseExpression((LOWEST))
 
-	for !p.curTokenIs(token.SEMICOLON) {
+	if p.peekTokenIs(token.SEMICOLON) && !p.panicking {
 		p.nextToken()
 	}
 	return stmt
 }
 
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stmt := &ast.ThrowStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+
+	if p.peekTokenIs(token.SEMICOLON) && !p.panicking {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseBreakStatement() *ast.BreakStatement {
+	stmt := &ast.BreakStatement{Token: p.curToken}
+	p.checkInsideLoop()
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+func (p *Parser) parseContinueStatement() *ast.ContinueStatement {
+	stmt := &ast.ContinueStatement{Token: p.curToken}
+	p.checkInsideLoop()
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// break and continue are syntactically fine anywhere, only their placement is wrong
+func (p *Parser) checkInsideLoop() {
+	if p.loopDepth > 0 {
+		return
+	}
+	p.reportError(&diagnostic.Diagnostic{
+		Severity: diagnostic.ERROR,
+		Code:     diagnostic.OUTSIDE_LOOP,
+		Message:  fmt.Sprintf("%s outside of a loop", p.curToken.Literal),
+		Span:     p.curToken.Span,
+		Actual:   p.curToken.Type,
+	})
+}
+
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 	stmt.Expression = p.parseExpression(LOWEST)
 
-	if p.peekTokenIs(token.SEMICOLON) {
+	if p.peekTokenIs(token.SEMICOLON) && !p.panicking {
 		p.nextToken()
 	}
 
@@ -183,8 +421,18 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	hint := ""
+	if t == token.EOF {
+		hint = "input ended where an expression was expected"
+	}
+	p.addError(&diagnostic.Diagnostic{
+		Severity: diagnostic.ERROR,
+		Code:     diagnostic.NO_PREFIX_PARSE,
+		Message:  fmt.Sprintf("no prefix parse function for %s found", t),
+		Span:     p.curToken.Span,
+		Actual:   t,
+		Hint:     hint,
+	})
 }
 
 func (p *Parser) parseExpression(precedence int) ast.Expression {
@@ -220,9 +468,37 @@ func (p *Parser) parseIdentifier() ast.Expression {
 func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		if big, ok := new(big.Int).SetString(p.curToken.Literal, 0); ok {
+			lit.Big = big
+			return lit
+		}
+	}
+	if err != nil {
+		p.addError(&diagnostic.Diagnostic{
+			Severity: diagnostic.ERROR,
+			Code:     diagnostic.INVALID_INTEGER,
+			Message:  fmt.Sprintf("could not parse %q as integer", p.curToken.Literal),
+			Span:     p.curToken.Span,
+			Actual:   p.curToken.Type,
+		})
+		return nil
+	}
+	lit.Value = value
+	return lit
+}
+
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.curToken}
+	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(&diagnostic.Diagnostic{
+			Severity: diagnostic.ERROR,
+			Code:     diagnostic.INVALID_FLOAT,
+			Message:  fmt.Sprintf("could not parse %q as float", p.curToken.Literal),
+			Span:     p.curToken.Span,
+			Actual:   p.curToken.Type,
+		})
 		return nil
 	}
 	lit.Value = value
@@ -269,6 +545,36 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return expression
 }
 
+// assignment is right associative, so a = b = 1 assigns 1 to both a and b
+func (p *Parser) parseAssignExpression(target ast.Expression) ast.Expression {
+	expression := &ast.AssignExpression{
+		Token:    p.curToken,
+		Operator: p.curToken.Literal,
+		Target:   target,
+	}
+
+	switch target.(type) {
+	case *ast.Identifier, *ast.IndexExpression:
+	default:
+		// a broken target has already been reported
+		if target == nil || p.panicking {
+			break
+		}
+		p.reportError(&diagnostic.Diagnostic{
+			Severity: diagnostic.ERROR,
+			Code:     diagnostic.INVALID_ASSIGNMENT,
+			Message:  fmt.Sprintf("cannot assign to %s", target.String()),
+			Span:     target.Span(),
+			Actual:   p.curToken.Type,
+			Hint:     "only variables and index expressions (like arr[0]) can be assigned to",
+		})
+	}
+
+	p.nextToken()
+	expression.Value = p.parseExpression(ASSIGN - 1)
+	return expression
+}
+
 func (p *Parser) parseIfExpression() ast.Expression {
 	expression := &ast.IfExpression{Token: p.curToken}
 
@@ -297,6 +603,105 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expression
 }
 
+func (p *Parser) parseWhileExpression() ast.Expression {
+	expression := &ast.WhileExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	p.nextToken()
+	expression.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expression.Body = p.parseLoopBody()
+	return expression
+}
+
+func (p *Parser) parseForExpression() ast.Expression {
+	expression := &ast.ForExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	expression.Variable = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+	p.nextToken()
+	expression.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expression.Body = p.parseLoopBody()
+	return expression
+}
+
+func (p *Parser) parseTryExpression() ast.Expression {
+	expression := &ast.TryExpression{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expression.Body = p.parseBlockStatement()
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+		if !p.expectPeek(token.LPAREN) {
+			return nil
+		}
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		expression.CatchParameter = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expression.Catch = p.parseBlockStatement()
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expression.Finally = p.parseBlockStatement()
+	}
+
+	if expression.Catch == nil && expression.Finally == nil {
+		p.addError(&diagnostic.Diagnostic{
+			Severity: diagnostic.ERROR,
+			Code:     diagnostic.UNEXPECTED_TOKEN,
+			Message:  fmt.Sprintf("expected catch or finally after the try block, got %s instead", p.peekToken.Type),
+			Span:     p.peekToken.Span,
+			Expected: []token.TokenType{token.CATCH, token.FINALLY},
+			Actual:   p.peekToken.Type,
+		})
+		return nil
+	}
+	return expression
+}
+
+func (p *Parser) parseLoopBody() *ast.BlockStatement {
+	p.loopDepth += 1
+	defer func() { p.loopDepth -= 1 }()
+	return p.parseBlockStatement()
+}
+
 func (p *Parser) parseFunctionLiteral() ast.Expression {
 	lit := &ast.FunctionLiteral{Token: p.curToken}
 
@@ -307,10 +712,54 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	if !p.expectPeek(token.LBRACE) {
 		return nil
 	}
+	// loops don't reach into the functions defined inside of them
+	outerLoopDepth := p.loopDepth
+	p.loopDepth = 0
 	lit.Body = p.parseBlockStatement()
+	p.loopDepth = outerLoopDepth
+	markTailCalls(lit.Body)
 	return lit
 }
 
+/*
+ * Marks the calls whose result is returned by the function as it is, so that the evaluator can make them
+ * without growing the stack. Those are the calls being the last expression of the body (also through the branches
+ * of an if being the last expression) and the returned calls, except for the ones inside of a try: the try still
+ * has to catch the errors of the call and run the finally block after it.
+ */
+func markTailCalls(body *ast.BlockStatement) {
+	markTailBlock(body)
+	ast.Walk(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FunctionLiteral, *ast.TryExpression:
+			// the nested functions get their own calls marked when they're parsed
+			return false
+		case *ast.ReturnStatement:
+			markTailExpression(node.ReturnValue)
+		}
+		return true
+	})
+}
+
+func markTailBlock(block *ast.BlockStatement) {
+	if block == nil || len(block.Statements) == 0 {
+		return
+	}
+	if statement, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement); ok {
+		markTailExpression(statement.Expression)
+	}
+}
+
+func markTailExpression(expression ast.Expression) {
+	switch expression := expression.(type) {
+	case *ast.CallExpression:
+		expression.Tail = true
+	case *ast.IfExpression:
+		markTailBlock(expression.Consequence)
+		markTailBlock(expression.Alternative)
+	}
+}
+
 func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 	identifiers := make([]*ast.Identifier, 0)
 	if p.peekTokenIs(token.RPAREN) {
@@ -318,12 +767,16 @@ func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 		return identifiers
 	}
 
-	p.nextToken()
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
 	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 	identifiers = append(identifiers, ident)
 	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
-		p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
 		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 		identifiers = append(identifiers, ident)
 	}
@@ -337,26 +790,40 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = make([]ast.Statement, 0)
 
+	outerBlockDepth := p.blockDepth
+	p.blockDepth = p.braceDepth
+	defer func() { p.blockDepth = outerBlockDepth }()
+
 	p.nextToken()
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
 		stmt := p.parseStatement()
 		if stmt != nil {
 			block.Statements = append(block.Statements, stmt)
 		}
+		if p.atBlockEnd {
+			p.atBlockEnd = false
+			break
+		}
 		p.nextToken()
 	}
+	if p.curTokenIs(token.EOF) {
+		p.curError(token.RBRACE)
+	}
+	block.RBrace = p.curToken
 	return block
 }
 
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
 	exp.Arguments = p.parseExpressionList(token.RPAREN)
+	exp.RParen = p.curToken
 	return exp
 }
 
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	array := &ast.ArrayLiteral{Token: p.curToken}
 	array.Elements = p.parseExpressionList(token.RBRACKET)
+	array.RBracket = p.curToken
 	return array
 }
 
@@ -381,6 +848,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	if !p.expectPeek(token.RBRACE) {
 		return nil
 	}
+	hash.RBrace = p.curToken
 	return hash
 }
 
@@ -392,6 +860,7 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
+	exp.RBracket = p.curToken
 	return exp
 }
 
@@ -6,7 +6,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/diagnostic"
 	"kjarmicki.github.com/monkey/lexer"
+	"kjarmicki.github.com/monkey/token"
 )
 
 func TestLetStatements(t *testing.T) {
@@ -95,6 +97,49 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	testIntegerLiteralExpression(t, program.Statements[0], "5", 5)
 }
 
+func TestBigIntegerLiteralExpression(t *testing.T) {
+	input := "99999999999999999999;"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	assert.Equal(t, len(program.Statements), 1, "program.Statements does not contain 1 statement")
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	assert.True(t, ok)
+	integer, ok := stmt.Expression.(*ast.IntegerLiteral)
+	assert.True(t, ok)
+	assert.Equal(t, "99999999999999999999", integer.Big.String())
+	assert.Equal(t, "99999999999999999999", integer.String())
+}
+
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"1.5;", 1.5},
+		{"0.25", 0.25},
+		{"1e-9", 1e-9},
+		{"2.5E+3", 2500},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		assert.Equal(t, len(program.Statements), 1, "program.Statements does not contain 1 statement")
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		assert.True(t, ok)
+		float, ok := stmt.Expression.(*ast.FloatLiteral)
+		assert.True(t, ok)
+		assert.Equal(t, tt.expected, float.Value)
+	}
+}
+
 func TestBooleanExpression(t *testing.T) {
 	input := "true;"
 
@@ -265,6 +310,52 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1, 2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		// logical and comparison operators
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a && b || c && d",
+			"((a && b) || (c && d))",
+		},
+		{
+			"a == b && c != d",
+			"((a == b) && (c != d))",
+		},
+		{
+			"a <= b == c >= d",
+			"((a <= b) == (c >= d))",
+		},
+		{
+			"a + b % c * d",
+			"(a + ((b % c) * d))",
+		},
+		{
+			"!a && -b < c",
+			"((!a) && ((-b) < c))",
+		},
+		{
+			"x = a || b",
+			"(x = (a || b))",
+		},
+		// assignments
+		{
+			"x = y + 1 == 2",
+			"(x = ((y + 1) == 2))",
+		},
+		{
+			"a = b = c",
+			"(a = (b = c))",
+		},
+		{
+			"a[i + 1] += f(x) * 2",
+			"((a[(i + 1)]) += (f(x) * 2))",
+		},
+		{
+			"h[\"k\"] /= 2 - 1",
+			"((h[k]) /= (2 - 1))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -278,6 +369,58 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 	}
 }
 
+func TestAssignExpression(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedTarget   string
+		expectedOperator string
+		expectedValue    any
+	}{
+		{"x = 5;", "x", "=", 5},
+		{"x += y", "x", "+=", "y"},
+		{"x -= 5;", "x", "-=", 5},
+		{"x *= true", "x", "*=", true},
+		{"arr[0] /= 5", "(arr[0])", "/=", 5},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		assert.Equal(t, 1, len(program.Statements))
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		assert.True(t, ok)
+		exp, ok := stmt.Expression.(*ast.AssignExpression)
+		assert.True(t, ok)
+		assert.Equal(t, tt.expectedTarget, exp.Target.String())
+		assert.Equal(t, tt.expectedOperator, exp.Operator)
+		testLiteralExpression(t, exp.Value, tt.expectedValue)
+	}
+}
+
+func TestInvalidAssignmentTarget(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string
+	}{
+		{"5 = x;", "1:1: error[E0010]: cannot assign to 5"},
+		{"let a = 1; f(x) += 1;", "1:12: error[E0010]: cannot assign to f(x)"},
+		{"a + b = c", "1:1: error[E0010]: cannot assign to (a + b)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		assert.Equal(t, 1, len(errors), tt.input)
+		assert.Equal(t, tt.expectedError, errors[0].String())
+	}
+}
+
 func TestIfExpression(t *testing.T) {
 	input := "if (x < y) { x }"
 
@@ -329,6 +472,139 @@ func TestIfElseExpression(t *testing.T) {
 	testIdentifier(t, alternative.Expression, "y")
 }
 
+func TestWhileExpression(t *testing.T) {
+	input := "while (x < y) { x; break; }"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 1, len(program.Statements))
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	assert.True(t, ok)
+	exp, ok := stmt.Expression.(*ast.WhileExpression)
+	assert.True(t, ok)
+	testInfixExpression(t, exp.Condition, "x", "<", "y")
+	assert.Equal(t, 2, len(exp.Body.Statements))
+	body, ok := exp.Body.Statements[0].(*ast.ExpressionStatement)
+	assert.True(t, ok)
+	testIdentifier(t, body.Expression, "x")
+	_, ok = exp.Body.Statements[1].(*ast.BreakStatement)
+	assert.True(t, ok)
+}
+
+func TestForExpression(t *testing.T) {
+	input := "for (x in [1, 2]) { if (x > 1) { continue } x }"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 1, len(program.Statements))
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	assert.True(t, ok)
+	exp, ok := stmt.Expression.(*ast.ForExpression)
+	assert.True(t, ok)
+	testIdentifier(t, exp.Variable, "x")
+	assert.Equal(t, "[1, 2]", exp.Iterable.String())
+	assert.Equal(t, 2, len(exp.Body.Statements))
+	assert.Equal(t, "for(x in [1, 2]) if(x > 1) continue;x", exp.String())
+}
+
+func TestTryExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { f() } catch (e) { e }", "try f() catch (e) e"},
+		{"try { f() } finally { g() }", "try f() finally g()"},
+		{"try { f() } catch (err) { 1 } finally { g() }", "try f() catch (err) 1 finally g()"},
+		{"let x = try { 1 } catch (e) { 2 }", "let x = try 1 catch (e) 2;"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		assert.Equal(t, 1, len(program.Statements), tt.input)
+		assert.Equal(t, tt.expected, program.String(), tt.input)
+	}
+
+	program := New(lexer.New("try { 1 } catch (e) { e }")).ParseProgram()
+	exp := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.TryExpression)
+	testIdentifier(t, exp.CatchParameter, "e")
+	assert.Equal(t, 1, len(exp.Body.Statements))
+	assert.Equal(t, 1, len(exp.Catch.Statements))
+	assert.Nil(t, exp.Finally)
+}
+
+func TestThrowStatement(t *testing.T) {
+	l := lexer.New(`throw "boom"; throw {"message": "m"}`)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 2, len(program.Statements))
+	stmt, ok := program.Statements[0].(*ast.ThrowStatement)
+	assert.True(t, ok)
+	assert.Equal(t, "boom", stmt.Value.(*ast.StringLiteral).Value)
+	assert.Equal(t, `throw boom;throw {message: m};`, program.String())
+}
+
+func TestTryExpressionErrors(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedErrors []string
+	}{
+		{"try { 1 }; let x = 1;", []string{"1:10: error[E0001]: expected catch or finally after the try block, got ; instead"}},
+		{"try { 1 } catch { 2 }", []string{"1:17: error[E0001]: expected next token to be (, got { instead"}},
+		{"try { 1 } catch (1) { 2 }", []string{"1:18: error[E0001]: expected next token to be IDENT, got INT instead"}},
+		{"try 1 catch (e) {}", []string{"1:5: error[E0001]: expected next token to be {, got INT instead"}},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		var errors []string
+		for _, d := range p.Errors() {
+			errors = append(errors, d.String())
+		}
+		assert.Equal(t, tt.expectedErrors, errors, tt.input)
+	}
+}
+
+func TestLoopControlOutsideOfLoop(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedErrors []string
+	}{
+		{"break;", []string{"1:1: error[E0009]: break outside of a loop"}},
+		{"if (true) { continue }", []string{"1:13: error[E0009]: continue outside of a loop"}},
+		{"while (true) { fn() { break; } }", []string{"1:23: error[E0009]: break outside of a loop"}},
+		{"while (true) { break; } continue; let x = 1;", []string{"1:25: error[E0009]: continue outside of a loop"}},
+		{"for (x in xs) { while (x) { break; } continue; }", nil},
+		{"while (true) { fn() { while (true) { break; } } }", nil},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		var errors []string
+		for _, d := range p.Errors() {
+			errors = append(errors, d.String())
+		}
+		assert.Equal(t, tt.expectedErrors, errors, tt.input)
+	}
+}
+
 func TestFunctionLiteral(t *testing.T) {
 	input := `fn(x, y) { x + y; }`
 
@@ -351,6 +627,16 @@ func TestFunctionLiteral(t *testing.T) {
 	bodyStmt, ok := function.Body.Statements[0].(*ast.ExpressionStatement)
 	assert.True(t, ok)
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
+	assert.Equal(t, "", function.Name)
+}
+
+func TestFunctionLiteralName(t *testing.T) {
+	program := New(lexer.New(`let add = fn(x, y) { x + y }; let nested = [fn() {}]`)).ParseProgram()
+
+	add := program.Statements[0].(*ast.LetStatement).Value.(*ast.FunctionLiteral)
+	assert.Equal(t, "add", add.Name)
+	nested := program.Statements[1].(*ast.LetStatement).Value.(*ast.ArrayLiteral).Elements[0].(*ast.FunctionLiteral)
+	assert.Equal(t, "", nested.Name)
 }
 
 func TestCallExpression(t *testing.T) {
@@ -375,6 +661,45 @@ func TestCallExpression(t *testing.T) {
 	testInfixExpression(t, exp.Arguments[2], 4, "+", 5)
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string // names of the functions called in tail position
+	}{
+		{"fn() { f() }", []string{"f"}},
+		{"fn() { f(); g() }", []string{"g"}},
+		{"fn() { return f() }", []string{"f"}},
+		{"fn() { if (x) { return f() }; g() }", []string{"f", "g"}},
+		{"fn() { if (x) { f() } else { g() } }", []string{"f", "g"}},
+		{"fn() { if (x) { f() } else { g() }; 1 }", nil},
+		{"fn() { while (x) { return f() } }", []string{"f"}},
+		{"fn() { while (x) { f() } }", nil},
+		{"fn() { 1 + f() }", nil},
+		{"fn() { f(g()) }", []string{"f"}},
+		{"fn() { let x = f() }", nil},
+		{"fn() { f()() }", []string{"f()"}},
+		{"fn() { try { return f() } catch (e) { g() } }", nil},
+		{"fn() { fn() { f() }; g() }", []string{"f", "g"}},
+		{"f(); return g()", nil},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		var tail []string
+		ast.Walk(program, func(node ast.Node) bool {
+			if call, ok := node.(*ast.CallExpression); ok && call.Tail {
+				tail = append(tail, call.Function.String())
+			}
+			return true
+		})
+		assert.Equal(t, tt.expected, tail, tt.input)
+	}
+}
+
 func TestParsingArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 3, 4 + 5]"
 
@@ -486,6 +811,298 @@ func TestParsingHashLiteralsWithExpressions(t *testing.T) {
 	}
 }
 
+func TestNodeSpans(t *testing.T) {
+	input := `let add = fn(a, b) {
+	a + b
+};
+add(1, [2, 3][0]);`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	tests := []struct {
+		node     ast.Node
+		expected string
+	}{
+		{program, "1:1-4:18"},
+		{program.Statements[0], "1:1-3:2"},
+		{program.Statements[0].(*ast.LetStatement).Value, "1:11-3:2"},
+		{program.Statements[0].(*ast.LetStatement).Value.(*ast.FunctionLiteral).Body.Statements[0], "2:2-2:7"},
+		{program.Statements[1], "4:1-4:18"},
+		{program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.CallExpression).Arguments[1], "4:8-4:17"},
+	}
+
+	for _, tt := range tests {
+		span := tt.node.Span()
+		actual := fmt.Sprintf("%d:%d-%d:%d", span.Start.Line, span.Start.Column, span.End.Line, span.End.Column)
+		assert.Equal(t, tt.expected, actual, tt.node.String())
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	input := `let x = 5;
+let = 10;`
+
+	l := lexer.New(input)
+	p := New(l)
+	p.ParseProgram()
+
+	assert.Equal(t, "2:5: error[E0001]: expected next token to be IDENT, got = instead", p.Errors()[0].String())
+}
+
+func TestErrorDiagnostics(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedCode     diagnostic.Code
+		expectedExpected []token.TokenType
+		expectedActual   token.TokenType
+		expectedSpan     string
+	}{
+		{"let 5;", diagnostic.UNEXPECTED_TOKEN, []token.TokenType{token.IDENT}, token.INT, "1:5"},
+		{"let x 5;", diagnostic.UNEXPECTED_TOKEN, []token.TokenType{token.ASSIGN}, token.INT, "1:7"},
+		{"add(1, 2", diagnostic.UNEXPECTED_TOKEN, []token.TokenType{token.RPAREN}, token.EOF, "1:9"},
+		{"5 + ;", diagnostic.NO_PREFIX_PARSE, nil, token.SEMICOLON, "1:5"},
+		{"1e999", diagnostic.INVALID_FLOAT, nil, token.FLOAT, "1:1"},
+		{"for (1 in xs) {}", diagnostic.UNEXPECTED_TOKEN, []token.TokenType{token.IDENT}, token.INT, "1:6"},
+		{"for (x of xs) {}", diagnostic.UNEXPECTED_TOKEN, []token.TokenType{token.IN}, token.IDENT, "1:8"},
+		{"while true {}", diagnostic.UNEXPECTED_TOKEN, []token.TokenType{token.LPAREN}, token.TRUE, "1:7"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		assert.NotEmpty(t, errors, tt.input)
+		d := errors[0]
+		assert.Equal(t, diagnostic.ERROR, d.Severity)
+		assert.Equal(t, tt.expectedCode, d.Code)
+		assert.Equal(t, tt.expectedExpected, d.Expected)
+		assert.Equal(t, tt.expectedActual, d.Actual)
+		assert.Equal(t, tt.expectedSpan, d.Span.String())
+	}
+}
+
+func TestDocComments(t *testing.T) {
+	input := `/// adds two numbers
+///
+/// works with strings too
+let add = fn(a, b) {
+	/// local helper
+	let sum = a + b;
+	// regular comment, not documentation
+	let other = 1;
+	sum
+};
+let undocumented = 1;
+/// dangling doc comment before an expression
+add(1, 2)`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 3, len(program.Statements))
+	add := program.Statements[0].(*ast.LetStatement)
+	assert.Equal(t, "adds two numbers\n\nworks with strings too", add.Doc)
+	body := add.Value.(*ast.FunctionLiteral).Body
+	assert.Equal(t, "local helper", body.Statements[0].(*ast.LetStatement).Doc)
+	assert.Equal(t, "", body.Statements[1].(*ast.LetStatement).Doc)
+	assert.Equal(t, "", program.Statements[1].(*ast.LetStatement).Doc)
+}
+
+func TestStatementsWithoutSemicolonAtEOF(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = 5", "let x = 5;"},
+		{"return 5", "return 5;"},
+		{"let x = 5 let y = 6", "let x = 5;let y = 6;"},
+		{"fn() { return 1 }", "fn() return 1;"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		assert.Equal(t, tt.expected, program.String())
+	}
+}
+
+// every independent error in the program should be reported once, and the valid statements
+// around them should still be parsed
+func TestErrorRecovery(t *testing.T) {
+	tests := []struct {
+		input              string
+		expectedErrors     []string
+		expectedStatements string
+	}{
+		{
+			"let = 5; let y = 10; let 7;",
+			[]string{
+				"1:5: error[E0001]: expected next token to be IDENT, got = instead",
+				"1:26: error[E0001]: expected next token to be IDENT, got INT instead",
+			},
+			"let y = 10;",
+		},
+		{
+			"let x = 5 +; let y = ;\nlet z = 1;",
+			[]string{
+				"1:12: error[E0002]: no prefix parse function for ; found",
+				"1:22: error[E0002]: no prefix parse function for ; found",
+			},
+			"let z = 1;",
+		},
+		{
+			"if (x) { 1 + } let y = 2;",
+			[]string{
+				"1:14: error[E0002]: no prefix parse function for } found",
+			},
+			"ifx let y = 2;",
+		},
+		{
+			"if (x) { 1 + * } let y = 2;",
+			[]string{
+				"1:14: error[E0002]: no prefix parse function for * found",
+			},
+			"ifx let y = 2;",
+		},
+		{
+			"fn(x { x }; let b = 1;",
+			[]string{
+				"1:6: error[E0001]: expected next token to be ), got { instead",
+			},
+			"fn() let b = 1;",
+		},
+		{
+			"fn(1, 2) { 3 }",
+			[]string{
+				"1:4: error[E0001]: expected next token to be IDENT, got INT instead",
+			},
+			"",
+		},
+		{
+			"let a = [1, 2; let b = 3; let c = add(1, 2;",
+			[]string{
+				"1:14: error[E0001]: expected next token to be ], got ; instead",
+				"1:43: error[E0001]: expected next token to be ), got ; instead",
+			},
+			"let b = 3;",
+		},
+		{
+			"let f = fn() { let x = 1;",
+			[]string{
+				"1:26: error[E0001]: expected }, got EOF instead",
+			},
+			"",
+		},
+		{
+			"}} let x = 1; }",
+			[]string{
+				"1:1: error[E0002]: no prefix parse function for } found",
+				"1:15: error[E0002]: no prefix parse function for } found",
+			},
+			"let x = 1;",
+		},
+		{
+			"let x = (1 + 2; let y = 3",
+			[]string{
+				"1:15: error[E0001]: expected next token to be ), got ; instead",
+			},
+			"let y = 3;",
+		},
+		{
+			"[fn() { 1 } 2]; let z = 3;",
+			[]string{
+				"1:13: error[E0001]: expected next token to be ], got INT instead",
+			},
+			"let z = 3;",
+		},
+		{
+			"let f = fn(x) {\n let = 1;\n return x +;\n x\n};\nf(1);",
+			[]string{
+				"2:6: error[E0001]: expected next token to be IDENT, got = instead",
+				"3:12: error[E0002]: no prefix parse function for ; found",
+			},
+			"let f = fn(x) x;f(1)",
+		},
+		// the statements broken by the closing brace leave the semicolon after it to the recovery
+		{
+			"let f = fn() { 1 + }; let z = ; 1",
+			[]string{
+				"1:20: error[E0002]: no prefix parse function for } found",
+				"1:31: error[E0002]: no prefix parse function for ; found",
+			},
+			"let f = fn() ;1",
+		},
+		{
+			"let f = fn() { return }; let z = ; 1",
+			[]string{
+				"1:23: error[E0002]: no prefix parse function for } found",
+				"1:34: error[E0002]: no prefix parse function for ; found",
+			},
+			"let f = fn() ;1",
+		},
+		{
+			"let f = fn() { let x = }; let z = ; 1",
+			[]string{
+				"1:24: error[E0002]: no prefix parse function for } found",
+				"1:35: error[E0002]: no prefix parse function for ; found",
+			},
+			"let f = fn() ;1",
+		},
+		{
+			"let",
+			[]string{
+				"1:4: error[E0001]: expected next token to be IDENT, got EOF instead",
+			},
+			"",
+		},
+		{
+			"if (x",
+			[]string{
+				"1:6: error[E0001]: expected next token to be ), got EOF instead",
+			},
+			"",
+		},
+		{
+			"let s = \"abc;\nlet t = 1;",
+			[]string{
+				"1:9: error[E0005]: unterminated string",
+			},
+			"",
+		},
+		{
+			"let a = 1 @ 2; let b = #; let c = 3;",
+			[]string{
+				"1:11: error[E0008]: unexpected character '@'",
+				"1:24: error[E0008]: unexpected character '#'",
+			},
+			"let a = 1;let c = 3;",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		actual := make([]string, len(p.Errors()))
+		for i, d := range p.Errors() {
+			actual[i] = d.String()
+		}
+		assert.Equal(t, tt.expectedErrors, actual, tt.input)
+		assert.Equal(t, tt.expectedStatements, program.String(), tt.input)
+	}
+}
+
 func testIdentifierExpression(t *testing.T, s ast.Statement, name string) {
 	t.Helper()
 	stmt, ok := s.(*ast.ExpressionStatement)
@@ -592,8 +1209,8 @@ func checkParserErrors(t *testing.T, p *Parser) {
 	if len(errors) == 0 {
 		return
 	}
-	for _, msg := range errors {
-		t.Errorf("parser error: %q", msg)
+	for _, d := range errors {
+		t.Errorf("parser error: %q", d.String())
 	}
 	t.FailNow()
 }
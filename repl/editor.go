@@ -0,0 +1,404 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// returned by ReadLine when the user pressed Ctrl-C, the line being edited is discarded
+var ErrInterrupted = errors.New("interrupted")
+
+// control keys
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlG     = 7
+	keyBackspace = 8
+	keyTab       = 9
+	keyLineFeed  = 10
+	keyCtrlK     = 11
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlR     = 18
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// keys sent as escape sequences, mapped outside of the Unicode range so they can't clash with typed runes
+const (
+	keyUp rune = unicode.MaxRune + 1 + iota
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDeleteForward
+	keyWordLeft
+	keyWordRight
+	keyUnknown
+)
+
+/*
+ * Line editor working on plain streams: keys are read from any io.Reader and the line is redrawn with ANSI escape codes.
+ * It doesn't know anything about terminals, putting the terminal into raw mode is up to the caller,
+ * which also makes it possible to drive the editor from tests.
+ *
+ * Supported keys: arrows, Home / End (Ctrl-A / Ctrl-E), Alt-B / Alt-F (word left / right), Backspace, Delete,
+ * Ctrl-K / Ctrl-U / Ctrl-W (delete till the end / from the start / previous word), Up / Down (Ctrl-P / Ctrl-N) for history,
+ * Ctrl-R for the reverse history search, Ctrl-C to discard the line and Ctrl-D on an empty line to end the input.
+ */
+type Editor struct {
+	in      *bufio.Reader
+	out     io.Writer
+	history *History
+
+	// state of the line being edited
+	prompt string
+	line   []rune
+	pos    int // cursor position in line
+}
+
+// a buffered reader is used as it is, so that the input the editor buffers isn't lost to the other reads sharing it
+// (e.g. readline() reading from the runtime's buffered input)
+func NewEditor(in io.Reader, out io.Writer, history *History) *Editor {
+	if history == nil {
+		history = NewHistory(0)
+	}
+	reader, ok := in.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(in)
+	}
+	return &Editor{in: reader, out: out, history: history}
+}
+
+// reads one line, without the line terminator. Returns io.EOF when the input ends (or on Ctrl-D)
+// and ErrInterrupted on Ctrl-C. Lines are not added to the history, that's up to the caller.
+func (e *Editor) ReadLine(prompt string) (string, error) {
+	e.prompt = prompt
+	e.line = e.line[:0]
+	e.pos = 0
+	historyIndex := len(e.history.Entries())
+	var edited []rune // line that was being edited before moving through the history
+	var pending rune  // key left over from the reverse search, handled before reading the next one
+
+	e.refresh()
+	for {
+		key, err := pending, error(nil)
+		if pending == 0 {
+			key, err = e.readKey()
+		}
+		pending = 0
+		if err == io.EOF && len(e.line) > 0 {
+			// unterminated last line still counts, EOF will be returned on the next call
+			e.write("\n")
+			return string(e.line), nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch key {
+		case keyEnter, keyLineFeed:
+			e.write("\n")
+			return string(e.line), nil
+		case keyCtrlC:
+			e.write("^C\n")
+			return "", ErrInterrupted
+		case keyCtrlD:
+			if len(e.line) == 0 {
+				e.write("\n")
+				return "", io.EOF
+			}
+			e.deleteRange(e.pos, e.pos+1)
+		case keyCtrlA, keyHome:
+			e.pos = 0
+		case keyCtrlE, keyEnd:
+			e.pos = len(e.line)
+		case keyCtrlB, keyLeft:
+			if e.pos > 0 {
+				e.pos -= 1
+			}
+		case keyCtrlF, keyRight:
+			if e.pos < len(e.line) {
+				e.pos += 1
+			}
+		case keyWordLeft:
+			e.pos = e.previousWord()
+		case keyWordRight:
+			e.pos = e.nextWord()
+		case keyBackspace, keyDelete:
+			if e.pos > 0 {
+				e.deleteRange(e.pos-1, e.pos)
+			}
+		case keyDeleteForward:
+			e.deleteRange(e.pos, e.pos+1)
+		case keyCtrlK:
+			e.deleteRange(e.pos, len(e.line))
+		case keyCtrlU:
+			e.deleteRange(0, e.pos)
+		case keyCtrlW:
+			e.deleteRange(e.previousWord(), e.pos)
+		case keyCtrlP, keyUp, keyCtrlN, keyDown:
+			entries := e.history.Entries()
+			if historyIndex == len(entries) {
+				edited = append(edited[:0], e.line...)
+			}
+			if key == keyCtrlP || key == keyUp {
+				if historyIndex == 0 {
+					continue
+				}
+				historyIndex -= 1
+			} else {
+				if historyIndex == len(entries) {
+					continue
+				}
+				historyIndex += 1
+			}
+			if historyIndex == len(entries) {
+				e.setLine(string(edited))
+			} else {
+				e.setLine(entries[historyIndex])
+			}
+		case keyCtrlR:
+			submit, next, err := e.reverseSearch()
+			if err != nil {
+				return "", err
+			}
+			if submit {
+				e.write("\n")
+				return string(e.line), nil
+			}
+			pending = next
+		case keyTab:
+			e.insert("  ")
+		default:
+			if key < ' ' || key == keyUnknown || key > unicode.MaxRune {
+				continue
+			}
+			e.insert(string(key))
+		}
+		e.refresh()
+	}
+}
+
+// incremental search through the history, from the most recent entries. Typing narrows the search,
+// Ctrl-R jumps to the next older match, Enter runs the match and Ctrl-G cancels the search.
+// Any other key accepts the match for editing and is returned to be handled as usual.
+func (e *Editor) reverseSearch() (submit bool, next rune, err error) {
+	entries := e.history.Entries()
+	original := string(e.line)
+	var query []rune
+	match := len(entries) // index of the current match
+	found := true
+
+	// finds the closest entry containing the query, at or before the given index
+	search := func(from int) {
+		for i := from; i >= 0; i-- {
+			if i < len(entries) && strings.Contains(entries[i], string(query)) {
+				match, found = i, true
+				e.setLine(entries[i])
+				return
+			}
+		}
+		found = false
+	}
+
+	for {
+		status := "reverse-i-search"
+		if !found {
+			status = "failing reverse-i-search"
+		}
+		e.redraw(fmt.Sprintf("(%s)`%s': ", status, string(query)), len(e.line))
+
+		key, err := e.readKey()
+		if err != nil {
+			return false, 0, err
+		}
+		switch {
+		case key == keyCtrlR:
+			if len(query) > 0 {
+				search(match - 1)
+			}
+		case key == keyBackspace || key == keyDelete:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				search(len(entries) - 1)
+			}
+		case key == keyCtrlG || key == keyCtrlC:
+			e.setLine(original)
+			return false, 0, nil
+		case key == keyEnter || key == keyLineFeed:
+			e.refresh()
+			return true, 0, nil
+		case key >= ' ' && key <= unicode.MaxRune && key != keyDelete:
+			query = append(query, key)
+			search(match)
+		default:
+			// leave the search and let the key do what it normally does
+			return false, key, nil
+		}
+	}
+}
+
+// reads a single key press, translating escape sequences
+func (e *Editor) readKey() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil || r != keyEscape {
+		return r, err
+	}
+
+	// a lone escape (or an escape at the end of input) has no meaning for the editor
+	next, _, err := e.in.ReadRune()
+	if err != nil {
+		return keyUnknown, nil
+	}
+	switch next {
+	case 'b':
+		return keyWordLeft, nil
+	case 'f':
+		return keyWordRight, nil
+	case '[', 'O':
+	default:
+		return keyUnknown, nil
+	}
+
+	// CSI sequence: optional numeric parameters followed by the final character, e.g. ESC [ 3 ~ or ESC [ 1 ; 5 C
+	var params strings.Builder
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return keyUnknown, nil
+		}
+		if (r >= '0' && r <= '9') || r == ';' {
+			params.WriteRune(r)
+			continue
+		}
+		return csiKey(params.String(), r), nil
+	}
+}
+
+func csiKey(params string, final rune) rune {
+	switch final {
+	case 'A':
+		return keyUp
+	case 'B':
+		return keyDown
+	case 'C':
+		if strings.HasSuffix(params, ";5") || strings.HasSuffix(params, ";3") {
+			return keyWordRight
+		}
+		return keyRight
+	case 'D':
+		if strings.HasSuffix(params, ";5") || strings.HasSuffix(params, ";3") {
+			return keyWordLeft
+		}
+		return keyLeft
+	case 'H':
+		return keyHome
+	case 'F':
+		return keyEnd
+	case '~':
+		switch params {
+		case "1", "7":
+			return keyHome
+		case "4", "8":
+			return keyEnd
+		case "3":
+			return keyDeleteForward
+		}
+	}
+	return keyUnknown
+}
+
+func (e *Editor) insert(s string) {
+	runes := []rune(s)
+	line := make([]rune, 0, len(e.line)+len(runes))
+	line = append(line, e.line[:e.pos]...)
+	line = append(line, runes...)
+	line = append(line, e.line[e.pos:]...)
+	e.line = line
+	e.pos += len(runes)
+}
+
+// removes runes in [from, to), clamped to the line
+func (e *Editor) deleteRange(from, to int) {
+	if to > len(e.line) {
+		to = len(e.line)
+	}
+	if from >= to {
+		return
+	}
+	e.line = append(e.line[:from], e.line[to:]...)
+	if e.pos > to {
+		e.pos -= to - from
+	} else if e.pos > from {
+		e.pos = from
+	}
+}
+
+func (e *Editor) setLine(s string) {
+	e.line = []rune(s)
+	e.pos = len(e.line)
+}
+
+// start of the word before the cursor
+func (e *Editor) previousWord() int {
+	pos := e.pos
+	for pos > 0 && !isWordRune(e.line[pos-1]) {
+		pos -= 1
+	}
+	for pos > 0 && isWordRune(e.line[pos-1]) {
+		pos -= 1
+	}
+	return pos
+}
+
+// end of the word after the cursor
+func (e *Editor) nextWord() int {
+	pos := e.pos
+	for pos < len(e.line) && !isWordRune(e.line[pos]) {
+		pos += 1
+	}
+	for pos < len(e.line) && isWordRune(e.line[pos]) {
+		pos += 1
+	}
+	return pos
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (e *Editor) refresh() {
+	e.redraw(e.prompt, e.pos)
+}
+
+// redraws the whole line: carriage return, prompt, contents, clear till the end of the screen line
+// and finally moves the cursor back to the given position. The line breaks of the inputs recalled
+// from the history are shown as ↵, so that they stay on one screen line.
+func (e *Editor) redraw(prompt string, cursor int) {
+	var out strings.Builder
+	out.WriteString("\r")
+	out.WriteString(prompt)
+	out.WriteString(strings.ReplaceAll(string(e.line), "\n", "↵"))
+	out.WriteString("\x1b[K")
+	if back := len(e.line) - cursor; back > 0 {
+		fmt.Fprintf(&out, "\x1b[%dD", back)
+	}
+	e.write(out.String())
+}
+
+func (e *Editor) write(s string) {
+	io.WriteString(e.out, s)
+}
@@ -0,0 +1,249 @@
+package repl
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/object"
+)
+
+const (
+	up        = "\x1b[A"
+	down      = "\x1b[B"
+	right     = "\x1b[C"
+	left      = "\x1b[D"
+	home      = "\x1b[H"
+	end       = "\x1b[F"
+	del       = "\x1b[3~"
+	backspace = "\x7f"
+	wordLeft  = "\x1bb"
+	wordRight = "\x1bf"
+	ctrlA     = "\x01"
+	ctrlC     = "\x03"
+	ctrlD     = "\x04"
+	ctrlE     = "\x05"
+	ctrlG     = "\x07"
+	ctrlK     = "\x0b"
+	ctrlR     = "\x12"
+	ctrlU     = "\x15"
+	ctrlW     = "\x17"
+)
+
+func TestEditorLineEditing(t *testing.T) {
+	tests := []struct {
+		keys     string
+		expected string
+	}{
+		{"let x = 5;\r", "let x = 5;"},
+		{"let x = 5;\n", "let x = 5;"},
+		{"1 + 3" + backspace + "2\r", "1 + 2"},
+		{"1 + 2" + left + left + left + left + left + "(" + end + ")\r", "(1 + 2)"},
+		{"+ 2" + home + "1 \r", "1 + 2"},
+		{"+ 2" + ctrlA + "1 " + ctrlE + " + 3\r", "1 + 2 + 3"},
+		{"abc" + left + left + right + "X\r", "abXc"},
+		{"abc" + home + del + "\r", "bc"},
+		{"abc" + home + ctrlD + "\r", "bc"},
+		{"abc" + left + left + ctrlK + "\r", "a"},
+		{"abc" + left + ctrlU + "\r", "c"},
+		{"let answer = 42" + ctrlW + "0" + ctrlW + ctrlW + "x\r", "let x"},
+		{"foo bar baz" + wordLeft + wordLeft + "X" + wordRight + "Y\r", "foo XbarY baz"},
+		{"x" + left + left + backspace + "\r", "x"},
+		{"x" + right + right + del + "\r", "x"},
+		{"\x1b[1;5D\x1b[1;5C" + "zażółć" + left + "\x1b[1~" + "ą\r", "ązażółć"},
+		{"if (x) {\t1 }\r", "if (x) {  1 }"},
+		{"\x1bx\x1b[99Zok\r", "ok"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		editor := NewEditor(strings.NewReader(tt.keys), &out, nil)
+
+		line, err := editor.ReadLine(PROMPT)
+		assert.NoError(t, err, tt.keys)
+		assert.Equal(t, tt.expected, line, tt.keys)
+	}
+}
+
+func TestEditorRedraw(t *testing.T) {
+	var out bytes.Buffer
+	editor := NewEditor(strings.NewReader("ab"+left+"\r"), &out, nil)
+
+	editor.ReadLine(PROMPT)
+
+	assert.Equal(t, "\r>> \x1b[K\r>> a\x1b[K\r>> ab\x1b[K\r>> ab\x1b[K\x1b[1D\n", out.String())
+}
+
+func TestEditorEndOfInput(t *testing.T) {
+	editor := NewEditor(strings.NewReader("1 + 2\r"+ctrlD+"x"+ctrlD+"\rlast"), io.Discard, nil)
+
+	line, err := editor.ReadLine(PROMPT)
+	assert.NoError(t, err)
+	assert.Equal(t, "1 + 2", line)
+
+	_, err = editor.ReadLine(PROMPT)
+	assert.Equal(t, io.EOF, err)
+
+	// Ctrl-D with the cursor at the end of a non-empty line does nothing
+	line, err = editor.ReadLine(PROMPT)
+	assert.NoError(t, err)
+	assert.Equal(t, "x", line)
+
+	// unterminated last line
+	line, err = editor.ReadLine(PROMPT)
+	assert.NoError(t, err)
+	assert.Equal(t, "last", line)
+
+	_, err = editor.ReadLine(PROMPT)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestEditorInterrupt(t *testing.T) {
+	var out bytes.Buffer
+	editor := NewEditor(strings.NewReader("let x = "+ctrlC+"5\r"), &out, nil)
+
+	_, err := editor.ReadLine(PROMPT)
+	assert.Equal(t, ErrInterrupted, err)
+	assert.True(t, strings.HasSuffix(out.String(), "^C\n"))
+
+	line, err := editor.ReadLine(PROMPT)
+	assert.NoError(t, err)
+	assert.Equal(t, "5", line)
+}
+
+func TestEditorHistory(t *testing.T) {
+	history := NewHistory(0)
+	history.Add("first")
+	history.Add("second")
+
+	tests := []struct {
+		keys     string
+		expected string
+	}{
+		{up + "\r", "second"},
+		{up + up + "\r", "first"},
+		{up + up + up + up + "\r", "first"},
+		{up + up + down + "\r", "second"},
+		{"draft" + up + down + "\r", "draft"},
+		{"draft" + down + "\r", "draft"},
+		{up + " edited\r", "second edited"},
+		{"\x10\x10\x0e\r", "second"},
+	}
+
+	for _, tt := range tests {
+		editor := NewEditor(strings.NewReader(tt.keys), io.Discard, history)
+
+		line, err := editor.ReadLine(PROMPT)
+		assert.NoError(t, err, tt.keys)
+		assert.Equal(t, tt.expected, line, tt.keys)
+	}
+}
+
+func TestEditorMultiLineEntry(t *testing.T) {
+	history := NewHistory(0)
+	history.Add("[1,\n2]")
+	var out bytes.Buffer
+	editor := NewEditor(strings.NewReader(up+"\r"), &out, history)
+
+	line, _ := editor.ReadLine(PROMPT)
+
+	assert.Equal(t, "[1,\n2]", line)
+	assert.Contains(t, out.String(), "\r>> [1,↵2]\x1b[K")
+}
+
+func TestEditorReverseSearch(t *testing.T) {
+	history := NewHistory(0)
+	history.Add("let add = fn(a, b) { a + b };")
+	history.Add("add(1, 2)")
+	history.Add("let x = 10;")
+	history.Add("puts(x)")
+
+	tests := []struct {
+		keys     string
+		expected string
+	}{
+		{ctrlR + "add\r", "add(1, 2)"},
+		{ctrlR + "add" + ctrlR + "\r", "let add = fn(a, b) { a + b };"},
+		{ctrlR + "add" + ctrlR + ctrlR + "\r", "let add = fn(a, b) { a + b };"},
+		{ctrlR + "x\r", "puts(x)"},
+		{ctrlR + "x =\r", "let x = 10;"},
+		{ctrlR + "x =" + backspace + backspace + "\r", "puts(x)"},
+		{ctrlR + "let" + ctrlR + home + "// \r", "// let add = fn(a, b) { a + b };"},
+		{"draft" + ctrlR + "add" + ctrlG + "!\r", "draft!"},
+		{ctrlR + "nothing like that" + ctrlG + "\r", ""},
+	}
+
+	for _, tt := range tests {
+		editor := NewEditor(strings.NewReader(tt.keys), io.Discard, history)
+
+		line, err := editor.ReadLine(PROMPT)
+		assert.NoError(t, err, tt.keys)
+		assert.Equal(t, tt.expected, line, tt.keys)
+	}
+
+	var out bytes.Buffer
+	editor := NewEditor(strings.NewReader(ctrlR+"zzz\r"), &out, history)
+	editor.ReadLine(PROMPT)
+	assert.Contains(t, out.String(), "(failing reverse-i-search)`zzz': ")
+}
+
+func TestHistory(t *testing.T) {
+	history := NewHistory(3)
+	for _, line := range []string{"a", "", "b", "b", "  ", "c", "d"} {
+		history.Add(line)
+	}
+
+	assert.Equal(t, []string{"b", "c", "d"}, history.Entries())
+}
+
+func TestHistoryFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	history, err := LoadHistory(path, 3)
+	assert.NoError(t, err)
+	assert.Empty(t, history.Entries())
+	for _, line := range []string{"1", "2", "2", "3", "4"} {
+		assert.NoError(t, history.Add(line))
+	}
+	content, _ := os.ReadFile(path)
+	assert.Equal(t, "1\n2\n3\n4\n", string(content))
+
+	// loading trims the file down to the limit
+	history, err = LoadHistory(path, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "3", "4"}, history.Entries())
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "2\n3\n4\n", string(content))
+
+	history.Add("5")
+	history, _ = LoadHistory(path, 0)
+	assert.Equal(t, []string{"2", "3", "4", "5"}, history.Entries())
+
+	// multi-line inputs are single entries, with the line breaks escaped in the file
+	history.Add("let f = fn() {\n  \"a\\nb\"\n}")
+	content, _ = os.ReadFile(path)
+	assert.Equal(t, "2\n3\n4\n5\nlet f = fn() {\\n  \"a\\\\nb\"\\n}\n", string(content))
+	history, _ = LoadHistory(path, 0)
+	assert.Equal(t, []string{"2", "3", "4", "5", "let f = fn() {\n  \"a\\nb\"\n}"}, history.Entries())
+}
+
+// the editor reads from the buffered input of the runtime, so that readline() gets the lines after the code
+func TestEditorSharesTheInput(t *testing.T) {
+	var out bytes.Buffer
+	runtime := object.NewRuntime(strings.NewReader("let name = readline()\rMonkey\nname\r"), &out, &out)
+	editor := NewEditor(runtime.StdinReader(), io.Discard, nil)
+	assert.Same(t, runtime.StdinReader(), editor.in)
+	session := newSession(&out, runtime)
+	for {
+		line, err := editor.ReadLine(PROMPT)
+		if err != nil {
+			break
+		}
+		session.eval("", line)
+	}
+	assert.Equal(t, "Monkey\n", out.String())
+}
@@ -0,0 +1,110 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// inputs entered in the REPL, oldest first. When backed by a file, new entries are appended to it right away,
+// so the history survives crashes and is shared by the sessions that run one after another.
+// The file has one entry per line, the line breaks of the multi-line entries (and the backslashes) are escaped.
+type History struct {
+	entries []string
+	max     int    // maximum number of entries kept, 0 means no limit
+	path    string // file the history is persisted in, empty for in-memory history
+}
+
+func NewHistory(max int) *History {
+	return &History{max: max}
+}
+
+// loads the history from the file, a file that doesn't exist yet is treated as an empty history.
+// When the file holds more than max entries, it's rewritten with just the most recent ones.
+func LoadHistory(path string, max int) (*History, error) {
+	h := &History{max: max, path: path}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines += 1
+		h.add(unescapeEntry(scanner.Text()))
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return h, err
+	}
+
+	if lines > len(h.entries) {
+		var content strings.Builder
+		for _, entry := range h.entries {
+			content.WriteString(escapeEntry(entry) + "\n")
+		}
+		return h, os.WriteFile(path, []byte(content.String()), 0o600)
+	}
+	return h, nil
+}
+
+func (h *History) Entries() []string {
+	return h.entries
+}
+
+// adds the entry to the history and persists it. Blank entries and repetitions of the previous one are skipped.
+func (h *History) Add(entry string) error {
+	if !h.add(entry) || h.path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(escapeEntry(entry) + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (h *History) add(entry string) bool {
+	if strings.TrimSpace(entry) == "" {
+		return false
+	}
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry {
+		return false
+	}
+	h.entries = append(h.entries, entry)
+	if h.max > 0 && len(h.entries) > h.max {
+		h.entries = h.entries[len(h.entries)-h.max:]
+	}
+	return true
+}
+
+var entryEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeEntry(entry string) string {
+	return entryEscaper.Replace(entry)
+}
+
+func unescapeEntry(line string) string {
+	var entry strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) {
+			i += 1
+			if line[i] == 'n' {
+				entry.WriteByte('\n')
+				continue
+			}
+		}
+		entry.WriteByte(line[i])
+	}
+	return entry.String()
+}
@@ -2,49 +2,196 @@ package repl
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strings"
 
-	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/diagnostic"
 	"kjarmicki.github.com/monkey/lexer"
 	"kjarmicki.github.com/monkey/object"
-	"kjarmicki.github.com/monkey/parser"
+	"kjarmicki.github.com/monkey/token"
 )
 
-const PROMPT = ">> "
+const (
+	PROMPT              = ">> "
+	CONTINUATION_PROMPT = ".. " // shown while the input is incomplete, e.g. inside of a function body
+)
+
+type Options struct {
+	Stderr      io.Writer // where the code run in the REPL writes errors, defaults to the REPL output
+	HistoryFile string    // file the history is persisted in, empty disables persistence
+	HistorySize int       // maximum number of remembered inputs, 0 means no limit
+}
+
+type lineReader interface {
+	ReadLine(prompt string) (string, error)
+}
 
-func Start(in io.Reader, out io.Writer) {
-	scanner := bufio.NewScanner(in)
-	env := object.NewEnvironment()
+// reads lines without any editing, used when the input is not a terminal (e.g. a piped script)
+type plainReader struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (r *plainReader) ReadLine(prompt string) (string, error) {
+	io.WriteString(r.out, prompt)
+	line, err := r.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func Start(in io.Reader, out io.Writer, options Options) {
+	history := NewHistory(options.HistorySize)
+	if options.HistoryFile != "" {
+		var err error
+		history, err = LoadHistory(options.HistoryFile, options.HistorySize)
+		if err != nil {
+			fmt.Fprintf(out, "could not load history: %s\n", err)
+		}
+	}
+
+	stderr := options.Stderr
+	if stderr == nil {
+		stderr = out
+	}
+	// the REPL and the code it runs (e.g. readline()) share the buffered input
+	runtime := object.NewRuntime(in, out, stderr)
+
+	var term *terminal
+	if f, ok := in.(*os.File); ok {
+		term = newTerminal(f)
+	}
+	var reader lineReader = &plainReader{in: runtime.StdinReader(), out: out}
+	if term != nil {
+		reader = NewEditor(runtime.StdinReader(), out, history)
+	}
+
+	session := newSession(out, runtime)
+	session.interruptible = term != nil
+	var input strings.Builder
+	prompt := PROMPT
 
 	for {
-		fmt.Printf(PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		line, err := readLine(reader, term, prompt)
+		if errors.Is(err, ErrInterrupted) {
+			input.Reset()
+			prompt = PROMPT
+			continue
+		}
+		if err != nil {
+			// whatever was left incomplete is still evaluated, so that the errors get reported
+			if input.Len() > 0 {
+				session.eval("", input.String())
+			}
 			return
 		}
 
-		line := scanner.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
-
-		program := p.ParseProgram()
+		// commands are recognized only at the start of a new input, a line like :x inside of a function body is just code
+		if input.Len() == 0 && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			addToHistory(out, history, line)
+			session.runCommand(strings.TrimSpace(line))
+			continue
+		}
 
-		if len(p.Errors()) != 0 {
-			printParserErrors(out, p.Errors())
+		input.WriteString(line)
+		input.WriteString("\n")
+		source := input.String()
+		if isIncomplete(source) {
+			prompt = CONTINUATION_PROMPT
 			continue
 		}
+		input.Reset()
+		prompt = PROMPT
+		// the whole input goes to the history, so that a function typed on several lines is recalled at once
+		addToHistory(out, history, strings.TrimSuffix(source, "\n"))
+		session.eval("", source)
+	}
+}
+
+func addToHistory(out io.Writer, history *History, entry string) {
+	if err := history.Add(entry); err != nil {
+		fmt.Fprintf(out, "could not save history: %s\n", err)
+		history.path = ""
+	}
+}
 
-		evaluated := evaluator.Eval(program, env)
-		if evaluated != nil {
-			io.WriteString(out, evaluated.Inspect())
-			io.WriteString(out, "\n")
+// the terminal is in raw mode only while a line is being edited, so that the evaluated code
+// can be interrupted with Ctrl-C and its output is processed as usual
+func readLine(reader lineReader, term *terminal, prompt string) (string, error) {
+	if term != nil {
+		if err := term.enableRawMode(); err == nil {
+			defer term.restore()
 		}
 	}
+	return reader.ReadLine(prompt)
 }
 
-func printParserErrors(out io.Writer, errors []string) {
-	for _, msg := range errors {
-		io.WriteString(out, "\t"+msg+"\n")
+// input is incomplete when it ends inside of a string, a block comment or unclosed brackets,
+// or with something that needs to be followed by more code (an operator or a keyword like else)
+func isIncomplete(source string) bool {
+	l := lexer.New(source)
+	depth := 0
+	last := token.TokenType(token.EOF)
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LPAREN, token.LBRACE, token.LBRACKET:
+			depth += 1
+		case token.RPAREN, token.RBRACE, token.RBRACKET:
+			depth -= 1
+		}
+		if tok.Type != token.DOC_COMMENT {
+			last = tok.Type
+		}
+	}
+
+	for _, err := range l.Errors() {
+		if err.Code == diagnostic.UNTERMINATED_STRING || err.Code == diagnostic.UNTERMINATED_COMMENT {
+			return true
+		}
 	}
+	return depth > 0 || continuationTokens[last]
+}
+
+var continuationTokens = map[token.TokenType]bool{
+	token.ASSIGN:          true,
+	token.PLUS:            true,
+	token.MINUS:           true,
+	token.BANG:            true,
+	token.ASTERISK:        true,
+	token.SLASH:           true,
+	token.PERCENT:         true,
+	token.LT:              true,
+	token.GT:              true,
+	token.LT_EQ:           true,
+	token.GT_EQ:           true,
+	token.EQ:              true,
+	token.NOT_EQ:          true,
+	token.AND:             true,
+	token.OR:              true,
+	token.PLUS_ASSIGN:     true,
+	token.MINUS_ASSIGN:    true,
+	token.ASTERISK_ASSIGN: true,
+	token.SLASH_ASSIGN:    true,
+	token.COMMA:           true,
+	token.COLON:           true,
+	token.LET:             true,
+	token.RETURN:          true,
+	token.IF:              true,
+	token.ELSE:            true,
+	token.WHILE:           true,
+	token.FOR:             true,
+	token.IN:              true,
+	token.FUNCTION:        true,
+	token.TRY:             true,
+	token.CATCH:           true,
+	token.FINALLY:         true,
+	token.THROW:           true,
+}
+
+func printParserErrors(out io.Writer, source string, errors []*diagnostic.Diagnostic) {
+	diagnostic.RenderAll(out, source, errors)
 }
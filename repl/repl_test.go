@@ -0,0 +1,134 @@
+package repl
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2\n", ">> 3\n>> "},
+		{"let x = 5;\nx * 2\n", ">> >> 10\n>> "},
+		{"let add = fn(a, b) {\n  a + b\n};\nadd(1, 2)\n", ">> .. .. >> 3\n>> "},
+		{"[1,\n2][1]\n", ">> .. 2\n>> "},
+		{"1 +\n2\n", ">> .. 3\n>> "},
+		{"\"multi\nline\"\n", ">> .. multi\nline\n>> "},
+		{"/* a\ncomment */ 7\n", ">> .. 7\n>> "},
+		{"1 + 2", ">> 3\n>> "},
+		{"let f = fn() {\n", ">> .. "},
+		{"puts(\"out\")\n", ">> out\nnull\n>> "},
+		{"let name = readline()\nMonkey\nname\n", ">> >> Monkey\n>> "},
+		{"let f = fn(x) { x + true }\nf(1)\n", ">> >> ERROR: 1:17: type mismatch: INTEGER + BOOLEAN\n    at f (1:17)\n    at 1:1\n>> "},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		Start(strings.NewReader(tt.input), &out, Options{})
+
+		if tt.input == "let f = fn() {\n" {
+			// incomplete input at the end is still reported
+			assert.Contains(t, out.String(), "expected }, got EOF instead", tt.input)
+			continue
+		}
+		assert.Equal(t, tt.expected, out.String(), tt.input)
+	}
+}
+
+func TestStartHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+
+	Start(strings.NewReader("let add = fn(a, b) {\n  a + b\n};\n:env\nadd(1, 2)\n"), &bytes.Buffer{}, Options{HistoryFile: path})
+
+	history, _ := LoadHistory(path, 0)
+	assert.Equal(t, []string{"let add = fn(a, b) {\n  a + b\n};", ":env", "add(1, 2)"}, history.Entries())
+}
+
+func TestIsIncomplete(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 + 2", false},
+		{"let x = 5;", false},
+		{"fn(x) { x }", false},
+		{"let x = 5", false},
+		{"let f = fn(x) {", true},
+		{"add(1,", true},
+		{"[1, 2", true},
+		{"{\"a\": ", true},
+		{"1 +", true},
+		{"x = ", true},
+		{"a &&", true},
+		{"try { f() } catch", true},
+		{"throw", true},
+		{"if (x) { 1 } else", true},
+		{"let", true},
+		{`"unterminated`, true},
+		{"/* unterminated", true},
+		{"1 + 2 // comment +", false},
+		{"}", false},
+		{"let x = )", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, isIncomplete(tt.input), tt.input)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.mk")
+	os.WriteFile(script, []byte("let double = fn(x) {\n  x * 2\n};\ndouble(21)\n"), 0o644)
+	broken := filepath.Join(dir, "broken.mk")
+	os.WriteFile(broken, []byte("let x 1;\n"), 0o644)
+	saved := filepath.Join(dir, "saved.mk")
+
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{":help\n", []string{"Commands:", "  :type <expr>    evaluate the expression and show the type of the result"}},
+		{"let x = 1;\nlet s = \"a\";\nlet f = fn(a) {\n a\n};\n:env\n", []string{"f: FUNCTION = fn(a) { ...\ns: STRING = a\nx: INTEGER = 1\n"}},
+		{":type 1 + 2\n", []string{">> INTEGER\n"}},
+		{":builtins\n", []string{"first(array: ARRAY) -> ANY\n", "puts(...values) -> NULL\n    prints the values, one per line\n"}},
+		{":builtins len\n", []string{">> len(value: STRING | ARRAY) -> INTEGER\n    number of characters in the string or elements in the array\n"}},
+		{":builtins nope\n", []string{"no builtin named nope\n"}},
+		{":type 1.5\n:type [1]\n:type let y = 1\n", []string{"FLOAT\n", "ARRAY\n", "NULL\n"}},
+		{":type 1 + true\n", []string{"ERROR: 1:1: type mismatch: INTEGER + BOOLEAN\n"}},
+		{":type let x 5\n", []string{"error[E0001]: expected next token to be =, got INT instead"}},
+		{":ast 1 + 2\n", []string{"Program 1:1\n  Statements[0]: ExpressionStatement 1:1\n    Expression: InfixExpression 1:1 Operator=\"+\"\n      Left: IntegerLiteral 1:1 Value=1\n      Right: IntegerLiteral 1:5 Value=2\n"}},
+		{":ast fn(a) { a }\n", []string{"FunctionLiteral 1:1 Locals=[a]\n", "Expression: Identifier 1:9 Value=\"a\" Binding=local(0,0)\n"}},
+		{"let x = 1;\nx + y\n", []string{"error[E0011]: identifier not found: y\n --> 1:5"}},
+		{":tokens let x\n", []string{"1:1    LET          \"let\"\n1:5    IDENT        \"x\"\n1:6    EOF          \"\"\n"}},
+		{":tokens \"open\n", []string{"error[E0005]: unterminated string"}},
+		{":load " + script + "\ndouble(5)\n", []string{">> 42\n>> 10\n"}},
+		{":load " + broken + "\n", []string{" --> " + broken + ":1:7"}},
+		{":load " + filepath.Join(dir, "missing.mk") + "\n", []string{"could not load "}},
+		{"let a = 1;\nlet b = a + true;\nlet c = fn() {\n 2\n};\n:save " + saved + "\n", []string{"saved 2 inputs to " + saved}},
+		{"let a = 1;\n:reset\na\n", []string{"session reset\n", "identifier not found: a"}},
+		{":time 1 + 2\n", []string{">> 3\ntook "}},
+		{":type\n", []string{"usage: :type <expr>\n"}},
+		{":bogus\n", []string{"unknown command :bogus, see :help\n"}},
+		{"let f = fn() {\n:env\n}\n", []string{"no prefix parse function for :"}},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		Start(strings.NewReader(tt.input), &out, Options{})
+
+		for _, expected := range tt.expected {
+			assert.Contains(t, out.String(), expected, tt.input)
+		}
+	}
+
+	content, _ := os.ReadFile(saved)
+	assert.Equal(t, "let a = 1;\nlet c = fn() {\n 2\n};\n", string(content))
+}
@@ -0,0 +1,232 @@
+package repl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/lexer"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/parser"
+	"kjarmicki.github.com/monkey/token"
+)
+
+// state of the REPL that outlives a single input: the environment and the inputs that evaluated fine
+type session struct {
+	out     io.Writer
+	runtime *object.Runtime
+	env     *object.Environment
+	inputs  []string // accepted inputs, in the order they were entered, see :save
+
+	interruptible bool // Ctrl-C stops the running code instead of the whole process, only for interactive sessions
+}
+
+func newSession(out io.Writer, runtime *object.Runtime) *session {
+	return &session{out: out, runtime: runtime, env: object.NewEnvironmentWithRuntime(runtime)}
+}
+
+// evaluates the source in the session environment and prints the result
+func (s *session) eval(file, source string) {
+	evaluated := s.run(file, source)
+	if evaluated == nil {
+		return
+	}
+	fmt.Fprintln(s.out, evaluated.Inspect())
+	if err, ok := evaluated.(*object.Error); ok {
+		for _, line := range err.StackTrace() {
+			fmt.Fprintf(s.out, "    %s\n", line)
+		}
+	}
+}
+
+// evaluates the source in the session environment, remembering it if it was fine.
+// Parse errors are printed right away and nil is returned then.
+func (s *session) run(file, source string) object.Object {
+	program := s.parse(file, source)
+	if program == nil {
+		return nil
+	}
+	if diagnostics := evaluator.Resolve(program, s.env); len(diagnostics) > 0 {
+		printParserErrors(s.out, source, diagnostics)
+		return nil
+	}
+	ctx, stop := context.Background(), func() {}
+	if s.interruptible {
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+	}
+	evaluated := evaluator.EvalContext(ctx, program, s.env)
+	stop()
+	if _, ok := evaluated.(*object.Error); !ok {
+		s.inputs = append(s.inputs, strings.TrimRight(source, "\n"))
+	}
+	return evaluated
+}
+
+func (s *session) parse(file, source string) *ast.Program {
+	p := parser.New(lexer.NewFile(file, source))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		printParserErrors(s.out, source, p.Errors())
+		return nil
+	}
+	return program
+}
+
+type command struct {
+	name string
+	args string // description of the arguments, for :help
+	help string
+	run  func(s *session, arg string)
+}
+
+// initialized in init, because :help refers to the list itself
+var commands []command
+
+func init() {
+	commands = []command{
+		{"help", "", "show this message", (*session).help},
+		{"env", "", "list the variables defined in the session", (*session).listEnv},
+		{"builtins", "", "describe the builtin functions, or just the one given by name", (*session).describeBuiltins},
+		{"type", "<expr>", "evaluate the expression and show the type of the result", (*session).showType},
+		{"ast", "<expr>", "show the syntax tree of the code", (*session).showAst},
+		{"tokens", "<expr>", "show the tokens of the code", (*session).showTokens},
+		{"load", "<file>", "run the file in the session", (*session).load},
+		{"save", "<file>", "save the inputs accepted in this session to the file", (*session).save},
+		{"reset", "", "forget all the variables and inputs", (*session).reset},
+		{"time", "<expr>", "evaluate the code and show how long it took", (*session).time},
+	}
+}
+
+// runs the :command line
+func (s *session) runCommand(line string) {
+	name, arg := line[1:], ""
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name, arg = name[:i], strings.TrimSpace(name[i+1:])
+	}
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if c.args != "" && arg == "" {
+			fmt.Fprintf(s.out, "usage: :%s %s\n", c.name, c.args)
+			return
+		}
+		c.run(s, arg)
+		return
+	}
+	fmt.Fprintf(s.out, "unknown command :%s, see :help\n", name)
+}
+
+func (s *session) help(string) {
+	fmt.Fprintln(s.out, "Commands:")
+	for _, c := range commands {
+		usage := ":" + c.name
+		if c.args != "" {
+			usage += " " + c.args
+		}
+		fmt.Fprintf(s.out, "  %-15s %s\n", usage, c.help)
+	}
+	fmt.Fprintln(s.out, "Anything else is evaluated as Monkey code. Unfinished input continues on the next line, Ctrl-C discards it.")
+}
+
+func (s *session) listEnv(string) {
+	for _, name := range s.env.Names() {
+		value, _ := s.env.Get(name)
+		fmt.Fprintf(s.out, "%s: %s = %s\n", name, value.Type(), firstLine(value.Inspect()))
+	}
+}
+
+func (s *session) describeBuiltins(name string) {
+	if name != "" {
+		builtin, ok := evaluator.LookupBuiltin(name)
+		if !ok {
+			fmt.Fprintf(s.out, "no builtin named %s\n", name)
+			return
+		}
+		fmt.Fprintln(s.out, builtin.Help())
+		return
+	}
+	for _, builtin := range evaluator.Builtins() {
+		fmt.Fprintln(s.out, builtin.Help())
+	}
+}
+
+// statements like let don't have a value, so their type is NULL
+func (s *session) showType(code string) {
+	switch evaluated := s.run("", code).(type) {
+	case nil:
+		fmt.Fprintln(s.out, evaluator.NULL.Type())
+	case *object.Error:
+		fmt.Fprintln(s.out, evaluated.Inspect())
+	default:
+		fmt.Fprintln(s.out, evaluated.Type())
+	}
+}
+
+func (s *session) showAst(code string) {
+	if program := s.parse("", code); program != nil {
+		// with the bindings of the variables, the problems are reported when the code is run
+		evaluator.Resolve(program, s.env)
+		io.WriteString(s.out, ast.Dump(program))
+	}
+}
+
+func (s *session) showTokens(code string) {
+	l := lexer.New(code)
+	for {
+		tok := l.NextToken()
+		fmt.Fprintf(s.out, "%-6s %-12s %q\n", tok.Span.Start, tok.Type, tok.Literal)
+		if tok.Type == token.EOF {
+			break
+		}
+	}
+	if errors := l.Errors(); len(errors) > 0 {
+		printParserErrors(s.out, code, errors)
+	}
+}
+
+func (s *session) load(file string) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintf(s.out, "could not load %s: %s\n", file, err)
+		return
+	}
+	s.eval(file, string(source))
+}
+
+func (s *session) save(file string) {
+	content := strings.Join(s.inputs, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		fmt.Fprintf(s.out, "could not save %s: %s\n", file, err)
+		return
+	}
+	fmt.Fprintf(s.out, "saved %d inputs to %s\n", len(s.inputs), file)
+}
+
+func (s *session) reset(string) {
+	s.env = object.NewEnvironmentWithRuntime(s.runtime)
+	s.inputs = nil
+	fmt.Fprintln(s.out, "session reset")
+}
+
+func (s *session) time(code string) {
+	start := time.Now()
+	s.eval("", code)
+	fmt.Fprintf(s.out, "took %s\n", time.Since(start))
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + " ..."
+	}
+	return s
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package repl
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// terminal in raw mode sends every key press right away and doesn't echo it, so the editor can handle it
+type terminal struct {
+	fd       uintptr
+	original syscall.Termios
+}
+
+// returns nil if the file is not a terminal
+func newTerminal(f *os.File) *terminal {
+	t := &terminal{fd: f.Fd()}
+	if err := t.ioctl(syscall.TCGETS, &t.original); err != nil {
+		return nil
+	}
+	return t
+}
+
+func IsTerminal(f *os.File) bool {
+	return newTerminal(f) != nil
+}
+
+// output processing is left on, so \n still moves to the beginning of the next line
+func (t *terminal) enableRawMode() error {
+	raw := t.original
+	raw.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.IEXTEN | syscall.ISIG
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	return t.ioctl(syscall.TCSETS, &raw)
+}
+
+func (t *terminal) restore() error {
+	return t.ioctl(syscall.TCSETS, &t.original)
+}
+
+func (t *terminal) ioctl(request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, t.fd, request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package repl
+
+import "os"
+
+// raw mode is only implemented for Linux, elsewhere the REPL reads plain lines
+type terminal struct{}
+
+func newTerminal(f *os.File) *terminal {
+	return nil
+}
+
+func IsTerminal(f *os.File) bool {
+	return false
+}
+
+func (t *terminal) enableRawMode() error {
+	return nil
+}
+
+func (t *terminal) restore() error {
+	return nil
+}
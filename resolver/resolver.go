@@ -0,0 +1,251 @@
+package resolver
+
+import (
+	"fmt"
+	"sort"
+
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/diagnostic"
+	"kjarmicki.github.com/monkey/token"
+)
+
+/*
+ * Resolves the variables of the program before it runs: every identifier gets the binding of the variable it refers
+ * to (ast.Identifier.Binding) and every function the list of its locals (ast.FunctionLiteral.Locals), so that
+ * the evaluator finds the variables by their slots instead of looking their names up in every enclosing environment.
+ *
+ * The scoping is the one the evaluator always had: functions have their own variables (the parameters and everything
+ * the body declares with let, for and catch, wherever in the body), blocks don't. Variables declared at the top level
+ * are globals, looked up by name, so that the host can define them too. defined tells which globals exist before
+ * the program runs: the builtins and the ones defined by the host or by the programs run before in the same environment.
+ *
+ * Until the declaration of a local runs, its name still refers to the variable of the enclosing function
+ * (or to the global) with the same name, as it did when the environments were looked up by name (ast.Binding.Outer).
+ *
+ * Reported problems:
+ *   - undefined variables: used or assigned to, but declared neither by the program nor before it runs
+ *   - variables used before the let (or for, or catch) defining them, in the same function or at the top level,
+ *     when there's no outer variable with the same name to use instead.
+ *     The functions nested in it can use the variables declared after them, since they might be called once
+ *     the variables are defined, and so can the loops declaring the variable, because of the previous iterations.
+ *
+ * Resolving the same program again gives the same result, so the program can be run more than once.
+ */
+func Resolve(program *ast.Program, defined func(name string) bool) []*diagnostic.Diagnostic {
+	r := &resolver{defined: defined}
+	global := newScope(nil, program, nil)
+	r.resolve(global, program)
+	sort.SliceStable(r.diagnostics, func(i, j int) bool {
+		return r.diagnostics[i].Span.Start.Offset < r.diagnostics[j].Span.Start.Offset
+	})
+	return r.diagnostics
+}
+
+type resolver struct {
+	defined     func(name string) bool
+	diagnostics []*diagnostic.Diagnostic
+}
+
+// variables of a function or of the top level
+type scope struct {
+	outer        *scope
+	function     bool
+	slots        map[string]int // of the function's locals, globals have none
+	declarations map[string][]declaration
+	loops        []token.Span // repeated parts of the code, without the ones of the nested functions
+}
+
+type declaration struct {
+	name *ast.Identifier
+	from int // offset from which the variable is defined, -1 for the parameters
+}
+
+// the code is the program or the body of the function, whose parameters are given
+func newScope(outer *scope, code ast.Node, params []*ast.Identifier) *scope {
+	s := &scope{outer: outer, function: outer != nil, slots: map[string]int{}, declarations: map[string][]declaration{}}
+	for _, param := range params {
+		s.declare(param, -1)
+	}
+	ast.Walk(code, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			s.declare(node.Name, node.Span().End.Offset)
+		case *ast.ForExpression:
+			// unlike the condition of while, the iterable is evaluated only once, before the loop
+			if node.Body != nil {
+				s.loops = append(s.loops, node.Body.Span())
+				s.declare(node.Variable, node.Body.Span().Start.Offset)
+			}
+		case *ast.WhileExpression:
+			s.loops = append(s.loops, node.Span())
+		case *ast.TryExpression:
+			if node.Catch != nil {
+				s.declare(node.CatchParameter, node.Catch.Span().Start.Offset)
+			}
+		case *ast.FunctionLiteral:
+			return false
+		}
+		return true
+	})
+	return s
+}
+
+func (s *scope) declare(name *ast.Identifier, from int) {
+	if name == nil {
+		return
+	}
+	if _, ok := s.declarations[name.Value]; !ok && s.function {
+		s.slots[name.Value] = len(s.slots)
+	}
+	s.declarations[name.Value] = append(s.declarations[name.Value], declaration{name: name, from: from})
+}
+
+// names of the locals, in the order of their slots
+func (s *scope) locals() []string {
+	if len(s.slots) == 0 {
+		return nil
+	}
+	locals := make([]string, len(s.slots))
+	for name, slot := range s.slots {
+		locals[slot] = name
+	}
+	return locals
+}
+
+func (r *resolver) resolve(s *scope, code ast.Node) {
+	targets := map[*ast.Identifier]bool{}
+	ast.Walk(code, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.LetStatement:
+			s.bind(node.Name)
+		case *ast.ForExpression:
+			s.bind(node.Variable)
+		case *ast.TryExpression:
+			if node.Catch != nil {
+				s.bind(node.CatchParameter)
+			}
+		case *ast.AssignExpression:
+			if target, ok := node.Target.(*ast.Identifier); ok {
+				targets[target] = true
+			}
+		case *ast.Identifier:
+			r.use(s, node, targets[node])
+		case *ast.FunctionLiteral:
+			fn := newScope(s, node.Body, node.Parameters)
+			for _, param := range node.Parameters {
+				fn.bind(param)
+			}
+			node.Locals = fn.locals()
+			r.resolve(fn, node.Body)
+			return false
+		}
+		return true
+	})
+}
+
+// binds the declared name to its own scope
+func (s *scope) bind(name *ast.Identifier) {
+	if name == nil {
+		return
+	}
+	name.Binding = ast.Binding{}
+	if s.function {
+		name.Binding = ast.Binding{Local: true, Slot: s.slots[name.Value]}
+	}
+}
+
+func (r *resolver) use(s *scope, identifier *ast.Identifier, assigned bool) {
+	name := identifier.Value
+	identifier.Binding = binding(s, name, 0)
+	if identifier.Binding.Local {
+		if identifier.Binding.Depth == 0 && !r.declaredOutside(s, name) {
+			r.checkDefinedBefore(s, identifier)
+		}
+		return
+	}
+
+	global := s
+	for global.function {
+		global = global.outer
+	}
+	if _, ok := global.declarations[name]; ok {
+		// only the top level code runs in the order of the declarations, the functions run when they're called
+		if !s.function && !r.defined(name) {
+			r.checkDefinedBefore(s, identifier)
+		}
+		return
+	}
+	if r.defined(name) {
+		return
+	}
+	message := fmt.Sprintf("identifier not found: %s", name)
+	if assigned {
+		message = fmt.Sprintf("cannot assign to undefined variable: %s", name)
+	}
+	r.diagnostics = append(r.diagnostics, &diagnostic.Diagnostic{
+		Severity: diagnostic.ERROR,
+		Code:     diagnostic.UNDEFINED_VARIABLE,
+		Message:  message,
+		Span:     identifier.Span(),
+		Hint:     "variables have to be declared with let before they're used",
+	})
+}
+
+// binding of the name in the scope, which is depth functions away from the one using the name
+func binding(s *scope, name string, depth int) ast.Binding {
+	for ; s.function; s = s.outer {
+		if slot, ok := s.slots[name]; ok {
+			outer := binding(s.outer, name, depth+1)
+			return ast.Binding{Local: true, Depth: depth, Slot: slot, Outer: &outer}
+		}
+		depth += 1
+	}
+	return ast.Binding{}
+}
+
+// whether the name is declared by the functions enclosing the scope, at the top level or before the program runs
+func (r *resolver) declaredOutside(s *scope, name string) bool {
+	for s = s.outer; s != nil; s = s.outer {
+		if _, ok := s.declarations[name]; ok {
+			return true
+		}
+	}
+	return r.defined(name)
+}
+
+func (r *resolver) checkDefinedBefore(s *scope, identifier *ast.Identifier) {
+	declarations := s.declarations[identifier.Value]
+	first := declarations[0]
+	for _, declaration := range declarations {
+		if declaration.from < first.from {
+			first = declaration
+		}
+	}
+	offset := identifier.Span().Start.Offset
+	if offset >= first.from {
+		return
+	}
+	for _, loop := range s.loops {
+		if !contains(loop, offset) {
+			continue
+		}
+		for _, declaration := range declarations {
+			if contains(loop, declaration.name.Span().Start.Offset) {
+				return
+			}
+		}
+	}
+	// the file is already given by the diagnostic's position
+	defined := first.name.Span().Start
+	r.diagnostics = append(r.diagnostics, &diagnostic.Diagnostic{
+		Severity: diagnostic.ERROR,
+		Code:     diagnostic.USED_BEFORE_DEFINED,
+		Message:  fmt.Sprintf("%s is used before it's defined", identifier.Value),
+		Span:     identifier.Span(),
+		Hint:     fmt.Sprintf("%s is defined at %d:%d", identifier.Value, defined.Line, defined.Column),
+	})
+}
+
+func contains(span token.Span, offset int) bool {
+	return span.Start.Offset <= offset && offset < span.End.Offset
+}
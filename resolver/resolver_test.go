@@ -0,0 +1,188 @@
+package resolver
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/lexer"
+	"kjarmicki.github.com/monkey/parser"
+)
+
+func TestBindings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string // bindings of the identifiers, in the order of the source
+	}{
+		{"let a = 1; a", []string{"a global", "a global"}},
+		{"fn(a, b) { a + b }", []string{"a local(0,0)", "b local(0,1)", "a local(0,0)", "b local(0,1)"}},
+		{"fn(a) { let b = a; b }", []string{"a local(0,0)", "b local(0,1)", "a local(0,0)", "b local(0,1)"}},
+		{"let g = 1; fn(a) { fn() { a + g } }", []string{"g global", "a local(0,0)", "a local(1,0)", "g global"}},
+		{"fn(a) { fn(b) { fn() { a + b } } }", []string{"a local(0,0)", "b local(0,0)", "a local(2,0)", "b local(1,0)"}},
+		// blocks don't have their own variables
+		{"fn() { if (true) { let a = 1 }; a }", []string{"a local(0,0)", "a local(0,0)"}},
+		{"fn(xs) { for (x in xs) { x } }", []string{"xs local(0,0)", "x local(0,1)", "xs local(0,0)", "x local(0,1)"}},
+		{"fn() { try { 1 } catch (e) { e } }", []string{"e local(0,0)", "e local(0,0)"}},
+		// declaring the variable again uses the same slot
+		{"fn() { let a = 1; let a = a + 1 }", []string{"a local(0,0)", "a local(0,0)", "a local(0,0)"}},
+		{"fn(a) { a = 2 }", []string{"a local(0,0)", "a local(0,0)"}},
+		// parameters shadow the outer variables
+		{"fn(a) { fn(a) { a } }", []string{"a local(0,0)", "a local(0,0)", "a local(0,0)"}},
+		{"let a = 1; fn() { fn() { a; let a = 2 } }", []string{"a global", "a local(0,0)", "a local(0,0)"}},
+		{"len([])", []string{"len global"}},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		assert.Empty(t, Resolve(program, defined("len")), tt.input)
+		assert.Equal(t, tt.expected, bindings(program), tt.input)
+	}
+}
+
+func TestOuterBindings(t *testing.T) {
+	program := parse("fn(a) { fn() { a; let a = 1 } }")
+	assert.Empty(t, Resolve(program, defined()))
+
+	var chain []string
+	ast.Walk(program, func(node ast.Node) bool {
+		if identifier, ok := node.(*ast.Identifier); ok && chain == nil {
+			for binding := &identifier.Binding; binding != nil; binding = binding.Outer {
+				chain = append(chain, binding.String())
+			}
+		}
+		return true
+	})
+	assert.Equal(t, []string{"local(0,0)", "local(1,0)", "global"}, chain)
+}
+
+func TestLocals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected [][]string // locals of the functions, in the order of the source
+	}{
+		{"fn() { 1 }", [][]string{nil}},
+		{"fn(a, b) { let c = 1; let a = 2; for (d in []) { try {} catch (e) {} } }", [][]string{{"a", "b", "c", "d", "e"}}},
+		{"fn(a) { let b = fn(c) { let d = 1 }; let e = 2 }", [][]string{{"a", "b", "e"}, {"c", "d"}}},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		assert.Empty(t, Resolve(program, defined()), tt.input)
+		var locals [][]string
+		ast.Walk(program, func(node ast.Node) bool {
+			if fn, ok := node.(*ast.FunctionLiteral); ok {
+				locals = append(locals, fn.Locals)
+			}
+			return true
+		})
+		assert.Equal(t, tt.expected, locals, tt.input)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"x", []string{"E0011 1:1 identifier not found: x"}},
+		{"x = 1", []string{"E0011 1:1 cannot assign to undefined variable: x"}},
+		{"fn() { x }", []string{"E0011 1:8 identifier not found: x"}},
+		{"fn() { let a = 1 }; a", []string{"E0011 1:21 identifier not found: a"}},
+		{"x; y", []string{"E0011 1:1 identifier not found: x", "E0011 1:4 identifier not found: y"}},
+		{"a; let a = 1", []string{"E0012 1:1 a is used before it's defined"}},
+		{"let a = a", []string{"E0012 1:9 a is used before it's defined"}},
+		{"fn() { a; let a = 1 }", []string{"E0012 1:8 a is used before it's defined"}},
+		{"for (x in x) {}", []string{"E0012 1:11 x is used before it's defined"}},
+		{"fn() { let f = fn() { e; try {} catch (e) {} } }", []string{"E0012 1:23 e is used before it's defined"}},
+		// defined by the time the functions run
+		{"let f = fn() { g() }; let g = fn() { 1 }", nil},
+		{"fn() { let f = fn() { a }; let a = 1 }", nil},
+		{"let f = fn(n) { f(n - 1) }", nil},
+		// defined by the previous iterations
+		{"let i = 0; while (i < 2) { if (i > 0) { last }; let last = i }", nil},
+		{"fn() { for (x in [1, 2]) { if (x > 1) { last }; let last = x } }", nil},
+		// until the local is defined, its name refers to the outer variable
+		{"try {} catch (e) {}; fn() { e; try {} catch (e) {} }", nil},
+		{"let x = 1; let g = fn() { let x = x + 1; x }; g()", nil},
+		{"fn(a) { fn() { a; let a = 1 } }", nil},
+		{"fn() { len; let len = 1 }", nil},
+		// defined before the program runs, e.g. by the previous inputs of the REPL
+		{"d; let d = 1", nil},
+		{"d = 1", nil},
+		{"puts(len([]))", nil},
+		{"let a = 1; a = 2; if (true) { let b = a }; b", nil},
+	}
+
+	for _, tt := range tests {
+		var actual []string
+		for _, d := range Resolve(parse(tt.input), defined("d", "puts", "len")) {
+			actual = append(actual, fmt.Sprintf("%s %s %s", d.Code, d.Span.Start, d.Message))
+		}
+		assert.Equal(t, tt.expected, actual, tt.input)
+	}
+}
+
+func TestUsedBeforeDefinedHint(t *testing.T) {
+	diagnostics := Resolve(parse("fn() {\n  a;\n  let a = 1;\n  let a = 2\n}"), defined())
+
+	assert.Len(t, diagnostics, 1)
+	assert.Equal(t, "a is defined at 3:7", diagnostics[0].Hint)
+}
+
+func TestResolvingAgain(t *testing.T) {
+	program := parse("let a = 1; fn(b) { let c = a + b; c }")
+	Resolve(program, defined())
+	first := bindings(program)
+
+	assert.Empty(t, Resolve(program, defined()))
+	assert.Equal(t, first, bindings(program))
+	assert.Equal(t, []string{"b", "c"}, program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.FunctionLiteral).Locals)
+}
+
+func parse(input string) *ast.Program {
+	return parser.New(lexer.New(input)).ParseProgram()
+}
+
+func defined(names ...string) func(name string) bool {
+	return func(name string) bool {
+		for _, defined := range names {
+			if name == defined {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// bindings of all the identifiers (the declared ones, which ast.Walk skips, included), sorted by their positions
+func bindings(program *ast.Program) []string {
+	var identifiers []*ast.Identifier
+	ast.Walk(program, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.Identifier:
+			identifiers = append(identifiers, node)
+		case *ast.LetStatement:
+			identifiers = append(identifiers, node.Name)
+		case *ast.FunctionLiteral:
+			identifiers = append(identifiers, node.Parameters...)
+		case *ast.ForExpression:
+			identifiers = append(identifiers, node.Variable)
+		case *ast.TryExpression:
+			if node.CatchParameter != nil {
+				identifiers = append(identifiers, node.CatchParameter)
+			}
+		}
+		return true
+	})
+	sort.Slice(identifiers, func(i, j int) bool {
+		return identifiers[i].Span().Start.Offset < identifiers[j].Span().Start.Offset
+	})
+
+	result := make([]string, len(identifiers))
+	for i, identifier := range identifiers {
+		result[i] = identifier.Value + " " + identifier.Binding.String()
+	}
+	return result
+}
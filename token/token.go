@@ -1,5 +1,7 @@
 package token
 
+import "fmt"
+
 const (
 	ILLEGAL = "ILLEGAL"
 	EOF     = "EOF"
@@ -7,8 +9,11 @@ const (
 	// identifiers + literals
 	IDENT  = "IDENT" // add, foobar, x, y, ...
 	INT    = "INT"
+	FLOAT  = "FLOAT" // 1.5, 1e-9, 2.5E+3
 	STRING = "STRING"
 
+	DOC_COMMENT = "DOC_COMMENT" // /// documentation, other comments are skipped by the lexer
+
 	// operators
 	ASSIGN   = "="
 	PLUS     = "+"
@@ -16,11 +21,21 @@ const (
 	BANG     = "!"
 	ASTERISK = "*"
 	SLASH    = "/"
+	PERCENT  = "%"
 	LT       = "<"
 	GT       = ">"
+	LT_EQ    = "<="
+	GT_EQ    = ">="
 	EQ       = "=="
 	NOT_EQ   = "!="
-	COLON    = ":"
+	AND      = "&&"
+	OR       = "||"
+
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
+	COLON           = ":"
 
 	// delimiters
 	COMMA     = ","
@@ -40,16 +55,34 @@ const (
 	IF       = "IF"
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
+	WHILE    = "WHILE"
+	FOR      = "FOR"
+	IN       = "IN"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	FINALLY  = "FINALLY"
+	THROW    = "THROW"
 )
 
 var keywords = map[string]TokenType{
-	"fn":     FUNCTION,
-	"let":    LET,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
+	"fn":       FUNCTION,
+	"let":      LET,
+	"true":     TRUE,
+	"false":    FALSE,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"while":    WHILE,
+	"for":      FOR,
+	"in":       IN,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"try":      TRY,
+	"catch":    CATCH,
+	"finally":  FINALLY,
+	"throw":    THROW,
 }
 
 type TokenType string
@@ -57,6 +90,59 @@ type TokenType string
 type Token struct {
 	Type    TokenType
 	Literal string
+	Span    Span // where in the source the token was found
+}
+
+// position in the source code, lines and columns start at 1
+type Position struct {
+	File   string // optional, empty when reading from the REPL or a plain string
+	Offset int    // byte offset, starts at 0
+	Line   int
+	Column int
+}
+
+// zero position means "unknown" (e.g. nodes built by hand rather than by the parser)
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.File != "" {
+			return p.File
+		}
+		return "-"
+	}
+	loc := fmt.Sprintf("%d:%d", p.Line, p.Column)
+	if p.File != "" {
+		return p.File + ":" + loc
+	}
+	return loc
+}
+
+// source range, Start is inclusive and End is exclusive (it points right after the last char)
+type Span struct {
+	Start Position
+	End   Position
+}
+
+func (s Span) IsValid() bool {
+	return s.Start.IsValid()
+}
+
+func (s Span) String() string {
+	return s.Start.String()
+}
+
+// spans from the start of the first span to the end of the last one
+func Join(from, to Span) Span {
+	if !from.IsValid() {
+		return to
+	}
+	if !to.IsValid() {
+		return from
+	}
+	return Span{Start: from.Start, End: to.End}
 }
 
 func LookupIdent(ident string) TokenType {
@@ -0,0 +1,542 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"kjarmicki.github.com/monkey/code"
+	"kjarmicki.github.com/monkey/compiler"
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/token"
+)
+
+/*
+ * Runs the bytecode produced by the compiler with a stack of values and a stack of call frames.
+ * Globals live in the environment, so the host defines them (and sees the results) the same way as with the evaluator.
+ * The operators, indexing and iteration are shared with the evaluator, so both give the same results.
+ */
+type VM struct {
+	constants []object.Object
+	globals   []string
+	main      *object.CompiledFunction
+	env       *object.Environment
+	rt        *object.Runtime
+
+	stack  []object.Object
+	sp     int // stack[sp-1] is the top of the stack
+	frames []*frame
+}
+
+// function being executed
+type frame struct {
+	closure  *object.Closure
+	ip       int // offset of the next instruction
+	start    int // offset of the instruction being executed
+	bp       int // position of the first local on the stack, the called closure is right below it
+	handlers []handler
+
+	// frames reused by tail calls remember the function they were created for, where it made the first of the calls
+	// and where the one being executed was called from (the spans are only looked up for the errors),
+	// so that the errors leaving them can be given the same stack as in the evaluator
+	tailCalls   int
+	called      *object.CompiledFunction
+	firstCallAt int
+	tailCaller  *object.CompiledFunction
+	tailCallAt  int
+}
+
+// try block the frame is in
+type handler struct {
+	target int // offset of the code handling the error
+	sp     int // stack pointer at the start of the try
+}
+
+// state of a for loop, kept on the stack while the loop runs
+type iterator struct {
+	items []object.Object
+	next  int
+}
+
+func (it *iterator) Type() object.ObjectType {
+	return "ITERATOR"
+}
+
+func (it *iterator) Inspect() string {
+	return fmt.Sprintf("iterator(%d/%d)", it.next, len(it.items))
+}
+
+func New(bytecode *compiler.Bytecode, env *object.Environment) *VM {
+	return &VM{
+		constants: bytecode.Constants,
+		globals:   bytecode.Globals,
+		main:      bytecode.Main,
+		env:       env,
+		rt:        env.Runtime(),
+	}
+}
+
+// runs the program as a new run of the runtime, the result is the same as what the evaluator gives for the program:
+// the value of the last statement (nil if it's not an expression) or an error
+func (vm *VM) Run(ctx context.Context) object.Object {
+	defer vm.rt.Begin(ctx)()
+	vm.sp = 0
+	vm.frames = []*frame{{closure: &object.Closure{Fn: vm.main}}}
+	return vm.execute()
+}
+
+// the operands of the instructions are decoded by the cases of the switch, which move ip past them
+func (vm *VM) execute() object.Object {
+	for {
+		f := vm.frames[len(vm.frames)-1]
+		f.start = f.ip
+		op := code.Opcode(f.closure.Fn.Instructions[f.ip])
+		f.ip += 1
+
+		var err *object.Error
+		if err = vm.rt.Step(); err != nil {
+			if result, done := vm.raise(err); done {
+				return result
+			}
+			continue
+		}
+
+		switch op {
+		case code.OpConstant:
+			constant := vm.constants[f.operand2()]
+			if str, ok := constant.(*object.String); ok {
+				// strings are allocated on every evaluation of the literal, like in the evaluator
+				if err = vm.rt.Allocate(object.StringSize(len(str.Value))); err == nil {
+					vm.push(&object.String{Value: str.Value})
+				}
+			} else {
+				vm.push(constant)
+			}
+		case code.OpNull:
+			vm.push(evaluator.NULL)
+		case code.OpTrue:
+			vm.push(evaluator.TRUE)
+		case code.OpFalse:
+			vm.push(evaluator.FALSE)
+		case code.OpPop:
+			vm.pop()
+		case code.OpDup2:
+			vm.push(vm.stack[vm.sp-2])
+			vm.push(vm.stack[vm.sp-2])
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpEqual, code.OpNotEqual,
+			code.OpLess, code.OpLessEqual, code.OpGreater, code.OpGreaterEqual:
+			right := vm.pop()
+			left := vm.pop()
+			err = vm.pushResult(evaluator.InfixOperation(vm.rt, operators[op], left, right))
+		case code.OpMinus:
+			err = vm.pushResult(evaluator.PrefixOperation("-", vm.pop()))
+		case code.OpBang:
+			err = vm.pushResult(evaluator.PrefixOperation("!", vm.pop()))
+
+		case code.OpJump:
+			f.ip = f.operand4()
+		case code.OpJumpIfFalsy:
+			target := f.operand4()
+			if !evaluator.IsTruthy(vm.pop()) {
+				f.ip = target
+			}
+		case code.OpJumpIfFalsyKeep:
+			target := f.operand4()
+			if !evaluator.IsTruthy(vm.stack[vm.sp-1]) {
+				f.ip = target
+			} else {
+				vm.pop()
+			}
+		case code.OpJumpIfTruthyKeep:
+			target := f.operand4()
+			if evaluator.IsTruthy(vm.stack[vm.sp-1]) {
+				f.ip = target
+			} else {
+				vm.pop()
+			}
+
+		case code.OpGetGlobal:
+			name := vm.globals[f.operand2()]
+			if val, ok := vm.env.Get(name); ok {
+				vm.push(val)
+			} else if builtin, ok := evaluator.LookupBuiltin(name); ok {
+				vm.push(builtin)
+			} else {
+				err = identifierNotFound(name)
+			}
+		case code.OpDefineGlobal:
+			vm.env.Set(vm.globals[f.operand2()], vm.pop())
+		case code.OpAssignGlobal:
+			name := vm.globals[f.operand2()]
+			if !vm.env.Assign(name, vm.stack[vm.sp-1]) {
+				err = undefinedAssignment(name)
+			}
+		case code.OpGetLocal:
+			slot := f.operand2()
+			if val := vm.stack[f.bp+slot]; val != nil {
+				vm.push(val)
+			} else {
+				err = identifierNotFound(f.closure.Fn.Locals[slot])
+			}
+		case code.OpDefineLocal:
+			vm.stack[f.bp+f.operand2()] = vm.pop()
+		case code.OpAssignLocal:
+			slot := f.operand2()
+			if vm.stack[f.bp+slot] != nil {
+				vm.stack[f.bp+slot] = vm.stack[vm.sp-1]
+			} else {
+				err = undefinedAssignment(f.closure.Fn.Locals[slot])
+			}
+		case code.OpGetCell:
+			slot := f.operand2()
+			err = vm.getCell(vm.stack[f.bp+slot].(*object.Cell), f.closure.Fn.Locals[slot])
+		case code.OpDefineCell:
+			vm.stack[f.bp+f.operand2()].(*object.Cell).Value = vm.pop()
+		case code.OpAssignCell:
+			slot := f.operand2()
+			err = vm.assignCell(vm.stack[f.bp+slot].(*object.Cell), f.closure.Fn.Locals[slot])
+		case code.OpGetFree:
+			index := f.operand2()
+			err = vm.getCell(f.closure.Free[index], f.closure.Fn.Free[index])
+		case code.OpAssignFree:
+			index := f.operand2()
+			err = vm.assignCell(f.closure.Free[index], f.closure.Fn.Free[index])
+		case code.OpGetLocalOrOuter:
+			slot, target := f.operand2(), f.operand4()
+			if val := vm.stack[f.bp+slot]; val != nil {
+				vm.push(val)
+				f.ip = target
+			}
+		case code.OpAssignLocalOrOuter:
+			slot, target := f.operand2(), f.operand4()
+			if vm.stack[f.bp+slot] != nil {
+				vm.stack[f.bp+slot] = vm.stack[vm.sp-1]
+				f.ip = target
+			}
+		case code.OpGetCellOrOuter:
+			cell, target := vm.stack[f.bp+f.operand2()].(*object.Cell), f.operand4()
+			if cell.Value != nil {
+				vm.push(cell.Value)
+				f.ip = target
+			}
+		case code.OpAssignCellOrOuter:
+			cell, target := vm.stack[f.bp+f.operand2()].(*object.Cell), f.operand4()
+			if cell.Value != nil {
+				cell.Value = vm.stack[vm.sp-1]
+				f.ip = target
+			}
+		case code.OpGetFreeOrOuter:
+			cell, target := f.closure.Free[f.operand2()], f.operand4()
+			if cell.Value != nil {
+				vm.push(cell.Value)
+				f.ip = target
+			}
+		case code.OpAssignFreeOrOuter:
+			cell, target := f.closure.Free[f.operand2()], f.operand4()
+			if cell.Value != nil {
+				cell.Value = vm.stack[vm.sp-1]
+				f.ip = target
+			}
+		case code.OpNewCell:
+			slot := f.bp + f.operand2()
+			vm.stack[slot] = &object.Cell{Value: vm.stack[slot]}
+		case code.OpLoadCell:
+			vm.push(vm.stack[f.bp+f.operand2()])
+		case code.OpLoadFreeCell:
+			vm.push(f.closure.Free[f.operand2()])
+		case code.OpClosure:
+			fn := vm.constants[f.operand2()].(*object.CompiledFunction)
+			free := make([]*object.Cell, f.operand2())
+			for i := range free {
+				free[i] = vm.stack[vm.sp-len(free)+i].(*object.Cell)
+			}
+			vm.sp -= len(free)
+			vm.push(&object.Closure{Fn: fn, Free: free})
+
+		case code.OpArray:
+			n := f.operand2()
+			if err = vm.rt.Allocate(object.ArraySize(n)); err == nil {
+				elements := make([]object.Object, n)
+				copy(elements, vm.stack[vm.sp-n:vm.sp])
+				vm.sp -= n
+				vm.push(&object.Array{Elements: elements})
+			}
+		case code.OpHash:
+			err = vm.buildHash(f.operand2())
+		case code.OpIndex:
+			index := vm.pop()
+			left := vm.pop()
+			err = vm.pushResult(evaluator.IndexOperation(left, index))
+		case code.OpSetIndex:
+			val := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+			err = vm.pushResult(evaluator.IndexAssignment(vm.rt, left, index, val))
+
+		case code.OpCall:
+			err = vm.call(f.operand1(), false)
+		case code.OpTailCall:
+			err = vm.call(f.operand1(), true)
+		case code.OpReturnValue, code.OpReturn:
+			var result object.Object
+			if op == code.OpReturnValue {
+				result = vm.pop()
+			}
+			if len(vm.frames) == 1 {
+				return result
+			}
+			vm.sp = f.bp - 1
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			vm.rt.LeaveCall()
+			vm.push(result)
+
+		case code.OpTry:
+			f.handlers = append(f.handlers, handler{target: f.operand4(), sp: vm.sp})
+		case code.OpPopTry:
+			f.handlers = f.handlers[:len(f.handlers)-1]
+		case code.OpCatch:
+			err = vm.pushResult(evaluator.CaughtError(vm.rt, vm.pop().(*object.Error)))
+		case code.OpRethrow:
+			err = vm.pop().(*object.Error)
+		case code.OpThrow:
+			err = evaluator.ThrownError(vm.pop())
+		case code.OpError:
+			err = &object.Error{Message: vm.constants[f.operand2()].(*object.String).Value}
+
+		case code.OpIter:
+			items, iterErr := evaluator.IterationItems(vm.rt, vm.pop())
+			if iterErr != nil {
+				err = iterErr
+			} else {
+				vm.push(&iterator{items: items})
+			}
+		case code.OpIterNext:
+			target := f.operand4()
+			it := vm.stack[vm.sp-1].(*iterator)
+			if it.next < len(it.items) {
+				vm.push(it.items[it.next])
+				it.next += 1
+			} else {
+				f.ip = target
+			}
+
+		default:
+			err = &object.Error{Message: fmt.Sprintf("unknown opcode %d", op)}
+		}
+
+		if err != nil {
+			if result, done := vm.raise(err); done {
+				return result
+			}
+		}
+	}
+}
+
+// indexed by the opcodes, a map lookup on every operation would slow the vm down
+var operators = [...]string{
+	code.OpAdd:          "+",
+	code.OpSub:          "-",
+	code.OpMul:          "*",
+	code.OpDiv:          "/",
+	code.OpMod:          "%",
+	code.OpEqual:        "==",
+	code.OpNotEqual:     "!=",
+	code.OpLess:         "<",
+	code.OpLessEqual:    "<=",
+	code.OpGreater:      ">",
+	code.OpGreaterEqual: ">=",
+}
+
+func (f *frame) operand1() int {
+	operand := int(f.closure.Fn.Instructions[f.ip])
+	f.ip += 1
+	return operand
+}
+
+func (f *frame) operand2() int {
+	operand := int(code.ReadUint16(f.closure.Fn.Instructions[f.ip:]))
+	f.ip += 2
+	return operand
+}
+
+func (f *frame) operand4() int {
+	operand := int(code.ReadUint32(f.closure.Fn.Instructions[f.ip:]))
+	f.ip += 4
+	return operand
+}
+
+func (vm *VM) push(obj object.Object) {
+	if vm.sp == len(vm.stack) {
+		vm.stack = append(vm.stack, obj)
+	} else {
+		vm.stack[vm.sp] = obj
+	}
+	vm.sp += 1
+}
+
+func (vm *VM) pop() object.Object {
+	vm.sp -= 1
+	return vm.stack[vm.sp]
+}
+
+// pushes the result of a shared operation, unless it's an error
+func (vm *VM) pushResult(result object.Object) *object.Error {
+	if err, ok := result.(*object.Error); ok {
+		return err
+	}
+	vm.push(result)
+	return nil
+}
+
+func (vm *VM) getCell(cell *object.Cell, name string) *object.Error {
+	if cell.Value == nil {
+		return identifierNotFound(name)
+	}
+	vm.push(cell.Value)
+	return nil
+}
+
+func (vm *VM) assignCell(cell *object.Cell, name string) *object.Error {
+	if cell.Value == nil {
+		return undefinedAssignment(name)
+	}
+	cell.Value = vm.stack[vm.sp-1]
+	return nil
+}
+
+func identifierNotFound(name string) *object.Error {
+	return &object.Error{Message: "identifier not found: " + name}
+}
+
+func undefinedAssignment(name string) *object.Error {
+	return &object.Error{Message: "cannot assign to undefined variable: " + name}
+}
+
+// the keys and values are on the stack in pairs
+func (vm *VM) buildHash(n int) *object.Error {
+	if err := vm.rt.Allocate(object.HashSize(n)); err != nil {
+		return err
+	}
+	pairs := make(map[object.HashKey]object.HashPair)
+	for i := vm.sp - 2*n; i < vm.sp; i += 2 {
+		key, value := vm.stack[i], vm.stack[i+1]
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return &object.Error{Message: fmt.Sprintf("unusable as hash key: %s", key.Type())}
+		}
+		pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+	}
+	vm.sp -= 2 * n
+	vm.push(&object.Hash{Pairs: pairs})
+	return nil
+}
+
+// calls the function below the arguments on the stack. Closures get a new frame, with the arguments as their first
+// locals, builtins are called right away and replace the function and the arguments with their result.
+// Tail calls of closures reuse the current frame instead, the called closure and the arguments take the place
+// of the current one and its locals.
+func (vm *VM) call(numArgs int, tail bool) *object.Error {
+	callee := vm.stack[vm.sp-1-numArgs]
+	switch callee := callee.(type) {
+	case *object.Closure:
+		fn := callee.Fn
+		// like in the evaluator, the errors raised before the body starts get no frame of the function
+		if numArgs < fn.NumParameters {
+			return &object.Error{Message: fmt.Sprintf("wrong number of arguments. got=%d, want=%d", numArgs, fn.NumParameters)}
+		}
+
+		var f *frame
+		if tail {
+			f = vm.frames[len(vm.frames)-1]
+			copy(vm.stack[f.bp-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+			vm.sp = f.bp + numArgs
+			if f.tailCalls == 0 {
+				f.called, f.firstCallAt = f.closure.Fn, f.start
+			}
+			f.tailCalls += 1
+			f.tailCaller, f.tailCallAt = f.closure.Fn, f.start
+			f.closure, f.ip = callee, 0
+		} else {
+			if err := vm.rt.EnterCall(); err != nil {
+				return err
+			}
+			f = &frame{closure: callee, bp: vm.sp - numArgs}
+			vm.frames = append(vm.frames, f)
+		}
+		// extra arguments are dropped, the other locals are undefined until their let
+		vm.sp = f.bp + fn.NumParameters
+		for i := fn.NumParameters; i < len(fn.Locals); i++ {
+			vm.push(nil)
+		}
+		return nil
+	case *object.Builtin:
+		args := make([]object.Object, numArgs)
+		copy(args, vm.stack[vm.sp-numArgs:vm.sp])
+		vm.sp -= numArgs + 1
+		var result object.Object
+		if callee.Signature != nil {
+			if err := callee.Signature.Check(callee.Name, args); err != nil {
+				result = err
+			}
+		}
+		if result == nil {
+			result = callee.Fn(vm.rt, args...)
+		}
+		if err, ok := result.(*object.Error); ok {
+			err.Stack = append(err.Stack, object.Frame{Function: callee.Name, Builtin: true, CallSite: vm.span()})
+			return err
+		}
+		vm.push(result)
+		return nil
+	default:
+		return &object.Error{Message: fmt.Sprintf("not a function: %s", callee.Type())}
+	}
+}
+
+// location of the instruction being executed by the innermost frame
+func (vm *VM) span() token.Span {
+	f := vm.frames[len(vm.frames)-1]
+	return f.closure.Fn.SourceMap.Lookup(f.start)
+}
+
+/*
+ * Raises the error: it goes to the innermost handler of the current frame or, when the frame has none,
+ * out of the function, recording the call on the error's stack. Once it leaves the program, it's the result of the run.
+ * Like in the evaluator, errors without a location get the one of the innermost code they pass through.
+ */
+func (vm *VM) raise(err *object.Error) (object.Object, bool) {
+	for {
+		if !err.Span.IsValid() {
+			err.Span = vm.span()
+		}
+		f := vm.frames[len(vm.frames)-1]
+		if len(f.handlers) > 0 && err.Catchable() {
+			h := f.handlers[len(f.handlers)-1]
+			f.handlers = f.handlers[:len(f.handlers)-1]
+			vm.sp = h.sp
+			vm.push(err)
+			f.ip = h.target
+			return nil, false
+		}
+		if len(vm.frames) == 1 {
+			return err, true
+		}
+		vm.sp = f.bp - 1
+		vm.frames = vm.frames[:len(vm.frames)-1]
+		vm.rt.LeaveCall()
+		name := f.closure.Fn.Name
+		if f.tailCalls > 0 {
+			err.Stack = append(err.Stack, object.Frame{Function: name, CallSite: f.tailCaller.SourceMap.Lookup(f.tailCallAt)})
+			if f.tailCalls > 1 {
+				err.Stack = append(err.Stack, object.Frame{
+					Function: f.tailCaller.Name,
+					CallSite: f.called.SourceMap.Lookup(f.firstCallAt),
+					Elided:   f.tailCalls > 2,
+				})
+			}
+			name = f.called.Name
+		}
+		err.Stack = append(err.Stack, object.Frame{Function: name, CallSite: vm.span()})
+	}
+}
@@ -0,0 +1,560 @@
+package vm
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"kjarmicki.github.com/monkey/ast"
+	"kjarmicki.github.com/monkey/compiler"
+	"kjarmicki.github.com/monkey/evaluator"
+	"kjarmicki.github.com/monkey/lexer"
+	"kjarmicki.github.com/monkey/object"
+	"kjarmicki.github.com/monkey/parser"
+)
+
+// the vm has to give exactly the same results as the evaluator, including the errors with their positions and stacks
+func TestSameResultsAsEvaluator(t *testing.T) {
+	inputs := []string{
+		// cases of the evaluator tests
+		"5",
+		"10",
+		"-5",
+		"-10",
+		"5 + 5 + 5 + 5 - 10",
+		"2 * 2 * 2 * 2 * 2",
+		"-50 + 100 + -50",
+		"5 * 2 + 10",
+		"5 + 2 * 10",
+		"20 + 2 * -10",
+		"50 / 2 * 2 + 10",
+		"2 * (5 + 10)",
+		"3 * 3 * 3 + 10",
+		"3 * (3 * 3) + 10",
+		"(5 + 10 * 2 + 15 / 3) * 2 + -10",
+		"7 % 3",
+		"-7 % 3",
+		"7 % -3",
+		"1 + 10 % 4 * 2",
+		"99999999999999999999 % 7",
+		"9223372036854775807 + 1",
+		"-9223372036854775807 - 2",
+		"9223372036854775807 * 9223372036854775807",
+		"99999999999999999999",
+		"-99999999999999999999",
+		"99999999999999999999 / 10",
+		"99999999999999999999 - 99999999999999999998",
+		"int(1e20)",
+		`int("123456789012345678901234567890")`,
+		"1.5",
+		"-2.5",
+		"1.5 + 1.5",
+		"7 / 2.0",
+		"7.0 / 2",
+		"0.1 * 3",
+		"10 - 0.5",
+		"2 * (1.25 + 1)",
+		"1e3 + 1",
+		"7.5 % 2",
+		"-7.5 % 2",
+		"1.5 < 2",
+		"2 > 1.5",
+		"2 == 2.0",
+		"2.0 != 2",
+		"0.1 + 0.2 == 0.3",
+		"1.5 > 1.5",
+		"99999999999999999999 > 9223372036854775807",
+		"-99999999999999999999 < 1",
+		"99999999999999999999 == 99999999999999999999",
+		"-99999999999999999999 < 0.5",
+		"100000000000000000000 == 1e20",
+		"1 <= 1",
+		"1 <= 0",
+		"2 >= 1",
+		"1 >= 2",
+		"1.5 <= 2",
+		"2.0 >= 2",
+		"99999999999999999999 >= 99999999999999999999",
+		"true",
+		"false",
+		"1 < 2",
+		"1 > 2",
+		"1 < 1",
+		"1 > 1",
+		"1 == 1",
+		"1 != 1",
+		"1 == 2",
+		"1 != 2",
+		"true == true",
+		"false == false",
+		"true == false",
+		"true != false",
+		"false != true",
+		"(1 < 2) == true",
+		"(1 < 2) == false",
+		"(1 > 2) == true",
+		"(1 > 2) == false",
+		"!true",
+		"!false",
+		"!5",
+		"!!true",
+		"!!false",
+		"!!5",
+		"if (true) { 10 }",
+		"if (false) { 10 }",
+		"if (1) { 10 }",
+		"if (1 < 2) { 10 }",
+		"if (1 > 2) { 10 }",
+		"if (1 > 2) { 10 } else { 20 }",
+		"if (1 < 2) { 10 } else { 20 }",
+		"return 10;",
+		"return 10; 9;",
+		"return 2 * 5; 9;",
+		"9; return 2 * 5; 9;",
+		`
+			if (10 > 1) {
+				if (10 > 1) {
+					return 10;
+				}
+				return 1;
+			}
+		`,
+		"true && true",
+		"true && false",
+		"false || true",
+		"false || false",
+		"1 < 2 && 2 < 3",
+		"1 > 2 || 2 > 3",
+		"1 && 2",
+		"if (false) { 1 } || 5",
+		"0 || 5",
+		"false && 5",
+		"if (false) { 1 } && 5",
+		"let x = 1; false && (x = 2); x",
+		"let x = 1; true || (x = 2); x",
+		"let x = 1; true && (x = 2); x",
+		"let x = 1; false || (x = 2); x",
+		"false && undefinedFunction()",
+		"true || 1 + true",
+		"let i = 0; while (i < 10) { let i = i + 1; }; i",
+		"let i = 0; while (false) { let i = i + 1; }; i",
+		"while (false) { 1 }",
+		"let i = 0; while (true) { let i = i + 1; if (i > 4) { break; } }; i",
+		`
+			let i = 0;
+			let sum = 0;
+			while (i < 10) {
+				let i = i + 1;
+				if (i > 5) { continue; }
+				let sum = sum + i;
+			}
+			sum
+		`,
+		"let f = fn() { let i = 0; while (true) { let i = i + 1; if (i == 3) { return i * 10; } } }; f()",
+		"let i = 0; while (i < 100000) { let i = i + 1; }; i",
+		"try { 1 } catch (e) { 2 }",
+		"try { 1 + true } catch (e) { 2 }",
+		`try { 1 + true } catch (e) { e["message"] }`,
+		`try { 1 + true } catch (e) { e["kind"] }`,
+		`try { len(1) } catch (e) { e["message"] }`,
+		`try { throw "boom" } catch (e) { e["message"] }`,
+		`try { throw "boom" } catch (e) { e["kind"] }`,
+		`try { throw 42 } catch (e) { e["value"] }`,
+		`try { throw {"message": "custom", "code": 7} } catch (e) { e["message"] + " " + e["value"]["message"] }`,
+		`try { try { throw "inner" } catch (e) { throw e } } catch (e) { e["message"] }`,
+		`try { 1 + true } catch (e) { e["value"] }`,
+		"let f = fn() { throw 1 }; let g = fn() { 1 + f() }; try { g() } catch (e) { len(e[\"stack\"]) }",
+		"let f = fn() { 1 + f() }; try { f() } catch (e) { e[\"kind\"] }",
+		"let log = []; try { log = push(log, 1) } finally { log = push(log, 2) }; log",
+		"let log = []; try { try { throw 1 } finally { log = push(log, \"finally\") } } catch (e) { log = push(log, \"catch\") }; log",
+		"try { 1 } finally { 2 }",
+		"try { throw 1 } catch (e) { 2 } finally { 3 }",
+		"try { 1 } finally { throw \"from finally\" }",
+		"try { throw 1 } catch (e) { throw 2 }",
+		"try { throw 1 } finally { 2 }",
+		// break leaves the try blocks before dropping the values of the loop, so the handlers find them
+		"let f = fn() { throw 1 }; let r = []; while (true) { r = push(r, 1 + try { try { break } finally { f() } } catch (e) { 10 }); break }; r",
+		"let f = fn() { try { return 1 } finally { return 2 } }; f()",
+		"let f = fn() { try { return 1 } catch (e) { 2 }; 3 }; f()",
+		"let i = 0; while (true) { try { i += 1; if (i > 2) { break } } finally { i += 10 } }; i",
+		"try { 1 + true } catch (e) { 2 }; e[\"kind\"]",
+		"try {} finally {}",
+		"throw \"uncaught\"",
+		"let sum = 0; for (x in [1, 2, 3]) { let sum = sum + x; }; sum",
+		"let sum = 0; for (x in []) { let sum = sum + x; }; sum",
+		"for (x in [1, 2, 3]) { x }",
+		"let sum = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { break; } let sum = sum + x; }; sum",
+		"let sum = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { continue; } let sum = sum + x; }; sum",
+		`let s = ""; for (ch in "zażółć") { let s = ch + s; }; s`,
+		`let s = ""; for (k in {"b": 2, "a": 1, "c": 3}) { let s = s + k; }; s`,
+		`let h = {"b": 2, "a": 1}; let sum = 0; for (k in h) { let sum = sum + h[k]; }; sum`,
+		"let f = fn(xs) { for (x in xs) { if (x > 1) { return x; } } }; f([1, 5, 7])",
+		"let sum = 0; for (xs in [[1, 2], [3]]) { for (x in xs) { if (x == 2) { break; } let sum = sum + x; } }; sum",
+		"let x = 10; for (x in [1, 2]) {}; x",
+		"let x = 1; x = 2; x",
+		"let x = 1; x = 2",
+		"let x = 1; let y = 1; x = y = 5; x + y",
+		"let x = 10; x += 5; x",
+		"let x = 10; x -= 5; x",
+		"let x = 10; x *= 5; x",
+		"let x = 10; x /= 5; x",
+		"let x = 1; x += 0.5; x",
+		`let s = "a"; s += "b"; s`,
+		"let x = 1; let f = fn() { x = 2 }; f(); x",
+		"let x = 1; let f = fn() { let x = 5; x = 2 }; f(); x",
+		"let counter = fn() { let n = 0; fn() { n += 1 } }(); counter(); counter(); counter()",
+		// a local refers to the outer variable of the same name until its let runs
+		"let x = 1; let f = fn(c) { if (c) { let x = 2 }; x }; f(false)",
+		"let x = 1; let f = fn(c) { if (c) { let x = 2 }; x }; f(true)",
+		"let x = 1; let g = fn() { let x = x + 1; x }; g()",
+		"let x = 1; let g = fn() { let x = x + 1; x }; g() * 10 + x",
+		"let f = fn(a) { fn() { let r = a; let a = 5; r + a } }; f(1)()",
+		"let x = 1; let f = fn() { if (false) { let x = 0 }; x = 2 }; f(); x",
+		"let x = 1; let f = fn() { if (false) { let x = 0 }; x += 2 }; f(); x",
+		"let f = fn() { if (false) { let len = 1 }; len([1]) }; f()",
+		"let f = fn(c) { let x = 1; fn() { if (c) { let x = 2 }; fn() { x } } }; f(false)()() * 10 + f(true)()()",
+		"let f = fn() { let x = 1; fn() { let g = fn() { x }; let a = g(); let x = 2; a * 10 + g() } }; f()()",
+		"let f = fn() { if (false) { let y = 0 }; y }; f()",
+		"let f = fn() { if (false) { let y = 0 }; y = 1 }; f()",
+		"let i = 0; let sum = 0; while (i < 5) { i += 1; sum += i; }; sum",
+		"let sum = 0; for (x in [1, 2, 3]) { sum += x }; sum",
+		"let arr = [1, 2, 3]; arr[0] = 5; arr[0] + arr[1]",
+		"let arr = [1, 2, 3]; arr[2] *= 10; arr[2]",
+		"let arr = [1, 2, 3]; let other = arr; arr[1] = 0; other[1]",
+		"let arr = [[1], [2]]; arr[1][0] = 7; arr[1][0]",
+		`let h = {"a": 1}; h["a"] = 2; h["a"]`,
+		`let h = {}; h["b"] = 3; h["b"]`,
+		`let h = {"a": 1}; h["a"] += 1; h["a"]`,
+		`let h = {}; h[1] = "one"; h[1.0]`,
+		"let order = []; let f = fn(v) { order = push(order, v); v }; f(1) + f(2); order[0] * 10 + order[1]",
+		"5 + true;",
+		"5 + true; 5;",
+		"-true",
+		"true + false;",
+		"5; true + false; 5",
+		"if (10 > 1) { true + false; }",
+		`
+			if (10 > 1) {
+				if (10 > 1) {
+					return true + false;
+				}
+				return 1;
+			}
+			`,
+		"foobar",
+		`"Hello" - "World"`,
+		`{"name": "Monkey"}[fn(x) { x }];`,
+		"1 / 0",
+		"1.5 + true",
+		"5 % 0",
+		"true && 1 + true",
+		"true <= false",
+		"x = 5",
+		"len = 5",
+		"let x = true; x += 1",
+		"let arr = [1]; arr[1] = 5",
+		"let arr = [1]; arr[-1] = 5",
+		`let arr = [1]; arr["0"] = 5`,
+		`let s = "abc"; s[0] = "x"`,
+		`let h = {}; h[fn() {}] = 1`,
+		`let h = {}; h["a"] += 1`,
+		"for (x in 5) { x }",
+		"while (true) { 1 + true }",
+		"let x = 1;\nlet y = x + z;",
+		"let f = fn(a) {\n  a + true\n};\nf(1)",
+		"len(1)",
+		"let a = 5; a;",
+		"let a = 5 * 5; a;",
+		"let a = 5; let b = a; b;",
+		"let a = 5; let b = a; let c = a + b + 5; c;",
+		"let identity = fn(x) { x; }; identity(5);",
+		"let identity = fn(x) { return x; }; identity(5);",
+		"let double = fn(x) { x * 2; }; double(5);",
+		"let add = fn(x, y) { x + y; }; add(5, 5);",
+		"let add = fn(x, y) { x + y; }; add(5 + 5, add(5, 5));",
+		"fn(x) { x; }(5)",
+		`len("")`,
+		`len("four")`,
+		`len("hello world")`,
+		`len("zażółć")`,
+		`len([1, 2])`,
+		`len("one", "two")`,
+		`len()`,
+		`first([1, 2, 3])`,
+		`first([])`,
+		`last([1, 2, 3])`,
+		`last([])`,
+		`rest([1, 2, 3])`,
+		`rest([])`,
+		`push([1, 2, 3], 4)`,
+		`push([], 1)`,
+		`push(1, 2)`,
+		`push([])`,
+		`int(3.99)`,
+		`int(-3.99)`,
+		`int(5)`,
+		`int(" 42 ")`,
+		`int("4.2")`,
+		`int(true)`,
+		`float(2)`,
+		`float(2.5)`,
+		`float("1e-3")`,
+		`float("abc")`,
+		`readline(1)`,
+		"[1, 2, 3][0]",
+		"[1, 2, 3][1]",
+		"[1, 2, 3][2]",
+		"let i = 0; [1][i];",
+		"[1, 2, 3][1 + 1];",
+		"let myArray = [1, 2, 3]; myArray[2];",
+		"let myArray = [1, 2, 3]; myArray[0] + myArray[1] + myArray[2];",
+		"let myArray = [1, 2, 3]; let i = myArray[0]; myArray[i]",
+		"[1, 2, 3][3]",
+		"[1, 2, 3][-1]",
+		`{"foo": 5}["foo"]`,
+		`{"foo": 5}["bar"]`,
+		`let key = "foo"; {"foo": 5}[key]`,
+		`{"foo": 5}[true]`,
+		`{5: 5}[5]`,
+		`{true: 5}[true]`,
+		`{false: 5}[false]`,
+		`{1.5: 5}[1.5]`,
+		`{2: 5}[2.0]`,
+		`{99999999999999999999: 5}[99999999999999999998 + 1]`,
+		`puts("hello", 1, [true])`,
+		`let f = fn(x) { puts(x) }; f("from a function")`,
+		`readline()`,
+		`readline(); readline()`,
+		`let sum = 0; let line = readline(); while (line) { sum += int(line); line = readline() }; sum`,
+		"let f = fn() { 1 + f() }; f()",
+		"let f = fn(n) { if (n > 0) { f(n - 1) } }; f(5)",
+		// tail calls don't add to the depth of the calls, errors get the frames of the last call and of the first one
+		"let count = fn(n) { if (n == 0) { \"done\" } else { count(n - 1) } }; count(20000)",
+		"let sum = fn(n, acc) { if (n == 0) { return acc }; return sum(n - 1, acc + n) }; sum(20000, 0)",
+		"let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; even(20001)",
+		"let f = fn(n) { let x = n; while (true) { if (x == 0) { return 0 }; return f(x - 1) } }; f(20000)",
+		"let f = fn(n) { if (n == 0) { len([1, 2]) } else { f(n - 1) } }; f(5)",
+		"let f = fn(n) { if (n == 0) { len(1) } else { f(n - 1) } }; f(5)",
+		"let h = fn() { 1 + true };\nlet g = fn() { h() };\nlet f = fn() { g() };\nf()",
+		"let h = fn() { 1 + true };\nlet g = fn() { h() };\nlet k = fn() { g() };\nlet f = fn() { k() };\nf()",
+		"let h = fn(x) { x + true };\nlet g = fn(y) { let z = y; fn() { z }; h(z) };\nlet f = fn() { 1 + g(2) };\nf()",
+		"let g = fn(a) { a };\nlet f = fn() { g() };\nf()",
+		"let f = fn(a) { a };\nf()",
+		"let f = fn(n) { if (n == 0) { throw \"end\" } else { f(n - 1) } }; try { f(3) } catch (e) { e[\"stack\"] }",
+		`for (c in "a long string") { [c, c, c] }`,
+		`"abc" + "def"`,
+		"[1, 2, 3]",
+		"push([1], 2)",
+		`let h = {"a": 1}; h["a"] = 2; h["b"] = 3`,
+		"1 + true",
+		"let add = fn(a, b) { a + b };\nlet twice = fn(x) { add(x, true) };\ntwice(1)",
+		"let f = fn() { len(1) };\n[f][0]()",
+		"fn() { x }()",
+		// closures and scopes
+		"let newAdder = fn(x) { fn(y) { x + y; } }; let addTwo = newAdder(2); addTwo(2);",
+		"let map = fn(arr, f) { let iter = fn(arr, accumulated) { if (len(arr) == 0) { accumulated } else { iter(rest(arr), push(accumulated, f(first(arr)))) } }; iter(arr, []) }; map([1, 2, 3], fn(x) { x * 2 })",
+		"let f = fn(a) { let g = fn() { a = a + 1; a }; g(); g() + a }; f(1)",
+		"let f = fn() { let fs = []; for (i in [1, 2, 3]) { fs = push(fs, fn() { i }) }; fs[0]() + fs[2]() }; f()",
+		"let outer = fn(x) { fn() { fn() { x += 1 } } }; let inc = outer(10)(); inc(); inc()",
+		"let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; fib(15)",
+		"let f = fn(a, b) { a }; f(1, 2, 3)",
+		// the last of the repeated parameters wins
+		"let f = fn(a, a) { a }; f(1, 2)",
+		"let f = fn(a, b, a) { fn() { a + b } }; f(1, 2, 3)()",
+		"let f = fn() { let x = 1; if (true) { let x = 2 }; x }; f()",
+		"fn(x) { x + 2; };",
+		`[1, 2 * 2, 3 + 3]`,
+		`"Hello" + " " + "World"`,
+		`let two = "two"; {"one": 10 - 9, two: 1 + 1, "thr" + "ee": 6 / 2, 4: 4, true: 5, false: 6, 1.5: 7}`,
+		`{"a": 1, [1]: 2}`,
+
+		// control flow through try and the function boundaries
+		"break",
+		"let f = fn() { continue }; f()",
+		"let f = fn() { try { break } finally { puts(1) } }; try { f() } catch (e) { e[\"message\"] }",
+		"let log = []; for (x in [1, 2, 3]) { try { if (x == 2) { continue } log = push(log, x) } finally { log = push(log, -x) } }; log",
+		"let f = fn() { for (x in [1, 2]) { try { try { return x } finally { puts(x) } } catch (e) { 0 } } }; f()",
+		"let f = fn() { try { throw 1 } catch (e) { return e[\"value\"] } finally { puts(\"done\") } }; f()",
+		"let f = fn() { try { throw 1 } catch (e) { throw 2 } finally { puts(\"done\") } }; try { f() } catch (e) { e[\"stack\"] }",
+		"let g = fn() { 1 + true }; let f = fn() { try { g() } finally { 2 } }; f()",
+		"let i = 0; while (i < 3) { i += 1; try { if (i == 2) { throw i } } catch (e) { continue } }; i",
+		"let x = try { 1 + true } catch (e) { 5 }; x * 2",
+		"for (x in [1, 2]) { try { break } catch (e) { 1 } }",
+		"let i = 0; while (true) { let x = if (true) { break }; i = 1 }; i",
+		"let x = 0; while (true) { x = if (true) { break }; x = 2 }; x",
+		"let f = fn() { let x = if (true) { return 5 }; 1 }; f()",
+		"let f = fn() { 1 }; f(1 + true)",
+		"5()",
+		"let f = fn(x) { x }; f()",
+	}
+
+	for _, input := range inputs {
+		expected := evaluator.Eval(parse(input), object.NewEnvironmentWithRuntime(object.NewRuntime(nil, nil, nil)))
+		actual := testRun(t, input, object.NewEnvironmentWithRuntime(object.NewRuntime(nil, nil, nil)))
+		assertSameResult(t, input, expected, actual)
+	}
+}
+
+func assertSameResult(t *testing.T, input string, expected, actual object.Object) {
+	if expected == nil || actual == nil {
+		assert.Equal(t, expected, actual, input)
+		return
+	}
+	assert.Equal(t, expected.Type(), actual.Type(), input)
+	assert.Equal(t, expected.Inspect(), actual.Inspect(), input)
+	if err, ok := expected.(*object.Error); ok {
+		if actualErr, ok := actual.(*object.Error); ok {
+			assert.Equal(t, err.Span, actualErr.Span, input)
+			assert.Equal(t, err.Stack, actualErr.Stack, input)
+			assert.Equal(t, err.Kind, actualErr.Kind, input)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelExpired()
+
+	tests := []struct {
+		input           string
+		ctx             context.Context
+		limits          object.Limits
+		expectedKind    object.ErrorKind
+		expectedMessage string
+	}{
+		{"let f = fn(n) { if (n > 0) { 1 + f(n - 1) } }; f(5)", context.Background(), object.Limits{MaxDepth: 5}, object.STACK_OVERFLOW_ERROR, "stack overflow: maximum call depth of 5 exceeded"},
+		{"while (true) {}", context.Background(), object.Limits{MaxSteps: 1000}, object.STEP_LIMIT_ERROR, "step limit of 1000 exceeded"},
+		{"while (true) {}", expired, object.Limits{}, object.TIMEOUT_ERROR, "evaluation timed out"},
+		{"1 + 2", cancelled, object.Limits{}, object.CANCELLED_ERROR, "evaluation cancelled"},
+		{`let s = "abc"; while (true) { s += s }`, context.Background(), object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR, "memory limit of 1048576 bytes exceeded"},
+		{"let h = {}; let i = 0; while (true) { h[i] = i; i += 1 }", context.Background(), object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR, "memory limit of 1048576 bytes exceeded"},
+		{`let log = []; try { while (true) {} } catch (e) { log = push(log, "catch") } finally { log = push(log, "finally") }`, context.Background(), object.Limits{MaxSteps: 1000}, object.STEP_LIMIT_ERROR, "step limit of 1000 exceeded"},
+	}
+
+	for _, tt := range tests {
+		runtime := object.NewRuntime(nil, nil, nil)
+		runtime.Limits = tt.limits
+		env := object.NewEnvironmentWithRuntime(runtime)
+		bytecode, err := compiler.New().Compile(parse(tt.input))
+		if !assert.NoError(t, err, tt.input) {
+			continue
+		}
+
+		result := New(bytecode, env).Run(tt.ctx)
+		runErr, ok := result.(*object.Error)
+		if assert.True(t, ok, "no error object returned for %s. got=%T(%+v)", tt.input, result, result) {
+			assert.Equal(t, tt.expectedKind, runErr.Kind, tt.input)
+			assert.Contains(t, runErr.Message, tt.expectedMessage, tt.input)
+		}
+		if log, ok := env.Get("log"); ok {
+			assert.Equal(t, "[]", log.Inspect(), tt.input)
+		}
+		assert.Equal(t, 0, len(New(bytecode, env).frames), "frames aren't kept between runs")
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	inputs := []string{
+		"1 + 2",
+		`"abc" + "def"`,
+		"[1, 2, 3]",
+		"push([1], 2)",
+		`let h = {"a": 1}; h["a"] = 2; h["b"] = 3`,
+		`for (c in "abc") { [c] }`,
+		`try { 1 + true } catch (e) { e }`,
+	}
+
+	for _, input := range inputs {
+		evaluated := object.NewEnvironmentWithRuntime(object.NewRuntime(nil, nil, nil))
+		evaluator.EvalContext(context.Background(), parse(input), evaluated)
+		run := object.NewEnvironmentWithRuntime(object.NewRuntime(nil, nil, nil))
+		testRun(t, input, run)
+		assert.Equal(t, evaluated.Runtime().Usage().Memory, run.Runtime().Usage().Memory, input)
+	}
+}
+
+// globals are kept in the environment, so subsequent programs compiled by the same compiler see them
+func TestGlobalsShareTheEnvironment(t *testing.T) {
+	env := object.NewEnvironmentWithRuntime(object.NewRuntime(nil, nil, nil))
+	env.Set("host", &object.Integer{Value: 40})
+	c := compiler.New()
+
+	for _, step := range []struct {
+		input    string
+		expected string
+	}{
+		{"let counter = fn() { let n = 0; fn() { n += 1 } }(); let x = host + 1", ""},
+		{"counter(); x += counter(); x", "43"},
+		{"host", "40"},
+	} {
+		bytecode, err := c.Compile(parse(step.input))
+		if !assert.NoError(t, err, step.input) {
+			continue
+		}
+		result := New(bytecode, env).Run(context.Background())
+		if step.expected == "" {
+			assert.Nil(t, result, step.input)
+		} else if assert.NotNil(t, result, step.input) {
+			assert.Equal(t, step.expected, result.Inspect(), step.input)
+		}
+	}
+	x, _ := env.Get("x")
+	assert.Equal(t, "43", x.Inspect())
+}
+
+// programs that load have to run without crashing the vm, whatever their instructions are. The fuzzed data
+// is the file without the checksum, which is added to it, so that the mutations get past it to the validation.
+func FuzzLoadAndRun(f *testing.F) {
+	seeds := []string{
+		"let f = fn(a, b) { a + b }; f(1, 2)",
+		"let make = fn(x) { fn() { x = x + 1 } }; let c = make(1); c(); c()",
+		"let r = []; for (x in [1, 2, 3]) { if (x == 2) { continue }; r = push(r, x) }; r",
+		"let i = 0; while (i < 3) { i += 1; if (i > 1) { break } }; i",
+		`try { throw "boom" } catch (e) { e["message"] } finally { 1 }`,
+		`let h = {"a": [1, 2]}; h["a"][0] = 3; h["a"] && !false || -1`,
+		"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(10)",
+	}
+	for _, seed := range seeds {
+		bytecode, err := compiler.New().Compile(parse(seed))
+		if err != nil {
+			f.Fatal(err)
+		}
+		data, err := bytecode.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data[:len(data)-4])
+	}
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		checksum := make([]byte, 4)
+		binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(payload))
+		data := append(append([]byte{}, payload...), checksum...)
+		bytecode, err := compiler.Load(data)
+		if err != nil {
+			return
+		}
+		runtime := object.NewRuntime(nil, nil, nil)
+		runtime.Limits = object.Limits{MaxSteps: 10000, MaxDepth: 50, MaxMemory: 1 << 20}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		New(bytecode, object.NewEnvironmentWithRuntime(runtime)).Run(ctx)
+	})
+}
+
+func parse(input string) *ast.Program {
+	return parser.New(lexer.New(input)).ParseProgram()
+}
+
+func testRun(t *testing.T, input string, env *object.Environment) object.Object {
+	bytecode, err := compiler.New().Compile(parse(input))
+	if !assert.NoError(t, err, input) {
+		return nil
+	}
+	return New(bytecode, env).Run(context.Background())
+}